@@ -7,9 +7,10 @@ import (
 type ActiveFile struct {
     *FileWithBuffer
     id  int64
+    fc  *fileCipher     // nil if not encrypted
 }
 
-func NewActiveFile(path string, id int64, wbufSize int64) (*ActiveFile, error) {
+func NewActiveFile(path string, id int64, wbufSize int64, fc *fileCipher) (*ActiveFile, error) {
     f, err := NewFileWithBuffer(path, true, wbufSize)
     if err != nil {
         return nil, err
@@ -18,12 +19,13 @@ func NewActiveFile(path string, id int64, wbufSize int64) (*ActiveFile, error) {
     af := &ActiveFile{
         FileWithBuffer: f,
         id: id,
+        fc: fc,
     }
     return af, nil
 }
 
 func (af *ActiveFile) AddRecord(rec *Record) error {
-    buf, err := rec.Encode()
+    buf, err := rec.encode(af.fc)
     if err != nil {
         log.Println(err)
         return err
@@ -37,3 +39,27 @@ func (af *ActiveFile) AddRecord(rec *Record) error {
     return nil
 }
 
+
+// append records with a single write and flush, returns the offset of each record
+func (af *ActiveFile) AddRecords(recs []*Record) ([]int64, error) {
+    offsets := make([]int64, len(recs))
+    offset := af.Size()
+    buf := make([]byte, 0)
+    for i, rec := range recs {
+        data, err := rec.encode(af.fc)
+        if err != nil {
+            log.Println(err)
+            return nil, err
+        }
+        offsets[i] = offset
+        offset += int64(len(data))
+        buf = append(buf, data...)
+    }
+
+    _, err := af.Write(buf)
+    if err != nil {
+        log.Fatal(err)
+    }
+    af.Flush()
+    return offsets, nil
+}
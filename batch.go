@@ -1,5 +1,129 @@
 package bitcask
 
 import (
+    "encoding/binary"
+    "log"
 )
 
+// Batch collects writes that are committed all-or-nothing by BitCask.Write.
+type Batch struct {
+    recs    []*Record
+}
+
+func NewBatch() *Batch {
+    return &Batch{
+        recs: make([]*Record, 0),
+    }
+}
+
+func (b *Batch) Set(key []byte, value []byte) {
+    b.SetWithExpr(key, value, 0)
+}
+
+func (b *Batch) SetWithExpr(key []byte, value []byte, expration uint32) {
+    rec := &Record{
+        flag: RECORD_FLAG_BATCH,
+        expration: expration,
+        valueSize: int64(len(value)),
+        keySize: int64(len(key)),
+        value: make([]byte, len(value)),
+        key: make([]byte, len(key)),
+    }
+    copy(rec.key, key)
+    copy(rec.value, value)
+    b.recs = append(b.recs, rec)
+}
+
+func (b *Batch) Del(key []byte) {
+    rec := &Record{
+        flag: RECORD_FLAG_BATCH | RECORD_FLAG_DELETED,
+        keySize: int64(len(key)),
+        key: make([]byte, len(key)),
+    }
+    copy(rec.key, key)
+    b.recs = append(b.recs, rec)
+}
+
+func (b *Batch) Len() int {
+    return len(b.recs)
+}
+
+func (b *Batch) Reset() {
+    b.recs = b.recs[:0]
+}
+
+// the commit marker closes a batch, its value holds the number of records in the batch
+func newBatchCommitRecord(n int) *Record {
+    rec := &Record{
+        flag: RECORD_FLAG_BATCH_COMMIT,
+        valueSize: 8,
+        value: make([]byte, 8),
+    }
+    binary.LittleEndian.PutUint64(rec.value, uint64(n))
+    return rec
+}
+
+func batchCommitCount(rec *Record) int64 {
+    if len(rec.value) != 8 {
+        return -1
+    }
+    return int64(binary.LittleEndian.Uint64(rec.value))
+}
+
+// Write commits all records in the batch with one write and one flush,
+// followed by a commit marker. A batch without its commit marker is
+// discarded on restore.
+func (bc *BitCask) Write(b *Batch) error {
+    if b.Len() == 0 {
+        return nil
+    }
+    if bc.opts.readOnly {
+        return ErrReadOnly
+    }
+    for _, rec := range b.recs {
+        bc.compressRecord(rec)
+    }
+
+    bc.mu.Lock()
+    err := bc.writeBatch(b)
+    seq := bc.writeSeq
+    bc.mu.Unlock()
+    if err != nil {
+        return err
+    }
+    return bc.waitSync(seq)
+}
+
+// requires bc.mu held
+func (bc *BitCask) writeBatch(b *Batch) error {
+    recs := make([]*Record, 0, b.Len() + 1)
+    recs = append(recs, b.recs...)
+    recs = append(recs, newBatchCommitRecord(b.Len()))
+
+    offsets, err := bc.activeFile.AddRecords(recs)
+    if err != nil {
+        log.Printf("write batch failed, err = %s", err)
+        return err
+    }
+    bc.writeSeq++
+    bc.notifyWrite()
+    bc.fileStat(bc.activeFile.id).TotalBytes = bc.activeFile.Size()
+
+    for i, rec := range b.recs {
+        di := &DirItem{
+            flag: rec.flag,
+            fileId: bc.activeFile.id,
+            valuePos: offsets[i] + RecordValueOffset(),
+            valueSize: rec.valueSize,
+            expration: rec.expration,
+        }
+        if err := bc.updateKeyDir(rec.key, di, bc.activeKD, true); err != nil {
+            return err
+        }
+    }
+
+    if bc.activeFile.Size() >= bc.opts.maxFileSize {
+        return bc.rotateActiveFile(bc.activeFile.id + 1)
+    }
+    return nil
+}
@@ -0,0 +1,116 @@
+package bitcask
+
+import (
+    "os"
+    . "gopkg.in/check.v1"
+)
+
+type testBatchSuite struct {
+    path string
+    bc   *BitCask
+}
+
+var _ = Suite(&testBatchSuite{})
+
+func (s *testBatchSuite) SetUpTest(c *C) {
+    s.path = c.MkDir()
+    var err error
+    s.bc, err = Open(s.path, NewOptions())
+    c.Assert(err, IsNil)
+}
+
+func (s *testBatchSuite) TearDownTest(c *C) {
+    s.bc.Close()
+}
+
+func (s *testBatchSuite) TestWrite(c *C) {
+    c.Assert(s.bc.Set([]byte("c"), []byte("old")), IsNil)
+
+    b := NewBatch()
+    b.Set([]byte("a"), []byte("1"))
+    b.Set([]byte("b"), []byte("2"))
+    b.Del([]byte("c"))
+    c.Assert(s.bc.Write(b), IsNil)
+
+    val, err := s.bc.Get([]byte("a"))
+    c.Assert(err, IsNil)
+    c.Assert(string(val), Equals, "1")
+    val, err = s.bc.Get([]byte("b"))
+    c.Assert(err, IsNil)
+    c.Assert(string(val), Equals, "2")
+    _, err = s.bc.Get([]byte("c"))
+    c.Assert(err, Equals, ErrKeyNotFound)
+
+    // batch survives reopen
+    s.bc.Close()
+    s.bc, err = Open(s.path, NewOptions())
+    c.Assert(err, IsNil)
+    val, err = s.bc.Get([]byte("b"))
+    c.Assert(err, IsNil)
+    c.Assert(string(val), Equals, "2")
+    _, err = s.bc.Get([]byte("c"))
+    c.Assert(err, Equals, ErrKeyNotFound)
+}
+
+func (s *testBatchSuite) TestPartialBatchDiscarded(c *C) {
+    c.Assert(s.bc.Set([]byte("a"), []byte("0")), IsNil)
+    path := s.bc.GetDataFilePath(s.bc.ActiveFileId())
+    s.bc.Close()
+
+    fi, err := os.Stat(path)
+    c.Assert(err, IsNil)
+    size := fi.Size()
+
+    // append batch records without the commit marker
+    b := NewBatch()
+    b.Set([]byte("a"), []byte("1"))
+    b.Set([]byte("b"), []byte("2"))
+    af, err := NewActiveFile(path, 0, 1024, nil)
+    c.Assert(err, IsNil)
+    for _, rec := range b.recs {
+        c.Assert(af.AddRecord(rec), IsNil)
+    }
+    af.Close()
+
+    s.bc, err = Open(s.path, NewOptions())
+    c.Assert(err, IsNil)
+    val, err := s.bc.Get([]byte("a"))
+    c.Assert(err, IsNil)
+    c.Assert(string(val), Equals, "0")
+    _, err = s.bc.Get([]byte("b"))
+    c.Assert(err, Equals, ErrKeyNotFound)
+
+    fi, err = os.Stat(path)
+    c.Assert(err, IsNil)
+    c.Assert(fi.Size(), Equals, size)
+}
+
+func (s *testBatchSuite) TestRotateFailure(c *C) {
+    s.bc.Close()
+    opts := NewOptions()
+    opts.SetMaxFileSize(64)
+    var err error
+    s.bc, err = Open(s.path, opts)
+    c.Assert(err, IsNil)
+
+    // a dir in place of the hint file fails the rotation
+    id := s.bc.ActiveFileId()
+    hint := s.bc.getHintFilePath(id)
+    c.Assert(os.Mkdir(hint, 0755), IsNil)
+
+    b := NewBatch()
+    b.Set([]byte("a"), make([]byte, 64))
+    c.Assert(s.bc.Write(b), NotNil)
+    c.Assert(s.bc.ActiveFileId(), Equals, id)
+    val, err := s.bc.Get([]byte("a"))
+    c.Assert(err, IsNil)
+    c.Assert(len(val), Equals, 64)
+
+    // the active file is still open and rotates on the next write
+    c.Assert(os.Remove(hint), IsNil)
+    c.Assert(s.bc.Set([]byte("b"), []byte("2")), IsNil)
+    c.Assert(s.bc.ActiveFileId(), Equals, id + 1)
+    val, err = s.bc.Get([]byte("a"))
+    c.Assert(err, IsNil)
+    c.Assert(len(val), Equals, 64)
+}
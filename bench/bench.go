@@ -27,7 +27,7 @@ func BenchRandomSet(num int) {
     value := make([]byte, valueSize)
     for i := 0; i < num; i++ {
         key := fmt.Sprintf("%09d", rand.Int() % num)
-        err := bc.Set(key, value)
+        err := bc.Set([]byte(key), value)
         if err != nil {
             log.Println(err)
             panic(err)
@@ -47,8 +47,8 @@ func BenchRandomGet(num int) {
     var found = 0
     for i := 0; i < num; i++ {
         key := fmt.Sprintf("%09d", rand.Int() % num)
-        _, err := bc.Get(key)
-        if err != nil && err != bitcask.ErrNotFound {
+        _, err := bc.Get([]byte(key))
+        if err != nil && err != bitcask.ErrKeyNotFound {
             log.Printf("%d, get key[%s] failed, err=%s", i, key, err)
             panic(err)
         }
@@ -2,6 +2,8 @@ package bitcask
 
 import (
     "hash/crc32"
+    "path/filepath"
+    "strings"
     "crypto/md5"
     "io"
     "bytes"
@@ -11,12 +13,23 @@ import (
     "log"
     "time"
     "os"
+    "sort"
 )
 
 var (
     ErrKeyNotFound = fmt.Errorf("key not found")
     ErrRecordCorrupted = fmt.Errorf("record corrupted")
     ErrInvalid = fmt.Errorf("invalid")
+    ErrSnapshotReleased = fmt.Errorf("snapshot released")
+    ErrMergeRunning = fmt.Errorf("there is a merge process running")
+    ErrLocked = fmt.Errorf("db is locked by another process")
+    ErrReadOnly = fmt.Errorf("db is opened read-only")
+    ErrMergeUnfinished = fmt.Errorf("a committed merge is not installed, open the db read-write first")
+    ErrNoSlotIndex = fmt.Errorf("slot index is disabled")
+)
+
+const (
+    LOCK_FILE = "LOCK"
 )
 
 type BitCask struct {
@@ -33,25 +46,59 @@ type BitCask struct {
     maxDataFileId   int64
 
     // slots info
-    keysInSlot      map[uint32]map[string]bool
+    keysInSlot      map[uint32]*slotIndex
     keysInTag       map[string]map[string]bool
+    tagIndexBytes   int64
 
     // file metas: fileId, md5, etc.
     fileMetas       []*FileMeta
+
+    // data files referenced by snapshots, and the ones to remove once released
+    pinnedFiles     map[int64]int
+    obsoleteFiles   map[int64]bool
+
+    // live and dead bytes of data files
+    fileStats       map[int64]*FileStat
+
+    // data keys of files, nil if encryption is disabled
+    keys            *keyStore
+
+    // flock on LOCK in dir, shared in read-only mode
+    lock            *fileLock
+
+    // sequence of the last write, and fsync shared by concurrent writers
+    writeSeq        uint64
+    syncer          *groupSyncer
+
+    // closed and renewed on every write, for replication streams to tail the active file
+    writeCh         chan struct{}
+
+    // stops background routines
+    closeCh         chan struct{}
+    bgWg            sync.WaitGroup
+    closed          bool
 }
 
 func (bc *BitCask) clear() {
     bc.activeFile = nil
-    bc.activeKD = NewKeyDir()
-    bc.keyDir = NewKeyDir()
+    bc.activeKD = bc.newKeyDir()
+    bc.keyDir = bc.newKeyDir()
     bc.isMerging = 0
     bc.minDataFileId = 0
     bc.maxDataFileId = 0
-    bc.keysInSlot = make(map[uint32]map[string]bool)
+    bc.keysInSlot = make(map[uint32]*slotIndex)
     bc.keysInTag = make(map[string]map[string]bool)
+    bc.tagIndexBytes = 0
     bc.fileMetas = make([]*FileMeta, 0)
+    bc.pinnedFiles = make(map[int64]int)
+    bc.obsoleteFiles = make(map[int64]bool)
+    bc.fileStats = make(map[int64]*FileStat)
     bc.recCache = NewRecordCache(bc)
     bc.dfCache = NewDataFileCache(bc)
+    bc.keys = nil
+    if bc.opts.keyProvider != nil {
+        bc.keys = newKeyStore(bc.opts.keyProvider, bc.getKeyFilePath)
+    }
 }
 
 func Open(dir string, opts *Options) (*BitCask, error) {
@@ -59,15 +106,45 @@ func Open(dir string, opts *Options) (*BitCask, error) {
         mu: &sync.RWMutex{},
         dir: dir,
         opts: opts,
+        closeCh: make(chan struct{}),
+        writeCh: make(chan struct{}),
     }
+    bc.syncer = newGroupSyncer(bc.syncActiveFile)
     bc.clear()
     log.Printf("open at %s", dir)
 
-    err := bc.Restore(-1)
+    lock, err := lockFile(dir + "/" + LOCK_FILE, opts.readOnly)
+    if err != nil {
+        log.Printf("lock db[%s] failed, err = %s", dir, err)
+        return nil, err
+    }
+    bc.lock = lock
+
+    err = bc.Restore(-1)
     if err != nil {
         log.Printf("restore failed, err = %s", err)
+        bc.lock.unlock()
         return nil, err
     }
+
+    // nothing to sync, expire or merge in read-only mode
+    if opts.readOnly {
+        log.Printf("open read-only succ.")
+        return bc, nil
+    }
+
+    if opts.syncMode == SYNC_INTERVAL {
+        bc.bgWg.Add(1)
+        go bc.syncLoop(time.Duration(opts.syncInterval) * time.Millisecond)
+    }
+    if opts.expireSweepInterval > 0 {
+        bc.bgWg.Add(1)
+        go bc.expireLoop(time.Duration(opts.expireSweepInterval) * time.Millisecond)
+    }
+    if opts.mergeCheckInterval > 0 {
+        bc.bgWg.Add(1)
+        go bc.mergeLoop(time.Duration(opts.mergeCheckInterval) * time.Millisecond)
+    }
     log.Printf("open succ.")
     return bc, nil
 }
@@ -75,17 +152,61 @@ func Open(dir string, opts *Options) (*BitCask, error) {
 func (bc *BitCask) Restore(fileIdRange int64) error {
     bc.mu.Lock()
     defer bc.mu.Unlock()
+    return bc.restore(fileIdRange)
+}
 
+// requires bc.mu held
+func (bc *BitCask) restore(fileIdRange int64) error {
     begin := time.Now()
+    readOnly := bc.opts.readOnly
+    if readOnly {
+        // files in the main dir are left as they are, uncommitted staging files are ignored
+        if _, err := os.Stat(bc.getMergeDir() + "/" + MERGE_MANIFEST); err == nil {
+            return ErrMergeUnfinished
+        }
+    } else if err := bc.recoverMerge(); err != nil {
+        log.Printf("recover merge failed, err = %s", err)
+        return err
+    }
+
     files, err := ioutil.ReadDir(bc.dir)
     if err != nil {
         log.Println(err)
         return err
     }
 
-    var corrupted bool = false
+    // files restored from data as their hint files are rejected
+    staleHints := make(map[int64]*KeyDir)
+    staleSums := make(map[int64]*dataSum)
+    ids := make([]int64, 0)
+    reporter := &restoreReporter{fn: bc.opts.restoreProgress, begin: begin}
     for _, file := range files {
         name := file.Name()
+        if readOnly && (isObsoletePath(name) || filepath.Ext(name) == ".key") {
+            continue
+        }
+        if strings.HasSuffix(name, ".data.repl") {
+            // partially received from a replication master
+            if !readOnly {
+                os.Remove(bc.dir + "/" + name)
+            }
+            continue
+        }
+        if isObsoletePath(name) {
+            // left by a snapshot that was not released
+            os.Remove(bc.dir + "/" + name)
+            if id, err := getIdFromDataPath(strings.TrimSuffix(name, ".obsolete")); err == nil {
+                bc.removeKeyFile(id)
+            }
+            continue
+        }
+        if id, err := getIdFromKeyPath(name); err == nil {
+            // left by a merge that was rolled back
+            if _, err := os.Stat(bc.GetDataFilePath(id)); os.IsNotExist(err) {
+                bc.removeKeyFile(id)
+            }
+            continue
+        }
         var err error
         var id int64
         id, err = getIdFromDataPath(name)
@@ -97,157 +218,143 @@ func (bc *BitCask) Restore(fileIdRange int64) error {
             outOfRange = true
         }
 
-        if corrupted || outOfRange {
-            err := bc.removeDataFile(id)
-            if err != nil {
-                log.Fatalf("remove data-file[%d] failed, err = %s", id, err)
-                return err
+        if outOfRange {
+            if readOnly {
+                continue
             }
-            continue
-        }
-
-        dataPath := bc.GetDataFilePath(id)
-        hintPath := bc.getHintFilePath(id)
-
-        var kd *KeyDir
-        if _, err = os.Stat(hintPath); err == nil {
-            kd, err = bc.restoreFromHintFile(hintPath, id)
-        } else {
-            kd, err = bc.restoreFromDataFile(dataPath, id)
-        }
-        if err != nil {
-            log.Printf("data-file[%d], corrupted! remove it.", id)
             err := bc.removeDataFile(id)
             if err != nil {
                 log.Fatalf("remove data-file[%d] failed, err = %s", id, err)
                 return err
             }
-            corrupted = true
             continue
         }
 
-        md5, err := bc.getDataFileMd5(id)
+        ids = append(ids, id)
+        reporter.progress.TotalBytes += file.Size()
+    }
+    sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+    reporter.progress.TotalFiles = len(ids)
+
+    // files are loaded in parallel, and put to keydir in the order of ids
+    err = bc.loadFiles(ids, func(load *fileLoad) error {
+        id := load.id
+        kd, err := bc.applyFileLoad(load)
         if err != nil {
-            log.Fatalf("calc md5 for data-file[%d] failed, err = %s", id, err)
             return err
         }
-        bc.addFileMeta(id, md5)
+        if load.staleHint {
+            staleHints[id] = kd
+            staleSums[id] = load.sum
+        }
+        bc.addFileMeta(id, load.sum.md5)
+        bc.fileStat(id).TotalBytes = load.sum.size
 
         if id < bc.minDataFileId {
             bc.minDataFileId = id
         }
-        if id > bc.maxDataFileId {
+        if id >= bc.maxDataFileId {
             bc.maxDataFileId = id
             bc.activeKD = kd
         }
-    }
 
-    // make active file
-    bc.activeFile, err = NewActiveFile(bc.GetDataFilePath(bc.maxDataFileId), bc.maxDataFileId, bc.opts.bufferSize)
+        reporter.progress.Files++
+        if load.fromHint {
+            reporter.progress.HintFiles++
+        }
+        reporter.progress.Bytes += load.sum.size
+        reporter.progress.Keys = bc.keyDir.Len()
+        reporter.progress.Done = reporter.progress.Files == len(ids)
+        reporter.report()
+        return nil
+    })
     if err != nil {
         return err
     }
 
+    // write rejected hint files again, the one of the active file is removed below
+    for id, kd := range staleHints {
+        if id == bc.maxDataFileId {
+            continue
+        }
+        if err := bc.replaceHintFile(id, staleSums[id], kd); err != nil {
+            log.Printf("write hint-file[%d] failed, err = %s", id, err)
+            return err
+        }
+    }
+
+    // make active file, the hint written on close is stale once it's appended
+    if !readOnly {
+        if err := os.Remove(bc.getHintFilePath(bc.maxDataFileId)); err != nil && !os.IsNotExist(err) {
+            return err
+        }
+        bc.activeFile, err = bc.newActiveFile(bc.maxDataFileId)
+        if err != nil {
+            return err
+        }
+    }
+
     // remove active file meta
     if len(bc.fileMetas) > 0 {
         bc.fileMetas = bc.fileMetas[:len(bc.fileMetas) - 1]
     }
 
     end := time.Now()
-    log.Printf("restore succ! costs %.2f seconds.", end.Sub(begin).Seconds())
+    log.Printf("restore succ! costs %.2f seconds, keydir takes %d MB for %d keys.",
+        end.Sub(begin).Seconds(), bc.keyDir.MemUsage() >> 20, bc.keyDir.Len())
     return nil
 }
 
 func (bc *BitCask) updateKeyDir(key []byte, di *DirItem, akd *KeyDir, fillSlot bool) error {
-    old, err := bc.keyDir.Get(key)
-    // add to keydir
-    if (err == nil && di.fileId >= old.fileId) || err == ErrKeyNotFound {
-        if err := bc.keyDir.Put(key, di); err != nil {
-            return err
-        }
-    }
-    if err != ErrKeyNotFound {
+    ok, err := bc.putKeyDir(key, di, akd)
+    if err != nil || !ok {
         return err
     }
-    // add to active keydir
-    if akd != nil {
-        if err := akd.Put(key, di); err != nil {
-            return err
-        }
-    }
-
-    // fill slot
-    if fillSlot {
-        tag, slot := HashKeyToSlot(key)
-        if bc.keysInSlot[slot] == nil {
-            bc.keysInSlot[slot] = make(map[string]bool)
-        }
-        bc.keysInSlot[slot][string(key)] = true
 
-        if len(tag) < len(key) {
-            if bc.keysInTag[string(tag)] == nil {
-                bc.keysInTag[string(tag)] = make(map[string]bool)
-            }
-            bc.keysInTag[string(tag)][string(key)] = true
-        }
+    // fill slot, deleted keys leave it
+    if di.flag & RECORD_FLAG_DELETED > 0 {
+        bc.unindexKey(key)
+    } else {
+        bc.indexKey(key, di, fillSlot)
     }
-
     return nil
 }
 
-func (bc *BitCask) restoreFromHintFile(path string, id int64) (*KeyDir, error) {
-    log.Printf("restore data from hint-file[%d]", id)
-    hf, err := NewHintFile(path, id, bc.opts.bufferSize)
-    if err != nil {
-        return nil, err
+// returns false if the key is kept as it is in keydir
+func (bc *BitCask) putKeyDir(key []byte, di *DirItem, akd *KeyDir) (bool, error) {
+    old, err := bc.keyDir.Get(key)
+    if err != nil && err != ErrKeyNotFound {
+        return false, err
     }
-
-    activeKD := NewKeyDir()
-    err = hf.ForEachItem(func (item *HintItem) error {
-        di := &DirItem{
-            flag: item.flag,
-            fileId: hf.id,
-            valuePos: item.valuePos,
-            valueSize: item.valueSize,
-            expration: item.expration,
-        }
-        if err := bc.updateKeyDir(item.key, di, activeKD, true); err != nil {
-            return err
+    // keep the entry from a newer file
+    if err == nil && di.fileId < old.fileId {
+        bc.addDeadBytes(di.fileId, recordSize(key, di))
+        return false, nil
+    }
+    if err == nil {
+        bc.addDeadBytes(old.fileId, recordSize(key, old))
+    } else {
+        old = nil
+    }
+    // add to keydir, old saves reading the key again in KEYDIR_HASH mode
+    if err := bc.keyDir.Replace(key, old, di); err != nil {
+        return false, err
+    }
+    // add to active keydir
+    if akd != nil {
+        if err := akd.Replace(key, old, di); err != nil {
+            return false, err
         }
-        return nil
-    })
-
-    if err != nil {
-        return nil, err
     }
-    return activeKD, nil
+    return true, nil
 }
 
 func (bc *BitCask) restoreFromDataFile(path string, id int64) (*KeyDir, error) {
-    log.Printf("restore data from data-file[%d]", id)
-    df, err := NewDataFile(path, id)
+    load, err := bc.loadDataFile(path, id)
     if err != nil {
         return nil, err
     }
-
-    activeKD := NewKeyDir()
-    err = df.ForEachItem(func (rec *Record, offset int64) error {
-        di := &DirItem{
-            flag: rec.flag,
-            fileId: df.id,
-            valuePos: offset + RecordValueOffset(),
-            valueSize: rec.valueSize,
-            expration: rec.expration,
-        }
-        if err := bc.updateKeyDir(rec.key, di, activeKD, true); err != nil {
-            return err
-        }
-        return nil
-    })
-    if err != nil {
-        return nil, err
-    }
-    return activeKD, nil
+    return bc.applyFileLoad(load)
 }
 
 func (bc *BitCask) Get(key []byte) ([]byte, error) {
@@ -255,9 +362,10 @@ func (bc *BitCask) Get(key []byte) ([]byte, error) {
     return value, err
 }
 
+// reads run concurrently under the read lock
 func (bc *BitCask) GetWithExpr(key []byte) ([]byte, uint32, error) {
-    bc.mu.Lock()
-    defer bc.mu.Unlock()
+    bc.mu.RLock()
+    defer bc.mu.RUnlock()
 
     di, err := bc.keyDir.Get(key)
     if err != nil {
@@ -268,6 +376,9 @@ func (bc *BitCask) GetWithExpr(key []byte) ([]byte, uint32, error) {
         log.Printf("key[%s] has been deleted", string(key))
         return nil, 0, ErrKeyNotFound
     }
+    if isExpired(di.expration, time.Now().Unix()) {
+        return nil, 0, ErrKeyNotFound
+    }
 
     rec, err := bc.refRecord(di.fileId, int64(di.valuePos) - RecordValueOffset())
     if err != nil {
@@ -275,33 +386,47 @@ func (bc *BitCask) GetWithExpr(key []byte) ([]byte, uint32, error) {
         return nil, 0, err
     }
     defer bc.unrefRecord(di.fileId, int64(di.valuePos) - RecordValueOffset())
-    return rec.value, di.expration, nil
+    return rec.ownedValue(), di.expration, nil
 }
 
-func (bc *BitCask) Del(key []byte) error {
-    bc.mu.Lock()
-    defer bc.mu.Unlock()
+// View calls fn with the value of key, which is not copied out of the
+// mapping of its data file in mmap mode. fn must not keep or modify value,
+// and it runs under the read lock, so it must not call bc.
+func (bc *BitCask) View(key []byte, fn func(value []byte, expration uint32) error) error {
+    bc.mu.RLock()
+    defer bc.mu.RUnlock()
 
+    di, err := bc.getLive(key)
+    if err != nil {
+        return err
+    }
+    offset := int64(di.valuePos) - RecordValueOffset()
+    rec, err := bc.refRecord(di.fileId, offset)
+    if err != nil {
+        return err
+    }
+    defer bc.unrefRecord(di.fileId, offset)
+    return fn(rec.value, di.expration)
+}
+
+func (bc *BitCask) Del(key []byte) error {
     rec := &Record{
         flag: RECORD_FLAG_DELETED,
         keySize: int64(len(key)),
         key: make([]byte, len(key)),
     }
     copy(rec.key, key)
-    return bc.addRecord(rec, true)
+    return bc.writeRecord(rec, true)
 }
 
 func (bc *BitCask) DelLocal(key []byte) error {
-    bc.mu.Lock()
-    defer bc.mu.Unlock()
-
     rec := &Record{
         flag: RECORD_FLAG_DELETED,
         keySize: int64(len(key)),
         key: make([]byte, len(key)),
     }
     copy(rec.key, key)
-    return bc.addRecord(rec, false)
+    return bc.writeRecord(rec, false)
 }
 
 func (bc *BitCask) Set(key []byte, val []byte) error {
@@ -309,9 +434,6 @@ func (bc *BitCask) Set(key []byte, val []byte) error {
 }
 
 func (bc *BitCask) SetWithExpr(key []byte, value []byte, expration uint32) error {
-    bc.mu.Lock()
-    defer bc.mu.Unlock()
-
     keySize := len(key)
     valueSize := len(value)
     rec := &Record{
@@ -323,7 +445,7 @@ func (bc *BitCask) SetWithExpr(key []byte, value []byte, expration uint32) error
     }
     copy(rec.key, key)
     copy(rec.value, value)
-    return bc.addRecord(rec, true)
+    return bc.writeRecord(rec, true)
 }
 
 const (
@@ -331,17 +453,21 @@ const (
 )
 
 func HashTag(key []byte) []byte {
-    part := key
-    if i := bytes.IndexByte(part, '{'); i != -1 {
-        part = part[i+1:]
-    } else {
-        return key
+    pos, size := hashTagPos(key)
+    return key[pos:pos + size]
+}
+
+// the tag is what's between the first '{' and the next '}', or the whole key
+func hashTagPos(key []byte) (int, int) {
+    i := bytes.IndexByte(key, '{')
+    if i == -1 {
+        return 0, len(key)
     }
-    if i := bytes.IndexByte(part, '}'); i != -1 {
-        return part[:i]
-    } else {
-        return key
+    j := bytes.IndexByte(key[i+1:], '}')
+    if j == -1 {
+        return 0, len(key)
     }
+    return i + 1, j
 }
 
 func HashTagToSlot(tag []byte) uint32 {
@@ -354,9 +480,23 @@ func HashKeyToSlot(key []byte) ([]byte, uint32) {
 }
 
 func (bc *BitCask) AddRecord(rec *Record, fillSlot bool) error {
+    return bc.writeRecord(rec, fillSlot)
+}
+
+// append the record, then wait for it to be synced according to the sync mode
+func (bc *BitCask) writeRecord(rec *Record, fillSlot bool) error {
+    if bc.opts.readOnly {
+        return ErrReadOnly
+    }
+    bc.compressRecord(rec)
     bc.mu.Lock()
-    defer bc.mu.Unlock()
-    return bc.addRecord(rec, fillSlot)
+    err := bc.addRecord(rec, fillSlot)
+    seq := bc.writeSeq
+    bc.mu.Unlock()
+    if err != nil {
+        return err
+    }
+    return bc.waitSync(seq)
 }
 
 // requires bc.mu held
@@ -366,8 +506,11 @@ func (bc *BitCask) addRecord(rec *Record, fillSlot bool) error {
     if err != nil {
         return err
     }
+    bc.writeSeq++
+    bc.notifyWrite()
+    bc.fileStat(bc.activeFile.id).TotalBytes = bc.activeFile.Size()
 
-    if rec.flag & RECORD_FLAG_MERGE == 0 {
+    if rec.flag & (RECORD_FLAG_MERGE | RECORD_FLAG_BATCH_COMMIT) == 0 {
         di := &DirItem{
             flag: rec.flag,
             fileId: bc.activeFile.id,
@@ -382,23 +525,36 @@ func (bc *BitCask) addRecord(rec *Record, fillSlot bool) error {
     }
 
     if bc.activeFile.Size() >= bc.opts.maxFileSize {
-        bc.rotateActiveFile(bc.activeFile.id + 1)
+        return bc.rotateActiveFile(bc.activeFile.id + 1)
     }
     return nil
 }
 
+func (bc *BitCask) newActiveFile(fileId int64) (*ActiveFile, error) {
+    fc, err := bc.newFileCipher(fileId)
+    if err != nil {
+        return nil, err
+    }
+    return NewActiveFile(bc.GetDataFilePath(fileId), fileId, bc.opts.bufferSize, fc)
+}
+
 func (bc *BitCask) rotateActiveFile(nextFileId int64) error {
     log.Printf("rotate activeFile to %d", nextFileId)
-    bc.activeFile.Close()
+    if err := bc.activeFile.Sync(); err != nil {
+        log.Printf("sync active file[%d] failed, err = %s", bc.activeFile.id, err)
+        return err
+    }
 
-    err := bc.generateHintFile(bc.activeFile.id)
-    if err != nil {
+    // keys are read from the active file in KEYDIR_HASH mode, so it is
+    // closed after the hint, and stays open if the hint can't be written
+    if err := bc.generateHintFile(bc.activeFile.id); err != nil {
         log.Println(err)
         return err
     }
+    bc.activeFile.Close()
     bc.activeKD.Clear()
 
-    af, err := NewActiveFile(bc.GetDataFilePath(nextFileId), nextFileId, bc.opts.bufferSize)
+    af, err := bc.newActiveFile(nextFileId)
     if err != nil {
         return err
     }
@@ -408,8 +564,40 @@ func (bc *BitCask) rotateActiveFile(nextFileId int64) error {
     return nil
 }
 
-func (bc *BitCask) getDataFileMd5(fileId int64) ([]byte, error) {
-    path := bc.GetDataFilePath(fileId)
+// dataSum is the md5 of a data file, with its size and mtime which stand
+// for the md5 when a hint file is read on Open
+type dataSum struct {
+    md5     []byte
+    size    int64
+    mtime   int64   // in nanoseconds
+}
+
+func (bc *BitCask) getDataFileSum(fileId int64) (*dataSum, error) {
+    return sumDataFile(bc.GetDataFilePath(fileId))
+}
+
+func sumDataFile(path string) (*dataSum, error) {
+    // stat first, a change while reading the md5 leaves the hint stale
+    sum, err := statDataFile(path)
+    if err != nil {
+        return nil, err
+    }
+    if sum.md5, err = fileMd5(path); err != nil {
+        return nil, err
+    }
+    return sum, nil
+}
+
+// the md5 is nil
+func statDataFile(path string) (*dataSum, error) {
+    fi, err := os.Stat(path)
+    if err != nil {
+        return nil, err
+    }
+    return &dataSum{size: fi.Size(), mtime: fi.ModTime().UnixNano()}, nil
+}
+
+func fileMd5(path string) ([]byte, error) {
     f, err := os.Open(path)
     if err != nil {
         return nil, err
@@ -432,53 +620,115 @@ func (bc *BitCask) addFileMeta(fileId int64, md5 []byte) {
 }
 
 func (bc *BitCask) generateHintFile(fileId int64) error {
-    hf, err := NewHintFile(bc.getHintFilePath(fileId), fileId, bc.opts.bufferSize)
+    sum, err := bc.getDataFileSum(fileId)
     if err != nil {
         return err
     }
-    defer hf.Close()
+    bc.addFileMeta(fileId, sum.md5)
+    return bc.writeHintFile(bc.getHintFilePath(fileId), fileId, sum, bc.activeKD)
+}
 
-    // write md5sum to hint file header
-    md5, err := bc.getDataFileMd5(fileId)
+// write hint file of data-file[fileId] at path from kd
+func (bc *BitCask) writeHintFile(path string, fileId int64, sum *dataSum, kd *KeyDir) error {
+    fc, err := bc.newFileCipher(fileId)
+    if err != nil {
+        return err
+    }
+    hf, err := NewHintFile(path, fileId, bc.opts.bufferSize, fc)
     if err != nil {
         return err
     }
-    bc.addFileMeta(fileId, md5)
+    defer hf.Close()
 
-    if err := hf.WriteHeader(md5); err != nil {
+    if err := hf.WriteHeader(sum); err != nil {
         return err
     }
 
-    for key, di := range bc.activeKD.mp {
-        hi := &HintItem{
-            flag: di.flag,
-            expration: di.expration,
-            valueSize: di.valueSize,
-            valuePos: di.valuePos,
-            keySize: int64(len(key)),
-            key: []byte(key),
-        }
-        err := hf.AddItem(hi)
-        if err != nil {
-            return err
-        }
+    err = kd.ForEach(func(key []byte, di *DirItem) error {
+        return hf.AddItem(newHintItem(key, di))
+    })
+    if err != nil {
+        return err
     }
+    if err := hf.WriteTrailer(); err != nil {
+        return err
+    }
+    return hf.Sync()
+}
 
-    return nil
+// write the hint file of data-file[fileId] aside, then rename it over the old one
+func (bc *BitCask) replaceHintFile(fileId int64, sum *dataSum, kd *KeyDir) error {
+    hintPath := bc.getHintFilePath(fileId)
+    tmpPath := hintPath + ".tmp"
+    os.Remove(tmpPath)
+    if err := bc.writeHintFile(tmpPath, fileId, sum, kd); err != nil {
+        return err
+    }
+    return os.Rename(tmpPath, hintPath)
 }
 
+// requires bc.mu held, see GetDataFiles
 func (bc *BitCask) GetFileMetas() []*FileMeta {
     return bc.fileMetas
 }
 
+// GetDataFiles returns a copy of the metas of closed files and the id of
+// the active file, taken together under the read lock
+func (bc *BitCask) GetDataFiles() ([]*FileMeta, int64) {
+    bc.mu.RLock()
+    defer bc.mu.RUnlock()
+    metas := make([]*FileMeta, 0, len(bc.fileMetas))
+    for _, meta := range bc.fileMetas {
+        m := *meta
+        metas = append(metas, &m)
+    }
+    return metas, bc.ActiveFileId()
+}
+
 func (bc *BitCask) Close() error {
+    bc.mu.Lock()
+    if bc.closed {
+        bc.mu.Unlock()
+        return nil
+    }
+    bc.closed = true
+    close(bc.closeCh)
+    bc.mu.Unlock()
+    bc.bgWg.Wait()
+
     bc.mu.Lock()
     defer bc.mu.Unlock()
-    return bc.close()
+    // the next open reads the hint instead of scanning the active file
+    if bc.activeFile != nil && bc.activeFile.Size() > 0 {
+        if err := bc.writeActiveHintFile(); err != nil {
+            log.Printf("write hint of active file[%d] failed, err = %s", bc.activeFile.id, err)
+        }
+    }
+    err := bc.close()
+    bc.lock.unlock()
+    return err
+}
+
+// requires bc.mu held
+func (bc *BitCask) writeActiveHintFile() error {
+    af := bc.activeFile
+    if err := af.Flush(); err != nil {
+        return err
+    }
+    sum, err := bc.getDataFileSum(af.id)
+    if err != nil {
+        return err
+    }
+    return bc.replaceHintFile(af.id, sum, bc.activeKD)
 }
 
 func (bc *BitCask) close() error {
-    bc.activeFile.Close()
+    if bc.activeFile != nil {
+        if bc.opts.syncMode != SYNC_NONE {
+            bc.activeFile.Sync()
+        }
+        bc.activeFile.Close()
+    }
     if bc.recCache != nil {
         bc.recCache.Close()
     }
@@ -489,22 +739,31 @@ func (bc *BitCask) close() error {
 }
 
 func (bc *BitCask) ClearAll() error {
+    if bc.opts.readOnly {
+        return ErrReadOnly
+    }
     log.Printf("clearing db[%s]...", bc.dir)
     bc.mu.Lock()
     defer bc.mu.Unlock()
 
     bc.close()
     bc.clear()
-    if err := os.RemoveAll(bc.dir); err != nil {
-        log.Fatalf("remove dir[%s] failed, err = %s", bc.dir, err)
+    // keep the LOCK file, it's still locked by us
+    files, err := ioutil.ReadDir(bc.dir)
+    if err != nil {
+        log.Fatalf("read dir[%s] failed, err = %s", bc.dir, err)
     }
-    if err := os.Mkdir(bc.dir, 0755); err != nil {
-        log.Fatalf("recreate dir[%s] failed, err = %s", bc.dir, err)
+    for _, file := range files {
+        if file.Name() == LOCK_FILE {
+            continue
+        }
+        if err := os.RemoveAll(bc.dir + "/" + file.Name()); err != nil {
+            log.Fatalf("remove %s in dir[%s] failed, err = %s", file.Name(), bc.dir, err)
+        }
     }
 
     // make active file
-    var err error
-    bc.activeFile, err = NewActiveFile(bc.GetDataFilePath(bc.maxDataFileId), bc.maxDataFileId, bc.opts.bufferSize)
+    bc.activeFile, err = bc.newActiveFile(bc.maxDataFileId)
     if err != nil {
         log.Fatal(err)
         return err
@@ -517,13 +776,15 @@ func (bc *BitCask) ClearAll() error {
 // truncate bitcask database to [0, fileId)
 func (bc *BitCask) Truncate(fileId int64) error {
     log.Printf("truncate db[%s] to [0, %d)", bc.dir, fileId)
+    // readers are done with the files before they are truncated. Files
+    // mapped by snapshots are only cut past the records they read.
     bc.mu.Lock()
-    bc.mu.Unlock()
+    defer bc.mu.Unlock()
 
     bc.close()
     bc.clear()
 
-    err := bc.Restore(fileId)
+    err := bc.restore(fileId)
     if err != nil {
         log.Fatalf("truncate db[%s] to [0, %d) failed, err = %s", bc.dir, fileId, err)
         return err
@@ -531,9 +792,29 @@ func (bc *BitCask) Truncate(fileId int64) error {
     return nil
 }
 
+// requires bc.mu held
 func (bc *BitCask) removeDataFile(fileId int64) error {
     dataPath := bc.GetDataFilePath(fileId)
     hintPath := bc.getHintFilePath(fileId)
+    delete(bc.fileStats, fileId)
+    // readers still holding the file keep it open, or mapped, till they're done
+    if bc.dfCache != nil {
+        bc.dfCache.Remove(fileId)
+    }
+
+    if bc.pinnedFiles[fileId] > 0 {
+        // keep the data for snapshots under another name so it's not restored
+        log.Printf("data-file[%d] is pinned by snapshot, remove it later", fileId)
+        if err := os.Rename(dataPath, getObsoletePath(dataPath)); err != nil && !os.IsNotExist(err) {
+            return err
+        }
+        if err := os.Remove(hintPath); err != nil && !os.IsNotExist(err) {
+            return err
+        }
+        bc.obsoleteFiles[fileId] = true
+        return nil
+    }
+
     if _, err := os.Stat(dataPath); err == nil {
         if err := os.Remove(dataPath); err != nil {
             return err
@@ -544,15 +825,35 @@ func (bc *BitCask) removeDataFile(fileId int64) error {
             return err
         }
     }
-    return nil
+    return bc.removeKeyFile(fileId)
 }
 
 func (bc *BitCask) SyncFile(fileId int64, offset int64, length int64, data []byte) error {
+    if bc.opts.readOnly {
+        return ErrReadOnly
+    }
     bc.mu.Lock()
-    defer bc.mu.Unlock()
+    err := bc.syncFile(fileId, offset, length, data)
+    seq := bc.writeSeq
+    bc.mu.Unlock()
+    if err != nil {
+        return err
+    }
+    return bc.waitSync(seq)
+}
 
+// requires bc.mu held
+// data holds whole records as the master has them on disk, they're appended
+// as is so the files stay identical to the master's
+func (bc *BitCask) syncFile(fileId int64, offset int64, length int64, data []byte) error {
+    if int64(len(data)) != length {
+        log.Printf("invalid sync, data length[%d] != %d", len(data), length)
+        return ErrInvalid
+    }
     if fileId > bc.activeFile.id {
-        bc.rotateActiveFile(fileId)
+        if err := bc.rotateActiveFile(fileId); err != nil {
+            return err
+        }
     }
     af := bc.activeFile
 
@@ -566,27 +867,67 @@ func (bc *BitCask) SyncFile(fileId int64, offset int64, length int64, data []byt
         return ErrInvalid
     }
 
-    rec, err := parseRecordAt(bytes.NewReader(data), 0)
-    if err != nil {
-        log.Printf("parse record failed, err = %s", err)
-        return err
-    }
-
-    // if it's a merge record
-    if rec.flag & RECORD_FLAG_MERGE > 0 {
-        f := rec.valueSize
-        if err := bc.removeDataFile(f); err != nil {
-            log.Printf("remove merged file[%d] failed, err = %s", fileId, err)
+    // check all records first, nothing is written if data is bad
+    recs := make([]*Record, 0)
+    r := bytes.NewReader(data)
+    var pos int64 = 0
+    var inBatch int = 0
+    for pos < length {
+        rec, err := parseRecordAt(r, pos, af.fc)
+        if err != nil {
+            log.Printf("parse record at %d failed, err = %s", pos, err)
             return err
         }
+        recs = append(recs, rec)
+        pos += rec.Size()
+        if rec.flag & RECORD_FLAG_BATCH > 0 {
+            inBatch++
+        } else {
+            inBatch = 0
+        }
+    }
+    if pos != length || inBatch > 0 {
+        log.Printf("invalid sync, data doesn't end at a record or batch boundary")
+        return ErrInvalid
     }
 
-    err = bc.addRecord(rec, true)
-    if err != nil {
-        log.Printf("append record failed, err = %s", err)
+    if _, err := af.Write(data); err != nil {
         return err
     }
-
+    if err := af.Flush(); err != nil {
+        return err
+    }
+    bc.writeSeq++
+    bc.notifyWrite()
+    bc.fileStat(af.id).TotalBytes = af.Size()
+
+    pos = offset
+    for _, rec := range recs {
+        recOffset := pos
+        pos += rec.Size()
+        if rec.flag & RECORD_FLAG_MERGE > 0 {
+            f := rec.valueSize
+            if err := bc.dropMergedFile(f); err != nil {
+                log.Printf("remove merged file[%d] failed, err = %s", f, err)
+                return err
+            }
+            continue
+        }
+        if rec.flag & RECORD_FLAG_BATCH_COMMIT > 0 {
+            continue
+        }
+        di := &DirItem{
+            flag: rec.flag,
+            fileId: af.id,
+            valuePos: recOffset + RecordValueOffset(),
+            valueSize: rec.valueSize,
+            expration: rec.expration,
+        }
+        if err := bc.updateKeyDir(rec.key, di, bc.activeKD, true); err != nil {
+            return err
+        }
+    }
+    // files are rotated as the master does, by the fileId of the sync
     return nil
 }
 
@@ -594,22 +935,36 @@ func (bc *BitCask) FirstKeyUnderSlot(slot uint32) ([]byte, error) {
     bc.mu.Lock()
     defer bc.mu.Unlock()
 
-    keys := bc.keysInSlot[slot]
-    if keys == nil {
+    if !bc.opts.slotIndex {
+        return nil, ErrNoSlotIndex
+    }
+    si := bc.keysInSlot[slot]
+    if si == nil {
+        return nil, nil
+    }
+    // pop the first key
+    it := si.keys.NewIterator()
+    it.SeekToFirst()
+    if !it.Valid() {
         return nil, nil
     }
-    // return a random key
-    for k, _ := range keys {
-        delete(keys, k)
-        return []byte(k), nil
+    key := append([]byte(nil), it.Key()...)
+    old, _ := si.keys.Delete(key)
+    si.bytes -= old.(int64)
+    si.keyBytes -= int64(len(key))
+    if si.keys.Len() == 0 {
+        delete(bc.keysInSlot, slot)
     }
-    return nil, nil
+    return key, nil
 }
 
 func (bc *BitCask) AllKeysWithTag(tag []byte) ([][]byte, error) {
     bc.mu.Lock()
     defer bc.mu.Unlock()
 
+    if !bc.opts.slotIndex {
+        return nil, ErrNoSlotIndex
+    }
     results := make([][]byte, 0)
     keys, ok := bc.keysInTag[string(tag)]
     if !ok || keys == nil {
@@ -617,7 +972,9 @@ func (bc *BitCask) AllKeysWithTag(tag []byte) ([][]byte, error) {
     } else {
         for k, _ := range keys {
             results = append(results, []byte(k))
+            bc.tagIndexBytes -= int64(len(k)) + TAG_INDEX_ITEM_SIZE
         }
+        bc.tagIndexBytes -= int64(len(tag)) + TAG_INDEX_ITEM_SIZE
     }
     delete(bc.keysInTag, string(tag))
     return results, nil
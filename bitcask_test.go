@@ -32,22 +32,22 @@ func TestBitCaskSimple(t *testing.T) {
         t.Error("open bitcask failed")
     }
 
-    err = bc.Set("key1", []byte("hello"))
+    err = bc.Set([]byte("key1"), []byte("hello"))
     if err != nil {
         t.Error(err)
     }
 
-    err = bc.Set("key2", []byte("world"))
+    err = bc.Set([]byte("key2"), []byte("world"))
     if err != nil {
         t.Error(err)
     }
 
-    err = bc.Set("key3", []byte("nihao"))
+    err = bc.Set([]byte("key3"), []byte("nihao"))
     if err != nil {
         t.Error(err)
     }
 
-    val, err := bc.Get("key3")
+    val, err := bc.Get([]byte("key3"))
     if err != nil {
         t.Error(err)
     }
@@ -55,7 +55,7 @@ func TestBitCaskSimple(t *testing.T) {
         t.Errorf("content[%s] invalid\n", string(val))
     }
 
-    val, err = bc.Get("key2")
+    val, err = bc.Get([]byte("key2"))
     if err != nil {
         t.Error(err)
     }
@@ -63,18 +63,18 @@ func TestBitCaskSimple(t *testing.T) {
         t.Errorf("content[%s] invalid\n", string(val))
     }
 
-    _, err = bc.Get("key4")
-    if err != bitcask.ErrNotFound {
+    _, err = bc.Get([]byte("key4"))
+    if err != bitcask.ErrKeyNotFound {
         t.Error("content invalid")
     }
 
-    err = bc.Del("key2")
+    err = bc.Del([]byte("key2"))
     if err != nil {
         t.Error(err)
     }
 
-    _, err = bc.Get("key2")
-    if err != bitcask.ErrNotFound {
+    _, err = bc.Get([]byte("key2"))
+    if err != bitcask.ErrKeyNotFound {
         t.Error("content invalid")
     }
 }
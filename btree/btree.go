@@ -0,0 +1,365 @@
+package btree
+
+import (
+    "bytes"
+    "sort"
+)
+
+// BTree is an in-memory B-tree ordered by key. Clone is O(1): nodes are
+// shared between clones and copied lazily on the first write.
+// A BTree is not safe for concurrent use, but a clone may be read while
+// the original is written.
+type BTree struct {
+    degree      int
+    length      int
+    root        *node
+    owner       *owner
+}
+
+// owner marks the nodes a tree is allowed to modify in place
+type owner struct {
+    _   int
+}
+
+type item struct {
+    key     []byte
+    value   interface{}
+}
+
+type node struct {
+    items       []item
+    children    []*node
+    owner       *owner
+}
+
+func New(degree int) *BTree {
+    if degree < 2 {
+        degree = 2
+    }
+    return &BTree{
+        degree: degree,
+        owner: &owner{},
+    }
+}
+
+func (t *BTree) maxItems() int {
+    return t.degree * 2 - 1
+}
+
+func (t *BTree) minItems() int {
+    return t.degree - 1
+}
+
+func (t *BTree) newNode() *node {
+    return &node{owner: t.owner}
+}
+
+func (t *BTree) Len() int {
+    return t.length
+}
+
+// Clone returns a copy of the tree, later writes to either tree are not
+// visible in the other one.
+func (t *BTree) Clone() *BTree {
+    out := *t
+    t.owner = &owner{}
+    out.owner = &owner{}
+    return &out
+}
+
+func (t *BTree) Clear() {
+    t.root = nil
+    t.length = 0
+}
+
+func (t *BTree) Get(key []byte) (interface{}, bool) {
+    n := t.root
+    for n != nil {
+        i, found := n.find(key)
+        if found {
+            return n.items[i].value, true
+        }
+        if len(n.children) == 0 {
+            break
+        }
+        n = n.children[i]
+    }
+    return nil, false
+}
+
+// Put sets the value for key and returns the replaced value if any.
+// The key is copied on insert.
+func (t *BTree) Put(key []byte, value interface{}) (interface{}, bool) {
+    if t.root == nil {
+        t.root = t.newNode()
+        t.root.items = append(t.root.items, item{copyKey(key), value})
+        t.length++
+        return nil, false
+    }
+
+    t.root = t.root.mutableFor(t.owner)
+    if len(t.root.items) >= t.maxItems() {
+        mid, second := t.root.split(t.maxItems() / 2)
+        oldRoot := t.root
+        t.root = t.newNode()
+        t.root.items = append(t.root.items, mid)
+        t.root.children = append(t.root.children, oldRoot, second)
+    }
+    old, replaced := t.root.insert(key, value, t.maxItems())
+    if !replaced {
+        t.length++
+    }
+    return old, replaced
+}
+
+// Delete removes key and returns its value if it was in the tree.
+func (t *BTree) Delete(key []byte) (interface{}, bool) {
+    if t.root == nil || len(t.root.items) == 0 {
+        return nil, false
+    }
+    t.root = t.root.mutableFor(t.owner)
+    out, ok := t.root.remove(key, t.minItems(), removeItem)
+    if len(t.root.items) == 0 && len(t.root.children) > 0 {
+        t.root = t.root.children[0]
+    }
+    if !ok {
+        return nil, false
+    }
+    t.length--
+    return out.value, true
+}
+
+// ForEach calls fn for every item in key order until fn returns false.
+func (t *BTree) ForEach(fn func(key []byte, value interface{}) bool) {
+    if t.root != nil {
+        t.root.forEach(fn)
+    }
+}
+
+func copyKey(key []byte) []byte {
+    k := make([]byte, len(key))
+    copy(k, key)
+    return k
+}
+
+///////////////////////////////////
+
+// find returns the index of the first item >= key and whether it equals key
+func (n *node) find(key []byte) (int, bool) {
+    i := sort.Search(len(n.items), func(i int) bool {
+        return bytes.Compare(n.items[i].key, key) >= 0
+    })
+    if i < len(n.items) && bytes.Equal(n.items[i].key, key) {
+        return i, true
+    }
+    return i, false
+}
+
+func (n *node) mutableFor(o *owner) *node {
+    if n.owner == o {
+        return n
+    }
+    out := &node{owner: o}
+    out.items = make([]item, len(n.items), cap(n.items))
+    copy(out.items, n.items)
+    if len(n.children) > 0 {
+        out.children = make([]*node, len(n.children), cap(n.children))
+        copy(out.children, n.children)
+    }
+    return out
+}
+
+func (n *node) mutableChild(i int) *node {
+    c := n.children[i].mutableFor(n.owner)
+    n.children[i] = c
+    return c
+}
+
+// split moves the items after i into a new node, returns item i and the new node
+func (n *node) split(i int) (item, *node) {
+    mid := n.items[i]
+    next := &node{owner: n.owner}
+    next.items = append(next.items, n.items[i+1:]...)
+    n.truncateItems(i)
+    if len(n.children) > 0 {
+        next.children = append(next.children, n.children[i+1:]...)
+        n.truncateChildren(i + 1)
+    }
+    return mid, next
+}
+
+func (n *node) maybeSplitChild(i int, maxItems int) bool {
+    if len(n.children[i].items) < maxItems {
+        return false
+    }
+    first := n.mutableChild(i)
+    mid, second := first.split(maxItems / 2)
+    n.insertItemAt(i, mid)
+    n.insertChildAt(i + 1, second)
+    return true
+}
+
+func (n *node) insert(key []byte, value interface{}, maxItems int) (interface{}, bool) {
+    i, found := n.find(key)
+    if found {
+        old := n.items[i].value
+        n.items[i].value = value
+        return old, true
+    }
+    if len(n.children) == 0 {
+        n.insertItemAt(i, item{copyKey(key), value})
+        return nil, false
+    }
+    if n.maybeSplitChild(i, maxItems) {
+        switch c := bytes.Compare(key, n.items[i].key); {
+        case c > 0:
+            i++
+        case c == 0:
+            old := n.items[i].value
+            n.items[i].value = value
+            return old, true
+        }
+    }
+    return n.mutableChild(i).insert(key, value, maxItems)
+}
+
+type removeType int
+
+const (
+    removeItem removeType = iota
+    removeMin
+    removeMax
+)
+
+func (n *node) remove(key []byte, minItems int, typ removeType) (item, bool) {
+    var i int
+    var found bool
+    switch typ {
+    case removeMax:
+        if len(n.children) == 0 {
+            return n.removeItemAt(len(n.items) - 1), true
+        }
+        i = len(n.items)
+    case removeMin:
+        if len(n.children) == 0 {
+            return n.removeItemAt(0), true
+        }
+        i = 0
+    case removeItem:
+        i, found = n.find(key)
+        if len(n.children) == 0 {
+            if found {
+                return n.removeItemAt(i), true
+            }
+            return item{}, false
+        }
+    }
+
+    // make sure the child we descend into can lose an item
+    if len(n.children[i].items) <= minItems {
+        return n.growChildAndRemove(i, key, minItems, typ)
+    }
+    child := n.mutableChild(i)
+    if found {
+        // replace the item with its predecessor from the child
+        out := n.items[i]
+        n.items[i], _ = child.remove(nil, minItems, removeMax)
+        return out, true
+    }
+    return child.remove(key, minItems, typ)
+}
+
+func (n *node) growChildAndRemove(i int, key []byte, minItems int, typ removeType) (item, bool) {
+    if i > 0 && len(n.children[i-1].items) > minItems {
+        // steal from left sibling
+        child := n.mutableChild(i)
+        from := n.mutableChild(i - 1)
+        stolen := from.removeItemAt(len(from.items) - 1)
+        child.insertItemAt(0, n.items[i-1])
+        n.items[i-1] = stolen
+        if len(from.children) > 0 {
+            child.insertChildAt(0, from.removeChildAt(len(from.children) - 1))
+        }
+    } else if i < len(n.items) && len(n.children[i+1].items) > minItems {
+        // steal from right sibling
+        child := n.mutableChild(i)
+        from := n.mutableChild(i + 1)
+        stolen := from.removeItemAt(0)
+        child.items = append(child.items, n.items[i])
+        n.items[i] = stolen
+        if len(from.children) > 0 {
+            child.children = append(child.children, from.removeChildAt(0))
+        }
+    } else {
+        // merge with right sibling
+        if i >= len(n.items) {
+            i--
+        }
+        child := n.mutableChild(i)
+        mid := n.removeItemAt(i)
+        right := n.removeChildAt(i + 1)
+        child.items = append(child.items, mid)
+        child.items = append(child.items, right.items...)
+        child.children = append(child.children, right.children...)
+    }
+    return n.remove(key, minItems, typ)
+}
+
+func (n *node) forEach(fn func(key []byte, value interface{}) bool) bool {
+    for i, it := range n.items {
+        if len(n.children) > 0 {
+            if !n.children[i].forEach(fn) {
+                return false
+            }
+        }
+        if !fn(it.key, it.value) {
+            return false
+        }
+    }
+    if len(n.children) > 0 {
+        return n.children[len(n.children) - 1].forEach(fn)
+    }
+    return true
+}
+
+func (n *node) insertItemAt(i int, it item) {
+    n.items = append(n.items, item{})
+    copy(n.items[i+1:], n.items[i:])
+    n.items[i] = it
+}
+
+func (n *node) removeItemAt(i int) item {
+    it := n.items[i]
+    copy(n.items[i:], n.items[i+1:])
+    n.items[len(n.items) - 1] = item{}
+    n.items = n.items[:len(n.items) - 1]
+    return it
+}
+
+func (n *node) truncateItems(i int) {
+    for j := i; j < len(n.items); j++ {
+        n.items[j] = item{}
+    }
+    n.items = n.items[:i]
+}
+
+func (n *node) insertChildAt(i int, c *node) {
+    n.children = append(n.children, nil)
+    copy(n.children[i+1:], n.children[i:])
+    n.children[i] = c
+}
+
+func (n *node) removeChildAt(i int) *node {
+    c := n.children[i]
+    copy(n.children[i:], n.children[i+1:])
+    n.children[len(n.children) - 1] = nil
+    n.children = n.children[:len(n.children) - 1]
+    return c
+}
+
+func (n *node) truncateChildren(i int) {
+    for j := i; j < len(n.children); j++ {
+        n.children[j] = nil
+    }
+    n.children = n.children[:i]
+}
@@ -0,0 +1,118 @@
+package btree_test
+
+import (
+    "fmt"
+    "math/rand"
+    "sort"
+    "testing"
+    "github.com/rocket323/bitcask/btree"
+)
+
+func key(i int) []byte {
+    return []byte(fmt.Sprintf("%06d", i))
+}
+
+func TestPutGetDelete(t *testing.T) {
+    tr := btree.New(3)
+    mp := make(map[string]int)
+
+    for i := 0; i < 20000; i++ {
+        k := rand.Intn(2000)
+        if rand.Intn(3) == 0 {
+            _, ok := tr.Delete(key(k))
+            _, exist := mp[string(key(k))]
+            if ok != exist {
+                t.Fatalf("delete %d, got %v, expect %v", k, ok, exist)
+            }
+            delete(mp, string(key(k)))
+        } else {
+            tr.Put(key(k), i)
+            mp[string(key(k))] = i
+        }
+    }
+
+    if tr.Len() != len(mp) {
+        t.Fatalf("len %d, expect %d", tr.Len(), len(mp))
+    }
+    for k, v := range mp {
+        got, ok := tr.Get([]byte(k))
+        if !ok || got.(int) != v {
+            t.Fatalf("get %s, got %v, expect %d", k, got, v)
+        }
+    }
+}
+
+func TestIterator(t *testing.T) {
+    tr := btree.New(2)
+    keys := make([]string, 0)
+    for _, i := range rand.Perm(500) {
+        tr.Put(key(i * 2), i)
+        keys = append(keys, string(key(i * 2)))
+    }
+    sort.Strings(keys)
+
+    it := tr.NewIterator()
+    n := 0
+    for it.SeekToFirst(); it.Valid(); it.Next() {
+        if string(it.Key()) != keys[n] {
+            t.Fatalf("next got %s, expect %s", it.Key(), keys[n])
+        }
+        n++
+    }
+    if n != len(keys) {
+        t.Fatalf("iterate %d items, expect %d", n, len(keys))
+    }
+
+    n = len(keys) - 1
+    for it.SeekToLast(); it.Valid(); it.Prev() {
+        if string(it.Key()) != keys[n] {
+            t.Fatalf("prev got %s, expect %s", it.Key(), keys[n])
+        }
+        n--
+    }
+    if n != -1 {
+        t.Fatalf("reverse iterate stop at %d", n)
+    }
+
+    // seek to a missing key lands on the next one
+    it.Seek(key(101))
+    if !it.Valid() || string(it.Key()) != string(key(102)) {
+        t.Fatalf("seek got invalid position")
+    }
+    it.Prev()
+    if !it.Valid() || string(it.Key()) != string(key(100)) {
+        t.Fatalf("prev after seek got invalid position")
+    }
+    it.Seek(key(999))
+    if it.Valid() {
+        t.Fatalf("seek past the end should be invalid")
+    }
+}
+
+func TestClone(t *testing.T) {
+    tr := btree.New(2)
+    for i := 0; i < 100; i++ {
+        tr.Put(key(i), i)
+    }
+    c := tr.Clone()
+    for i := 0; i < 100; i += 2 {
+        tr.Delete(key(i))
+    }
+    tr.Put(key(1), -1)
+
+    if c.Len() != 100 {
+        t.Fatalf("clone len %d, expect 100", c.Len())
+    }
+    for i := 0; i < 100; i++ {
+        v, ok := c.Get(key(i))
+        if !ok || v.(int) != i {
+            t.Fatalf("clone get %d, got %v", i, v)
+        }
+    }
+    if v, _ := tr.Get(key(1)); v.(int) != -1 {
+        t.Fatalf("tree get 1, got %v", v)
+    }
+    if tr.Len() != 50 {
+        t.Fatalf("tree len %d, expect 50", tr.Len())
+    }
+}
@@ -0,0 +1,144 @@
+package btree
+
+type frame struct {
+    n   *node
+    i   int
+}
+
+// Iterator walks a BTree in key order. The tree must not be modified while
+// iterating, iterate over a Clone if writes may happen.
+//
+// The top frame of the stack points at the current item, the frames below
+// hold the index of the child that was descended into.
+type Iterator struct {
+    t       *BTree
+    stack   []frame
+}
+
+func (t *BTree) NewIterator() *Iterator {
+    return &Iterator{
+        t: t,
+        stack: make([]frame, 0, 8),
+    }
+}
+
+func (it *Iterator) Valid() bool {
+    return len(it.stack) > 0
+}
+
+func (it *Iterator) Key() []byte {
+    f := it.stack[len(it.stack) - 1]
+    return f.n.items[f.i].key
+}
+
+func (it *Iterator) Value() interface{} {
+    f := it.stack[len(it.stack) - 1]
+    return f.n.items[f.i].value
+}
+
+func (it *Iterator) top() *frame {
+    return &it.stack[len(it.stack) - 1]
+}
+
+func (it *Iterator) SeekToFirst() {
+    it.stack = it.stack[:0]
+    n := it.t.root
+    if n == nil || len(n.items) == 0 {
+        return
+    }
+    it.descendFirst(n)
+}
+
+func (it *Iterator) SeekToLast() {
+    it.stack = it.stack[:0]
+    n := it.t.root
+    if n == nil || len(n.items) == 0 {
+        return
+    }
+    it.descendLast(n)
+}
+
+// Seek moves to the first item whose key >= key
+func (it *Iterator) Seek(key []byte) {
+    it.stack = it.stack[:0]
+    n := it.t.root
+    if n == nil || len(n.items) == 0 {
+        return
+    }
+    for {
+        i, found := n.find(key)
+        it.stack = append(it.stack, frame{n, i})
+        if found {
+            return
+        }
+        if len(n.children) == 0 {
+            it.ascendNext()
+            return
+        }
+        n = n.children[i]
+    }
+}
+
+func (it *Iterator) Next() {
+    f := it.top()
+    if len(f.n.children) > 0 {
+        f.i++
+        it.descendFirst(f.n.children[f.i])
+        return
+    }
+    f.i++
+    it.ascendNext()
+}
+
+func (it *Iterator) Prev() {
+    f := it.top()
+    if len(f.n.children) > 0 {
+        it.descendLast(f.n.children[f.i])
+        return
+    }
+    f.i--
+    it.ascendPrev()
+}
+
+func (it *Iterator) descendFirst(n *node) {
+    for {
+        it.stack = append(it.stack, frame{n, 0})
+        if len(n.children) == 0 {
+            return
+        }
+        n = n.children[0]
+    }
+}
+
+func (it *Iterator) descendLast(n *node) {
+    for len(n.children) > 0 {
+        it.stack = append(it.stack, frame{n, len(n.children) - 1})
+        n = n.children[len(n.children) - 1]
+    }
+    it.stack = append(it.stack, frame{n, len(n.items) - 1})
+}
+
+// pop finished frames, the next item of a parent has the same index as the child
+func (it *Iterator) ascendNext() {
+    for len(it.stack) > 0 {
+        f := it.top()
+        if f.i < len(f.n.items) {
+            return
+        }
+        it.stack = it.stack[:len(it.stack) - 1]
+    }
+}
+
+// pop finished frames, the previous item of a parent is left of the child
+func (it *Iterator) ascendPrev() {
+    for len(it.stack) > 0 {
+        f := it.top()
+        if f.i >= 0 {
+            return
+        }
+        it.stack = it.stack[:len(it.stack) - 1]
+        if len(it.stack) > 0 {
+            it.top().i--
+        }
+    }
+}
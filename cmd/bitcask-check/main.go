@@ -0,0 +1,65 @@
+package main
+
+import (
+    "encoding/hex"
+    "flag"
+    "fmt"
+    "io"
+    "io/ioutil"
+    "log"
+    "os"
+    "github.com/rocket323/bitcask"
+)
+
+// bitcask-check verifies the records and hint files of a db that is not
+// opened, and repairs them with -repair. It exits with 1 if issues are
+// left, 2 if the check itself failed.
+
+func run(args []string, out io.Writer) int {
+    fs := flag.NewFlagSet("bitcask-check", flag.ContinueOnError)
+    fs.SetOutput(out)
+    dbPath := fs.String("db", "./bitcask_db", "db path")
+    repair := fs.Bool("repair", false, "cut damaged records out of data files and write bad hint files again")
+    masterKey := fs.String("master_key", "", "hex master key of an encrypted db")
+    masterKeyId := fs.Uint("master_key_id", 1, "id of the master key")
+    verbose := fs.Bool("v", false, "log progress")
+    if err := fs.Parse(args); err != nil {
+        return 2
+    }
+    if !*verbose {
+        log.SetOutput(ioutil.Discard)
+    }
+
+    opts := bitcask.NewOptions()
+    if *masterKey != "" {
+        key, err := hex.DecodeString(*masterKey)
+        if err != nil {
+            fmt.Fprintf(out, "invalid master key, err = %s\n", err)
+            return 2
+        }
+        opts.SetEncryption(bitcask.NewStaticKeyProvider(uint32(*masterKeyId), key))
+    }
+
+    report, err := bitcask.VerifyDir(*dbPath, opts, *repair)
+    if err != nil {
+        fmt.Fprintf(out, "check %s failed, err = %s\n", *dbPath, err)
+        return 2
+    }
+    for _, issue := range report.Issues {
+        fmt.Fprintln(out, issue)
+    }
+    fmt.Fprintf(out, "%d data files, %d records, %d hint files, %d hint items, %d issues\n",
+        report.DataFiles, report.Records, report.HintFiles, report.HintItems, len(report.Issues))
+    if !report.OK() {
+        if !*repair {
+            fmt.Fprintln(out, "run with -repair to fix them")
+        }
+        return 1
+    }
+    return 0
+}
+
+func main() {
+    log.SetFlags(log.Lshortfile | log.LstdFlags)
+    os.Exit(run(os.Args[1:], os.Stdout))
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+    "bytes"
+    "fmt"
+    "io/ioutil"
+    "os"
+    "strings"
+    "testing"
+    "github.com/rocket323/bitcask"
+)
+
+func TestCheck(t *testing.T) {
+    dir, err := ioutil.TempDir("", "bitcask-check")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+
+    opts := bitcask.NewOptions()
+    opts.SetMaxFileSize(1024)
+    bc, err := bitcask.Open(dir, opts)
+    if err != nil {
+        t.Fatal(err)
+    }
+    for i := 0; i < 100; i++ {
+        if err := bc.Set([]byte(fmt.Sprintf("key%03d", i)), []byte("value")); err != nil {
+            t.Fatal(err)
+        }
+    }
+    bc.Close()
+
+    out := new(bytes.Buffer)
+    if code := run([]string{"-db", dir}, out); code != 0 {
+        t.Fatalf("exit %d: %s", code, out)
+    }
+
+    // damage the value of the first record
+    path := dir + "/000000000.data"
+    data, err := ioutil.ReadFile(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+    data[bitcask.RecordValueOffset()] ^= 0xff
+    if err := ioutil.WriteFile(path, data, 0644); err != nil {
+        t.Fatal(err)
+    }
+
+    out.Reset()
+    if code := run([]string{"-db", dir}, out); code != 1 || !strings.Contains(out.String(), "offset 0") {
+        t.Fatalf("exit %d: %s", code, out)
+    }
+    out.Reset()
+    if code := run([]string{"-db", dir, "-repair"}, out); code != 0 || !strings.Contains(out.String(), "(repaired)") {
+        t.Fatalf("exit %d: %s", code, out)
+    }
+    out.Reset()
+    if code := run([]string{"-db", dir}, out); code != 0 || !strings.Contains(out.String(), "99 records") {
+        t.Fatalf("exit %d: %s", code, out)
+    }
+
+    out.Reset()
+    if code := run([]string{"-db", dir + "/missing"}, out); code != 2 {
+        t.Fatalf("exit %d: %s", code, out)
+    }
+}
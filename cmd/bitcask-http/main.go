@@ -0,0 +1,105 @@
+package main
+
+import (
+    "context"
+    "flag"
+    "log"
+    "net/http"
+    "os"
+    "os/signal"
+    "syscall"
+    "time"
+    "github.com/rocket323/bitcask"
+)
+
+var (
+    dbPath string
+    addr string
+    maxFileSize int64
+    syncMode string
+    expireSweepInterval int64
+    mergeCheckInterval int64
+    snapshotTTL int64
+    readOnly bool
+    keyDirMode string
+    slotIndex bool
+    useMmap bool
+)
+
+func init() {
+    flag.StringVar(&dbPath, "db", "./bitcask_db", "db path")
+    flag.StringVar(&addr, "addr", ":8080", "listen address")
+    flag.Int64Var(&maxFileSize, "max_file_size", 100, "max size of a data file in MB")
+    flag.StringVar(&syncMode, "sync", "none", "none, always or interval")
+    flag.Int64Var(&expireSweepInterval, "expire_sweep_interval", 1000, "ms between sweeps of expired keys, 0 disables it")
+    flag.Int64Var(&mergeCheckInterval, "merge_check_interval", 60000, "ms between merge checks, 0 disables merge")
+    flag.Int64Var(&snapshotTTL, "snapshot_ttl", 600, "seconds an idle snapshot is kept")
+    flag.BoolVar(&readOnly, "read_only", false, "open the db read-only")
+    flag.StringVar(&keyDirMode, "keydir", "btree", "btree, compact or hash")
+    flag.BoolVar(&slotIndex, "slot_index", true, "keep the keys of each slot in memory, or scan the keydir for them")
+    flag.BoolVar(&useMmap, "mmap", false, "read closed data files through mmap")
+}
+
+func main() {
+    flag.Parse()
+    log.SetFlags(log.Lshortfile | log.LstdFlags)
+
+    opts := bitcask.NewOptions()
+    opts.SetMaxFileSize(maxFileSize * 1024 * 1024)
+    switch syncMode {
+    case "none":
+        opts.SetSyncMode(bitcask.SYNC_NONE)
+    case "always":
+        opts.SetSyncMode(bitcask.SYNC_ALWAYS)
+    case "interval":
+        opts.SetSyncMode(bitcask.SYNC_INTERVAL)
+    default:
+        log.Fatalf("unknown sync mode %s", syncMode)
+    }
+    opts.SetExpireSweepInterval(expireSweepInterval)
+    opts.SetMergeCheckInterval(mergeCheckInterval)
+    opts.SetReadOnly(readOnly)
+    switch keyDirMode {
+    case "btree":
+        opts.SetKeyDirMode(bitcask.KEYDIR_BTREE)
+    case "compact":
+        opts.SetKeyDirMode(bitcask.KEYDIR_COMPACT)
+    case "hash":
+        opts.SetKeyDirMode(bitcask.KEYDIR_HASH)
+    default:
+        log.Fatalf("unknown keydir mode %s", keyDirMode)
+    }
+    opts.SetSlotIndex(slotIndex)
+    opts.SetMmap(useMmap)
+
+    bc, err := bitcask.Open(dbPath, opts)
+    if err != nil {
+        log.Fatalf("open db at %s failed, err = %s", dbPath, err)
+    }
+    s := NewServer(bc, time.Duration(snapshotTTL) * time.Second)
+    hs := &http.Server{Addr: addr, Handler: s}
+
+    sigCh := make(chan os.Signal, 1)
+    signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+    shutdown := make(chan struct{})
+    go func() {
+        defer close(shutdown)
+        sig := <-sigCh
+        log.Printf("got signal %s, shutting down", sig)
+        ctx, cancel := context.WithTimeout(context.Background(), 10 * time.Second)
+        defer cancel()
+        hs.Shutdown(ctx)
+    }()
+
+    log.Printf("serving %s on %s", dbPath, addr)
+    if err := hs.ListenAndServe(); err == http.ErrServerClosed {
+        // wait for the requests running
+        <-shutdown
+    } else if err != nil {
+        log.Printf("serve failed, err = %s", err)
+    }
+    s.Close()
+    if err := bc.Close(); err != nil {
+        log.Printf("close db failed, err = %s", err)
+    }
+}
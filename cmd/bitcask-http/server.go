@@ -0,0 +1,423 @@
+package main
+
+import (
+    "encoding/base64"
+    "encoding/hex"
+    "encoding/json"
+    "io/ioutil"
+    "log"
+    "net/http"
+    "net/url"
+    "strconv"
+    "strings"
+    "time"
+    "github.com/rocket323/bitcask"
+)
+
+// REST api of a db:
+//
+//   GET    /kv/{key}               value, with the remaining ttl in TTL_HEADER
+//   PUT    /kv/{key}               value in body, ttl in seconds in TTL_HEADER
+//   DELETE /kv/{key}
+//   GET    /kv?prefix=&start=&end=&limit=&values=&encoding=
+//   POST   /merge?wait=
+//   GET    /files
+//   GET    /stats
+//   POST   /snapshot               a read-only view, released after idle time
+//   GET    /snapshot/{id}/kv/{key}
+//   GET    /snapshot/{id}/kv?...   listing as /kv
+//   DELETE /snapshot/{id}
+//
+// Keys are escaped in the path, so a key can hold '/'.
+
+const (
+    TTL_HEADER = "X-Bitcask-TTL"
+    defaultListLimit = 100
+    maxListLimit = 10000
+    maxValueSize = 64 * 1024 * 1024
+)
+
+type Server struct {
+    bc          *bitcask.BitCask
+    mux         *http.ServeMux
+    snaps       *snapshots
+    start       time.Time
+}
+
+func NewServer(bc *bitcask.BitCask, snapshotTTL time.Duration) *Server {
+    s := &Server{
+        bc: bc,
+        mux: http.NewServeMux(),
+        snaps: newSnapshots(snapshotTTL),
+        start: time.Now(),
+    }
+    s.mux.HandleFunc("/kv", s.handleKV)
+    s.mux.HandleFunc("/kv/", s.handleKV)
+    s.mux.HandleFunc("/merge", s.handleMerge)
+    s.mux.HandleFunc("/files", s.handleFiles)
+    s.mux.HandleFunc("/stats", s.handleStats)
+    s.mux.HandleFunc("/snapshot", s.handleSnapshot)
+    s.mux.HandleFunc("/snapshot/", s.handleSnapshot)
+    return s
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+    s.mux.ServeHTTP(w, r)
+}
+
+// Close releases the snapshots
+func (s *Server) Close() {
+    s.snaps.Close()
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(code)
+    if err := json.NewEncoder(w).Encode(v); err != nil {
+        log.Printf("write response failed, err = %s", err)
+    }
+}
+
+func writeError(w http.ResponseWriter, code int, msg string) {
+    writeJSON(w, code, map[string]string{"error": msg})
+}
+
+// status code of err from the db
+func writeDBError(w http.ResponseWriter, err error) {
+    switch err {
+    case bitcask.ErrKeyNotFound:
+        writeError(w, http.StatusNotFound, err.Error())
+    case bitcask.ErrReadOnly:
+        writeError(w, http.StatusForbidden, err.Error())
+    case bitcask.ErrSnapshotReleased:
+        writeError(w, http.StatusNotFound, err.Error())
+    default:
+        writeError(w, http.StatusInternalServerError, err.Error())
+    }
+}
+
+// the unescaped rest of the path after prefix, escaped '/' in a key is kept
+func pathKey(r *http.Request, prefix string) (string, bool) {
+    p := r.URL.EscapedPath()
+    if !strings.HasPrefix(p, prefix) {
+        return "", false
+    }
+    key, err := url.PathUnescape(p[len(prefix):])
+    if err != nil {
+        return "", false
+    }
+    return key, true
+}
+
+func (s *Server) handleKV(w http.ResponseWriter, r *http.Request) {
+    key, ok := pathKey(r, "/kv/")
+    if !ok || key == "" {
+        if r.Method != http.MethodGet {
+            writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+            return
+        }
+        list(w, r, s.bc.NewIterator)
+        return
+    }
+
+    switch r.Method {
+    case http.MethodGet, http.MethodHead:
+        value, expration, err := s.bc.GetWithExpr([]byte(key))
+        if err != nil {
+            writeDBError(w, err)
+            return
+        }
+        writeValue(w, r, value, expration)
+    case http.MethodPut:
+        s.put(w, r, []byte(key))
+    case http.MethodDelete:
+        if _, err := s.bc.TTL([]byte(key)); err != nil {
+            writeDBError(w, err)
+            return
+        }
+        if err := s.bc.Del([]byte(key)); err != nil {
+            writeDBError(w, err)
+            return
+        }
+        w.WriteHeader(http.StatusNoContent)
+    default:
+        writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+    }
+}
+
+func writeValue(w http.ResponseWriter, r *http.Request, value []byte, expration uint32) {
+    w.Header().Set("Content-Type", "application/octet-stream")
+    w.Header().Set("Content-Length", strconv.Itoa(len(value)))
+    if expration > 0 {
+        ttl := int64(expration) - time.Now().Unix()
+        if ttl < 0 {
+            ttl = 0
+        }
+        w.Header().Set(TTL_HEADER, strconv.FormatInt(ttl, 10))
+    }
+    w.WriteHeader(http.StatusOK)
+    if r.Method != http.MethodHead {
+        w.Write(value)
+    }
+}
+
+func (s *Server) put(w http.ResponseWriter, r *http.Request, key []byte) {
+    var expration uint32 = 0
+    if h := r.Header.Get(TTL_HEADER); h != "" {
+        ttl, err := strconv.ParseInt(h, 10, 64)
+        if err != nil || ttl <= 0 {
+            writeError(w, http.StatusBadRequest, "invalid ttl " + h)
+            return
+        }
+        expration = uint32(time.Now().Unix() + ttl)
+    }
+    value, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxValueSize))
+    if err != nil {
+        writeError(w, http.StatusBadRequest, err.Error())
+        return
+    }
+    if err := s.bc.SetWithExpr(key, value, expration); err != nil {
+        writeDBError(w, err)
+        return
+    }
+    w.WriteHeader(http.StatusNoContent)
+}
+
+type listItem struct {
+    Key     string      `json:"key"`
+    Value   *string     `json:"value,omitempty"`
+}
+
+type listResult struct {
+    Items   []*listItem `json:"items"`
+    Next    *string     `json:"next"`       // start of the next page, null at the end
+}
+
+// keys in [start, end) with prefix in order, values are included if asked,
+// as strings or base64 with encoding=base64. The iterator only keeps the
+// keys of the page.
+func list(w http.ResponseWriter, r *http.Request, newIterator func(*bitcask.IteratorOptions) (*bitcask.Iterator, error)) {
+    q := r.URL.Query()
+    prefix := q.Get("prefix")
+    start, end := q.Get("start"), q.Get("end")
+    withValues := q.Get("values") == "true" || q.Get("values") == "1"
+    encoding := q.Get("encoding")
+    if encoding != "" && encoding != "base64" {
+        writeError(w, http.StatusBadRequest, "unknown encoding " + encoding)
+        return
+    }
+    limit := defaultListLimit
+    if l := q.Get("limit"); l != "" {
+        n, err := strconv.Atoi(l)
+        if err != nil || n <= 0 {
+            writeError(w, http.StatusBadRequest, "invalid limit " + l)
+            return
+        }
+        limit = n
+        if limit > maxListLimit {
+            limit = maxListLimit
+        }
+    }
+
+    opts := bitcask.NewIteratorOptions()
+    opts.SetPrefix([]byte(prefix))
+    if end != "" {
+        opts.SetRange([]byte(start), []byte(end))
+    } else {
+        opts.SetRange([]byte(start), nil)
+    }
+    // one more key for the start of the next page
+    opts.SetLimit(limit + 1)
+    it, err := newIterator(opts)
+    if err != nil {
+        writeDBError(w, err)
+        return
+    }
+    defer it.Close()
+
+    res := &listResult{Items: make([]*listItem, 0)}
+    for it.SeekToFirst(); it.Valid(); it.Next() {
+        key := it.Key()
+        if len(res.Items) == limit {
+            next := string(key)
+            res.Next = &next
+            break
+        }
+        item := &listItem{Key: string(key)}
+        if withValues {
+            value, err := it.Value()
+            if err != nil {
+                writeDBError(w, err)
+                return
+            }
+            v := string(value)
+            if encoding == "base64" {
+                v = base64.StdEncoding.EncodeToString(value)
+            }
+            item.Value = &v
+        }
+        res.Items = append(res.Items, item)
+    }
+    writeJSON(w, http.StatusOK, res)
+}
+
+// POST /merge merges all closed data files in background, with wait=true
+// it returns when the merge is done
+func (s *Server) handleMerge(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost {
+        writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+        return
+    }
+    done := make(chan int, 1)
+    s.bc.Merge(done)
+    if q := r.URL.Query().Get("wait"); q != "true" && q != "1" {
+        writeJSON(w, http.StatusAccepted, map[string]string{"status": "started"})
+        return
+    }
+    if <-done != 1 {
+        writeError(w, http.StatusInternalServerError, "merge failed, see the server log")
+        return
+    }
+    writeJSON(w, http.StatusOK, map[string]string{"status": "done"})
+}
+
+type fileInfo struct {
+    FileId      int64   `json:"file_id"`
+    Md5         string  `json:"md5,omitempty"`      // of closed files
+    Size        int64   `json:"size"`
+    DeadBytes   int64   `json:"dead_bytes"`
+    Active      bool    `json:"active"`
+}
+
+func (s *Server) files() []*fileInfo {
+    // files rotated after the stats are taken are closed in the metas
+    stats := s.bc.GetFileStats()
+    md5s := make(map[int64]string)
+    metas, active := s.bc.GetDataFiles()
+    for _, meta := range metas {
+        md5s[meta.FileId] = hex.EncodeToString(meta.Md5)
+    }
+    files := make([]*fileInfo, 0)
+    for _, fs := range stats {
+        files = append(files, &fileInfo{
+            FileId: fs.FileId,
+            Md5: md5s[fs.FileId],
+            Size: fs.TotalBytes,
+            DeadBytes: fs.DeadBytes,
+            Active: fs.FileId == active,
+        })
+    }
+    return files
+}
+
+func (s *Server) handleFiles(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet {
+        writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+        return
+    }
+    writeJSON(w, http.StatusOK, s.files())
+}
+
+type stats struct {
+    Keys            int64   `json:"keys"`
+    Slots           int     `json:"slots"`
+    DataFiles       int     `json:"data_files"`
+    DataBytes       int64   `json:"data_bytes"`
+    DeadBytes       int64   `json:"dead_bytes"`
+    KeyDirBytes     int64   `json:"keydir_bytes"`
+    ActiveFileId    int64   `json:"active_file_id"`
+    Snapshots       int     `json:"snapshots"`
+    Uptime          int64   `json:"uptime_seconds"`
+}
+
+func (s *Server) handleStats(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet {
+        writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+        return
+    }
+    _, active := s.bc.GetDataFiles()
+    st := &stats{
+        ActiveFileId: active,
+        Snapshots: s.snaps.Len(),
+        Uptime: int64(time.Since(s.start).Seconds()),
+        KeyDirBytes: s.bc.KeyDirStats().MemBytes,
+    }
+    summary := s.bc.SlotsSummary()
+    st.Slots = len(summary)
+    for _, stat := range summary {
+        st.Keys += stat.Keys
+    }
+    for _, f := range s.files() {
+        st.DataFiles++
+        st.DataBytes += f.Size
+        st.DeadBytes += f.DeadBytes
+    }
+    writeJSON(w, http.StatusOK, st)
+}
+
+func (s *Server) handleSnapshot(w http.ResponseWriter, r *http.Request) {
+    rest, _ := pathKey(r, "/snapshot/")
+    if rest == "" {
+        if r.Method != http.MethodPost {
+            writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+            return
+        }
+        snap, err := s.bc.Snapshot()
+        if err != nil {
+            writeDBError(w, err)
+            return
+        }
+        id := s.snaps.Add(snap)
+        writeJSON(w, http.StatusCreated, map[string]interface{}{
+            "id": id,
+            "idle_timeout_seconds": int64(s.snaps.ttl.Seconds()),
+        })
+        return
+    }
+
+    // {id}, {id}/kv or {id}/kv/{key}
+    parts := strings.SplitN(strings.TrimPrefix(r.URL.EscapedPath(), "/snapshot/"), "/", 2)
+    id, err := strconv.ParseUint(parts[0], 10, 64)
+    if err != nil {
+        writeError(w, http.StatusNotFound, "invalid snapshot id")
+        return
+    }
+    if len(parts) == 1 {
+        if r.Method != http.MethodDelete {
+            writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+            return
+        }
+        if !s.snaps.Release(id) {
+            writeError(w, http.StatusNotFound, "snapshot not found")
+            return
+        }
+        w.WriteHeader(http.StatusNoContent)
+        return
+    }
+
+    snap := s.snaps.Get(id)
+    if snap == nil {
+        writeError(w, http.StatusNotFound, "snapshot not found")
+        return
+    }
+    defer s.snaps.Put(id)
+    if r.Method != http.MethodGet && r.Method != http.MethodHead {
+        writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+        return
+    }
+    key, ok := pathKey(r, "/snapshot/" + parts[0] + "/kv/")
+    if !ok || key == "" {
+        if parts[1] != "kv" && parts[1] != "kv/" {
+            writeError(w, http.StatusNotFound, "not found")
+            return
+        }
+        list(w, r, snap.NewIterator)
+        return
+    }
+    value, expration, err := snap.GetWithExpr([]byte(key))
+    if err != nil {
+        writeDBError(w, err)
+        return
+    }
+    writeValue(w, r, value, expration)
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+    "bytes"
+    "encoding/json"
+    "fmt"
+    "io/ioutil"
+    "net/http"
+    "net/http/httptest"
+    "net/url"
+    "os"
+    "strings"
+    "testing"
+    "time"
+    "github.com/rocket323/bitcask"
+)
+
+type testServer struct {
+    t       *testing.T
+    dir     string
+    bc      *bitcask.BitCask
+    s       *Server
+    hs      *httptest.Server
+}
+
+func startServer(t *testing.T, snapshotTTL time.Duration) *testServer {
+    dir, err := ioutil.TempDir("", "bitcask-http")
+    if err != nil {
+        t.Fatal(err)
+    }
+    opts := bitcask.NewOptions()
+    opts.SetMaxFileSize(4096)
+    bc, err := bitcask.Open(dir, opts)
+    if err != nil {
+        t.Fatal(err)
+    }
+    s := NewServer(bc, snapshotTTL)
+    return &testServer{t: t, dir: dir, bc: bc, s: s, hs: httptest.NewServer(s)}
+}
+
+func (ts *testServer) stop() {
+    ts.hs.Close()
+    ts.s.Close()
+    ts.bc.Close()
+    os.RemoveAll(ts.dir)
+}
+
+func (ts *testServer) do(method string, path string, body []byte, header http.Header) (*http.Response, []byte) {
+    req, err := http.NewRequest(method, ts.hs.URL + path, bytes.NewReader(body))
+    if err != nil {
+        ts.t.Fatal(err)
+    }
+    for k, v := range header {
+        req.Header[k] = v
+    }
+    resp, err := http.DefaultClient.Do(req)
+    if err != nil {
+        ts.t.Fatal(err)
+    }
+    defer resp.Body.Close()
+    data, err := ioutil.ReadAll(resp.Body)
+    if err != nil {
+        ts.t.Fatal(err)
+    }
+    return resp, data
+}
+
+func (ts *testServer) expect(code int, method string, path string, body []byte) []byte {
+    resp, data := ts.do(method, path, body, nil)
+    if resp.StatusCode != code {
+        ts.t.Fatalf("%s %s: got %d %s, want %d", method, path, resp.StatusCode, data, code)
+    }
+    return data
+}
+
+func (ts *testServer) list(path string) *listResult {
+    res := &listResult{}
+    if err := json.Unmarshal(ts.expect(http.StatusOK, "GET", path, nil), res); err != nil {
+        ts.t.Fatal(err)
+    }
+    return res
+}
+
+func keysOf(res *listResult) string {
+    keys := make([]string, 0, len(res.Items))
+    for _, item := range res.Items {
+        keys = append(keys, item.Key)
+    }
+    return strings.Join(keys, ",")
+}
+
+func TestKV(t *testing.T) {
+    ts := startServer(t, time.Minute)
+    defer ts.stop()
+
+    ts.expect(http.StatusNotFound, "GET", "/kv/a", nil)
+    ts.expect(http.StatusNoContent, "PUT", "/kv/a", []byte("1"))
+    if v := ts.expect(http.StatusOK, "GET", "/kv/a", nil); string(v) != "1" {
+        t.Fatalf("got %s", v)
+    }
+
+    // a key with '/' and binary value
+    key := "/kv/" + url.PathEscape("dir/file")
+    ts.expect(http.StatusNoContent, "PUT", key, []byte{0, 1, 2})
+    if v := ts.expect(http.StatusOK, "GET", key, nil); !bytes.Equal(v, []byte{0, 1, 2}) {
+        t.Fatalf("got %v", v)
+    }
+    v, err := ts.bc.Get([]byte("dir/file"))
+    if err != nil || !bytes.Equal(v, []byte{0, 1, 2}) {
+        t.Fatalf("got %v, err %v", v, err)
+    }
+
+    // ttl
+    resp, _ := ts.do("PUT", "/kv/ttl", []byte("v"), http.Header{TTL_HEADER: {"100"}})
+    if resp.StatusCode != http.StatusNoContent {
+        t.Fatalf("got %d", resp.StatusCode)
+    }
+    resp, _ = ts.do("GET", "/kv/ttl", nil, nil)
+    if ttl := resp.Header.Get(TTL_HEADER); ttl != "100" && ttl != "99" {
+        t.Fatalf("ttl %s", ttl)
+    }
+    resp, _ = ts.do("GET", "/kv/a", nil, nil)
+    if ttl := resp.Header.Get(TTL_HEADER); ttl != "" {
+        t.Fatalf("ttl %s", ttl)
+    }
+    resp, _ = ts.do("PUT", "/kv/ttl", []byte("v"), http.Header{TTL_HEADER: {"-1"}})
+    if resp.StatusCode != http.StatusBadRequest {
+        t.Fatalf("got %d", resp.StatusCode)
+    }
+
+    ts.expect(http.StatusNoContent, "DELETE", "/kv/a", nil)
+    ts.expect(http.StatusNotFound, "DELETE", "/kv/a", nil)
+    ts.expect(http.StatusNotFound, "GET", "/kv/a", nil)
+    ts.expect(http.StatusMethodNotAllowed, "POST", "/kv/a", nil)
+}
+
+func TestList(t *testing.T) {
+    ts := startServer(t, time.Minute)
+    defer ts.stop()
+
+    for i := 0; i < 10; i++ {
+        ts.expect(http.StatusNoContent, "PUT", fmt.Sprintf("/kv/a%d", i), []byte(fmt.Sprintf("v%d", i)))
+        ts.expect(http.StatusNoContent, "PUT", fmt.Sprintf("/kv/b%d", i), []byte("v"))
+    }
+    ts.expect(http.StatusNoContent, "DELETE", "/kv/a5", nil)
+
+    res := ts.list("/kv?prefix=a&limit=4")
+    if keysOf(res) != "a0,a1,a2,a3" || res.Next == nil || *res.Next != "a4" {
+        t.Fatalf("got %s", keysOf(res))
+    }
+    res = ts.list("/kv?prefix=a&limit=4&start=" + *res.Next)
+    if keysOf(res) != "a4,a6,a7,a8" || res.Next == nil {
+        t.Fatalf("got %s", keysOf(res))
+    }
+    res = ts.list("/kv?prefix=a&limit=4&start=" + *res.Next)
+    if keysOf(res) != "a9" || res.Next != nil {
+        t.Fatalf("got %s", keysOf(res))
+    }
+
+    res = ts.list("/kv?start=a8&end=b2&values=true")
+    if keysOf(res) != "a8,a9,b0,b1" || *res.Items[0].Value != "v8" {
+        t.Fatalf("got %s", keysOf(res))
+    }
+    res = ts.list("/kv?prefix=a1&values=true&encoding=base64")
+    if *res.Items[0].Value != "djE=" {
+        t.Fatalf("got %s", *res.Items[0].Value)
+    }
+    ts.expect(http.StatusBadRequest, "GET", "/kv?limit=x", nil)
+}
+
+func TestAdmin(t *testing.T) {
+    ts := startServer(t, time.Minute)
+    defer ts.stop()
+
+    value := bytes.Repeat([]byte("x"), 100)
+    for round := 0; round < 3; round++ {
+        for i := 0; i < 50; i++ {
+            ts.expect(http.StatusNoContent, "PUT", fmt.Sprintf("/kv/key%02d", i), value)
+        }
+    }
+
+    files := make([]*fileInfo, 0)
+    if err := json.Unmarshal(ts.expect(http.StatusOK, "GET", "/files", nil), &files); err != nil {
+        t.Fatal(err)
+    }
+    if len(files) < 3 || !files[len(files) - 1].Active || files[0].Md5 == "" || files[0].Size == 0 {
+        t.Fatalf("files %+v", files)
+    }
+
+    st := &stats{}
+    if err := json.Unmarshal(ts.expect(http.StatusOK, "GET", "/stats", nil), st); err != nil {
+        t.Fatal(err)
+    }
+    if st.Keys != 50 || st.DataFiles != len(files) || st.DeadBytes == 0 {
+        t.Fatalf("stats %+v", st)
+    }
+
+    ts.expect(http.StatusOK, "POST", "/merge?wait=true", nil)
+    after := &stats{}
+    json.Unmarshal(ts.expect(http.StatusOK, "GET", "/stats", nil), after)
+    if after.Keys != 50 || after.DataBytes >= st.DataBytes {
+        t.Fatalf("stats %+v after merge, %+v before", after, st)
+    }
+    ts.expect(http.StatusMethodNotAllowed, "GET", "/merge", nil)
+}
+
+// files and stats are read while writes rotate files
+func TestAdminWhileWriting(t *testing.T) {
+    ts := startServer(t, time.Minute)
+    defer ts.stop()
+
+    done := make(chan struct{})
+    go func() {
+        defer close(done)
+        value := bytes.Repeat([]byte("x"), 100)
+        for i := 0; i < 500; i++ {
+            if err := ts.bc.Set([]byte(fmt.Sprintf("key%03d", i)), value); err != nil {
+                t.Error(err)
+                return
+            }
+        }
+    }()
+    for writing := true; writing; {
+        select {
+        case <-done:
+            writing = false
+        default:
+        }
+        files := make([]*fileInfo, 0)
+        if err := json.Unmarshal(ts.expect(http.StatusOK, "GET", "/files", nil), &files); err != nil {
+            t.Fatal(err)
+        }
+        for _, f := range files {
+            if f.Active == (f.Md5 != "") {
+                t.Fatalf("files %+v", files)
+            }
+        }
+        ts.expect(http.StatusOK, "GET", "/stats", nil)
+    }
+}
+
+func TestSnapshot(t *testing.T) {
+    ts := startServer(t, 200 * time.Millisecond)
+    defer ts.stop()
+
+    ts.expect(http.StatusNoContent, "PUT", "/kv/a", []byte("old"))
+    var created struct {
+        Id  uint64  `json:"id"`
+    }
+    if err := json.Unmarshal(ts.expect(http.StatusCreated, "POST", "/snapshot", nil), &created); err != nil {
+        t.Fatal(err)
+    }
+    snap := fmt.Sprintf("/snapshot/%d", created.Id)
+    ts.expect(http.StatusNoContent, "PUT", "/kv/a", []byte("new"))
+    ts.expect(http.StatusNoContent, "PUT", "/kv/b", []byte("new"))
+
+    if v := ts.expect(http.StatusOK, "GET", snap + "/kv/a", nil); string(v) != "old" {
+        t.Fatalf("got %s", v)
+    }
+    ts.expect(http.StatusNotFound, "GET", snap + "/kv/b", nil)
+    if res := ts.list(snap + "/kv?values=true"); keysOf(res) != "a" || *res.Items[0].Value != "old" {
+        t.Fatalf("got %s", keysOf(res))
+    }
+
+    ts.expect(http.StatusNoContent, "DELETE", snap, nil)
+    ts.expect(http.StatusNotFound, "GET", snap + "/kv/a", nil)
+    ts.expect(http.StatusNotFound, "DELETE", snap, nil)
+
+    // idle snapshots are released
+    ts.expect(http.StatusCreated, "POST", "/snapshot", nil)
+    if n := ts.s.snaps.Len(); n != 1 {
+        t.Fatalf("%d snapshots", n)
+    }
+    deadline := time.Now().Add(5 * time.Second)
+    for ts.s.snaps.Len() > 0 {
+        if time.Now().After(deadline) {
+            t.Fatal("snapshot is not released")
+        }
+        time.Sleep(10 * time.Millisecond)
+    }
+}
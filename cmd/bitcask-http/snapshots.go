@@ -0,0 +1,139 @@
+package main
+
+import (
+    "log"
+    "sync"
+    "time"
+    "github.com/rocket323/bitcask"
+)
+
+// Snapshots pin data files until released, the ones left idle by clients
+// are released after ttl.
+type snapshots struct {
+    mu          sync.Mutex
+    ttl         time.Duration
+    next        uint64
+    snaps       map[uint64]*snapshotEntry
+    closeCh     chan struct{}
+    wg          sync.WaitGroup
+}
+
+type snapshotEntry struct {
+    snap        *bitcask.Snapshot
+    lastUsed    time.Time
+    refs        int         // requests using it
+    released    bool        // release when refs drops to 0
+}
+
+func newSnapshots(ttl time.Duration) *snapshots {
+    ss := &snapshots{
+        ttl: ttl,
+        next: 1,
+        snaps: make(map[uint64]*snapshotEntry),
+        closeCh: make(chan struct{}),
+    }
+    interval := ttl / 4
+    if interval < 10 * time.Millisecond {
+        interval = 10 * time.Millisecond
+    }
+    ss.wg.Add(1)
+    go ss.expireLoop(interval)
+    return ss
+}
+
+func (ss *snapshots) Add(snap *bitcask.Snapshot) uint64 {
+    ss.mu.Lock()
+    defer ss.mu.Unlock()
+    id := ss.next
+    ss.next++
+    ss.snaps[id] = &snapshotEntry{snap: snap, lastUsed: time.Now()}
+    return id
+}
+
+// Get returns the snapshot of id held until Put, nil if there's none
+func (ss *snapshots) Get(id uint64) *bitcask.Snapshot {
+    ss.mu.Lock()
+    defer ss.mu.Unlock()
+    e, ok := ss.snaps[id]
+    if !ok || e.released {
+        return nil
+    }
+    e.refs++
+    return e.snap
+}
+
+func (ss *snapshots) Put(id uint64) {
+    ss.mu.Lock()
+    defer ss.mu.Unlock()
+    e, ok := ss.snaps[id]
+    if !ok {
+        return
+    }
+    e.refs--
+    e.lastUsed = time.Now()
+    if e.refs == 0 && e.released {
+        delete(ss.snaps, id)
+        e.snap.Release()
+    }
+}
+
+// Release returns false if there's no snapshot of id
+func (ss *snapshots) Release(id uint64) bool {
+    ss.mu.Lock()
+    defer ss.mu.Unlock()
+    e, ok := ss.snaps[id]
+    if !ok || e.released {
+        return false
+    }
+    ss.release(id, e)
+    return true
+}
+
+// requires ss.mu held
+func (ss *snapshots) release(id uint64, e *snapshotEntry) {
+    e.released = true
+    if e.refs == 0 {
+        delete(ss.snaps, id)
+        e.snap.Release()
+    }
+}
+
+func (ss *snapshots) Len() int {
+    ss.mu.Lock()
+    defer ss.mu.Unlock()
+    return len(ss.snaps)
+}
+
+func (ss *snapshots) expireLoop(interval time.Duration) {
+    defer ss.wg.Done()
+    ticker := time.NewTicker(interval)
+    defer ticker.Stop()
+
+    for {
+        select {
+        case <-ss.closeCh:
+            return
+        case now := <-ticker.C:
+            ss.mu.Lock()
+            for id, e := range ss.snaps {
+                if !e.released && e.refs == 0 && now.Sub(e.lastUsed) >= ss.ttl {
+                    log.Printf("snapshot[%d] idle for %s, release it", id, now.Sub(e.lastUsed))
+                    ss.release(id, e)
+                }
+            }
+            ss.mu.Unlock()
+        }
+    }
+}
+
+// Close releases all snapshots, requests must be done
+func (ss *snapshots) Close() {
+    close(ss.closeCh)
+    ss.wg.Wait()
+    ss.mu.Lock()
+    defer ss.mu.Unlock()
+    for id, e := range ss.snaps {
+        delete(ss.snaps, id)
+        e.snap.Release()
+    }
+}
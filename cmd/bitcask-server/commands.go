@@ -0,0 +1,667 @@
+package main
+
+import (
+    "bytes"
+    "fmt"
+    "os"
+    "runtime"
+    "strconv"
+    "strings"
+    "sync"
+    "sync/atomic"
+    "time"
+    "github.com/rocket323/bitcask"
+)
+
+const (
+    version = "0.1.0"
+)
+
+func parseInt(arg []byte) (int64, bool) {
+    n, err := strconv.ParseInt(string(arg), 10, 64)
+    return n, err == nil
+}
+
+func nowMs() int64 {
+    return time.Now().UnixNano() / int64(time.Millisecond)
+}
+
+// expration of a key living ms from now, ttl is kept in seconds so it's
+// rounded up
+func expireAfter(ms int64) uint32 {
+    return uint32(time.Now().Unix() + (ms + 999) / 1000)
+}
+
+func (c *client) writeNotInt() {
+    c.w.WriteError("ERR value is not an integer or out of range")
+}
+
+func (c *client) writeSyntaxErr() {
+    c.w.WriteError("ERR syntax error")
+}
+
+func cmdPing(c *client, args [][]byte) {
+    if len(args) > 2 {
+        c.w.WriteError("ERR wrong number of arguments for 'ping' command")
+    } else if len(args) == 2 {
+        c.w.WriteBulk(args[1])
+    } else {
+        c.w.WriteStatus("PONG")
+    }
+}
+
+func cmdEcho(c *client, args [][]byte) {
+    c.w.WriteBulk(args[1])
+}
+
+func cmdQuit(c *client, args [][]byte) {
+    c.w.WriteStatus("OK")
+    c.quit = true
+}
+
+// there is only db 0
+func cmdSelect(c *client, args [][]byte) {
+    if string(args[1]) != "0" {
+        c.w.WriteError("ERR DB index is out of range")
+        return
+    }
+    c.w.WriteStatus("OK")
+}
+
+// only for clients asking on connect
+func cmdCommand(c *client, args [][]byte) {
+    c.w.WriteArrayLen(0)
+}
+
+func cmdGet(c *client, args [][]byte) {
+    value, err := c.s.bc.Get(args[1])
+    if err == bitcask.ErrKeyNotFound {
+        c.w.WriteBulk(nil)
+        return
+    }
+    if err != nil {
+        c.writeErr(err)
+        return
+    }
+    if value == nil {
+        value = []byte{}
+    }
+    c.w.WriteBulk(value)
+}
+
+// SET key value [EX seconds|PX milliseconds] [NX|XX] [KEEPTTL]
+func cmdSet(c *client, args [][]byte) {
+    var expration uint32 = 0
+    var nx, xx, keepTTL, hasTTL bool
+    for i := 3; i < len(args); i++ {
+        opt := strings.ToLower(string(args[i]))
+        switch {
+        case opt == "nx" && !xx:
+            nx = true
+        case opt == "xx" && !nx:
+            xx = true
+        case opt == "keepttl" && !hasTTL:
+            keepTTL = true
+        case (opt == "ex" || opt == "px") && !hasTTL && !keepTTL && i + 1 < len(args):
+            n, ok := parseInt(args[i + 1])
+            if !ok {
+                c.writeNotInt()
+                return
+            }
+            if n <= 0 {
+                c.w.WriteError("ERR invalid expire time in 'set' command")
+                return
+            }
+            if opt == "ex" {
+                n *= 1000
+            }
+            expration = expireAfter(n)
+            hasTTL = true
+            i++
+        default:
+            c.writeSyntaxErr()
+            return
+        }
+    }
+
+    if !nx && !xx && !keepTTL {
+        c.s.mu.RLock()
+        err := c.s.bc.SetWithExpr(args[1], args[2], expration)
+        c.s.mu.RUnlock()
+        if err != nil {
+            c.writeErr(err)
+            return
+        }
+        c.w.WriteStatus("OK")
+        return
+    }
+
+    c.s.mu.Lock()
+    defer c.s.mu.Unlock()
+    ttl, err := c.s.bc.TTL(args[1])
+    if err != nil && err != bitcask.ErrKeyNotFound {
+        c.writeErr(err)
+        return
+    }
+    exists := err == nil
+    if (nx && exists) || (xx && !exists) {
+        c.w.WriteBulk(nil)
+        return
+    }
+    if keepTTL && exists && ttl >= 0 {
+        expration = uint32(time.Now().Unix() + ttl)
+    }
+    if err := c.s.bc.SetWithExpr(args[1], args[2], expration); err != nil {
+        c.writeErr(err)
+        return
+    }
+    c.w.WriteStatus("OK")
+}
+
+func cmdSetEx(c *client, args [][]byte) {
+    setEx(c, args, 1000)
+}
+
+func cmdPSetEx(c *client, args [][]byte) {
+    setEx(c, args, 1)
+}
+
+func setEx(c *client, args [][]byte, unit int64) {
+    n, ok := parseInt(args[2])
+    if !ok {
+        c.writeNotInt()
+        return
+    }
+    if n <= 0 {
+        c.w.WriteError("ERR invalid expire time in '" + strings.ToLower(string(args[0])) + "' command")
+        return
+    }
+    c.s.mu.RLock()
+    err := c.s.bc.SetWithExpr(args[1], args[3], expireAfter(n * unit))
+    c.s.mu.RUnlock()
+    if err != nil {
+        c.writeErr(err)
+        return
+    }
+    c.w.WriteStatus("OK")
+}
+
+func cmdSetNx(c *client, args [][]byte) {
+    c.s.mu.Lock()
+    defer c.s.mu.Unlock()
+    _, err := c.s.bc.TTL(args[1])
+    if err == nil {
+        c.w.WriteInt(0)
+        return
+    }
+    if err != bitcask.ErrKeyNotFound {
+        c.writeErr(err)
+        return
+    }
+    if err := c.s.bc.Set(args[1], args[2]); err != nil {
+        c.writeErr(err)
+        return
+    }
+    c.w.WriteInt(1)
+}
+
+// the keys deleted are counted, so DEL owns the lock
+func cmdDel(c *client, args [][]byte) {
+    c.s.mu.Lock()
+    defer c.s.mu.Unlock()
+
+    b := bitcask.NewBatch()
+    seen := make(map[string]bool)
+    for _, key := range args[1:] {
+        // a key given twice is deleted and counted once
+        if seen[string(key)] {
+            continue
+        }
+        seen[string(key)] = true
+        _, err := c.s.bc.TTL(key)
+        if err == bitcask.ErrKeyNotFound {
+            continue
+        }
+        if err != nil {
+            c.writeErr(err)
+            return
+        }
+        b.Del(key)
+    }
+    if b.Len() > 0 {
+        if err := c.s.bc.Write(b); err != nil {
+            c.writeErr(err)
+            return
+        }
+    }
+    c.w.WriteInt(int64(b.Len()))
+}
+
+func cmdExists(c *client, args [][]byte) {
+    var n int64 = 0
+    for _, key := range args[1:] {
+        _, err := c.s.bc.TTL(key)
+        if err == nil {
+            n++
+        } else if err != bitcask.ErrKeyNotFound {
+            c.writeErr(err)
+            return
+        }
+    }
+    c.w.WriteInt(n)
+}
+
+func cmdExpire(c *client, args [][]byte) {
+    n, ok := parseInt(args[2])
+    if !ok {
+        c.writeNotInt()
+        return
+    }
+    expireAt(c, args[1], nowMs() + n * 1000)
+}
+
+func cmdPExpire(c *client, args [][]byte) {
+    n, ok := parseInt(args[2])
+    if !ok {
+        c.writeNotInt()
+        return
+    }
+    expireAt(c, args[1], nowMs() + n)
+}
+
+func cmdExpireAt(c *client, args [][]byte) {
+    n, ok := parseInt(args[2])
+    if !ok {
+        c.writeNotInt()
+        return
+    }
+    expireAt(c, args[1], n * 1000)
+}
+
+// a time in the past deletes the key as redis does
+func expireAt(c *client, key []byte, ms int64) {
+    if ms <= nowMs() {
+        c.s.mu.Lock()
+        defer c.s.mu.Unlock()
+        _, err := c.s.bc.TTL(key)
+        if err == nil {
+            err = c.s.bc.Del(key)
+            if err == nil {
+                c.w.WriteInt(1)
+                return
+            }
+        }
+        if err == bitcask.ErrKeyNotFound {
+            c.w.WriteInt(0)
+            return
+        }
+        c.writeErr(err)
+        return
+    }
+
+    c.s.mu.RLock()
+    err := c.s.bc.Expire(key, uint32((ms + 999) / 1000))
+    c.s.mu.RUnlock()
+    if err == bitcask.ErrKeyNotFound {
+        c.w.WriteInt(0)
+        return
+    }
+    if err != nil {
+        c.writeErr(err)
+        return
+    }
+    c.w.WriteInt(1)
+}
+
+func cmdTTL(c *client, args [][]byte) {
+    ttl(c, args[1], 1)
+}
+
+func cmdPTTL(c *client, args [][]byte) {
+    ttl(c, args[1], 1000)
+}
+
+func ttl(c *client, key []byte, unit int64) {
+    n, err := c.s.bc.TTL(key)
+    if err == bitcask.ErrKeyNotFound {
+        c.w.WriteInt(-2)
+        return
+    }
+    if err != nil {
+        c.writeErr(err)
+        return
+    }
+    if n < 0 {
+        c.w.WriteInt(-1)
+        return
+    }
+    c.w.WriteInt(n * unit)
+}
+
+func cmdPersist(c *client, args [][]byte) {
+    c.s.mu.Lock()
+    defer c.s.mu.Unlock()
+    n, err := c.s.bc.TTL(args[1])
+    if err == bitcask.ErrKeyNotFound || (err == nil && n < 0) {
+        c.w.WriteInt(0)
+        return
+    }
+    if err == nil {
+        err = c.s.bc.Persist(args[1])
+    }
+    if err != nil {
+        c.writeErr(err)
+        return
+    }
+    c.w.WriteInt(1)
+}
+
+func cmdMGet(c *client, args [][]byte) {
+    values := make([][]byte, 0, len(args) - 1)
+    for _, key := range args[1:] {
+        value, err := c.s.bc.Get(key)
+        if err != nil && err != bitcask.ErrKeyNotFound {
+            c.writeErr(err)
+            return
+        }
+        if err == nil && value == nil {
+            value = []byte{}
+        }
+        values = append(values, value)
+    }
+    c.w.WriteArrayLen(len(values))
+    for _, value := range values {
+        c.w.WriteBulk(value)
+    }
+}
+
+// all or nothing with a batch
+func cmdMSet(c *client, args [][]byte) {
+    if len(args) % 2 != 1 {
+        c.w.WriteError("ERR wrong number of arguments for 'mset' command")
+        return
+    }
+    b := bitcask.NewBatch()
+    for i := 1; i < len(args); i += 2 {
+        b.Set(args[i], args[i + 1])
+    }
+    c.s.mu.RLock()
+    err := c.s.bc.Write(b)
+    c.s.mu.RUnlock()
+    if err != nil {
+        c.writeErr(err)
+        return
+    }
+    c.w.WriteStatus("OK")
+}
+
+// Scan cursors are numbers as clients expect, each stands for the last key
+// returned. Only the latest ones are kept, an evicted cursor is an error.
+type scanCursors struct {
+    mu      sync.Mutex
+    max     int
+    next    uint64
+    keys    map[uint64][]byte
+    order   []uint64
+}
+
+func newScanCursors(max int) *scanCursors {
+    return &scanCursors{
+        max: max,
+        next: 1,
+        keys: make(map[uint64][]byte),
+    }
+}
+
+func (sc *scanCursors) put(key []byte) uint64 {
+    sc.mu.Lock()
+    defer sc.mu.Unlock()
+
+    if len(sc.order) >= sc.max {
+        delete(sc.keys, sc.order[0])
+        sc.order = sc.order[1:]
+    }
+    id := sc.next
+    sc.next++
+    sc.keys[id] = key
+    sc.order = append(sc.order, id)
+    return id
+}
+
+func (sc *scanCursors) get(id uint64) ([]byte, bool) {
+    sc.mu.Lock()
+    defer sc.mu.Unlock()
+    key, ok := sc.keys[id]
+    return key, ok
+}
+
+// SCAN cursor [MATCH pattern] [COUNT count] [TYPE type]
+func cmdScan(c *client, args [][]byte) {
+    cursor, err := strconv.ParseUint(string(args[1]), 10, 64)
+    if err != nil {
+        c.w.WriteError("ERR invalid cursor")
+        return
+    }
+    var pattern []byte
+    count := 10
+    for i := 2; i < len(args); i += 2 {
+        if i + 1 >= len(args) {
+            c.writeSyntaxErr()
+            return
+        }
+        switch strings.ToLower(string(args[i])) {
+        case "match":
+            pattern = args[i + 1]
+        case "count":
+            n, ok := parseInt(args[i + 1])
+            if !ok {
+                c.writeNotInt()
+                return
+            }
+            if n < 1 {
+                c.writeSyntaxErr()
+                return
+            }
+            count = int(n)
+        case "type":
+            // all values are strings
+            if strings.ToLower(string(args[i + 1])) != "string" {
+                count = 0
+            }
+        default:
+            c.writeSyntaxErr()
+            return
+        }
+    }
+
+    var last []byte
+    if cursor != 0 {
+        var ok bool
+        if last, ok = c.s.scans.get(cursor); !ok {
+            c.w.WriteError("ERR invalid cursor")
+            return
+        }
+    }
+    keys := make([][]byte, 0)
+    if count == 0 {
+        c.w.WriteArrayLen(2)
+        c.w.WriteBulk([]byte("0"))
+        c.w.WriteArrayLen(0)
+        return
+    }
+
+    it, err := c.s.bc.NewIterator(nil)
+    if err != nil {
+        c.writeErr(err)
+        return
+    }
+    defer it.Close()
+    if last == nil {
+        it.SeekToFirst()
+    } else {
+        it.Seek(last)
+        if it.Valid() && bytes.Equal(it.Key(), last) {
+            it.Next()
+        }
+    }
+    var key []byte
+    for n := 0; it.Valid() && n < count; it.Next() {
+        key = append([]byte(nil), it.Key()...)
+        if pattern == nil || globMatch(pattern, key) {
+            keys = append(keys, key)
+        }
+        n++
+    }
+
+    next := []byte("0")
+    if it.Valid() {
+        next = []byte(strconv.FormatUint(c.s.scans.put(key), 10))
+    }
+    c.w.WriteArrayLen(2)
+    c.w.WriteBulk(next)
+    c.w.WriteArrayLen(len(keys))
+    for _, key := range keys {
+        c.w.WriteBulk(key)
+    }
+}
+
+// glob-style matching as redis KEYS and SCAN do: * ? [abc] [^a-z] \x
+func globMatch(pattern []byte, s []byte) bool {
+    for len(pattern) > 0 {
+        switch pattern[0] {
+        case '*':
+            for len(pattern) > 1 && pattern[1] == '*' {
+                pattern = pattern[1:]
+            }
+            if len(pattern) == 1 {
+                return true
+            }
+            for i := 0; i <= len(s); i++ {
+                if globMatch(pattern[1:], s[i:]) {
+                    return true
+                }
+            }
+            return false
+        case '?':
+            if len(s) == 0 {
+                return false
+            }
+            s = s[1:]
+            pattern = pattern[1:]
+        case '[':
+            if len(s) == 0 {
+                return false
+            }
+            p := pattern[1:]
+            not := len(p) > 0 && p[0] == '^'
+            if not {
+                p = p[1:]
+            }
+            match := false
+            for len(p) > 0 && p[0] != ']' {
+                if p[0] == '\\' && len(p) >= 2 {
+                    p = p[1:]
+                    match = match || p[0] == s[0]
+                    p = p[1:]
+                } else if len(p) >= 3 && p[1] == '-' && p[2] != ']' {
+                    lo, hi := p[0], p[2]
+                    if lo > hi {
+                        lo, hi = hi, lo
+                    }
+                    match = match || (s[0] >= lo && s[0] <= hi)
+                    p = p[3:]
+                } else {
+                    match = match || p[0] == s[0]
+                    p = p[1:]
+                }
+            }
+            if len(p) > 0 {
+                // skip ']'
+                p = p[1:]
+            }
+            if match == not {
+                return false
+            }
+            s = s[1:]
+            pattern = p
+        case '\\':
+            if len(pattern) >= 2 {
+                pattern = pattern[1:]
+            }
+            fallthrough
+        default:
+            if len(s) == 0 || pattern[0] != s[0] {
+                return false
+            }
+            s = s[1:]
+            pattern = pattern[1:]
+        }
+    }
+    return len(s) == 0
+}
+
+func (s *Server) dbSize() int64 {
+    var n int64 = 0
+    for _, stat := range s.bc.SlotsSummary() {
+        n += stat.Keys
+    }
+    return n
+}
+
+func cmdDbSize(c *client, args [][]byte) {
+    c.w.WriteInt(c.s.dbSize())
+}
+
+// INFO [section]
+func cmdInfo(c *client, args [][]byte) {
+    section := "all"
+    if len(args) > 1 {
+        section = strings.ToLower(string(args[1]))
+    }
+    want := func(name string) bool {
+        return section == "all" || section == "default" || section == "everything" || section == name
+    }
+
+    buf := new(bytes.Buffer)
+    if want("server") {
+        fmt.Fprintf(buf, "# Server\r\n")
+        fmt.Fprintf(buf, "bitcask_version:%s\r\n", version)
+        fmt.Fprintf(buf, "go_version:%s\r\n", runtime.Version())
+        fmt.Fprintf(buf, "process_id:%d\r\n", os.Getpid())
+        fmt.Fprintf(buf, "uptime_in_seconds:%d\r\n", int64(time.Since(c.s.start).Seconds()))
+        fmt.Fprintf(buf, "\r\n")
+    }
+    if want("clients") {
+        fmt.Fprintf(buf, "# Clients\r\n")
+        fmt.Fprintf(buf, "connected_clients:%d\r\n", atomic.LoadInt64(&c.s.connected))
+        fmt.Fprintf(buf, "\r\n")
+    }
+    if want("stats") {
+        fmt.Fprintf(buf, "# Stats\r\n")
+        fmt.Fprintf(buf, "total_commands_processed:%d\r\n", atomic.LoadInt64(&c.s.commands))
+        fmt.Fprintf(buf, "\r\n")
+    }
+    if want("bitcask") {
+        var files, total, dead int64
+        for _, fs := range c.s.bc.GetFileStats() {
+            files++
+            total += fs.TotalBytes
+            dead += fs.DeadBytes
+        }
+        fmt.Fprintf(buf, "# Bitcask\r\n")
+        fmt.Fprintf(buf, "data_files:%d\r\n", files)
+        _, active := c.s.bc.GetDataFiles()
+        fmt.Fprintf(buf, "active_file_id:%d\r\n", active)
+        fmt.Fprintf(buf, "data_bytes:%d\r\n", total)
+        fmt.Fprintf(buf, "dead_bytes:%d\r\n", dead)
+        fmt.Fprintf(buf, "keydir_bytes:%d\r\n", c.s.bc.KeyDirStats().MemBytes)
+        fmt.Fprintf(buf, "\r\n")
+    }
+    if want("keyspace") {
+        fmt.Fprintf(buf, "# Keyspace\r\n")
+        if n := c.s.dbSize(); n > 0 {
+            fmt.Fprintf(buf, "db0:keys=%d\r\n", n)
+        }
+    }
+    c.w.WriteBulk(buf.Bytes())
+}
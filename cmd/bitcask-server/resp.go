@@ -0,0 +1,234 @@
+package main
+
+import (
+    "bufio"
+    "fmt"
+    "io"
+    "strconv"
+)
+
+// RESP, the redis protocol. Requests are arrays of bulk strings, or inline
+// commands split by spaces as typed in telnet.
+
+const (
+    maxBulkSize = 512 * 1024 * 1024
+    maxArgs = 1024 * 1024
+    maxInlineSize = 64 * 1024
+)
+
+var (
+    ErrProtocol = fmt.Errorf("protocol error")
+)
+
+type respReader struct {
+    r   *bufio.Reader
+}
+
+func newRespReader(r io.Reader) *respReader {
+    return &respReader{r: bufio.NewReaderSize(r, 16 * 1024)}
+}
+
+// read a line without the trailing \r\n
+func (rr *respReader) readLine() ([]byte, error) {
+    line, err := rr.r.ReadSlice('\n')
+    if err == bufio.ErrBufferFull {
+        return nil, ErrProtocol
+    }
+    if err != nil {
+        return nil, err
+    }
+    n := len(line) - 1
+    if n > 0 && line[n - 1] == '\r' {
+        n--
+    }
+    return line[:n], nil
+}
+
+func parseLen(data []byte, max int64) (int64, error) {
+    n, err := strconv.ParseInt(string(data), 10, 64)
+    if err != nil || n < -1 || n > max {
+        return 0, ErrProtocol
+    }
+    return n, nil
+}
+
+// ReadCommand returns the args of the next command, nil for an empty line
+func (rr *respReader) ReadCommand() ([][]byte, error) {
+    line, err := rr.readLine()
+    if err != nil {
+        return nil, err
+    }
+    if len(line) == 0 {
+        return nil, nil
+    }
+    if line[0] != '*' {
+        return splitInline(line)
+    }
+
+    n, err := parseLen(line[1:], maxArgs)
+    if err != nil {
+        return nil, err
+    }
+    args := make([][]byte, 0, n)
+    for i := int64(0); i < n; i++ {
+        arg, err := rr.readBulk()
+        if err != nil {
+            return nil, err
+        }
+        args = append(args, arg)
+    }
+    return args, nil
+}
+
+func (rr *respReader) readBulk() ([]byte, error) {
+    line, err := rr.readLine()
+    if err != nil {
+        return nil, err
+    }
+    if len(line) == 0 || line[0] != '$' {
+        return nil, ErrProtocol
+    }
+    n, err := parseLen(line[1:], maxBulkSize)
+    if err != nil || n < 0 {
+        return nil, ErrProtocol
+    }
+    data := make([]byte, n + 2)
+    if _, err := io.ReadFull(rr.r, data); err != nil {
+        return nil, err
+    }
+    if data[n] != '\r' || data[n + 1] != '\n' {
+        return nil, ErrProtocol
+    }
+    return data[:n], nil
+}
+
+// ReadReply reads a reply as the client does, errors are returned as error
+// and arrays as []interface{}
+func (rr *respReader) ReadReply() (interface{}, error) {
+    line, err := rr.readLine()
+    if err != nil {
+        return nil, err
+    }
+    if len(line) == 0 {
+        return nil, ErrProtocol
+    }
+    switch line[0] {
+    case '+':
+        return string(line[1:]), nil
+    case '-':
+        return fmt.Errorf("%s", line[1:]), nil
+    case ':':
+        return strconv.ParseInt(string(line[1:]), 10, 64)
+    case '$':
+        n, err := parseLen(line[1:], maxBulkSize)
+        if err != nil {
+            return nil, err
+        }
+        if n < 0 {
+            return nil, nil
+        }
+        data := make([]byte, n + 2)
+        if _, err := io.ReadFull(rr.r, data); err != nil {
+            return nil, err
+        }
+        return data[:n], nil
+    case '*':
+        n, err := parseLen(line[1:], maxArgs)
+        if err != nil {
+            return nil, err
+        }
+        if n < 0 {
+            return nil, nil
+        }
+        items := make([]interface{}, 0, n)
+        for i := int64(0); i < n; i++ {
+            item, err := rr.ReadReply()
+            if err != nil {
+                return nil, err
+            }
+            items = append(items, item)
+        }
+        return items, nil
+    }
+    return nil, ErrProtocol
+}
+
+func splitInline(line []byte) ([][]byte, error) {
+    if len(line) > maxInlineSize {
+        return nil, ErrProtocol
+    }
+    args := make([][]byte, 0)
+    for i := 0; i < len(line); {
+        for i < len(line) && (line[i] == ' ' || line[i] == '\t') {
+            i++
+        }
+        start := i
+        for i < len(line) && line[i] != ' ' && line[i] != '\t' {
+            i++
+        }
+        if i > start {
+            args = append(args, append([]byte(nil), line[start:i]...))
+        }
+    }
+    return args, nil
+}
+
+type respWriter struct {
+    w   *bufio.Writer
+}
+
+func newRespWriter(w io.Writer) *respWriter {
+    return &respWriter{w: bufio.NewWriterSize(w, 16 * 1024)}
+}
+
+func (rw *respWriter) WriteStatus(s string) {
+    rw.w.WriteString("+")
+    rw.w.WriteString(s)
+    rw.w.WriteString("\r\n")
+}
+
+func (rw *respWriter) WriteError(s string) {
+    rw.w.WriteString("-")
+    rw.w.WriteString(s)
+    rw.w.WriteString("\r\n")
+}
+
+func (rw *respWriter) WriteInt(n int64) {
+    rw.w.WriteString(":")
+    rw.w.WriteString(strconv.FormatInt(n, 10))
+    rw.w.WriteString("\r\n")
+}
+
+// a nil data is the null bulk string
+func (rw *respWriter) WriteBulk(data []byte) {
+    if data == nil {
+        rw.w.WriteString("$-1\r\n")
+        return
+    }
+    rw.w.WriteString("$")
+    rw.w.WriteString(strconv.Itoa(len(data)))
+    rw.w.WriteString("\r\n")
+    rw.w.Write(data)
+    rw.w.WriteString("\r\n")
+}
+
+func (rw *respWriter) WriteArrayLen(n int) {
+    rw.w.WriteString("*")
+    rw.w.WriteString(strconv.Itoa(n))
+    rw.w.WriteString("\r\n")
+}
+
+func (rw *respWriter) WriteCommand(args ...[]byte) {
+    rw.WriteArrayLen(len(args))
+    for _, arg := range args {
+        rw.WriteBulk(arg)
+    }
+}
+
+func (rw *respWriter) Buffered() int {
+    return rw.w.Buffered()
+}
+
+func (rw *respWriter) Flush() error {
+    return rw.w.Flush()
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+    "io"
+    "log"
+    "net"
+    "strings"
+    "sync"
+    "sync/atomic"
+    "time"
+    "github.com/rocket323/bitcask"
+)
+
+type Server struct {
+    bc          *bitcask.BitCask
+    start       time.Time
+
+    mu          sync.RWMutex    // writes share it, the ones checking the key first own it
+    scans       *scanCursors
+    targets     *migrateTargets
+
+    lmu         sync.Mutex
+    listeners   []net.Listener
+    conns       map[net.Conn]bool
+    closed      bool
+    wg          sync.WaitGroup
+
+    // stats
+    connected   int64
+    commands    int64
+}
+
+type client struct {
+    s           *Server
+    conn        net.Conn
+    r           *respReader
+    w           *respWriter
+    quit        bool
+}
+
+type command struct {
+    fn          func(c *client, args [][]byte)
+    arity       int     // number of args with the name, -n means at least n
+}
+
+var commands map[string]*command
+
+func init() {
+    commands = map[string]*command{
+        "ping":             {cmdPing, -1},
+        "echo":             {cmdEcho, 2},
+        "quit":             {cmdQuit, 1},
+        "select":           {cmdSelect, 2},
+        "command":          {cmdCommand, -1},
+        "info":             {cmdInfo, -1},
+        "dbsize":           {cmdDbSize, 1},
+
+        "get":              {cmdGet, 2},
+        "set":              {cmdSet, -3},
+        "setex":            {cmdSetEx, 4},
+        "psetex":           {cmdPSetEx, 4},
+        "setnx":            {cmdSetNx, 3},
+        "del":              {cmdDel, -2},
+        "exists":           {cmdExists, -2},
+        "expire":           {cmdExpire, 3},
+        "pexpire":          {cmdPExpire, 3},
+        "expireat":         {cmdExpireAt, 3},
+        "ttl":              {cmdTTL, 2},
+        "pttl":             {cmdPTTL, 2},
+        "persist":          {cmdPersist, 2},
+        "mget":             {cmdMGet, -2},
+        "mset":             {cmdMSet, -3},
+        "scan":             {cmdScan, -2},
+
+        "slotshashkey":     {cmdSlotsHashKey, -1},
+        "slotsinfo":        {cmdSlotsInfo, -1},
+        "slotsmgrtone":     {cmdSlotsMgrtOne, 5},
+        "slotsmgrtslot":    {cmdSlotsMgrtSlot, 5},
+        "slotsmgrttagone":  {cmdSlotsMgrtTagOne, 5},
+        "slotsmgrttagslot": {cmdSlotsMgrtTagSlot, 5},
+        "slotsrestore":     {cmdSlotsRestore, -4},
+    }
+}
+
+func NewServer(bc *bitcask.BitCask) *Server {
+    return &Server{
+        bc: bc,
+        start: time.Now(),
+        scans: newScanCursors(1024),
+        targets: newMigrateTargets(),
+        conns: make(map[net.Conn]bool),
+    }
+}
+
+// Serve accepts connections on l until it's closed
+func (s *Server) Serve(l net.Listener) error {
+    s.lmu.Lock()
+    if s.closed {
+        s.lmu.Unlock()
+        l.Close()
+        return nil
+    }
+    s.listeners = append(s.listeners, l)
+    s.lmu.Unlock()
+
+    for {
+        conn, err := l.Accept()
+        if err != nil {
+            s.lmu.Lock()
+            closed := s.closed
+            s.lmu.Unlock()
+            if closed {
+                return nil
+            }
+            if ne, ok := err.(net.Error); ok && ne.Temporary() {
+                time.Sleep(10 * time.Millisecond)
+                continue
+            }
+            return err
+        }
+
+        s.lmu.Lock()
+        if s.closed {
+            s.lmu.Unlock()
+            conn.Close()
+            return nil
+        }
+        s.conns[conn] = true
+        s.wg.Add(1)
+        s.lmu.Unlock()
+        go s.serveConn(conn)
+    }
+}
+
+// Close stops accepting connections, closes the ones open and waits for them
+func (s *Server) Close() {
+    s.lmu.Lock()
+    s.closed = true
+    for _, l := range s.listeners {
+        l.Close()
+    }
+    for conn := range s.conns {
+        conn.Close()
+    }
+    s.lmu.Unlock()
+    s.wg.Wait()
+    s.targets.Close()
+}
+
+func (s *Server) serveConn(conn net.Conn) {
+    defer func() {
+        s.lmu.Lock()
+        delete(s.conns, conn)
+        s.lmu.Unlock()
+        conn.Close()
+        atomic.AddInt64(&s.connected, -1)
+        s.wg.Done()
+    }()
+    atomic.AddInt64(&s.connected, 1)
+
+    c := &client{
+        s: s,
+        conn: conn,
+        r: newRespReader(conn),
+        w: newRespWriter(conn),
+    }
+    for !c.quit {
+        args, err := c.r.ReadCommand()
+        if err == ErrProtocol {
+            c.w.WriteError("ERR Protocol error")
+            c.w.Flush()
+            return
+        }
+        if err != nil {
+            if err != io.EOF && !isClosedErr(err) {
+                log.Printf("read from %s failed, err = %s", conn.RemoteAddr(), err)
+            }
+            return
+        }
+        if len(args) == 0 {
+            continue
+        }
+        c.dispatch(args)
+
+        // replies of pipelined commands go out together
+        if c.r.r.Buffered() == 0 || c.w.Buffered() > 64 * 1024 {
+            if err := c.w.Flush(); err != nil {
+                return
+            }
+        }
+    }
+    c.w.Flush()
+}
+
+func isClosedErr(err error) bool {
+    return strings.Contains(err.Error(), "use of closed network connection")
+}
+
+func (c *client) dispatch(args [][]byte) {
+    atomic.AddInt64(&c.s.commands, 1)
+    name := strings.ToLower(string(args[0]))
+    cmd, ok := commands[name]
+    if !ok {
+        c.w.WriteError("ERR unknown command '" + string(args[0]) + "'")
+        return
+    }
+    if (cmd.arity > 0 && len(args) != cmd.arity) || (cmd.arity < 0 && len(args) < -cmd.arity) {
+        c.w.WriteError("ERR wrong number of arguments for '" + name + "' command")
+        return
+    }
+    cmd.fn(c, args)
+}
+
+// reply err as the redis error of it
+func (c *client) writeErr(err error) {
+    switch err {
+    case bitcask.ErrReadOnly:
+        c.w.WriteError("READONLY " + err.Error())
+    default:
+        c.w.WriteError("ERR " + err.Error())
+    }
+}
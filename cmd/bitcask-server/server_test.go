@@ -0,0 +1,307 @@
+package main
+
+import (
+    "fmt"
+    "io/ioutil"
+    "net"
+    "os"
+    "reflect"
+    "strconv"
+    "testing"
+    "github.com/rocket323/bitcask"
+)
+
+type testServer struct {
+    dir     string
+    bc      *bitcask.BitCask
+    s       *Server
+    addr    *net.TCPAddr
+}
+
+func startServer(t *testing.T) *testServer {
+    dir, err := ioutil.TempDir("", "bitcask-server")
+    if err != nil {
+        t.Fatal(err)
+    }
+    opts := bitcask.NewOptions()
+    opts.SetMaxFileSize(4096)
+    bc, err := bitcask.Open(dir, opts)
+    if err != nil {
+        t.Fatal(err)
+    }
+    l, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    ts := &testServer{dir: dir, bc: bc, s: NewServer(bc), addr: l.Addr().(*net.TCPAddr)}
+    go ts.s.Serve(l)
+    return ts
+}
+
+func (ts *testServer) stop() {
+    ts.s.Close()
+    ts.bc.Close()
+    os.RemoveAll(ts.dir)
+}
+
+type testClient struct {
+    t       *testing.T
+    conn    net.Conn
+    r       *respReader
+    w       *respWriter
+}
+
+func (ts *testServer) dial(t *testing.T) *testClient {
+    conn, err := net.Dial("tcp", ts.addr.String())
+    if err != nil {
+        t.Fatal(err)
+    }
+    return &testClient{t: t, conn: conn, r: newRespReader(conn), w: newRespWriter(conn)}
+}
+
+func (tc *testClient) do(args ...interface{}) interface{} {
+    data := make([][]byte, 0, len(args))
+    for _, arg := range args {
+        data = append(data, []byte(fmt.Sprint(arg)))
+    }
+    tc.w.WriteCommand(data...)
+    if err := tc.w.Flush(); err != nil {
+        tc.t.Fatal(err)
+    }
+    reply, err := tc.r.ReadReply()
+    if err != nil {
+        tc.t.Fatal(err)
+    }
+    return reply
+}
+
+// compares bulk strings as strings
+func (tc *testClient) expect(want interface{}, args ...interface{}) {
+    got := normalize(tc.do(args...))
+    if e, ok := got.(error); ok {
+        got = "-" + e.Error()
+    }
+    if !reflect.DeepEqual(got, want) {
+        tc.t.Fatalf("%v: got %#v, want %#v", args, got, want)
+    }
+}
+
+func normalize(reply interface{}) interface{} {
+    switch v := reply.(type) {
+    case []byte:
+        return string(v)
+    case []interface{}:
+        items := make([]interface{}, 0, len(v))
+        for _, item := range v {
+            items = append(items, normalize(item))
+        }
+        return items
+    }
+    return reply
+}
+
+func TestStrings(t *testing.T) {
+    ts := startServer(t)
+    defer ts.stop()
+    c := ts.dial(t)
+
+    c.expect("PONG", "PING")
+    c.expect("OK", "SET", "a", "1")
+    c.expect("1", "GET", "a")
+    c.expect(nil, "GET", "b")
+    c.expect("OK", "SET", "empty", "")
+    c.expect("", "GET", "empty")
+
+    c.expect(nil, "SET", "a", "2", "NX")
+    c.expect("OK", "SET", "b", "2", "NX")
+    c.expect(nil, "SET", "c", "3", "XX")
+    c.expect("OK", "SET", "b", "3", "XX")
+    c.expect("3", "GET", "b")
+    c.expect(int64(0), "SETNX", "b", "4")
+    c.expect(int64(1), "SETNX", "c", "4")
+    c.expect("-ERR syntax error", "SET", "a", "1", "NX", "XX")
+
+    c.expect("OK", "MSET", "k1", "v1", "k2", "v2")
+    c.expect([]interface{}{"v1", nil, "v2"}, "MGET", "k1", "nokey", "k2")
+    c.expect(int64(2), "EXISTS", "k1", "k2", "nokey")
+    c.expect(int64(2), "DEL", "k1", "k2", "nokey")
+    c.expect(int64(0), "EXISTS", "k1")
+    c.expect("OK", "SET", "k3", "v3")
+    c.expect(int64(1), "DEL", "k3", "k3", "nokey", "nokey")
+    c.expect(int64(0), "EXISTS", "k3")
+    c.expect(int64(4), "DBSIZE")
+
+    c.expect("-ERR unknown command 'NOSUCH'", "NOSUCH")
+    c.expect("-ERR wrong number of arguments for 'get' command", "GET")
+}
+
+func TestExpire(t *testing.T) {
+    ts := startServer(t)
+    defer ts.stop()
+    c := ts.dial(t)
+
+    c.expect("OK", "SET", "a", "1", "EX", 100)
+    ttl := c.do("TTL", "a").(int64)
+    if ttl < 99 || ttl > 100 {
+        t.Fatalf("ttl %d", ttl)
+    }
+    c.expect("OK", "SET", "a", "2", "KEEPTTL")
+    if c.do("TTL", "a").(int64) < 99 {
+        t.Fatalf("ttl not kept")
+    }
+    c.expect(int64(1), "PERSIST", "a")
+    c.expect(int64(-1), "TTL", "a")
+    c.expect(int64(0), "PERSIST", "a")
+    c.expect(int64(-2), "TTL", "nokey")
+
+    c.expect(int64(1), "EXPIRE", "a", 50)
+    if pttl := c.do("PTTL", "a").(int64); pttl <= 49000 || pttl > 51000 {
+        t.Fatalf("pttl %d", pttl)
+    }
+    c.expect(int64(0), "EXPIRE", "nokey", 50)
+    // expire in the past deletes the key
+    c.expect(int64(1), "EXPIRE", "a", -1)
+    c.expect(nil, "GET", "a")
+
+    c.expect("OK", "SETEX", "b", 10, "v")
+    c.expect(int64(10), "TTL", "b")
+    c.expect("-ERR invalid expire time in 'setex' command", "SETEX", "b", 0, "v")
+}
+
+func TestScan(t *testing.T) {
+    ts := startServer(t)
+    defer ts.stop()
+    c := ts.dial(t)
+
+    for i := 0; i < 100; i++ {
+        c.expect("OK", "SET", fmt.Sprintf("key:%03d", i), "v")
+        c.expect("OK", "SET", fmt.Sprintf("other:%03d", i), "v")
+    }
+    c.expect(int64(1), "DEL", "key:050")
+
+    seen := make(map[string]bool)
+    cursor := "0"
+    for calls := 0; ; calls++ {
+        if calls > 100 {
+            t.Fatal("scan doesn't end")
+        }
+        reply := normalize(c.do("SCAN", cursor, "MATCH", "key:*", "COUNT", 7)).([]interface{})
+        for _, key := range reply[1].([]interface{}) {
+            if seen[key.(string)] {
+                t.Fatalf("%s returned twice", key)
+            }
+            seen[key.(string)] = true
+        }
+        cursor = reply[0].(string)
+        if cursor == "0" {
+            break
+        }
+    }
+    if len(seen) != 99 || seen["key:050"] {
+        t.Fatalf("scan returned %d keys", len(seen))
+    }
+    c.expect("-ERR invalid cursor", "SCAN", 12345)
+}
+
+func TestGlobMatch(t *testing.T) {
+    cases := []struct {
+        pattern, s  string
+        match       bool
+    }{
+        {"*", "", true},
+        {"key:*", "key:1", true},
+        {"key:*", "key", false},
+        {"k?y", "key", true},
+        {"k?y", "ky", false},
+        {"*:*:x", "a:b:x", true},
+        {"k[ae]y", "kay", true},
+        {"k[^ae]y", "kay", false},
+        {"k[a-c]y", "kby", true},
+        {"k[a-c]y", "kdy", false},
+        {"k\\*y", "k*y", true},
+        {"k\\*y", "kxy", false},
+    }
+    for _, tc := range cases {
+        if globMatch([]byte(tc.pattern), []byte(tc.s)) != tc.match {
+            t.Errorf("match %q %q, want %v", tc.pattern, tc.s, tc.match)
+        }
+    }
+}
+
+func TestInline(t *testing.T) {
+    ts := startServer(t)
+    defer ts.stop()
+    c := ts.dial(t)
+
+    // pipelined inline commands, as typed in telnet
+    if _, err := c.conn.Write([]byte("SET a 1\r\n\r\nGET  a\r\nQUIT\r\n")); err != nil {
+        t.Fatal(err)
+    }
+    for _, want := range []interface{}{"OK", "1", "OK"} {
+        reply, err := c.r.ReadReply()
+        if err != nil {
+            t.Fatal(err)
+        }
+        if got := normalize(reply); got != want {
+            t.Fatalf("got %#v, want %#v", got, want)
+        }
+    }
+    if _, err := c.r.ReadReply(); err == nil {
+        t.Fatal("connection is not closed by quit")
+    }
+}
+
+func TestSlotsMigrate(t *testing.T) {
+    src := startServer(t)
+    defer src.stop()
+    dst := startServer(t)
+    defer dst.stop()
+    c := src.dial(t)
+    d := dst.dial(t)
+    host, port := "127.0.0.1", strconv.Itoa(dst.addr.Port)
+
+    for i := 0; i < 20; i++ {
+        c.expect("OK", "SET", fmt.Sprintf("{user1}key%02d", i), i)
+    }
+    c.expect("OK", "SET", "plain", "p", "EX", 100)
+    _, tagSlot := bitcask.HashKeyToSlot([]byte("{user1}"))
+    _, plainSlot := bitcask.HashKeyToSlot([]byte("plain"))
+    c.expect([]interface{}{int64(tagSlot), int64(plainSlot)}, "SLOTSHASHKEY", "{user1}x", "plain")
+
+    info := normalize(c.do("SLOTSINFO")).([]interface{})
+    if len(info) != 2 {
+        t.Fatalf("slotsinfo %v", info)
+    }
+    c.expect([]interface{}{[]interface{}{int64(tagSlot), int64(20)}}, "SLOTSINFO", tagSlot, 1)
+
+    // one key, with its ttl
+    c.expect(int64(1), "SLOTSMGRTONE", host, port, 1000, "plain")
+    c.expect(int64(0), "SLOTSMGRTONE", host, port, 1000, "plain")
+    c.expect(nil, "GET", "plain")
+    d.expect("p", "GET", "plain")
+    if ttl := d.do("TTL", "plain").(int64); ttl < 99 || ttl > 100 {
+        t.Fatalf("ttl %d", ttl)
+    }
+
+    // a key of the slot, then the whole tag
+    c.expect([]interface{}{int64(1), int64(19)}, "SLOTSMGRTSLOT", host, port, 1000, tagSlot)
+    c.expect(int64(19), "SLOTSMGRTTAGONE", host, port, 1000, "{user1}key05")
+    c.expect([]interface{}{int64(0), int64(0)}, "SLOTSMGRTSLOT", host, port, 1000, tagSlot)
+    c.expect(int64(0), "DBSIZE")
+    d.expect(int64(21), "DBSIZE")
+    for i := 0; i < 20; i++ {
+        d.expect(strconv.Itoa(i), "GET", fmt.Sprintf("{user1}key%02d", i))
+    }
+
+    // nothing is lost when the target is down
+    c.expect("OK", "SET", "{user2}a", "v")
+    _, slot2 := bitcask.HashKeyToSlot([]byte("{user2}a"))
+    dst.s.Close()
+    if reply := c.do("SLOTSMGRTTAGSLOT", host, port, 100, slot2); reply == nil {
+        t.Fatal("no error")
+    } else if _, ok := reply.(error); !ok {
+        t.Fatalf("got %v", reply)
+    }
+    c.expect("v", "GET", "{user2}a")
+    c.expect([]interface{}{[]interface{}{int64(slot2), int64(1)}}, "SLOTSINFO", slot2, 1)
+}
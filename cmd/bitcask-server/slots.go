@@ -0,0 +1,320 @@
+package main
+
+import (
+    "bytes"
+    "fmt"
+    "net"
+    "strconv"
+    "sync"
+    "time"
+    "github.com/rocket323/bitcask"
+)
+
+// Codis slot commands. Keys are moved to another bitcask-server with
+// SLOTSRESTORE key ttlms value [key ttlms value ...], values are sent as
+// they are, not in the rdb dump format of redis.
+
+const (
+    defaultMigrateTimeout = 1000    // ms
+)
+
+// a connection to the server keys are moved to, one migration at a time
+type respTarget struct {
+    mu          sync.Mutex
+    addr        string
+    timeout     time.Duration
+    conn        net.Conn
+    r           *respReader
+    w           *respWriter
+}
+
+func (t *respTarget) connect() error {
+    if t.conn != nil {
+        return nil
+    }
+    conn, err := net.DialTimeout("tcp", t.addr, t.timeout)
+    if err != nil {
+        return err
+    }
+    t.conn = conn
+    t.r = newRespReader(conn)
+    t.w = newRespWriter(conn)
+    return nil
+}
+
+func (t *respTarget) close() {
+    if t.conn != nil {
+        t.conn.Close()
+        t.conn = nil
+    }
+}
+
+func (t *respTarget) MigrateKeys(items []*bitcask.MigrateItem) error {
+    t.mu.Lock()
+    defer t.mu.Unlock()
+
+    if err := t.connect(); err != nil {
+        return err
+    }
+    now := nowMs()
+    args := make([][]byte, 0, 1 + 3 * len(items))
+    args = append(args, []byte("SLOTSRESTORE"))
+    for _, item := range items {
+        var ttl int64 = 0
+        if item.Expration > 0 {
+            ttl = int64(item.Expration) * 1000 - now
+            if ttl <= 0 {
+                // expires on the way, it's gone anyway
+                ttl = 1
+            }
+        }
+        args = append(args, item.Key, []byte(strconv.FormatInt(ttl, 10)), item.Value)
+    }
+
+    t.conn.SetDeadline(time.Now().Add(t.timeout))
+    t.w.WriteCommand(args...)
+    err := t.w.Flush()
+    var reply interface{}
+    if err == nil {
+        reply, err = t.r.ReadReply()
+    }
+    if err != nil {
+        // the reply may come later, don't reuse the connection
+        t.close()
+        return err
+    }
+    t.conn.SetDeadline(time.Time{})
+    if e, ok := reply.(error); ok {
+        return e
+    }
+    if reply != "OK" {
+        return fmt.Errorf("unexpected reply of slotsrestore: %v", reply)
+    }
+    return nil
+}
+
+type migrateTargets struct {
+    mu          sync.Mutex
+    targets     map[string]*respTarget
+}
+
+func newMigrateTargets() *migrateTargets {
+    return &migrateTargets{targets: make(map[string]*respTarget)}
+}
+
+func (mt *migrateTargets) get(addr string, timeout time.Duration) *respTarget {
+    mt.mu.Lock()
+    defer mt.mu.Unlock()
+    t, ok := mt.targets[addr]
+    if !ok {
+        t = &respTarget{addr: addr}
+        mt.targets[addr] = t
+    }
+    t.mu.Lock()
+    t.timeout = timeout
+    t.mu.Unlock()
+    return t
+}
+
+func (mt *migrateTargets) Close() {
+    mt.mu.Lock()
+    defer mt.mu.Unlock()
+    for _, t := range mt.targets {
+        t.mu.Lock()
+        t.close()
+        t.mu.Unlock()
+    }
+}
+
+// SLOTSMGRT* host port timeout ...
+func (c *client) migrateTarget(args [][]byte) (*respTarget, bool) {
+    port, ok := parseInt(args[2])
+    if !ok {
+        c.writeNotInt()
+        return nil, false
+    }
+    timeout, ok := parseInt(args[3])
+    if !ok {
+        c.writeNotInt()
+        return nil, false
+    }
+    if timeout <= 0 {
+        timeout = defaultMigrateTimeout
+    }
+    addr := net.JoinHostPort(string(args[1]), strconv.FormatInt(port, 10))
+    return c.s.targets.get(addr, time.Duration(timeout) * time.Millisecond), true
+}
+
+func (c *client) parseSlot(arg []byte) (uint32, bool) {
+    n, ok := parseInt(arg)
+    if !ok || n < 0 || n >= bitcask.MaxSlotNum {
+        c.w.WriteError("ERR invalid slot number")
+        return 0, false
+    }
+    return uint32(n), true
+}
+
+func (s *Server) slotKeys(slot uint32) int64 {
+    stat, err := s.bc.SlotInfo(slot)
+    if err != nil {
+        return 0
+    }
+    return stat.Keys
+}
+
+// SLOTSHASHKEY key [key ...]
+func cmdSlotsHashKey(c *client, args [][]byte) {
+    c.w.WriteArrayLen(len(args) - 1)
+    for _, key := range args[1:] {
+        _, slot := bitcask.HashKeyToSlot(key)
+        c.w.WriteInt(int64(slot))
+    }
+}
+
+// SLOTSINFO [start] [count], the slots with keys and their number of keys
+func cmdSlotsInfo(c *client, args [][]byte) {
+    var start, count int64 = 0, bitcask.MaxSlotNum
+    var ok bool
+    if len(args) > 3 {
+        c.w.WriteError("ERR wrong number of arguments for 'slotsinfo' command")
+        return
+    }
+    if len(args) > 1 {
+        if start, ok = parseInt(args[1]); !ok || start < 0 {
+            c.writeNotInt()
+            return
+        }
+    }
+    if len(args) > 2 {
+        if count, ok = parseInt(args[2]); !ok || count < 0 {
+            c.writeNotInt()
+            return
+        }
+    }
+
+    stats := make([]*bitcask.SlotStat, 0)
+    for _, stat := range c.s.bc.SlotsSummary() {
+        if int64(stat.Slot) >= start && int64(stat.Slot) < start + count {
+            stats = append(stats, stat)
+        }
+    }
+    c.w.WriteArrayLen(len(stats))
+    for _, stat := range stats {
+        c.w.WriteArrayLen(2)
+        c.w.WriteInt(int64(stat.Slot))
+        c.w.WriteInt(stat.Keys)
+    }
+}
+
+// move key, or all keys of its hash tag if withTag is set
+func (c *client) migrate(t *respTarget, key []byte, withTag bool) (int64, error) {
+    var progress *bitcask.MigrateProgress
+    var err error
+    if tag := bitcask.HashTag(key); withTag && len(tag) < len(key) {
+        progress, err = c.s.bc.MigrateTag(tag, t)
+    } else {
+        progress, err = c.s.bc.MigrateKey(key, t)
+    }
+    if progress == nil {
+        return 0, err
+    }
+    return progress.Moved, err
+}
+
+func slotsMgrtOne(c *client, args [][]byte, withTag bool) {
+    t, ok := c.migrateTarget(args)
+    if !ok {
+        return
+    }
+    n, err := c.migrate(t, args[4], withTag)
+    if err != nil {
+        c.writeErr(err)
+        return
+    }
+    c.w.WriteInt(n)
+}
+
+// keys are taken in order without removing them from the slot index, so a
+// failed move leaves the slot as it was
+func slotsMgrtSlot(c *client, args [][]byte, withTag bool) {
+    t, ok := c.migrateTarget(args)
+    if !ok {
+        return
+    }
+    slot, ok := c.parseSlot(args[4])
+    if !ok {
+        return
+    }
+
+    var moved int64 = 0
+    var last []byte
+    for moved == 0 {
+        keys, _, err := c.s.bc.KeysInSlot(slot, nil, 1)
+        if err != nil {
+            c.writeErr(err)
+            return
+        }
+        // a key rewritten while being moved is left to the next call
+        if len(keys) == 0 || bytes.Equal(keys[0], last) {
+            break
+        }
+        last = keys[0]
+        // an expired key moves nothing but leaves the slot
+        if moved, err = c.migrate(t, keys[0], withTag); err != nil {
+            c.writeErr(err)
+            return
+        }
+    }
+    c.w.WriteArrayLen(2)
+    c.w.WriteInt(moved)
+    c.w.WriteInt(c.s.slotKeys(slot))
+}
+
+// SLOTSMGRTONE host port timeout key
+func cmdSlotsMgrtOne(c *client, args [][]byte) {
+    slotsMgrtOne(c, args, false)
+}
+
+// SLOTSMGRTTAGONE host port timeout key
+func cmdSlotsMgrtTagOne(c *client, args [][]byte) {
+    slotsMgrtOne(c, args, true)
+}
+
+// SLOTSMGRTSLOT host port timeout slot
+func cmdSlotsMgrtSlot(c *client, args [][]byte) {
+    slotsMgrtSlot(c, args, false)
+}
+
+// SLOTSMGRTTAGSLOT host port timeout slot
+func cmdSlotsMgrtTagSlot(c *client, args [][]byte) {
+    slotsMgrtSlot(c, args, true)
+}
+
+// SLOTSRESTORE key ttlms value [key ttlms value ...]
+func cmdSlotsRestore(c *client, args [][]byte) {
+    if (len(args) - 1) % 3 != 0 {
+        c.w.WriteError("ERR wrong number of arguments for 'slotsrestore' command")
+        return
+    }
+    b := bitcask.NewBatch()
+    for i := 1; i < len(args); i += 3 {
+        ttl, ok := parseInt(args[i + 1])
+        if !ok || ttl < 0 {
+            c.writeNotInt()
+            return
+        }
+        var expration uint32 = 0
+        if ttl > 0 {
+            expration = expireAfter(ttl)
+        }
+        b.SetWithExpr(args[i], args[i + 2], expration)
+    }
+    c.s.mu.RLock()
+    err := c.s.bc.Write(b)
+    c.s.mu.RUnlock()
+    if err != nil {
+        c.writeErr(err)
+        return
+    }
+    c.w.WriteStatus("OK")
+}
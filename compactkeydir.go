@@ -0,0 +1,480 @@
+package bitcask
+
+import (
+    "bytes"
+    "encoding/binary"
+    "fmt"
+    "math"
+    "sort"
+)
+
+// compactTable is the KeyDir of KEYDIR_COMPACT mode, an open-addressing hash
+// table whose slots pack a DirItem into 4 words:
+//
+//   w0: hash fragment (20 bits) | key ref (44 bits: slab 24, offset 20)
+//   w1: fileId (32 bits) | expration (32 bits)
+//   w2: state (8 bits) | flag (8 bits) | valuePos (48 bits)
+//   w3: valueSize
+//
+// Keys are stored inline in slabs as uvarint(len) + key. Slots are split into
+// pages which are copied on write like btree nodes, so Clone only copies the
+// page and slab lists. Bytes in a slab are never modified once written: the
+// table appends to its tail slab only, clones start a slab of their own.
+
+const (
+    COMPACT_SLOT_WORDS  = 4
+    COMPACT_PAGE_SLOTS  = 4096
+    COMPACT_MIN_SLOTS   = 64
+    COMPACT_SLAB_SIZE   = 1 << 20
+    COMPACT_SLAB_MIN    = 4096      // a new slab starts this big, and grows to COMPACT_SLAB_SIZE
+    COMPACT_MAX_SLABS   = 1 << 24
+    COMPACT_OFFSET_BITS = 20
+    COMPACT_REF_BITS    = 44
+    COMPACT_MAX_48      = 1 << 48 - 1
+)
+
+const (
+    compactRefMask      = 1 << COMPACT_REF_BITS - 1
+    compactOffsetMask   = 1 << COMPACT_OFFSET_BITS - 1
+)
+
+// slot states
+const (
+    SLOT_EMPTY      = 0
+    SLOT_USED       = 1
+    SLOT_DELETED    = 2     // a removed key, probing goes on past it
+)
+
+var (
+    ErrKeyDirOverflow = fmt.Errorf("dir item doesn't fit in the compact keydir")
+)
+
+type compactOwner struct {
+    _   int
+}
+
+type compactPage struct {
+    owner   *compactOwner
+    words   []uint64
+}
+
+// slots split into pages copied on write
+type slotPages struct {
+    owner       *compactOwner
+    pages       []*compactPage
+    pageShift   uint        // log2 of slots per page
+    mask        uint64      // slots - 1
+    used        int
+    deleted     int
+}
+
+type compactTable struct {
+    slotPages
+    slabs       [][]byte
+    tail        int         // slab appended to, -1 if there's none
+    keyBytes    int64       // bytes in slabs, with deleted keys
+    garbage     int64       // bytes of deleted keys
+}
+
+// slots is a power of 2, pages are owned by owner
+func newSlotPages(slots int, owner *compactOwner) slotPages {
+    pageSlots := slots
+    if pageSlots > COMPACT_PAGE_SLOTS {
+        pageSlots = COMPACT_PAGE_SLOTS
+    }
+    sp := slotPages{
+        owner: owner,
+        mask: uint64(slots - 1),
+    }
+    for 1 << sp.pageShift < pageSlots {
+        sp.pageShift++
+    }
+    sp.pages = make([]*compactPage, slots / pageSlots)
+    for i := range sp.pages {
+        sp.pages[i] = &compactPage{owner: owner, words: make([]uint64, pageSlots * COMPACT_SLOT_WORDS)}
+    }
+    return sp
+}
+
+func newCompactTable(slots int) *compactTable {
+    return &compactTable{
+        slotPages: newSlotPages(slots, &compactOwner{}),
+        tail: -1,
+    }
+}
+
+// FNV-1a with the finalizer of murmur3, so the low bits used as the index
+// depend on every byte of the key
+func keyHash(key []byte) uint64 {
+    var h uint64 = 14695981039346656037
+    for _, b := range key {
+        h ^= uint64(b)
+        h *= 1099511628211
+    }
+    h ^= h >> 33
+    h *= 0xff51afd7ed558ccd
+    h ^= h >> 33
+    h *= 0xc4ceb9fe1a85ec53
+    h ^= h >> 33
+    return h
+}
+
+func slotState(s []uint64) uint64 {
+    return s[2] >> 56
+}
+
+func (sp *slotPages) slots() uint64 {
+    return sp.mask + 1
+}
+
+func (sp *slotPages) slot(i uint64) []uint64 {
+    p := sp.pages[i >> sp.pageShift]
+    off := (i & (1 << sp.pageShift - 1)) * COMPACT_SLOT_WORDS
+    return p.words[off:off + COMPACT_SLOT_WORDS]
+}
+
+// the slot in a page owned by sp, copy the page if it's shared with a clone
+func (sp *slotPages) mutableSlot(i uint64) []uint64 {
+    n := i >> sp.pageShift
+    if p := sp.pages[n]; p.owner != sp.owner {
+        cp := &compactPage{owner: sp.owner, words: make([]uint64, len(p.words))}
+        copy(cp.words, p.words)
+        sp.pages[n] = cp
+    }
+    return sp.slot(i)
+}
+
+// both sp and the copy returned copy pages on write from now on
+func (sp *slotPages) clone() slotPages {
+    out := *sp
+    out.pages = append([]*compactPage(nil), sp.pages...)
+    sp.owner = &compactOwner{}
+    out.owner = &compactOwner{}
+    return out
+}
+
+// the table is rehashed before it's full, at least a quarter of the slots
+// are kept empty
+func (sp *slotPages) full() bool {
+    return uint64(sp.used + sp.deleted + 1) * 4 > sp.slots() * 3
+}
+
+// the size of the table rehashed to, twice as big if at least half of the
+// slots are used
+func (sp *slotPages) rehashSlots() int {
+    slots := int(sp.slots())
+    if sp.used * 2 >= slots {
+        slots *= 2
+    }
+    return slots
+}
+
+func (sp *slotPages) tombstone(s []uint64) {
+    s[0], s[1], s[2], s[3] = 0, 0, SLOT_DELETED << 56, 0
+    sp.used--
+    sp.deleted++
+}
+
+func (sp *slotPages) pagesMemUsage() int64 {
+    return int64(len(sp.pages)) * (int64(1 << sp.pageShift) * COMPACT_SLOT_WORDS * 8 + 48)
+}
+
+func (t *compactTable) keyAt(ref uint64) []byte {
+    slab := t.slabs[ref >> COMPACT_OFFSET_BITS]
+    off := ref & compactOffsetMask
+    n, sz := binary.Uvarint(slab[off:])
+    begin := off + uint64(sz)
+    end := begin + n
+    return slab[begin:end:end]
+}
+
+func (t *compactTable) addKey(key []byte) (uint64, error) {
+    var buf [binary.MaxVarintLen64]byte
+    sz := binary.PutUvarint(buf[:], uint64(len(key)))
+    need := sz + len(key)
+
+    idx := t.tail
+    if need > COMPACT_SLAB_SIZE {
+        // a big key has a slab of its own
+        idx = -1
+    } else if idx >= 0 && len(t.slabs[idx]) + need > COMPACT_SLAB_SIZE {
+        idx = -1
+    }
+    if idx < 0 {
+        if len(t.slabs) >= COMPACT_MAX_SLABS {
+            return 0, ErrKeyDirOverflow
+        }
+        size := COMPACT_SLAB_MIN
+        if need > size {
+            size = need
+        }
+        t.slabs = append(t.slabs, make([]byte, 0, size))
+        idx = len(t.slabs) - 1
+        if need <= COMPACT_SLAB_SIZE {
+            t.tail = idx
+        }
+    }
+
+    slab := t.slabs[idx]
+    off := len(slab)
+    slab = append(slab, buf[:sz]...)
+    slab = append(slab, key...)
+    t.slabs[idx] = slab
+    t.keyBytes += int64(need)
+    return uint64(idx) << COMPACT_OFFSET_BITS | uint64(off), nil
+}
+
+func (t *compactTable) keySize(ref uint64) int64 {
+    key := t.keyAt(ref)
+    var buf [binary.MaxVarintLen64]byte
+    return int64(binary.PutUvarint(buf[:], uint64(len(key))) + len(key))
+}
+
+// find returns the slot of key, or the slot to put it to if it's not found
+func (t *compactTable) find(key []byte, h uint64) (uint64, bool) {
+    frag := h >> COMPACT_REF_BITS
+    var free uint64
+    hasFree := false
+    for i := h & t.mask; ; i = (i + 1) & t.mask {
+        s := t.slot(i)
+        switch slotState(s) {
+        case SLOT_EMPTY:
+            if !hasFree {
+                free = i
+            }
+            return free, false
+        case SLOT_DELETED:
+            if !hasFree {
+                free, hasFree = i, true
+            }
+        default:
+            if s[0] >> COMPACT_REF_BITS == frag && bytes.Equal(t.keyAt(s[0] & compactRefMask), key) {
+                return i, true
+            }
+        }
+    }
+}
+
+func packSlot(s []uint64, w0 uint64, di *DirItem) {
+    s[0] = w0
+    s[1] = uint64(di.fileId) << 32 | uint64(di.expration)
+    s[2] = SLOT_USED << 56 | uint64(di.flag) << 48 | uint64(di.valuePos)
+    s[3] = uint64(di.valueSize)
+}
+
+func unpackSlot(s []uint64) *DirItem {
+    return &DirItem{
+        flag: uint8(s[2] >> 48),
+        fileId: int64(s[1] >> 32),
+        valuePos: int64(s[2] & COMPACT_MAX_48),
+        valueSize: int64(s[3]),
+        expration: uint32(s[1]),
+    }
+}
+
+func fitsCompactSlot(di *DirItem) bool {
+    return di.fileId >= 0 && di.fileId <= math.MaxUint32 &&
+        di.valuePos >= 0 && di.valuePos <= COMPACT_MAX_48 &&
+        di.valueSize >= 0
+}
+
+func (t *compactTable) get(key []byte) (*DirItem, bool) {
+    i, found := t.find(key, keyHash(key))
+    if !found {
+        return nil, false
+    }
+    return unpackSlot(t.slot(i)), true
+}
+
+func (t *compactTable) put(key []byte, di *DirItem) error {
+    if !fitsCompactSlot(di) {
+        return ErrKeyDirOverflow
+    }
+    h := keyHash(key)
+    i, found := t.find(key, h)
+    if found {
+        s := t.mutableSlot(i)
+        packSlot(s, s[0], di)
+        return nil
+    }
+
+    // drop deleted keys from slabs once they take half of the bytes
+    if t.full() || t.garbage >= COMPACT_SLAB_SIZE && t.garbage * 2 >= t.keyBytes {
+        if err := t.rehash(); err != nil {
+            return err
+        }
+        i, _ = t.find(key, h)
+    }
+    ref, err := t.addKey(key)
+    if err != nil {
+        return err
+    }
+    s := t.mutableSlot(i)
+    if slotState(s) == SLOT_DELETED {
+        t.deleted--
+    }
+    packSlot(s, h >> COMPACT_REF_BITS << COMPACT_REF_BITS | ref, di)
+    t.used++
+    return nil
+}
+
+func (t *compactTable) del(key []byte) bool {
+    i, found := t.find(key, keyHash(key))
+    if !found {
+        return false
+    }
+    s := t.mutableSlot(i)
+    t.garbage += t.keySize(s[0] & compactRefMask)
+    t.tombstone(s)
+    return true
+}
+
+// rehash moves the keys to a new table. Keys are copied to new slabs if at
+// least half of the bytes in slabs are of deleted keys, otherwise slabs are
+// shared.
+func (t *compactTable) rehash() error {
+    out := &compactTable{
+        slotPages: newSlotPages(t.rehashSlots(), t.owner),
+        tail: -1,
+    }
+    copyKeys := t.garbage * 2 >= t.keyBytes
+    if !copyKeys {
+        out.slabs = t.slabs
+        out.tail = t.tail
+        out.keyBytes = t.keyBytes
+        out.garbage = t.garbage
+    }
+
+    for i := uint64(0); i < t.slots(); i++ {
+        s := t.slot(i)
+        if slotState(s) != SLOT_USED {
+            continue
+        }
+        key := t.keyAt(s[0] & compactRefMask)
+        ref := s[0] & compactRefMask
+        if copyKeys {
+            var err error
+            if ref, err = out.addKey(key); err != nil {
+                return err
+            }
+        }
+        j := keyHash(key) & out.mask
+        for slotState(out.slot(j)) != SLOT_EMPTY {
+            j = (j + 1) & out.mask
+        }
+        d := out.slot(j)
+        d[0] = s[0] &^ compactRefMask | ref
+        d[1], d[2], d[3] = s[1], s[2], s[3]
+        out.used++
+    }
+    *t = *out
+    return nil
+}
+
+func (t *compactTable) clone() *compactTable {
+    out := *t
+    out.slotPages = t.slotPages.clone()
+    out.slabs = append([][]byte(nil), t.slabs...)
+    out.tail = -1
+    return &out
+}
+
+func (t *compactTable) clear() {
+    *t = *newCompactTable(COMPACT_MIN_SLOTS)
+}
+
+// forEach calls fn for every key matched in slot order, fn may delete keys
+// but must not put any
+func (t *compactTable) forEach(match func(di *DirItem) bool, fn func(key []byte, di *DirItem) error) error {
+    for i := uint64(0); i < t.slots(); i++ {
+        s := t.slot(i)
+        if slotState(s) != SLOT_USED {
+            continue
+        }
+        di := unpackSlot(s)
+        if match != nil && !match(di) {
+            continue
+        }
+        if err := fn(t.keyAt(s[0] & compactRefMask), di); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+func (t *compactTable) memUsage() int64 {
+    n := t.pagesMemUsage()
+    for _, slab := range t.slabs {
+        n += int64(cap(slab)) + 24
+    }
+    return n
+}
+
+// compactIterator walks a compactTable in key order, it sorts the keys of
+// its range when created, so the table must not be modified while iterating
+type compactIterator struct {
+    t       *compactTable
+    slots   []uint64    // used slots in key order
+    pos     int
+}
+
+func (t *compactTable) newIterator(r *keyRange) *compactIterator {
+    var h rangeHeap
+    if r == nil || r.limit <= 0 {
+        h = make(rangeHeap, 0, t.used)
+    }
+    for i := uint64(0); i < t.slots(); i++ {
+        s := t.slot(i)
+        if slotState(s) != SLOT_USED {
+            continue
+        }
+        if r.matches(unpackSlot(s)) {
+            r.add(&h, rangeEntry{key: t.keyAt(s[0] & compactRefMask), ref: i})
+        }
+    }
+    entries := sortRange(h)
+    slots := make([]uint64, len(entries))
+    for i, e := range entries {
+        slots[i] = e.ref
+    }
+    return &compactIterator{t: t, slots: slots, pos: len(slots)}
+}
+
+func (it *compactIterator) keyOf(pos int) []byte {
+    return it.t.keyAt(it.t.slot(it.slots[pos])[0] & compactRefMask)
+}
+
+func (it *compactIterator) Valid() bool {
+    return it.pos >= 0 && it.pos < len(it.slots)
+}
+
+func (it *compactIterator) Key() []byte {
+    return it.keyOf(it.pos)
+}
+
+func (it *compactIterator) Value() interface{} {
+    return unpackSlot(it.t.slot(it.slots[it.pos]))
+}
+
+// Seek moves to the first key >= key
+func (it *compactIterator) Seek(key []byte) {
+    it.pos = sort.Search(len(it.slots), func(i int) bool {
+        return bytes.Compare(it.keyOf(i), key) >= 0
+    })
+}
+
+func (it *compactIterator) SeekToFirst() {
+    it.pos = 0
+}
+
+func (it *compactIterator) SeekToLast() {
+    it.pos = len(it.slots) - 1
+}
+
+func (it *compactIterator) Next() {
+    it.pos++
+}
+
+func (it *compactIterator) Prev() {
+    it.pos--
+}
@@ -0,0 +1,211 @@
+package bitcask
+
+import (
+    "bytes"
+    "fmt"
+    "math/rand"
+    "sort"
+    . "gopkg.in/check.v1"
+)
+
+type testCompactSuite struct {
+}
+
+var _ = Suite(&testCompactSuite{})
+
+func checkKeyDir(c *C, kd *KeyDir, model map[string]*DirItem) {
+    c.Assert(kd.Len(), Equals, len(model))
+    for key, di := range model {
+        got, err := kd.Get([]byte(key))
+        c.Assert(err, IsNil)
+        c.Assert(got, DeepEquals, di)
+    }
+
+    seen := 0
+    c.Assert(kd.ForEach(func(key []byte, di *DirItem) error {
+        c.Assert(di, DeepEquals, model[string(key)])
+        seen++
+        return nil
+    }), IsNil)
+    c.Assert(seen, Equals, len(model))
+
+    keys := make([]string, 0, len(model))
+    for key := range model {
+        keys = append(keys, key)
+    }
+    sort.Strings(keys)
+    it, err := kd.NewIterator()
+    c.Assert(err, IsNil)
+    i := 0
+    for it.SeekToFirst(); it.Valid(); it.Next() {
+        c.Assert(string(it.Key()), Equals, keys[i])
+        c.Assert(it.Value().(*DirItem), DeepEquals, model[keys[i]])
+        i++
+    }
+    c.Assert(i, Equals, len(keys))
+}
+
+func (s *testCompactSuite) TestTable(c *C) {
+    kd := newKeyDirOf(KEYDIR_COMPACT, nil)
+    model := make(map[string]*DirItem)
+    r := rand.New(rand.NewSource(1))
+    for i := 0; i < 50000; i++ {
+        key := fmt.Sprintf("key%05d", r.Intn(20000))
+        if r.Intn(4) == 0 {
+            err := kd.Del([]byte(key))
+            if _, ok := model[key]; ok {
+                c.Assert(err, IsNil)
+                delete(model, key)
+            } else {
+                c.Assert(err, Equals, ErrKeyNotFound)
+            }
+            continue
+        }
+        di := &DirItem{
+            flag: uint8(r.Intn(256)),
+            fileId: r.Int63n(1 << 32),
+            valuePos: r.Int63n(1 << 48),
+            valueSize: r.Int63(),
+            expration: r.Uint32(),
+        }
+        c.Assert(kd.Put([]byte(key), di), IsNil)
+        model[key] = di
+    }
+
+    // a key longer than a slab
+    big := bytes.Repeat([]byte("b"), COMPACT_SLAB_SIZE + 1)
+    di := &DirItem{fileId: 1, valuePos: 2, valueSize: 3}
+    c.Assert(kd.Put(big, di), IsNil)
+    model[string(big)] = di
+    checkKeyDir(c, kd, model)
+
+    c.Assert(kd.Put([]byte("a"), &DirItem{fileId: 1 << 32}), Equals, ErrKeyDirOverflow)
+    c.Assert(kd.Put([]byte("a"), &DirItem{valuePos: 1 << 48}), Equals, ErrKeyDirOverflow)
+
+    kd.Clear()
+    checkKeyDir(c, kd, map[string]*DirItem{})
+}
+
+func (s *testCompactSuite) TestSeek(c *C) {
+    kd := newKeyDirOf(KEYDIR_COMPACT, nil)
+    for _, key := range []string{"b", "d", "f"} {
+        c.Assert(kd.Put([]byte(key), &DirItem{}), IsNil)
+    }
+    it, err := kd.NewIterator()
+    c.Assert(err, IsNil)
+    c.Assert(it.Valid(), Equals, false)
+    it.Seek([]byte("c"))
+    c.Assert(string(it.Key()), Equals, "d")
+    it.Prev()
+    c.Assert(string(it.Key()), Equals, "b")
+    it.Prev()
+    c.Assert(it.Valid(), Equals, false)
+    it.Seek([]byte("g"))
+    c.Assert(it.Valid(), Equals, false)
+    it.SeekToLast()
+    c.Assert(string(it.Key()), Equals, "f")
+}
+
+// writes to a clone or the KeyDir it's cloned from don't show in the other
+func (s *testCompactSuite) TestClone(c *C) {
+    kd := newKeyDirOf(KEYDIR_COMPACT, nil)
+    model := make(map[string]*DirItem)
+    for i := 0; i < 1000; i++ {
+        key := fmt.Sprintf("key%04d", i)
+        di := &DirItem{fileId: 1, valuePos: int64(i)}
+        c.Assert(kd.Put([]byte(key), di), IsNil)
+        model[key] = di
+    }
+
+    clone := kd.Clone()
+    cloneModel := make(map[string]*DirItem)
+    for key, di := range model {
+        cloneModel[key] = di
+    }
+    for i := 0; i < 10000; i += 2 {
+        key := fmt.Sprintf("key%04d", i)
+        di := &DirItem{fileId: 2, valuePos: int64(i)}
+        c.Assert(kd.Put([]byte(key), di), IsNil)
+        model[key] = di
+        if i % 3 == 0 && i < 1000 {
+            c.Assert(clone.Del([]byte(key)), IsNil)
+            delete(cloneModel, key)
+        }
+    }
+    for i := 1; i < 1000; i += 2 {
+        key := fmt.Sprintf("key%04d", i)
+        c.Assert(kd.Del([]byte(key)), IsNil)
+        delete(model, key)
+        di := &DirItem{fileId: 3}
+        c.Assert(clone.Put([]byte(key + "x"), di), IsNil)
+        cloneModel[key + "x"] = di
+    }
+    checkKeyDir(c, kd, model)
+    checkKeyDir(c, clone, cloneModel)
+}
+
+func (s *testCompactSuite) TestMemUsage(c *C) {
+    tree := newKeyDirOf(KEYDIR_BTREE, nil)
+    table := newKeyDirOf(KEYDIR_COMPACT, nil)
+    for i := 0; i < 100000; i++ {
+        key := []byte(fmt.Sprintf("user:%08d", i))
+        di := &DirItem{fileId: int64(i / 1000), valuePos: int64(i), valueSize: 100}
+        c.Assert(tree.Put(key, di), IsNil)
+        c.Assert(table.Put(key, di), IsNil)
+    }
+    c.Assert(tree.MemUsage(), Equals, int64(100000 * (KEYDIR_BTREE_ITEM_SIZE + 13)))
+    c.Assert(table.MemUsage() < tree.MemUsage(), Equals, true)
+    c.Assert(table.MemUsage() > 100000 * (COMPACT_SLOT_WORDS * 8 + 14), Equals, true)
+
+    // deleted keys are dropped from slabs, though new keys take their slots
+    for i := 0; i < 100000; i++ {
+        c.Assert(table.Del([]byte(fmt.Sprintf("user:%08d", i))), IsNil)
+    }
+    for i := 0; i < 100000; i++ {
+        c.Assert(table.Put([]byte(fmt.Sprintf("item:%08d", i)), &DirItem{}), IsNil)
+    }
+    c.Assert(table.table.garbage * 2 < table.table.keyBytes, Equals, true)
+}
+
+func (s *testCompactSuite) TestCompactMode(c *C) {
+    dir := c.MkDir()
+    opts := NewOptions()
+    opts.SetMaxFileSize(1024)
+    opts.SetKeyDirMode(KEYDIR_COMPACT)
+    bc, err := Open(dir, opts)
+    c.Assert(err, IsNil)
+    for round := 0; round < 3; round++ {
+        for i := 0; i < 100; i++ {
+            key := []byte(fmt.Sprintf("key%03d", i))
+            c.Assert(bc.Set(key, []byte(fmt.Sprintf("value%d-%d", round, i))), IsNil)
+        }
+    }
+    for i := 0; i < 100; i += 10 {
+        c.Assert(bc.Del([]byte(fmt.Sprintf("key%03d", i))), IsNil)
+    }
+    inputs := make([]int64, 0)
+    for _, meta := range bc.GetFileMetas() {
+        inputs = append(inputs, meta.FileId)
+    }
+    c.Assert(bc.runMerge(inputs), IsNil)
+    c.Assert(bc.Close(), IsNil)
+
+    bc, err = Open(dir, opts)
+    c.Assert(err, IsNil)
+    defer bc.Close()
+    stats := bc.KeyDirStats()
+    c.Assert(stats.Mode, Equals, KEYDIR_COMPACT)
+    c.Assert(stats.Keys, Equals, 100)
+    c.Assert(stats.MemBytes > 0, Equals, true)
+
+    keys := make([]string, 0)
+    c.Assert(bc.Scan(nil, nil, func(key []byte, value []byte) error {
+        var i int
+        fmt.Sscanf(string(key), "key%d", &i)
+        c.Assert(string(value), Equals, fmt.Sprintf("value2-%d", i))
+        keys = append(keys, string(key))
+        return nil
+    }), IsNil)
+    c.Assert(len(keys), Equals, 90)
+    c.Assert(sort.StringsAreSorted(keys), Equals, true)
+}
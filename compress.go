@@ -0,0 +1,124 @@
+package bitcask
+
+import (
+    "encoding/binary"
+    "fmt"
+    "sync"
+    "github.com/golang/snappy"
+    "github.com/klauspost/compress/zstd"
+    "github.com/pierrec/lz4/v4"
+)
+
+// value codecs, stored in bits 4-5 of the record flag.
+// records written before compression was added have these bits clear,
+// so they are read as COMPRESS_NONE.
+const (
+    COMPRESS_NONE = iota
+    COMPRESS_SNAPPY
+    COMPRESS_ZSTD
+    COMPRESS_LZ4
+)
+
+const (
+    RECORD_CODEC_SHIFT = 4
+    RECORD_CODEC_MASK = 0x3 << RECORD_CODEC_SHIFT
+)
+
+var (
+    ErrUnknownCodec = fmt.Errorf("unknown compression codec")
+)
+
+var (
+    zstdOnce    sync.Once
+    zstdEnc     *zstd.Encoder
+    zstdDec     *zstd.Decoder
+    zstdErr     error
+)
+
+func recordCodec(flag uint8) int {
+    return int(flag & RECORD_CODEC_MASK) >> RECORD_CODEC_SHIFT
+}
+
+func setRecordCodec(flag uint8, codec int) uint8 {
+    return flag &^ RECORD_CODEC_MASK | uint8(codec << RECORD_CODEC_SHIFT) & RECORD_CODEC_MASK
+}
+
+func initZstd() error {
+    zstdOnce.Do(func() {
+        zstdEnc, zstdErr = zstd.NewWriter(nil)
+        if zstdErr != nil {
+            return
+        }
+        zstdDec, zstdErr = zstd.NewReader(nil)
+    })
+    return zstdErr
+}
+
+func compressValue(codec int, src []byte) ([]byte, error) {
+    switch codec {
+    case COMPRESS_NONE:
+        return src, nil
+    case COMPRESS_SNAPPY:
+        return snappy.Encode(nil, src), nil
+    case COMPRESS_ZSTD:
+        if err := initZstd(); err != nil {
+            return nil, err
+        }
+        return zstdEnc.EncodeAll(src, nil), nil
+    case COMPRESS_LZ4:
+        // lz4 blocks don't carry the raw size, keep it as a uvarint prefix
+        dst := make([]byte, binary.MaxVarintLen64 + lz4.CompressBlockBound(len(src)))
+        n := binary.PutUvarint(dst, uint64(len(src)))
+        var c lz4.Compressor
+        m, err := c.CompressBlock(src, dst[n:])
+        if err != nil {
+            return nil, err
+        }
+        if m == 0 {
+            // incompressible, caller falls back to raw
+            return src, nil
+        }
+        return dst[:n + m], nil
+    }
+    return nil, ErrUnknownCodec
+}
+
+func decompressValue(codec int, src []byte) ([]byte, error) {
+    switch codec {
+    case COMPRESS_NONE:
+        return src, nil
+    case COMPRESS_SNAPPY:
+        return snappy.Decode(nil, src)
+    case COMPRESS_ZSTD:
+        if err := initZstd(); err != nil {
+            return nil, err
+        }
+        return zstdDec.DecodeAll(src, nil)
+    case COMPRESS_LZ4:
+        size, n := binary.Uvarint(src)
+        if n <= 0 {
+            return nil, ErrRecordCorrupted
+        }
+        dst := make([]byte, size)
+        m, err := lz4.UncompressBlock(src[n:], dst)
+        if err != nil {
+            return nil, err
+        }
+        if uint64(m) != size {
+            return nil, ErrRecordCorrupted
+        }
+        return dst, nil
+    }
+    return nil, ErrUnknownCodec
+}
+
+// choose the codec for a new record according to the options,
+// Record.Encode falls back to raw if the value doesn't shrink
+func (bc *BitCask) compressRecord(rec *Record) {
+    codec := COMPRESS_NONE
+    if rec.flag & (RECORD_FLAG_DELETED | RECORD_FLAG_MERGE | RECORD_FLAG_BATCH_COMMIT) == 0 &&
+            len(rec.value) > 0 && int64(len(rec.value)) >= bc.opts.compressMinSize {
+        codec = bc.opts.compression
+    }
+    rec.flag = setRecordCodec(rec.flag, codec)
+}
@@ -0,0 +1,84 @@
+package bitcask
+
+import (
+    "bytes"
+    "fmt"
+    . "gopkg.in/check.v1"
+)
+
+type testCompressSuite struct {
+    path string
+}
+
+var _ = Suite(&testCompressSuite{})
+
+func (s *testCompressSuite) SetUpTest(c *C) {
+    s.path = c.MkDir()
+}
+
+func (s *testCompressSuite) open(c *C, codec int) *BitCask {
+    opts := NewOptions()
+    opts.SetCompression(codec)
+    bc, err := Open(s.path, opts)
+    c.Assert(err, IsNil)
+    return bc
+}
+
+func jsonValue(i int) []byte {
+    return bytes.Repeat([]byte(fmt.Sprintf(`{"id":%d,"name":"user","tags":["a","b"]}`, i)), 20)
+}
+
+func (s *testCompressSuite) check(c *C, bc *BitCask, n int) {
+    for i := 0; i < n; i++ {
+        val, err := bc.Get([]byte(fmt.Sprintf("key%03d", i)))
+        c.Assert(err, IsNil)
+        c.Assert(val, DeepEquals, jsonValue(i))
+    }
+    val, err := bc.Get([]byte("small"))
+    c.Assert(err, IsNil)
+    c.Assert(string(val), Equals, "v")
+}
+
+func (s *testCompressSuite) TestCodecs(c *C) {
+    for _, codec := range []int{COMPRESS_SNAPPY, COMPRESS_ZSTD, COMPRESS_LZ4} {
+        s.path = c.MkDir()
+        bc := s.open(c, codec)
+        for i := 0; i < 100; i++ {
+            c.Assert(bc.Set([]byte(fmt.Sprintf("key%03d", i)), jsonValue(i)), IsNil)
+        }
+        c.Assert(bc.Set([]byte("small"), []byte("v")), IsNil)
+        s.check(c, bc, 100)
+        bc.Close()
+
+        // any codec can be read back whatever the current option is
+        bc = s.open(c, COMPRESS_NONE)
+        s.check(c, bc, 100)
+        bc.Close()
+    }
+}
+
+func (s *testCompressSuite) TestMixedFormats(c *C) {
+    bc := s.open(c, COMPRESS_NONE)
+    for i := 0; i < 50; i++ {
+        c.Assert(bc.Set([]byte(fmt.Sprintf("key%03d", i)), jsonValue(i)), IsNil)
+    }
+    raw := bc.activeFile.Size()
+    bc.Close()
+
+    bc = s.open(c, COMPRESS_ZSTD)
+    for i := 50; i < 100; i++ {
+        c.Assert(bc.Set([]byte(fmt.Sprintf("key%03d", i)), jsonValue(i)), IsNil)
+    }
+    c.Assert(bc.Set([]byte("small"), []byte("v")), IsNil)
+    c.Assert(bc.activeFile.Size() - raw < raw / 5, Equals, true)
+    s.check(c, bc, 100)
+
+    // merge rewrites compressed records as they are
+    c.Assert(bc.runMerge([]int64{bc.activeFile.id}), IsNil)
+    s.check(c, bc, 100)
+    bc.Close()
+
+    bc = s.open(c, COMPRESS_NONE)
+    s.check(c, bc, 100)
+    bc.Close()
+}
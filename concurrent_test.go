@@ -0,0 +1,72 @@
+package bitcask
+
+import (
+    "fmt"
+    "sync"
+    . "gopkg.in/check.v1"
+)
+
+type testConcurrentSuite struct {
+    path string
+    bc   *BitCask
+}
+
+var _ = Suite(&testConcurrentSuite{})
+
+func (s *testConcurrentSuite) SetUpTest(c *C) {
+    s.path = c.MkDir()
+    opts := NewOptions()
+    opts.SetMaxFileSize(4096)
+    opts.SetCacheSize(64)
+    opts.SetMaxOpenFiles(4)
+    var err error
+    s.bc, err = Open(s.path, opts)
+    c.Assert(err, IsNil)
+}
+
+func (s *testConcurrentSuite) TearDownTest(c *C) {
+    s.bc.Close()
+}
+
+func (s *testConcurrentSuite) TestReadsWithWrites(c *C) {
+    for i := 0; i < 200; i++ {
+        c.Assert(s.bc.Set([]byte(fmt.Sprintf("key%03d", i)), []byte(fmt.Sprintf("value%03d", i))), IsNil)
+    }
+
+    var wg sync.WaitGroup
+    errs := make(chan error, 16)
+    for r := 0; r < 8; r++ {
+        wg.Add(1)
+        go func(r int) {
+            defer wg.Done()
+            for n := 0; n < 500; n++ {
+                i := (n * 7 + r) % 200
+                val, err := s.bc.Get([]byte(fmt.Sprintf("key%03d", i)))
+                if err != nil {
+                    errs <- err
+                    return
+                }
+                if string(val) != fmt.Sprintf("value%03d", i) {
+                    errs <- fmt.Errorf("key%03d has value %s", i, val)
+                    return
+                }
+            }
+        }(r)
+    }
+    wg.Add(1)
+    go func() {
+        defer wg.Done()
+        // rewrite the same values, so readers always see the same data
+        for i := 0; i < 200; i++ {
+            if err := s.bc.Set([]byte(fmt.Sprintf("key%03d", i)), []byte(fmt.Sprintf("value%03d", i))); err != nil {
+                errs <- err
+                return
+            }
+        }
+    }()
+    wg.Wait()
+    close(errs)
+    for err := range errs {
+        c.Assert(err, IsNil)
+    }
+}
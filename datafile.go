@@ -2,30 +2,50 @@ package bitcask
 
 import (
     "io"
+    "os"
     "github.com/rocket323/bitcask/lru"
 )
 
 type DataFile struct {
     FileReader
     id  int64
+    fc  *fileCipher     // nil if not encrypted
 }
 
-func NewDataFile(path string, fileId int64) (*DataFile, error) {
-    f, err := NewFileWithBuffer(path, false, 1000)
+// a mapped data file must not be written while it's open
+func NewDataFile(path string, fileId int64, fc *fileCipher, mapped bool) (*DataFile, error) {
+    var f FileReader
+    var err error
+    if mapped && mmapSupported {
+        f, err = NewMmapFile(path)
+    } else {
+        f, err = NewFileWithBuffer(path, false, 1000)
+    }
     if err != nil {
         return nil, err
     }
     df := &DataFile{
         f,
         fileId,
+        fc,
     }
     return df, nil
 }
 
+// the bytes of a mapped file, nil if it's read with pread
+func (df *DataFile) slicer() byteSlicer {
+    if mf, ok := df.FileReader.(*MmapFile); ok {
+        return mf
+    }
+    return nil
+}
+
+// records of a mapped file are borrowed, fn copies the keys and values it
+// keeps after df is closed
 func (df *DataFile) ForEachItem(fn func(rec *Record, offset int64) error) error {
     var offset int64 = 0
     for {
-        rec, err := parseRecordAt(df, offset)
+        rec, err := parseRecordAt(df, offset, df.fc)
         if err != nil {
             if err == io.EOF {
                 break
@@ -65,28 +85,51 @@ func NewDataFileCache(env Env) *DataFileCache {
     return dfc
 }
 
+// the active file can't be refed, a handle of it would miss what's written
+// after it's opened, it's read through the ActiveFile instead
 func (c *DataFileCache) Ref(fileId int64) (*DataFile, error) {
+    env := c.env
+    if af := env.getActiveFile(); af != nil && af.id == fileId {
+        return nil, ErrInvalid
+    }
     v, err := c.cache.Ref(fileId)
     if err == nil {
         return v.(*DataFile), nil
     }
-    env := c.env
 
+    fc, err := env.getFileCipher(fileId)
+    if err != nil {
+        return nil, err
+    }
     path := env.GetDataFilePath(fileId)
-    df, err := NewDataFile(path, fileId)
+    df, err := NewDataFile(path, fileId, fc, env.getOptions().mmap)
+    // merged while pinned by a snapshot
+    if os.IsNotExist(err) {
+        df, err = NewDataFile(getObsoletePath(path), fileId, fc, env.getOptions().mmap)
+    }
     if err != nil {
         return nil, err
     }
-    c.cache.Put(fileId, df)
-    c.cache.Ref(fileId)
-    return df, nil
+    // another reader may have opened it meanwhile
+    v, ok := c.cache.PutAndRef(fileId, df)
+    if !ok {
+        df.Close()
+    }
+    return v.(*DataFile), nil
 }
 
 func (c *DataFileCache) Unref(fileId int64) {
     c.cache.Unref(fileId)
 }
 
+// drop a removed data file, it's closed once it's unrefed by all, so readers
+// of a mapping never see it unmapped
+func (c *DataFileCache) Remove(fileId int64) {
+    c.cache.Remove(fileId)
+}
+
+// files in use are closed when they're unrefed
 func (c *DataFileCache) Close() {
-    c.cache.Close()
+    c.cache.RemoveAll()
 }
 
@@ -0,0 +1,374 @@
+package bitcask
+
+import (
+    "bytes"
+    "crypto/aes"
+    "crypto/cipher"
+    "crypto/rand"
+    "encoding/binary"
+    "fmt"
+    "hash/crc32"
+    "io"
+    "io/ioutil"
+    "log"
+    "os"
+    "sync"
+)
+
+// Each data file gets a random data key, stored in a sidecar .key file
+// wrapped by a master key of the KeyProvider. Record keys and values, and
+// the keys in hint files, are sealed with AES-GCM under the data key.
+// Rotating the master key only rewraps the .key files.
+
+var (
+    ErrNoCipher = fmt.Errorf("data is encrypted but no key is available")
+    ErrKeyFileCorrupted = fmt.Errorf("key file corrupted")
+)
+
+const (
+    DATA_KEY_SIZE = 32
+    GCM_NONCE_SIZE = 12
+    GCM_TAG_SIZE = 16
+    CIPHER_OVERHEAD = GCM_NONCE_SIZE + GCM_TAG_SIZE
+    // masterKeyId(4) + nonce + wrapped data key + crc(4)
+    KEY_FILE_SIZE = 4 + GCM_NONCE_SIZE + DATA_KEY_SIZE + GCM_TAG_SIZE + 4
+)
+
+type KeyProvider interface {
+    // id of the master key that wraps new data keys
+    CurrentKeyId() uint32
+    // master key (16, 24 or 32 bytes) by id, old ids must stay available
+    // until RotateEncryptionKey has rewrapped the files using them
+    MasterKey(id uint32) ([]byte, error)
+}
+
+type StaticKeyProvider struct {
+    mu          sync.RWMutex
+    current     uint32
+    keys        map[uint32][]byte
+}
+
+func NewStaticKeyProvider(id uint32, key []byte) *StaticKeyProvider {
+    kp := &StaticKeyProvider{
+        keys: make(map[uint32][]byte),
+    }
+    kp.AddKey(id, key)
+    kp.current = id
+    return kp
+}
+
+// add a master key, and make it current
+func (kp *StaticKeyProvider) AddKey(id uint32, key []byte) {
+    kp.mu.Lock()
+    defer kp.mu.Unlock()
+    kp.keys[id] = append([]byte(nil), key...)
+    kp.current = id
+}
+
+func (kp *StaticKeyProvider) CurrentKeyId() uint32 {
+    kp.mu.RLock()
+    defer kp.mu.RUnlock()
+    return kp.current
+}
+
+func (kp *StaticKeyProvider) MasterKey(id uint32) ([]byte, error) {
+    kp.mu.RLock()
+    defer kp.mu.RUnlock()
+    key, ok := kp.keys[id]
+    if !ok {
+        return nil, fmt.Errorf("master key[%d] not found", id)
+    }
+    return key, nil
+}
+
+/////////////////////////////////
+type fileCipher struct {
+    aead    cipher.AEAD
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+    block, err := aes.NewCipher(key)
+    if err != nil {
+        return nil, err
+    }
+    return cipher.NewGCM(block)
+}
+
+func newFileCipher(dataKey []byte) (*fileCipher, error) {
+    aead, err := newGCM(dataKey)
+    if err != nil {
+        return nil, err
+    }
+    return &fileCipher{aead: aead}, nil
+}
+
+// returns nonce + ciphertext + tag
+func (fc *fileCipher) seal(plain []byte) ([]byte, error) {
+    out := make([]byte, GCM_NONCE_SIZE, GCM_NONCE_SIZE + len(plain) + GCM_TAG_SIZE)
+    if _, err := io.ReadFull(rand.Reader, out); err != nil {
+        return nil, err
+    }
+    return fc.aead.Seal(out, out, plain, nil), nil
+}
+
+func (fc *fileCipher) open(data []byte) ([]byte, error) {
+    if len(data) < CIPHER_OVERHEAD {
+        return nil, ErrRecordCorrupted
+    }
+    return fc.aead.Open(nil, data[:GCM_NONCE_SIZE], data[GCM_NONCE_SIZE:], nil)
+}
+
+/////////////////////////////////
+type keyStore struct {
+    mu          sync.Mutex
+    provider    KeyProvider
+    pathFn      func(fileId int64) string
+    ciphers     map[int64]*fileCipher
+}
+
+func newKeyStore(provider KeyProvider, pathFn func(fileId int64) string) *keyStore {
+    return &keyStore{
+        provider: provider,
+        pathFn: pathFn,
+        ciphers: make(map[int64]*fileCipher),
+    }
+}
+
+// cipher of data-file[fileId], a new data key is made if create is set,
+// otherwise a file without key is a plaintext file and nil is returned
+func (ks *keyStore) get(fileId int64, create bool) (*fileCipher, error) {
+    ks.mu.Lock()
+    defer ks.mu.Unlock()
+    if fc, ok := ks.ciphers[fileId]; ok {
+        return fc, nil
+    }
+
+    path := ks.pathFn(fileId)
+    _, dataKey, err := ks.readKeyFile(path)
+    if os.IsNotExist(err) {
+        if !create {
+            return nil, nil
+        }
+        dataKey = make([]byte, DATA_KEY_SIZE)
+        if _, err := io.ReadFull(rand.Reader, dataKey); err != nil {
+            return nil, err
+        }
+        err = ks.writeKeyFile(path, dataKey)
+    }
+    if err != nil {
+        log.Printf("load data key of file[%d] failed, err = %s", fileId, err)
+        return nil, err
+    }
+
+    fc, err := newFileCipher(dataKey)
+    if err != nil {
+        return nil, err
+    }
+    ks.ciphers[fileId] = fc
+    return fc, nil
+}
+
+func (ks *keyStore) remove(fileId int64) error {
+    ks.mu.Lock()
+    delete(ks.ciphers, fileId)
+    ks.mu.Unlock()
+    if err := os.Remove(ks.pathFn(fileId)); err != nil && !os.IsNotExist(err) {
+        return err
+    }
+    return nil
+}
+
+// rewrap the data key of file with the current master key
+func (ks *keyStore) rewrap(fileId int64) error {
+    ks.mu.Lock()
+    defer ks.mu.Unlock()
+    path := ks.pathFn(fileId)
+    keyId, dataKey, err := ks.readKeyFile(path)
+    if os.IsNotExist(err) {
+        // removed by merge meanwhile
+        return nil
+    }
+    if err != nil {
+        return err
+    }
+    if keyId == ks.provider.CurrentKeyId() {
+        return nil
+    }
+    return ks.writeKeyFile(path, dataKey)
+}
+
+func (ks *keyStore) readKeyFile(path string) (uint32, []byte, error) {
+    data, err := ioutil.ReadFile(path)
+    if err != nil {
+        return 0, nil, err
+    }
+    return ks.unwrapKey(data)
+}
+
+// decode a key file, returns the master key id and the data key
+func (ks *keyStore) unwrapKey(data []byte) (uint32, []byte, error) {
+    if len(data) != KEY_FILE_SIZE {
+        return 0, nil, ErrKeyFileCorrupted
+    }
+    body := data[:KEY_FILE_SIZE - 4]
+    if crc32.ChecksumIEEE(body) != binary.LittleEndian.Uint32(data[KEY_FILE_SIZE - 4:]) {
+        return 0, nil, ErrKeyFileCorrupted
+    }
+
+    keyId := binary.LittleEndian.Uint32(body[0:4])
+    master, err := ks.provider.MasterKey(keyId)
+    if err != nil {
+        return 0, nil, err
+    }
+    aead, err := newGCM(master)
+    if err != nil {
+        return 0, nil, err
+    }
+    nonce := body[4:4 + GCM_NONCE_SIZE]
+    dataKey, err := aead.Open(nil, nonce, body[4 + GCM_NONCE_SIZE:], nil)
+    if err != nil {
+        return 0, nil, err
+    }
+    return keyId, dataKey, nil
+}
+
+func (ks *keyStore) writeKeyFile(path string, dataKey []byte) error {
+    keyId := ks.provider.CurrentKeyId()
+    master, err := ks.provider.MasterKey(keyId)
+    if err != nil {
+        return err
+    }
+    aead, err := newGCM(master)
+    if err != nil {
+        return err
+    }
+
+    data := make([]byte, 4 + GCM_NONCE_SIZE, KEY_FILE_SIZE)
+    binary.LittleEndian.PutUint32(data[0:4], keyId)
+    if _, err := io.ReadFull(rand.Reader, data[4:]); err != nil {
+        return err
+    }
+    data = aead.Seal(data, data[4:], dataKey, nil)
+    crc := make([]byte, 4)
+    binary.LittleEndian.PutUint32(crc, crc32.ChecksumIEEE(data))
+    data = append(data, crc...)
+    return writeKeyFileData(path, data)
+}
+
+// write key file via a tmp file, so a crash leaves either the old or the new one
+func writeKeyFileData(path string, data []byte) error {
+    tmpPath := path + ".tmp"
+    f, err := os.OpenFile(tmpPath, os.O_WRONLY | os.O_CREATE | os.O_TRUNC, 0600)
+    if err != nil {
+        return err
+    }
+    if _, err := f.Write(data); err != nil {
+        f.Close()
+        return err
+    }
+    if err := f.Sync(); err != nil {
+        f.Close()
+        return err
+    }
+    f.Close()
+    return os.Rename(tmpPath, path)
+}
+
+// install a key file copied from another db, i.e. a replication master.
+// a different data key already in place is replaced only if replace is set.
+// returns whether the data key changed
+func (ks *keyStore) install(fileId int64, data []byte, replace bool) (bool, error) {
+    _, dataKey, err := ks.unwrapKey(data)
+    if err != nil {
+        return false, err
+    }
+    ks.mu.Lock()
+    defer ks.mu.Unlock()
+    path := ks.pathFn(fileId)
+    _, cur, err := ks.readKeyFile(path)
+    if err == nil && bytes.Equal(cur, dataKey) {
+        return false, nil
+    }
+    if err != nil && !os.IsNotExist(err) {
+        return false, err
+    }
+    if err == nil && !replace {
+        log.Printf("data key of file[%d] differs from the installed one", fileId)
+        return false, ErrInvalid
+    }
+    if err := writeKeyFileData(path, data); err != nil {
+        return false, err
+    }
+    delete(ks.ciphers, fileId)
+    return true, nil
+}
+
+/////////////////////////////////
+// cipher of data-file[fileId], nil if encryption is disabled or the file has no key
+func (bc *BitCask) getFileCipher(fileId int64) (*fileCipher, error) {
+    if bc.keys == nil {
+        return nil, nil
+    }
+    return bc.keys.get(fileId, false)
+}
+
+// cipher for writing data-file[fileId], makes a data key if needed
+func (bc *BitCask) newFileCipher(fileId int64) (*fileCipher, error) {
+    if bc.keys == nil {
+        return nil, nil
+    }
+    return bc.keys.get(fileId, !bc.opts.readOnly)
+}
+
+func (bc *BitCask) removeKeyFile(fileId int64) error {
+    if bc.keys == nil {
+        return nil
+    }
+    return bc.keys.remove(fileId)
+}
+
+// install the key file of data-file[fileId] from a replication master.
+// the key of the active file can still change while it has no records
+// requires bc.mu held
+func (bc *BitCask) installKeyFile(fileId int64, data []byte) error {
+    if bc.keys == nil {
+        return ErrNoCipher
+    }
+    af := bc.activeFile
+    emptyActive := af != nil && af.id == fileId && af.Size() == 0
+    changed, err := bc.keys.install(fileId, data, emptyActive)
+    if err != nil {
+        return err
+    }
+    if changed && emptyActive {
+        // reopen it with the new key
+        return bc.resetActiveFile(fileId)
+    }
+    return nil
+}
+
+// RotateEncryptionKey rewraps the data keys of all files with the
+// current master key of the provider, the data files are not rewritten.
+func (bc *BitCask) RotateEncryptionKey() error {
+    if bc.keys == nil {
+        return ErrNoCipher
+    }
+    if bc.opts.readOnly {
+        return ErrReadOnly
+    }
+    files, err := ioutil.ReadDir(bc.dir)
+    if err != nil {
+        return err
+    }
+    for _, file := range files {
+        fileId, err := getIdFromKeyPath(file.Name())
+        if err != nil {
+            continue
+        }
+        if err := bc.keys.rewrap(fileId); err != nil {
+            log.Printf("rewrap data key of file[%d] failed, err = %s", fileId, err)
+            return err
+        }
+    }
+    return syncDir(bc.dir)
+}
@@ -0,0 +1,106 @@
+package bitcask
+
+import (
+    "bytes"
+    "fmt"
+    "io/ioutil"
+    . "gopkg.in/check.v1"
+)
+
+type testEncryptSuite struct {
+    path string
+}
+
+var _ = Suite(&testEncryptSuite{})
+
+func (s *testEncryptSuite) SetUpTest(c *C) {
+    s.path = c.MkDir()
+}
+
+func (s *testEncryptSuite) open(c *C, kp KeyProvider) *BitCask {
+    opts := NewOptions()
+    opts.SetMaxFileSize(4096)
+    opts.SetCompression(COMPRESS_SNAPPY)
+    if kp != nil {
+        opts.SetEncryption(kp)
+    }
+    bc, err := Open(s.path, opts)
+    c.Assert(err, IsNil)
+    return bc
+}
+
+func (s *testEncryptSuite) check(c *C, bc *BitCask) {
+    for i := 0; i < 100; i++ {
+        val, err := bc.Get([]byte(fmt.Sprintf("secret-key-%03d", i)))
+        c.Assert(err, IsNil)
+        c.Assert(string(val), Equals, fmt.Sprintf("secret-value-%03d", i))
+    }
+}
+
+// no file in the db dir contains the plaintext
+func (s *testEncryptSuite) checkNoPlaintext(c *C) {
+    files, err := ioutil.ReadDir(s.path)
+    c.Assert(err, IsNil)
+    for _, file := range files {
+        if file.IsDir() {
+            continue
+        }
+        data, err := ioutil.ReadFile(s.path + "/" + file.Name())
+        c.Assert(err, IsNil)
+        c.Assert(bytes.Contains(data, []byte("secret")), Equals, false, Commentf("file %s", file.Name()))
+    }
+}
+
+func (s *testEncryptSuite) TestEncrypt(c *C) {
+    kp := NewStaticKeyProvider(1, bytes.Repeat([]byte{1}, 32))
+    bc := s.open(c, kp)
+    for i := 0; i < 100; i++ {
+        key := []byte(fmt.Sprintf("secret-key-%03d", i))
+        c.Assert(bc.Set(key, []byte(fmt.Sprintf("secret-value-%03d", i))), IsNil)
+    }
+    s.check(c, bc)
+    c.Assert(len(bc.GetFileMetas()) > 0, Equals, true)
+    bc.Close()
+    s.checkNoPlaintext(c)
+
+    // reopen from hint files and data file, then merge
+    bc = s.open(c, kp)
+    s.check(c, bc)
+    c.Assert(bc.runMerge([]int64{0, 1}), IsNil)
+    s.check(c, bc)
+    bc.Close()
+    s.checkNoPlaintext(c)
+
+    bc = s.open(c, kp)
+    s.check(c, bc)
+    bc.Close()
+}
+
+func (s *testEncryptSuite) TestRotate(c *C) {
+    kp := NewStaticKeyProvider(1, bytes.Repeat([]byte{1}, 32))
+    bc := s.open(c, kp)
+    for i := 0; i < 100; i++ {
+        key := []byte(fmt.Sprintf("secret-key-%03d", i))
+        c.Assert(bc.Set(key, []byte(fmt.Sprintf("secret-value-%03d", i))), IsNil)
+    }
+    kp.AddKey(2, bytes.Repeat([]byte{2}, 32))
+    c.Assert(bc.RotateEncryptionKey(), IsNil)
+    bc.Close()
+
+    // the old master key is not needed anymore
+    bc = s.open(c, NewStaticKeyProvider(2, bytes.Repeat([]byte{2}, 32)))
+    s.check(c, bc)
+    bc.Close()
+
+    // a wrong master key or no encryption fails the open, and keeps the files
+    opts := NewOptions()
+    _, err := Open(s.path, opts)
+    c.Assert(err, NotNil)
+    opts.SetEncryption(NewStaticKeyProvider(1, bytes.Repeat([]byte{1}, 32)))
+    _, err = Open(s.path, opts)
+    c.Assert(err, NotNil)
+
+    bc = s.open(c, NewStaticKeyProvider(2, bytes.Repeat([]byte{2}, 32)))
+    s.check(c, bc)
+    bc.Close()
+}
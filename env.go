@@ -13,6 +13,7 @@ type Env interface {
     getOptions() *Options
     getRecordCache() *RecordCache
     getDataFileCache() *DataFileCache
+    getFileCipher(fileId int64) (*fileCipher, error)
 
     getActiveFile() *ActiveFile
     GetDataFilePath(fileId int64) string
@@ -44,6 +45,23 @@ func getIdFromDataPath(path string) (int64, error) {
     return id, err
 }
 
+func getIdFromKeyPath(path string) (int64, error) {
+    base := filepath.Base(path)
+    if filepath.Ext(base) != ".key" {
+        return 0, ErrInvalid
+    }
+    return strconv.ParseInt(strings.TrimSuffix(base, ".key"), 10, 64)
+}
+
+// data file removed while pinned by snapshots
+func getObsoletePath(dataPath string) string {
+    return dataPath + ".obsolete"
+}
+
+func isObsoletePath(path string) bool {
+    return strings.HasSuffix(path, ".data.obsolete")
+}
+
 func (bc *BitCask) getOptions() *Options {
     return bc.opts
 }
@@ -60,6 +78,22 @@ func (bc *BitCask) GetDataFilePath(id int64) string {
 func (bc *BitCask) getHintFilePath(id int64) string {
     return bc.dir + "/" + getBaseFromId(id) + ".hint"
 }
+func (bc *BitCask) getKeyFilePath(id int64) string {
+    return bc.dir + "/" + getBaseFromId(id) + ".key"
+}
+func (bc *BitCask) getMergeDir() string {
+    return bc.dir + "/" + MERGE_DIR
+}
+func (bc *BitCask) getMergeDataFilePath(id int64) string {
+    return bc.getMergeDir() + "/" + getBaseFromId(id) + ".data"
+}
+func (bc *BitCask) getMergeHintFilePath(id int64) string {
+    return bc.getMergeDir() + "/" + getBaseFromId(id) + ".hint"
+}
+// data file being received from a replication master
+func (bc *BitCask) getReplDataFilePath(id int64) string {
+    return bc.GetDataFilePath(id) + ".repl"
+}
 func (bc *BitCask) GetMinDataFileId() int64 {
     return bc.minDataFileId
 }
@@ -75,7 +109,11 @@ func (bc *BitCask) NextDataFileId(fileId int64) int64 {
     return fileId
 }
 
+// in read-only mode it's the last data file
 func (bc *BitCask) ActiveFileId() int64 {
+    if bc.activeFile == nil {
+        return bc.maxDataFileId
+    }
     return bc.activeFile.id
 }
 
@@ -87,8 +125,12 @@ func (bc *BitCask) refDataFile(fileId int64) (*DataFile, error) {
     if bc.dfCache != nil {
         return bc.dfCache.Ref(fileId)
     } else {
+        fc, err := bc.getFileCipher(fileId)
+        if err != nil {
+            return nil, err
+        }
         path := bc.GetDataFilePath(fileId)
-        df, err := NewDataFile(path, fileId)
+        df, err := NewDataFile(path, fileId, fc, bc.opts.mmap)
         if err != nil {
             return nil, err
         }
@@ -102,12 +144,37 @@ func (bc *BitCask) unrefDataFile(fileId int64) {
 }
 
 func (bc *BitCask) RefRecord(fileId int64, offset int64) (*Record, error) {
-    bc.mu.Lock()
-    defer bc.mu.Unlock()
+    bc.mu.RLock()
+    defer bc.mu.RUnlock()
     return bc.refRecord(fileId, offset)
 }
 
+// records of fileId are read in place from the mapping of the file,
+// requires bc.mu held
+func (bc *BitCask) isMapped(fileId int64) bool {
+    if !bc.opts.mmap || !mmapSupported || bc.dfCache == nil {
+        return false
+    }
+    return bc.activeFile == nil || bc.activeFile.id != fileId
+}
+
+// requires bc.mu held, a read lock is enough: the caches lock themselves
+// and closed data files are read with pread or through a read-only mapping.
+// A record of a mapped file is borrowed, the file is refed instead of the
+// record being cached, until the record is unrefed.
 func (bc *BitCask) refRecord(fileId int64, offset int64) (*Record, error) {
+    if bc.isMapped(fileId) {
+        df, err := bc.refDataFile(fileId)
+        if err != nil {
+            return nil, err
+        }
+        rec, err := parseRecordAt(df, offset, df.fc)
+        if err != nil {
+            bc.unrefDataFile(fileId)
+            return nil, err
+        }
+        return rec, nil
+    }
     if bc.recCache != nil {
         return bc.recCache.Ref(fileId, offset)
     } else {
@@ -115,7 +182,7 @@ func (bc *BitCask) refRecord(fileId int64, offset int64) (*Record, error) {
         if err != nil {
             return nil, err
         }
-        rec, err := parseRecordAt(df, offset)
+        rec, err := parseRecordAt(df, offset, df.fc)
         if err != nil {
             return nil, err
         }
@@ -124,12 +191,16 @@ func (bc *BitCask) refRecord(fileId int64, offset int64) (*Record, error) {
 }
 
 func (bc *BitCask) UnrefRecord(fileId int64, offset int64) {
-    bc.mu.Lock()
-    defer bc.mu.Unlock()
+    bc.mu.RLock()
+    defer bc.mu.RUnlock()
     bc.unrefRecord(fileId, offset)
 }
 
 func (bc *BitCask) unrefRecord(fileId int64, offset int64) {
+    if bc.isMapped(fileId) {
+        bc.unrefDataFile(fileId)
+        return
+    }
     if bc.recCache != nil {
         bc.recCache.Unref(fileId, offset)
     }
@@ -21,10 +21,12 @@ type FileWithBuffer struct {
     n           int         // bytes buffered in wbuf
 }
 
-func NewFileWithBuffer(path string, create bool, wbufSize int64) (*FileWithBuffer, error) {
-    flags := os.O_RDWR | os.O_APPEND
-    if create {
-        flags |= os.O_CREATE
+// a writable file is created if it doesn't exist, otherwise it's opened
+// read-only, so files are only read in read-only directories
+func NewFileWithBuffer(path string, writable bool, wbufSize int64) (*FileWithBuffer, error) {
+    flags := os.O_RDONLY
+    if writable {
+        flags = os.O_RDWR | os.O_APPEND | os.O_CREATE
     }
     f, err := os.OpenFile(path, flags, 0644)
     if err != nil {
@@ -128,6 +130,12 @@ func (f *FileWithBuffer) Sync() error {
     return f.f.Sync()
 }
 
+// fsync data already flushed to the os, the write buffer is not touched
+// so it can be called concurrently with writes.
+func (f *FileWithBuffer) SyncFlushed() error {
+    return f.f.Sync()
+}
+
 func (f *FileWithBuffer) Close() error {
     f.Flush()
     return f.f.Close()
@@ -137,3 +145,79 @@ func (f *FileWithBuffer) Path() string {
     return f.path
 }
 
+///////////////////////////////////
+
+// MmapFile reads a closed file through a read-only mapping of it
+type MmapFile struct {
+    path        string
+    data        []byte      // nil if the file is empty
+}
+
+func NewMmapFile(path string) (*MmapFile, error) {
+    f, err := os.Open(path)
+    if err != nil {
+        return nil, err
+    }
+    // the mapping stays valid after the file is closed
+    defer f.Close()
+    fi, err := f.Stat()
+    if err != nil {
+        return nil, err
+    }
+    mf := &MmapFile{path: path}
+    // an empty file can't be mapped
+    if fi.Size() > 0 {
+        if mf.data, err = mmap(f, fi.Size()); err != nil {
+            return nil, err
+        }
+    }
+    return mf, nil
+}
+
+func (f *MmapFile) ReadAt(data []byte, offset int64) (int, error) {
+    if offset >= int64(len(f.data)) {
+        return 0, io.EOF
+    }
+    n := copy(data, f.data[offset:])
+    if n < len(data) {
+        return n, io.EOF
+    }
+    return n, nil
+}
+
+// slice returns n bytes at offset without copying, they are valid until the
+// file is closed and must not be written
+func (f *MmapFile) slice(offset int64, n int64) ([]byte, error) {
+    if n < 0 || offset + n > int64(len(f.data)) {
+        return nil, io.EOF
+    }
+    // appends to it must not write to the mapping
+    return f.data[offset:offset + n:offset + n], nil
+}
+
+func (f *MmapFile) Size() int64 {
+    return int64(len(f.data))
+}
+
+func (f *MmapFile) Close() error {
+    if f.data == nil {
+        return nil
+    }
+    data := f.data
+    f.data = nil
+    return munmap(data)
+}
+
+func (f *MmapFile) Path() string {
+    return f.path
+}
+
+// fsync a directory, so new files and renames in it are durable
+func syncDir(dir string) error {
+    d, err := os.Open(dir)
+    if err != nil {
+        return err
+    }
+    defer d.Close()
+    return d.Sync()
+}
@@ -36,7 +36,8 @@ func TestFileSimple(t *testing.T) {
         t.Error("write bytes failed")
     }
 
-    data, err := f.ReadAt(3, 5)
+    data := make([]byte, 5)
+    _, err = f.ReadAt(data, 3)
     if err != nil {
         t.Error("read failed")
     }
@@ -44,7 +45,8 @@ func TestFileSimple(t *testing.T) {
         t.Error("content invalid")
     }
 
-    data, err = f.ReadAt(12, 11)
+    data = make([]byte, 11)
+    _, err = f.ReadAt(data, 12)
     if err != nil {
         t.Error("read failed")
     }
@@ -52,11 +54,12 @@ func TestFileSimple(t *testing.T) {
         t.Error("content invalid")
     }
 
-    data, err = f.ReadAt(12, 100)
+    data = make([]byte, 100)
+    n, err := f.ReadAt(data, 12)
     if err != io.EOF {
         t.Error("read failed")
     }
-    if (string(data) != "hello world bbbbb") {
+    if (string(data[:n]) != "hello world bbbbb") {
         t.Error("content invalid")
     }
 
@@ -89,7 +92,8 @@ func TestFileLargeBuffer(t *testing.T) {
         t.Error(err)
     }
 
-    data, err := f.ReadAt(0, 9)
+    data := make([]byte, 9)
+    _, err = f.ReadAt(data, 0)
     if err != nil {
         t.Error(err)
     }
@@ -97,7 +101,8 @@ func TestFileLargeBuffer(t *testing.T) {
         t.Errorf("content[%s] invalid\n", string(data))
     }
 
-    data, err = f.ReadAt(12, 3)
+    data = make([]byte, 3)
+    _, err = f.ReadAt(data, 12)
     if err != nil {
         t.Error(err)
     }
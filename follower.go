@@ -0,0 +1,460 @@
+package bitcask
+
+import (
+    "bytes"
+    "io"
+    "log"
+    "net"
+    "os"
+    "sort"
+    "sync"
+    "time"
+)
+
+// ReplicationFollower keeps a db in sync with a master serving a
+// ReplicationSource. On connect the master sends its closed data files
+// with their md5, the follower truncates itself at the first file that
+// differs, then applies the stream from its own position. The follower db
+// must not be written otherwise, and should not run merges or expire sweeps.
+
+const (
+    REPL_RETRY_INTERVAL = time.Second
+)
+
+type ReplicationFollower struct {
+    bc              *BitCask
+    addr            string
+    mu              sync.Mutex
+    conn            net.Conn
+    connected       bool
+    lagBytes        int64
+    lagRecords      int64
+    retryInterval   time.Duration
+    closeCh         chan struct{}
+    closed          bool
+    wg              sync.WaitGroup
+
+    // whole data file being received, i.e. a merge output
+    recvFile        *os.File
+    recvFileId      int64
+}
+
+func NewReplicationFollower(bc *BitCask, addr string) *ReplicationFollower {
+    return &ReplicationFollower{
+        bc: bc,
+        addr: addr,
+        retryInterval: REPL_RETRY_INTERVAL,
+        closeCh: make(chan struct{}),
+        recvFileId: -1,
+    }
+}
+
+func (rf *ReplicationFollower) SetRetryInterval(d time.Duration) {
+    rf.retryInterval = d
+}
+
+// Start follows the master in the background, reconnecting on errors until Close.
+func (rf *ReplicationFollower) Start() {
+    rf.wg.Add(1)
+    go rf.run()
+}
+
+func (rf *ReplicationFollower) Close() {
+    rf.mu.Lock()
+    if !rf.closed {
+        rf.closed = true
+        close(rf.closeCh)
+        if rf.conn != nil {
+            rf.conn.Close()
+        }
+    }
+    rf.mu.Unlock()
+    rf.wg.Wait()
+}
+
+// Lag returns how many bytes and records the master has written that are
+// not applied yet, as of the last frame received.
+func (rf *ReplicationFollower) Lag() (int64, int64) {
+    rf.mu.Lock()
+    defer rf.mu.Unlock()
+    return rf.lagBytes, rf.lagRecords
+}
+
+// Connected tells whether the follower is streaming from the master.
+func (rf *ReplicationFollower) Connected() bool {
+    rf.mu.Lock()
+    defer rf.mu.Unlock()
+    return rf.connected
+}
+
+// Position returns the end of the active file of the follower db.
+func (rf *ReplicationFollower) Position() ReplPosition {
+    return rf.bc.replPosition()
+}
+
+func (rf *ReplicationFollower) run() {
+    defer rf.wg.Done()
+    for {
+        conn, err := net.Dial("tcp", rf.addr)
+        if err == nil {
+            rf.mu.Lock()
+            if rf.closed {
+                rf.mu.Unlock()
+                conn.Close()
+                return
+            }
+            rf.conn = conn
+            rf.mu.Unlock()
+
+            err = rf.Follow(conn)
+            conn.Close()
+            rf.mu.Lock()
+            rf.conn = nil
+            rf.mu.Unlock()
+        }
+
+        select {
+        case <-rf.closeCh:
+            return
+        default:
+        }
+        log.Printf("follow master[%s] failed, retry in %s, err = %s", rf.addr, rf.retryInterval, err)
+        timer := time.NewTimer(rf.retryInterval)
+        select {
+        case <-rf.closeCh:
+            timer.Stop()
+            return
+        case <-timer.C:
+        }
+    }
+}
+
+// Follow resyncs with the master on rw, then applies the stream until rw fails.
+func (rf *ReplicationFollower) Follow(rw io.ReadWriter) error {
+    defer rf.abortRecvFile()
+    defer func() {
+        rf.mu.Lock()
+        rf.connected = false
+        rf.mu.Unlock()
+    }()
+
+    infos, head, err := readReplHandshake(rw)
+    if err != nil {
+        return err
+    }
+    from, err := rf.resync(infos, head)
+    if err != nil {
+        return err
+    }
+    log.Printf("follow master[%s] from %d:%d, master head at %d:%d", rf.addr, from.FileId, from.Offset, head.FileId, head.Offset)
+    if _, err := rw.Write(from.Encode()); err != nil {
+        return err
+    }
+    rf.mu.Lock()
+    rf.connected = true
+    rf.mu.Unlock()
+
+    for {
+        f, err := ReadReplFrame(rw)
+        if err != nil {
+            return err
+        }
+        if err := rf.apply(f); err != nil {
+            log.Printf("apply frame of data-file[%d] at %d failed, err = %s", f.FileId, f.Offset, err)
+            return err
+        }
+        rf.mu.Lock()
+        rf.lagBytes = f.PendingBytes
+        rf.lagRecords = f.PendingRecords
+        rf.mu.Unlock()
+        if f.Type != REPL_FRAME_FILE {
+            if _, err := rw.Write(rf.Position().Encode()); err != nil {
+                return err
+            }
+        }
+    }
+}
+
+// truncate the db at the first data file that differs from the master,
+// returns the position to stream from
+func (rf *ReplicationFollower) resync(infos []*ReplFileInfo, head ReplPosition) (ReplPosition, error) {
+    bc := rf.bc
+    master := make(map[int64]*ReplFileInfo)
+    for _, info := range infos {
+        master[info.FileId] = info
+    }
+
+    local, pos, err := bc.replFileInfos()
+    if err != nil {
+        return pos, err
+    }
+    have := make(map[int64]bool)
+    var truncateAt int64 = -1
+    mismatch := func(fileId int64) {
+        if truncateAt < 0 || fileId < truncateAt {
+            truncateAt = fileId
+        }
+    }
+    for _, info := range local {
+        have[info.FileId] = true
+        if m, ok := master[info.FileId]; !ok || !bytes.Equal(m.Md5, info.Md5) {
+            mismatch(info.FileId)
+        }
+    }
+    // a master file below our position we don't have, i.e. a merge output
+    for _, info := range infos {
+        if info.FileId < pos.FileId && !have[info.FileId] {
+            mismatch(info.FileId)
+        }
+    }
+    // the active file must be a prefix of the master's
+    if m, ok := master[pos.FileId]; ok {
+        if pos.Offset > m.Size {
+            mismatch(pos.FileId)
+        }
+    } else if pos.FileId == head.FileId {
+        if pos.Offset > head.Offset {
+            mismatch(pos.FileId)
+        }
+    } else if pos.Offset > 0 || len(local) > 0 {
+        mismatch(pos.FileId)
+    }
+
+    if truncateAt >= 0 {
+        log.Printf("data-file[%d] differs from the master, truncate", truncateAt)
+        if err := bc.Truncate(truncateAt); err != nil {
+            return pos, err
+        }
+        if local, pos, err = bc.replFileInfos(); err != nil {
+            return pos, err
+        }
+    }
+
+    // an empty db starts at the first file of the master
+    _, onMaster := master[pos.FileId]
+    if len(local) == 0 && pos.Offset == 0 && !onMaster && pos.FileId != head.FileId {
+        first := head.FileId
+        if len(infos) > 0 {
+            first = infos[0].FileId
+        }
+        bc.mu.Lock()
+        err := bc.resetActiveFile(first)
+        bc.mu.Unlock()
+        if err != nil {
+            return pos, err
+        }
+        pos = ReplPosition{first, 0}
+    }
+    return pos, nil
+}
+
+func (rf *ReplicationFollower) apply(f *ReplFrame) error {
+    bc := rf.bc
+    switch f.Type {
+    case REPL_FRAME_RECORDS:
+        return bc.SyncFile(f.FileId, f.Offset, int64(len(f.Data)), f.Data)
+    case REPL_FRAME_KEY:
+        bc.mu.Lock()
+        defer bc.mu.Unlock()
+        return bc.installKeyFile(f.FileId, f.Data)
+    case REPL_FRAME_FILE:
+        return rf.recvFileChunk(f)
+    case REPL_FRAME_FILE_END:
+        return rf.finishRecvFile(f)
+    }
+    return nil
+}
+
+func (rf *ReplicationFollower) recvFileChunk(f *ReplFrame) error {
+    bc := rf.bc
+    if f.Offset == 0 {
+        rf.abortRecvFile()
+        file, err := os.OpenFile(bc.getReplDataFilePath(f.FileId), os.O_WRONLY | os.O_CREATE | os.O_TRUNC, 0644)
+        if err != nil {
+            return err
+        }
+        rf.recvFile = file
+        rf.recvFileId = f.FileId
+    }
+    if rf.recvFile == nil || rf.recvFileId != f.FileId {
+        return ErrInvalid
+    }
+    if fi, err := rf.recvFile.Stat(); err != nil || fi.Size() != f.Offset {
+        return ErrInvalid
+    }
+    _, err := rf.recvFile.Write(f.Data)
+    return err
+}
+
+func (rf *ReplicationFollower) finishRecvFile(f *ReplFrame) error {
+    bc := rf.bc
+    if f.Offset == 0 && rf.recvFile == nil {
+        // an empty file has no chunks
+        file, err := os.OpenFile(bc.getReplDataFilePath(f.FileId), os.O_WRONLY | os.O_CREATE | os.O_TRUNC, 0644)
+        if err != nil {
+            return err
+        }
+        rf.recvFile = file
+        rf.recvFileId = f.FileId
+    }
+    if rf.recvFile == nil || rf.recvFileId != f.FileId {
+        return ErrInvalid
+    }
+    file := rf.recvFile
+    rf.recvFile = nil
+    rf.recvFileId = -1
+    if err := file.Sync(); err != nil {
+        file.Close()
+        return err
+    }
+    file.Close()
+
+    path := bc.getReplDataFilePath(f.FileId)
+    md5, err := fileMd5(path)
+    if err != nil {
+        return err
+    }
+    if !bytes.Equal(md5, f.Data) {
+        log.Printf("md5 of received data-file[%d] mismatch", f.FileId)
+        os.Remove(path)
+        return ErrRecordCorrupted
+    }
+
+    bc.mu.Lock()
+    defer bc.mu.Unlock()
+    return bc.installDataFile(f.FileId, path, md5)
+}
+
+func (rf *ReplicationFollower) abortRecvFile() {
+    if rf.recvFile != nil {
+        rf.recvFile.Close()
+        os.Remove(rf.recvFile.Name())
+        rf.recvFile = nil
+        rf.recvFileId = -1
+    }
+}
+
+/////////////////////////////////
+func (bc *BitCask) replPosition() ReplPosition {
+    bc.mu.RLock()
+    defer bc.mu.RUnlock()
+    if bc.activeFile == nil {
+        return ReplPosition{bc.maxDataFileId, 0}
+    }
+    return ReplPosition{bc.activeFile.id, bc.activeFile.Size()}
+}
+
+// closed data files and the end of the active file
+func (bc *BitCask) replFileInfos() ([]*ReplFileInfo, ReplPosition, error) {
+    bc.mu.RLock()
+    defer bc.mu.RUnlock()
+    infos := make([]*ReplFileInfo, 0, len(bc.fileMetas))
+    for _, meta := range bc.fileMetas {
+        fi, err := os.Stat(bc.GetDataFilePath(meta.FileId))
+        if err != nil {
+            return nil, ReplPosition{}, err
+        }
+        infos = append(infos, &ReplFileInfo{meta.FileId, fi.Size(), meta.Md5})
+    }
+    head := ReplPosition{bc.maxDataFileId, 0}
+    if bc.activeFile != nil {
+        head = ReplPosition{bc.activeFile.id, bc.activeFile.Size()}
+    }
+    return infos, head, nil
+}
+
+// move the empty active file to fileId, requires bc.mu held
+func (bc *BitCask) resetActiveFile(fileId int64) error {
+    af := bc.activeFile
+    if af.Size() > 0 {
+        return ErrInvalid
+    }
+    af.Close()
+    if af.id != fileId {
+        if err := os.Remove(bc.GetDataFilePath(af.id)); err != nil && !os.IsNotExist(err) {
+            return err
+        }
+        if err := bc.removeKeyFile(af.id); err != nil {
+            return err
+        }
+        delete(bc.fileStats, af.id)
+    }
+
+    naf, err := bc.newActiveFile(fileId)
+    if err != nil {
+        return err
+    }
+    bc.activeFile = naf
+    bc.activeKD.Clear()
+    bc.maxDataFileId = fileId
+    if len(bc.fileMetas) == 0 {
+        bc.minDataFileId = fileId
+    }
+    log.Printf("reset activeFile to %d", fileId)
+    return nil
+}
+
+// move a whole data file received from the master in place, requires bc.mu held
+func (bc *BitCask) installDataFile(fileId int64, path string, md5 []byte) error {
+    if bc.hasDataFile(fileId) {
+        log.Printf("data-file[%d] exists, can't install it", fileId)
+        os.Remove(path)
+        return ErrInvalid
+    }
+    dataPath := bc.GetDataFilePath(fileId)
+    if err := os.Rename(path, dataPath); err != nil {
+        return err
+    }
+    kd, err := bc.restoreFromDataFile(dataPath, fileId)
+    if err != nil {
+        return err
+    }
+    sum, err := statDataFile(dataPath)
+    if err != nil {
+        return err
+    }
+    sum.md5 = md5
+    if err := bc.writeHintFile(bc.getHintFilePath(fileId), fileId, sum, kd); err != nil {
+        return err
+    }
+    bc.addFileMeta(fileId, md5)
+    sort.Slice(bc.fileMetas, func(i, j int) bool { return bc.fileMetas[i].FileId < bc.fileMetas[j].FileId })
+    bc.minDataFileId = bc.fileMetas[0].FileId
+    bc.fileStat(fileId).TotalBytes = sum.size
+    log.Printf("install data-file[%d] from master", fileId)
+    return nil
+}
+
+// remove a data file merged by the master, the live keys in it are in the
+// merge outputs already, so any key still pointing to it is dropped.
+// requires bc.mu held
+func (bc *BitCask) dropMergedFile(fileId int64) error {
+    keys := make([][]byte, 0)
+    err := bc.keyDir.ForEachMatch(func(di *DirItem) bool {
+        return di.fileId == fileId
+    }, func(key []byte, di *DirItem) error {
+        keys = append(keys, key)
+        return nil
+    })
+    if err != nil {
+        return err
+    }
+    for _, key := range keys {
+        bc.keyDir.Del(key)
+        bc.unindexKey(key)
+    }
+
+    metas := make([]*FileMeta, 0, len(bc.fileMetas))
+    for _, meta := range bc.fileMetas {
+        if meta.FileId != fileId {
+            metas = append(metas, meta)
+        }
+    }
+    bc.fileMetas = metas
+    if len(metas) > 0 {
+        bc.minDataFileId = metas[0].FileId
+    } else {
+        bc.minDataFileId = bc.activeFile.id
+    }
+    return bc.removeDataFile(fileId)
+}
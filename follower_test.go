@@ -0,0 +1,188 @@
+package bitcask
+
+import (
+    "fmt"
+    "net"
+    "time"
+    . "gopkg.in/check.v1"
+)
+
+type testFollowerSuite struct {
+    master      *BitCask
+    follower    *BitCask
+    rs          *ReplicationSource
+    addr        string
+}
+
+var _ = Suite(&testFollowerSuite{})
+
+func (s *testFollowerSuite) open(c *C, opts *Options) {
+    var err error
+    s.master, err = Open(c.MkDir(), opts)
+    c.Assert(err, IsNil)
+    s.follower, err = Open(c.MkDir(), opts)
+    c.Assert(err, IsNil)
+
+    s.rs = NewReplicationSource(s.master)
+    l, err := net.Listen("tcp", "127.0.0.1:0")
+    c.Assert(err, IsNil)
+    s.addr = l.Addr().String()
+    go s.rs.Serve(l)
+}
+
+func (s *testFollowerSuite) SetUpTest(c *C) {
+    opts := NewOptions()
+    opts.SetMaxFileSize(2048)
+    s.open(c, opts)
+}
+
+func (s *testFollowerSuite) TearDownTest(c *C) {
+    s.rs.Close()
+    s.master.Close()
+    s.follower.Close()
+}
+
+func (s *testFollowerSuite) write(c *C, from int, to int) {
+    for i := from; i < to; i++ {
+        c.Assert(s.master.Set([]byte(fmt.Sprintf("key%03d", i)), []byte(fmt.Sprintf("value%03d-%d", i, to))), IsNil)
+    }
+    c.Assert(s.master.Del([]byte(fmt.Sprintf("key%03d", from))), IsNil)
+}
+
+func (s *testFollowerSuite) follow(c *C) *ReplicationFollower {
+    rf := NewReplicationFollower(s.follower, s.addr)
+    rf.SetRetryInterval(10 * time.Millisecond)
+    rf.Start()
+    return rf
+}
+
+// wait until rf has applied everything of the master
+func (s *testFollowerSuite) waitSynced(c *C, rf *ReplicationFollower) {
+    deadline := time.Now().Add(5 * time.Second)
+    for time.Now().Before(deadline) {
+        lagBytes, lagRecords := rf.Lag()
+        if rf.Connected() && rf.Position() == s.master.replPosition() && lagBytes == 0 && lagRecords == 0 {
+            return
+        }
+        time.Sleep(5 * time.Millisecond)
+    }
+    c.Fatalf("follower at %v, master at %v", rf.Position(), s.master.replPosition())
+}
+
+func (s *testFollowerSuite) check(c *C, n int) {
+    for i := 0; i < n; i++ {
+        key := []byte(fmt.Sprintf("key%03d", i))
+        want, err1 := s.master.Get(key)
+        got, err2 := s.follower.Get(key)
+        c.Assert(err2, Equals, err1)
+        c.Assert(got, DeepEquals, want)
+    }
+    masterInfos, _, err := s.master.replFileInfos()
+    c.Assert(err, IsNil)
+    followerInfos, _, err := s.follower.replFileInfos()
+    c.Assert(err, IsNil)
+    c.Assert(followerInfos, DeepEquals, masterInfos)
+}
+
+func (s *testFollowerSuite) TestFollow(c *C) {
+    s.write(c, 0, 100)
+    rf := s.follow(c)
+    defer rf.Close()
+    s.waitSynced(c, rf)
+    s.check(c, 100)
+
+    // tail new writes, with a batch
+    s.write(c, 50, 150)
+    b := NewBatch()
+    b.Set([]byte("key000"), []byte("batch"))
+    b.Del([]byte("key001"))
+    c.Assert(s.master.Write(b), IsNil)
+    s.waitSynced(c, rf)
+    s.check(c, 150)
+
+    // reconnect from where it stopped
+    rf.Close()
+    s.write(c, 100, 200)
+    rf = s.follow(c)
+    defer rf.Close()
+    s.waitSynced(c, rf)
+    s.check(c, 200)
+}
+
+func (s *testFollowerSuite) TestDiverged(c *C) {
+    s.write(c, 0, 100)
+    // local writes the master doesn't have
+    for i := 0; i < 80; i++ {
+        c.Assert(s.follower.Set([]byte(fmt.Sprintf("key%03d", i)), []byte("local")), IsNil)
+    }
+    c.Assert(s.follower.Set([]byte("local"), []byte("local")), IsNil)
+
+    rf := s.follow(c)
+    defer rf.Close()
+    s.waitSynced(c, rf)
+    s.check(c, 100)
+    _, err := s.follower.Get([]byte("local"))
+    c.Assert(err, Equals, ErrKeyNotFound)
+}
+
+func (s *testFollowerSuite) TestMergeOffline(c *C) {
+    s.write(c, 0, 200)
+    rf := s.follow(c)
+    s.waitSynced(c, rf)
+    rf.Close()
+
+    s.write(c, 0, 100)
+    inputs := make([]int64, 0)
+    for _, meta := range s.master.GetFileMetas() {
+        inputs = append(inputs, meta.FileId)
+    }
+    c.Assert(s.master.runMerge(inputs), IsNil)
+    s.write(c, 150, 250)
+
+    rf = s.follow(c)
+    defer rf.Close()
+    s.waitSynced(c, rf)
+    s.check(c, 250)
+}
+
+func (s *testFollowerSuite) TestMergeOnline(c *C) {
+    s.write(c, 0, 200)
+    rf := s.follow(c)
+    defer rf.Close()
+    s.waitSynced(c, rf)
+
+    for round := 0; round < 3; round++ {
+        s.write(c, 0, 100)
+        inputs := make([]int64, 0)
+        for _, meta := range s.master.GetFileMetas() {
+            inputs = append(inputs, meta.FileId)
+        }
+        c.Assert(s.master.runMerge(inputs), IsNil)
+        s.write(c, 100, 200)
+        s.waitSynced(c, rf)
+        s.check(c, 200)
+    }
+}
+
+func (s *testFollowerSuite) TestEncrypted(c *C) {
+    s.TearDownTest(c)
+    opts := NewOptions()
+    opts.SetMaxFileSize(2048)
+    opts.SetEncryption(NewStaticKeyProvider(1, make([]byte, 32)))
+    s.open(c, opts)
+
+    s.write(c, 0, 200)
+    rf := s.follow(c)
+    defer rf.Close()
+    s.waitSynced(c, rf)
+    s.check(c, 200)
+
+    inputs := make([]int64, 0)
+    for _, meta := range s.master.GetFileMetas() {
+        inputs = append(inputs, meta.FileId)
+    }
+    c.Assert(s.master.runMerge(inputs), IsNil)
+    s.write(c, 100, 200)
+    s.waitSynced(c, rf)
+    s.check(c, 200)
+}
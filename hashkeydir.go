@@ -0,0 +1,315 @@
+package bitcask
+
+import (
+    "bytes"
+    "sort"
+    "github.com/rocket323/bitcask/btree"
+)
+
+// hashTable is the KeyDir of KEYDIR_HASH mode. It keeps only the 64-bit hash
+// of each key, in w0 of the slots, the other words are packed as in the
+// compact table. A key is told from another key of the same hash by reading
+// the key of the record its slot points to. The other key goes to the
+// overflow tree, which keeps keys as the btree KeyDir does.
+//
+// A key is either in the slot of its hash or in the overflow tree, so keys
+// in the overflow tree are found without reading any record.
+
+// reads the key of the record di points to
+type keyReader func(di *DirItem) ([]byte, error)
+
+type hashTable struct {
+    slotPages
+    overflow    *btree.BTree
+    readKey     keyReader
+    hash        func(key []byte) uint64
+}
+
+func newHashTable(readKey keyReader) *hashTable {
+    return &hashTable{
+        slotPages: newSlotPages(COMPACT_MIN_SLOTS, &compactOwner{}),
+        overflow: btree.New(KEYDIR_BTREE_DEGREE),
+        readKey: readKey,
+        hash: keyHash,
+    }
+}
+
+// findHash returns the slot of hash h, or the slot to put it to if there's none
+func (t *hashTable) findHash(h uint64) (uint64, bool) {
+    var free uint64
+    hasFree := false
+    for i := h & t.mask; ; i = (i + 1) & t.mask {
+        s := t.slot(i)
+        switch slotState(s) {
+        case SLOT_EMPTY:
+            if !hasFree {
+                free = i
+            }
+            return free, false
+        case SLOT_DELETED:
+            if !hasFree {
+                free, hasFree = i, true
+            }
+        default:
+            if s[0] == h {
+                return i, true
+            }
+        }
+    }
+}
+
+func (t *hashTable) isKeyOf(s []uint64, key []byte) (bool, error) {
+    stored, err := t.readKey(unpackSlot(s))
+    if err != nil {
+        return false, err
+    }
+    return bytes.Equal(stored, key), nil
+}
+
+func (t *hashTable) get(key []byte) (*DirItem, error) {
+    if v, ok := t.overflow.Get(key); ok {
+        return v.(*DirItem), nil
+    }
+    i, found := t.findHash(t.hash(key))
+    if !found {
+        return nil, ErrKeyNotFound
+    }
+    s := t.slot(i)
+    if ok, err := t.isKeyOf(s, key); err != nil {
+        return nil, err
+    } else if !ok {
+        return nil, ErrKeyNotFound
+    }
+    return unpackSlot(s), nil
+}
+
+// getAt returns the item of key if it points to the record at fileId and
+// valuePos, whose key is key. No record is read.
+func (t *hashTable) getAt(key []byte, fileId int64, valuePos int64) (*DirItem, bool) {
+    var di *DirItem
+    if v, ok := t.overflow.Get(key); ok {
+        di = v.(*DirItem)
+    } else if i, found := t.findHash(t.hash(key)); found {
+        di = unpackSlot(t.slot(i))
+    }
+    if di == nil || !sameRecord(di, &DirItem{fileId: fileId, valuePos: valuePos}) {
+        return nil, false
+    }
+    return di, true
+}
+
+// old is an item of key, if the slot of its hash points to the same record
+// it's the slot of key
+func (t *hashTable) put(key []byte, old *DirItem, di *DirItem) error {
+    if !fitsCompactSlot(di) {
+        return ErrKeyDirOverflow
+    }
+    if _, ok := t.overflow.Get(key); ok {
+        t.overflow.Put(key, di)
+        return nil
+    }
+    h := t.hash(key)
+    i, found := t.findHash(h)
+    if found {
+        s := t.slot(i)
+        same := old != nil && sameRecord(unpackSlot(s), old)
+        if !same {
+            var err error
+            if same, err = t.isKeyOf(s, key); err != nil {
+                return err
+            }
+        }
+        if !same {
+            t.overflow.Put(key, di)
+            return nil
+        }
+        packSlot(t.mutableSlot(i), h, di)
+        return nil
+    }
+
+    if t.full() {
+        t.rehash()
+        i, _ = t.findHash(h)
+    }
+    s := t.mutableSlot(i)
+    if slotState(s) == SLOT_DELETED {
+        t.deleted--
+    }
+    packSlot(s, h, di)
+    t.used++
+    return nil
+}
+
+func sameRecord(a *DirItem, b *DirItem) bool {
+    return a.fileId == b.fileId && a.valuePos == b.valuePos
+}
+
+func (t *hashTable) del(key []byte) (bool, error) {
+    if _, ok := t.overflow.Delete(key); ok {
+        return true, nil
+    }
+    h := t.hash(key)
+    i, found := t.findHash(h)
+    if !found {
+        return false, nil
+    }
+    if same, err := t.isKeyOf(t.slot(i), key); err != nil || !same {
+        return false, err
+    }
+
+    // a key of the same hash takes the slot
+    var next []byte
+    var nextDi *DirItem
+    t.overflow.ForEach(func(k []byte, v interface{}) bool {
+        if t.hash(k) == h {
+            next, nextDi = k, v.(*DirItem)
+            return false
+        }
+        return true
+    })
+    if next != nil {
+        t.overflow.Delete(next)
+        packSlot(t.mutableSlot(i), h, nextDi)
+        return true, nil
+    }
+    t.tombstone(t.mutableSlot(i))
+    return true, nil
+}
+
+// hashes are kept in the slots, so rehash reads no record
+func (t *hashTable) rehash() {
+    out := newSlotPages(t.rehashSlots(), t.owner)
+    for i := uint64(0); i < t.slots(); i++ {
+        s := t.slot(i)
+        if slotState(s) != SLOT_USED {
+            continue
+        }
+        j := s[0] & out.mask
+        for slotState(out.slot(j)) != SLOT_EMPTY {
+            j = (j + 1) & out.mask
+        }
+        copy(out.slot(j), s)
+        out.used++
+    }
+    t.slotPages = out
+}
+
+func (t *hashTable) len() int {
+    return t.used + t.overflow.Len()
+}
+
+func (t *hashTable) clone() *hashTable {
+    out := *t
+    out.slotPages = t.slotPages.clone()
+    out.overflow = t.overflow.Clone()
+    return &out
+}
+
+func (t *hashTable) clear() {
+    t.slotPages = newSlotPages(COMPACT_MIN_SLOTS, &compactOwner{})
+    t.overflow.Clear()
+}
+
+// forEach reads the key of every item matched and calls fn with it, fn may
+// delete keys but must not put any
+func (t *hashTable) forEach(match func(di *DirItem) bool, fn func(key []byte, di *DirItem) error) error {
+    for i := uint64(0); i < t.slots(); i++ {
+        s := t.slot(i)
+        if slotState(s) != SLOT_USED {
+            continue
+        }
+        di := unpackSlot(s)
+        if match != nil && !match(di) {
+            continue
+        }
+        key, err := t.readKey(di)
+        if err != nil {
+            return err
+        }
+        if err := fn(key, di); err != nil {
+            return err
+        }
+    }
+
+    // fn may delete from the overflow tree
+    entries := make([]rangeEntry, 0)
+    t.overflow.ForEach(func(key []byte, v interface{}) bool {
+        if di := v.(*DirItem); match == nil || match(di) {
+            entries = append(entries, rangeEntry{key: key, di: di})
+        }
+        return true
+    })
+    for _, e := range entries {
+        if err := fn(e.key, e.di); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+func (t *hashTable) memUsage() int64 {
+    n := t.pagesMemUsage()
+    t.overflow.ForEach(func(key []byte, v interface{}) bool {
+        n += KEYDIR_BTREE_ITEM_SIZE + int64(len(key))
+        return true
+    })
+    return n
+}
+
+// hashIterator walks a hashTable in key order over the keys of its range
+// read when it's created
+type hashIterator struct {
+    entries     []rangeEntry
+    pos         int
+}
+
+func (t *hashTable) newIterator(r *keyRange) (*hashIterator, error) {
+    var h rangeHeap
+    if r == nil || r.limit <= 0 {
+        h = make(rangeHeap, 0, t.len())
+    }
+    err := t.forEach(r.matches, func(key []byte, di *DirItem) error {
+        r.add(&h, rangeEntry{key: key, di: di})
+        return nil
+    })
+    if err != nil {
+        return nil, err
+    }
+    entries := sortRange(h)
+    return &hashIterator{entries: entries, pos: len(entries)}, nil
+}
+
+func (it *hashIterator) Valid() bool {
+    return it.pos >= 0 && it.pos < len(it.entries)
+}
+
+func (it *hashIterator) Key() []byte {
+    return it.entries[it.pos].key
+}
+
+func (it *hashIterator) Value() interface{} {
+    return it.entries[it.pos].di
+}
+
+// Seek moves to the first key >= key
+func (it *hashIterator) Seek(key []byte) {
+    it.pos = sort.Search(len(it.entries), func(i int) bool {
+        return bytes.Compare(it.entries[i].key, key) >= 0
+    })
+}
+
+func (it *hashIterator) SeekToFirst() {
+    it.pos = 0
+}
+
+func (it *hashIterator) SeekToLast() {
+    it.pos = len(it.entries) - 1
+}
+
+func (it *hashIterator) Next() {
+    it.pos++
+}
+
+func (it *hashIterator) Prev() {
+    it.pos--
+}
@@ -0,0 +1,222 @@
+package bitcask
+
+import (
+    "bytes"
+    "fmt"
+    "math/rand"
+    "time"
+    . "gopkg.in/check.v1"
+)
+
+type testHashSuite struct {
+    records     map[int64][]byte    // valuePos -> key
+    nextPos     int64
+    reads       int
+}
+
+var _ = Suite(&testHashSuite{})
+
+func (s *testHashSuite) SetUpTest(c *C) {
+    s.records = make(map[int64][]byte)
+    s.nextPos = 0
+    s.reads = 0
+}
+
+func (s *testHashSuite) readKey(di *DirItem) ([]byte, error) {
+    s.reads++
+    key, ok := s.records[di.valuePos]
+    if !ok {
+        return nil, ErrRecordCorrupted
+    }
+    return key, nil
+}
+
+// a record of key, as if it's appended to a file
+func (s *testHashSuite) record(key []byte) *DirItem {
+    s.nextPos++
+    s.records[s.nextPos] = append([]byte(nil), key...)
+    return &DirItem{fileId: 1, valuePos: s.nextPos, valueSize: int64(len(key))}
+}
+
+// keys of the same length collide
+func (s *testHashSuite) newKeyDir() *KeyDir {
+    kd := newKeyDirOf(KEYDIR_HASH, s.readKey)
+    kd.hashes.hash = func(key []byte) uint64 {
+        return uint64(len(key))
+    }
+    return kd
+}
+
+func (s *testHashSuite) TestCollision(c *C) {
+    kd := s.newKeyDir()
+    model := make(map[string]*DirItem)
+    r := rand.New(rand.NewSource(1))
+    for i := 0; i < 5000; i++ {
+        key := []byte(fmt.Sprintf("%0*d", 1 + r.Intn(4), r.Intn(100)))
+        switch r.Intn(4) {
+        case 0:
+            err := kd.Del(key)
+            if _, ok := model[string(key)]; ok {
+                c.Assert(err, IsNil)
+                delete(model, string(key))
+            } else {
+                c.Assert(err, Equals, ErrKeyNotFound)
+            }
+        default:
+            di := s.record(key)
+            c.Assert(kd.Put(key, di), IsNil)
+            model[string(key)] = di
+        }
+    }
+    c.Assert(kd.hashes.overflow.Len() > 0, Equals, true)
+    checkKeyDir(c, kd, model)
+
+    for key, di := range model {
+        got, ok := kd.GetAt([]byte(key), di.fileId, di.valuePos)
+        c.Assert(ok, Equals, true)
+        c.Assert(got, DeepEquals, di)
+        _, ok = kd.GetAt([]byte(key), di.fileId, di.valuePos + 1)
+        c.Assert(ok, Equals, false)
+    }
+
+    // a key of a hash taken is not found
+    _, err := kd.Get([]byte("x"))
+    c.Assert(err, Equals, ErrKeyNotFound)
+}
+
+func (s *testHashSuite) TestClone(c *C) {
+    kd := s.newKeyDir()
+    model := make(map[string]*DirItem)
+    for i := 0; i < 300; i++ {
+        key := []byte(fmt.Sprintf("%d", i))
+        di := s.record(key)
+        c.Assert(kd.Put(key, di), IsNil)
+        model[string(key)] = di
+    }
+    clone := kd.Clone()
+    cloneModel := make(map[string]*DirItem)
+    for key, di := range model {
+        cloneModel[key] = di
+    }
+
+    for i := 0; i < 300; i += 3 {
+        key := []byte(fmt.Sprintf("%d", i))
+        c.Assert(kd.Del(key), IsNil)
+        delete(model, string(key))
+        di := s.record(key)
+        c.Assert(clone.Put(key, di), IsNil)
+        cloneModel[string(key)] = di
+    }
+    for i := 300; i < 1000; i++ {
+        key := []byte(fmt.Sprintf("%d", i))
+        di := s.record(key)
+        c.Assert(kd.Put(key, di), IsNil)
+        model[string(key)] = di
+    }
+    checkKeyDir(c, kd, model)
+    checkKeyDir(c, clone, cloneModel)
+}
+
+// an overwrite reads the old key once, in Get
+func (s *testHashSuite) TestReplace(c *C) {
+    kd := s.newKeyDir()
+    a := s.record([]byte("a"))
+    c.Assert(kd.Put([]byte("a"), a), IsNil)
+    b := s.record([]byte("b"))
+    c.Assert(kd.Put([]byte("b"), b), IsNil)
+
+    s.reads = 0
+    old, err := kd.Get([]byte("a"))
+    c.Assert(err, IsNil)
+    c.Assert(s.reads, Equals, 1)
+    di := s.record([]byte("a"))
+    c.Assert(kd.Replace([]byte("a"), old, di), IsNil)
+    c.Assert(s.reads, Equals, 1)
+    c.Assert(kd.hashes.overflow.Len(), Equals, 1)
+
+    // an old item kd doesn't have any more falls back to reading the key
+    c.Assert(kd.Replace([]byte("b"), old, s.record([]byte("b"))), IsNil)
+    c.Assert(kd.Replace([]byte("c"), old, s.record([]byte("c"))), IsNil)
+    c.Assert(kd.hashes.overflow.Len(), Equals, 2)
+    got, err := kd.Get([]byte("a"))
+    c.Assert(err, IsNil)
+    c.Assert(got, DeepEquals, di)
+}
+
+// an error reading a key is returned, not taken as a missing key
+func (s *testHashSuite) TestReadError(c *C) {
+    kd := s.newKeyDir()
+    di := s.record([]byte("a"))
+    c.Assert(kd.Put([]byte("a"), di), IsNil)
+    delete(s.records, di.valuePos)
+
+    _, err := kd.Get([]byte("b"))
+    c.Assert(err, Equals, ErrRecordCorrupted)
+    c.Assert(kd.Put([]byte("b"), s.record([]byte("b"))), Equals, ErrRecordCorrupted)
+    c.Assert(kd.Del([]byte("a")), Equals, ErrRecordCorrupted)
+    _, err = kd.NewIterator()
+    c.Assert(err, Equals, ErrRecordCorrupted)
+}
+
+func longKey(i int) []byte {
+    return []byte(fmt.Sprintf("%s:%05d", bytes.Repeat([]byte("k"), 200), i))
+}
+
+func (s *testHashSuite) TestHashMode(c *C) {
+    dir := c.MkDir()
+    opts := NewOptions()
+    opts.SetMaxFileSize(64 * 1024)
+    opts.SetKeyDirMode(KEYDIR_HASH)
+    bc, err := Open(dir, opts)
+    c.Assert(err, IsNil)
+    for round := 0; round < 3; round++ {
+        for i := 0; i < 300; i++ {
+            c.Assert(bc.Set(longKey(i), []byte(fmt.Sprintf("value%d-%d", round, i))), IsNil)
+        }
+    }
+    for i := 0; i < 300; i += 10 {
+        c.Assert(bc.Del(longKey(i)), IsNil)
+    }
+    c.Assert(bc.SetWithExpr(longKey(1), []byte("gone"), uint32(time.Now().Unix() - 1)), IsNil)
+    n, err := bc.sweepExpired()
+    c.Assert(err, IsNil)
+    c.Assert(n, Equals, 1)
+
+    snap, err := bc.Snapshot()
+    c.Assert(err, IsNil)
+    c.Assert(bc.Set(longKey(2), []byte("new")), IsNil)
+    inputs := make([]int64, 0)
+    for _, meta := range bc.GetFileMetas() {
+        inputs = append(inputs, meta.FileId)
+    }
+    c.Assert(bc.runMerge(inputs), IsNil)
+    v, err := snap.Get(longKey(2))
+    c.Assert(err, IsNil)
+    c.Assert(string(v), Equals, "value2-2")
+    snap.Release()
+    c.Assert(bc.Close(), IsNil)
+
+    mem := make(map[int]int64)
+    for _, mode := range []int{KEYDIR_HASH, KEYDIR_BTREE} {
+        opts.SetKeyDirMode(mode)
+        bc, err = Open(dir, opts)
+        c.Assert(err, IsNil)
+        values := make(map[string]string)
+        c.Assert(bc.Scan(nil, nil, func(key []byte, value []byte) error {
+            values[string(key)] = string(value)
+            return nil
+        }), IsNil)
+        c.Assert(len(values), Equals, 269)
+        c.Assert(values[string(longKey(2))], Equals, "new")
+        c.Assert(values[string(longKey(3))], Equals, "value2-3")
+        for i := 0; i < 300; i += 10 {
+            _, err := bc.Get(longKey(i))
+            c.Assert(err, Equals, ErrKeyNotFound)
+        }
+        c.Assert(bc.KeyDirStats().Mode, Equals, mode)
+        stats := bc.KeyDirStats()
+        mem[mode] = stats.MemBytes - stats.SlotIndexBytes
+        c.Assert(bc.Close(), IsNil)
+    }
+    c.Assert(mem[KEYDIR_HASH] * 4 < mem[KEYDIR_BTREE], Equals, true)
+}
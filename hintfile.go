@@ -4,32 +4,69 @@ import (
     "io"
     "bytes"
     "encoding/binary"
+    "fmt"
+    "hash/crc32"
     "log"
     "crypto/md5"
 )
 
+// Hint file v2 starts with a magic, then the fileId, md5, size and mtime of
+// the data file. Items carry the slot and the hash tag of the key so restore
+// doesn't hash any key. The header and every item have a crc, and the
+// trailer has the number of items so a cut off file is detected:
+//
+//   header:  magic(8) fileId(8) md5(16) dataSize(8) dataMtime(8) crc(4)
+//   item:    crc(4) flag(1) expration(4) valueSize(8) valuePos(8) keySize(8)
+//            slot(2) tagPos(4) tagSize(4) key
+//   trailer: items(8) magic(8)
+//
+// Open checks the size and mtime of the data file, the md5 is only read if
+// they don't match and by Verify. v1 files have no magic, fileId and md5
+// only, and items without the slot, crc and trailer.
+
+var (
+    ErrHintStale = fmt.Errorf("md5 in hint file doesn't match the data file")
+)
+
 type HintItem struct {
     flag            uint8
     expration       uint32
     valueSize       int64
     valuePos        int64
     keySize         int64
+    slot            uint32
+    tagPos          uint32      // the tag is key[tagPos:tagPos+tagSize]
+    tagSize         uint32
     key             []byte
 }
 
 const (
-    HINT_FILE_HEADER_SIZE = 8 + md5.Size
-    HINT_ITEM_HEADER_SIZE = 29
+    HINT_FILE_MAGIC = 0xb17ca5c4d1a70002    // never a fileId of v1, which is >= 0
+    HINT_FILE_HEADER_SIZE = 8 + 8 + md5.Size + 16 + 4
+    HINT_ITEM_HEADER_SIZE = 43
+    HINT_TRAILER_MAGIC = 0xb17ca5c4d1a7ffff
+    HINT_TRAILER_SIZE = 16
+
+    HINT_FILE_HEADER_SIZE_V1 = 8 + md5.Size
+    HINT_ITEM_HEADER_SIZE_V1 = 29
+)
+
+const (
+    HINT_FLAG_ENCRYPTED = 1 << 7    // key is sealed with the data key of the file
 )
 
 func (hi *HintItem) Encode() ([]byte, error) {
     buf := new(bytes.Buffer)
     var data = []interface{}{
+        uint32(0),      // crc
         hi.flag,
         hi.expration,
         hi.valueSize,
         hi.valuePos,
         hi.keySize,
+        uint16(hi.slot),
+        hi.tagPos,
+        hi.tagSize,
         hi.key,
     }
 
@@ -40,38 +77,116 @@ func (hi *HintItem) Encode() ([]byte, error) {
             return nil, err
         }
     }
-    return buf.Bytes(), nil
+    item := buf.Bytes()
+    binary.LittleEndian.PutUint32(item[0:4], crc32.ChecksumIEEE(item[4:]))
+    return item, nil
+}
+
+func newHintItem(key []byte, di *DirItem) *HintItem {
+    pos, size := hashTagPos(key)
+    return &HintItem{
+        flag: di.flag,
+        expration: di.expration,
+        valueSize: di.valueSize,
+        valuePos: di.valuePos,
+        keySize: int64(len(key)),
+        slot: HashTagToSlot(key[pos:pos + size]),
+        tagPos: uint32(pos),
+        tagSize: uint32(size),
+        key: key,
+    }
 }
 
-func parseHintItemAt(f FileReader, offset int64) (*HintItem, error) {
-    header := make([]byte, HINT_ITEM_HEADER_SIZE)
+func (hi *HintItem) tag() []byte {
+    return hi.key[hi.tagPos:hi.tagPos + hi.tagSize]
+}
+
+func hintItemHeaderSize(version int) int64 {
+    if version == 1 {
+        return HINT_ITEM_HEADER_SIZE_V1
+    }
+    return HINT_ITEM_HEADER_SIZE
+}
+
+// keySize of the returned item is the stored size, the item must end
+// before end
+func parseHintItemAt(f FileReader, offset int64, end int64, fc *fileCipher, version int) (*HintItem, error) {
+    headerSize := hintItemHeaderSize(version)
+    if offset + headerSize > end {
+        return nil, ErrRecordCorrupted
+    }
+    header := make([]byte, headerSize)
     _, err := f.ReadAt(header, offset)
     if err != nil {
         return nil, err
     }
 
+    h := header
+    if version >= 2 {
+        h = header[4:]
+    }
     hi := &HintItem{
-        flag:           uint8(header[0]),
-        expration:      uint32(binary.LittleEndian.Uint32(header[1:5])),
-        valueSize:      int64(binary.LittleEndian.Uint64(header[5:13])),
-        valuePos:       int64(binary.LittleEndian.Uint64(header[13:21])),
-        keySize:        int64(binary.LittleEndian.Uint64(header[21:29])),
+        flag:           uint8(h[0]),
+        expration:      uint32(binary.LittleEndian.Uint32(h[1:5])),
+        valueSize:      int64(binary.LittleEndian.Uint64(h[5:13])),
+        valuePos:       int64(binary.LittleEndian.Uint64(h[13:21])),
+        keySize:        int64(binary.LittleEndian.Uint64(h[21:29])),
+    }
+    if version >= 2 {
+        hi.slot = uint32(binary.LittleEndian.Uint16(h[29:31]))
+        hi.tagPos = binary.LittleEndian.Uint32(h[31:35])
+        hi.tagSize = binary.LittleEndian.Uint32(h[35:39])
+    }
+    if hi.keySize < 0 || hi.keySize > end - offset - headerSize {
+        return nil, ErrRecordCorrupted
     }
 
-    offset += HINT_ITEM_HEADER_SIZE
+    offset += headerSize
     hi.key = make([]byte, hi.keySize)
-    _, err = f.ReadAt(hi.key, offset)
+    err = readFullAt(f, hi.key, offset)
     if err != nil {
         log.Println(err)
         return nil, err
     }
+    if version >= 2 {
+        crc := crc32.ChecksumIEEE(h)
+        crc = crc32.Update(crc, crc32.IEEETable, hi.key)
+        if crc != binary.LittleEndian.Uint32(header[0:4]) {
+            return nil, ErrRecordCorrupted
+        }
+    }
 
+    if hi.flag & HINT_FLAG_ENCRYPTED > 0 {
+        if fc == nil {
+            return nil, ErrNoCipher
+        }
+        if hi.key, err = fc.open(hi.key); err != nil {
+            log.Printf("decrypt hint key failed, err = %s", err)
+            return nil, ErrRecordCorrupted
+        }
+        hi.flag &^= HINT_FLAG_ENCRYPTED
+    }
+
+    if version == 1 {
+        pos, size := hashTagPos(hi.key)
+        hi.slot = HashTagToSlot(hi.key[pos:pos + size])
+        hi.tagPos, hi.tagSize = uint32(pos), uint32(size)
+    } else if hi.slot >= MaxSlotNum || int64(hi.tagPos) + int64(hi.tagSize) > int64(len(hi.key)) {
+        log.Printf("invalid slot[%d] or tag[%d, %d) of hint item", hi.slot, hi.tagPos, hi.tagPos + hi.tagSize)
+        return nil, ErrRecordCorrupted
+    }
     return hi, nil
 }
 
 type HintFile struct {
     *FileWithBuffer
     id int64
+    fc *fileCipher      // nil if not encrypted
+    version int         // 0 until the header is read or written
+    dataSize int64      // of the data file, 0 in v1
+    dataMtime int64
+    itemsOffset int64
+    items int64         // written
 }
 
 type FileMeta struct {
@@ -79,7 +194,8 @@ type FileMeta struct {
     Md5 []byte
 }
 
-func NewHintFile(path string, id int64, wbufSize int64) (*HintFile, error) {
+// NewHintFile creates a hint file to write, see openHintFile to read one
+func NewHintFile(path string, id int64, wbufSize int64, fc *fileCipher) (*HintFile, error) {
     f, err := NewFileWithBuffer(path, true, wbufSize)
     if err != nil {
         return nil, err
@@ -88,42 +204,159 @@ func NewHintFile(path string, id int64, wbufSize int64) (*HintFile, error) {
     hf := &HintFile{
         FileWithBuffer: f,
         id: id,
+        fc: fc,
     }
     return hf, nil
 }
 
-func (hf *HintFile) WriteHeader(md5sum []byte) error {
-    if err := binary.Write(hf, binary.LittleEndian, hf.id); err != nil {
-        return err
+// open a hint file read-only, it's never created
+func openHintFile(path string, id int64, fc *fileCipher) (*HintFile, error) {
+    f, err := NewFileWithBuffer(path, false, 0)
+    if err != nil {
+        return nil, err
     }
-    if err := binary.Write(hf, binary.LittleEndian, md5sum); err != nil {
+    return &HintFile{FileWithBuffer: f, id: id, fc: fc}, nil
+}
+
+// sum is of the data file
+func (hf *HintFile) WriteHeader(sum *dataSum) error {
+    buf := new(bytes.Buffer)
+    var data = []interface{}{
+        uint64(HINT_FILE_MAGIC),
+        hf.id,
+        sum.md5,
+        sum.size,
+        sum.mtime,
+    }
+    for _, v := range data {
+        if err := binary.Write(buf, binary.LittleEndian, v); err != nil {
+            return err
+        }
+    }
+    binary.Write(buf, binary.LittleEndian, crc32.ChecksumIEEE(buf.Bytes()))
+    if _, err := hf.Write(buf.Bytes()); err != nil {
         return err
     }
+    hf.version = 2
+    hf.dataSize, hf.dataMtime = sum.size, sum.mtime
+    hf.itemsOffset = int64(buf.Len())
     return nil
 }
 
+// WriteTrailer ends the file after the last item
+func (hf *HintFile) WriteTrailer() error {
+    for _, v := range []interface{}{hf.items, uint64(HINT_TRAILER_MAGIC)} {
+        if err := binary.Write(hf, binary.LittleEndian, v); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// ReadHeader returns the md5 of the data file, the size and mtime of it
+// are kept in hf.
+func (hf *HintFile) ReadHeader() ([]byte, error) {
+    header := make([]byte, HINT_FILE_HEADER_SIZE)
+    n, err := hf.ReadAt(header, 0)
+    if n < HINT_FILE_HEADER_SIZE_V1 {
+        if err == nil || err == io.EOF {
+            err = ErrRecordCorrupted
+        }
+        return nil, err
+    }
+
+    if binary.LittleEndian.Uint64(header[0:8]) != HINT_FILE_MAGIC {
+        hf.version = 1
+        hf.itemsOffset = HINT_FILE_HEADER_SIZE_V1
+        return header[8:HINT_FILE_HEADER_SIZE_V1], nil
+    }
+    if n < HINT_FILE_HEADER_SIZE {
+        return nil, ErrRecordCorrupted
+    }
+    crc := crc32.ChecksumIEEE(header[:HINT_FILE_HEADER_SIZE - 4])
+    if crc != binary.LittleEndian.Uint32(header[HINT_FILE_HEADER_SIZE - 4:]) {
+        return nil, ErrRecordCorrupted
+    }
+    hf.version = 2
+    hf.dataSize = int64(binary.LittleEndian.Uint64(header[32:40]))
+    hf.dataMtime = int64(binary.LittleEndian.Uint64(header[40:48]))
+    hf.itemsOffset = HINT_FILE_HEADER_SIZE
+    return header[16:16 + md5.Size], nil
+}
+
+// number of items in the trailer of a v2 file
+func (hf *HintFile) readTrailer() (int64, error) {
+    if hf.Size() - HINT_TRAILER_SIZE < hf.itemsOffset {
+        return 0, ErrRecordCorrupted
+    }
+    trailer := make([]byte, HINT_TRAILER_SIZE)
+    if _, err := hf.ReadAt(trailer, hf.Size() - HINT_TRAILER_SIZE); err != nil {
+        return 0, err
+    }
+    if binary.LittleEndian.Uint64(trailer[8:16]) != HINT_TRAILER_MAGIC {
+        return 0, ErrRecordCorrupted
+    }
+    return int64(binary.LittleEndian.Uint64(trailer[0:8])), nil
+}
+
 func (hf *HintFile) ForEachItem(fn func(item *HintItem) error) error {
-    var offset int64 = HINT_FILE_HEADER_SIZE
-    for {
-        hi, err := parseHintItemAt(hf, offset)
+    return hf.forEachItemAt(func(item *HintItem, offset int64) error {
+        return fn(item)
+    })
+}
+
+func (hf *HintFile) forEachItemAt(fn func(item *HintItem, offset int64) error) error {
+    if hf.version == 0 {
+        if _, err := hf.ReadHeader(); err != nil {
+            return err
+        }
+    }
+    end := hf.Size()
+    var count int64 = -1
+    if hf.version >= 2 {
+        var err error
+        if count, err = hf.readTrailer(); err != nil {
+            return err
+        }
+        end -= HINT_TRAILER_SIZE
+    }
+    headerSize := hintItemHeaderSize(hf.version)
+
+    var items int64 = 0
+    var offset int64 = hf.itemsOffset
+    for offset < end {
+        hi, err := parseHintItemAt(hf, offset, end, hf.fc, hf.version)
         if err != nil {
-            if err == io.EOF {
-                break
-            }
             return err
         }
 
-        err = fn(hi)
+        err = fn(hi, offset)
         if err != nil {
             return err
         }
 
-        offset += HINT_ITEM_HEADER_SIZE + int64(hi.keySize)
+        items++
+        offset += headerSize + int64(hi.keySize)
+    }
+    if count >= 0 && items != count {
+        log.Printf("hint-file[%d] has %d items, %d in trailer", hf.id, items, count)
+        return ErrRecordCorrupted
     }
     return nil
 }
 
 func (hf *HintFile) AddItem(item *HintItem) error {
+    if hf.fc != nil {
+        key, err := hf.fc.seal(item.key)
+        if err != nil {
+            return err
+        }
+        sealed := *item
+        sealed.flag |= HINT_FLAG_ENCRYPTED
+        sealed.key = key
+        sealed.keySize = int64(len(key))
+        item = &sealed
+    }
     buf, err := item.Encode()
     if err != nil {
         log.Println(err)
@@ -135,6 +368,6 @@ func (hf *HintFile) AddItem(item *HintItem) error {
         log.Println(err)
         return err
     }
+    hf.items++
     return nil
 }
-
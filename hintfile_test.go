@@ -0,0 +1,167 @@
+package bitcask
+
+import (
+    "fmt"
+    "io/ioutil"
+    "os"
+    "time"
+    . "gopkg.in/check.v1"
+)
+
+type testHintSuite struct {
+    dir     string
+    opts    *Options
+}
+
+var _ = Suite(&testHintSuite{})
+
+func (s *testHintSuite) SetUpTest(c *C) {
+    s.dir = c.MkDir()
+    s.opts = NewOptions()
+    s.opts.SetMaxFileSize(1024)
+
+    bc, err := Open(s.dir, s.opts)
+    c.Assert(err, IsNil)
+    for i := 0; i < 100; i++ {
+        c.Assert(bc.Set([]byte(fmt.Sprintf("key%03d", i)), []byte(fmt.Sprintf("value%03d", i))), IsNil)
+    }
+    c.Assert(bc.Close(), IsNil)
+}
+
+func (s *testHintSuite) hintPath(id int64) string {
+    return fmt.Sprintf("%s/%09d.hint", s.dir, id)
+}
+
+// opens the db, checks all keys and returns the hint file of data-file[0]
+func (s *testHintSuite) reopen(c *C) []byte {
+    bc, err := Open(s.dir, s.opts)
+    c.Assert(err, IsNil)
+    defer bc.Close()
+    c.Assert(bc.keyDir.Len(), Equals, 100)
+    for i := 0; i < 100; i++ {
+        v, err := bc.Get([]byte(fmt.Sprintf("key%03d", i)))
+        c.Assert(err, IsNil)
+        c.Assert(string(v), Equals, fmt.Sprintf("value%03d", i))
+    }
+    data, err := ioutil.ReadFile(s.hintPath(0))
+    c.Assert(err, IsNil)
+    return data
+}
+
+func (s *testHintSuite) TestHintFormat(c *C) {
+    hf, err := NewHintFile(s.hintPath(0), 0, 0, nil)
+    c.Assert(err, IsNil)
+    defer hf.Close()
+    md5, err := fileMd5(fmt.Sprintf("%s/%09d.data", s.dir, 0))
+    c.Assert(err, IsNil)
+    hintMd5, err := hf.ReadHeader()
+    c.Assert(err, IsNil)
+    c.Assert(hintMd5, DeepEquals, md5)
+    c.Assert(hf.version, Equals, 2)
+
+    var items int64 = 0
+    c.Assert(hf.ForEachItem(func(item *HintItem) error {
+        items++
+        return nil
+    }), IsNil)
+    count, err := hf.readTrailer()
+    c.Assert(err, IsNil)
+    c.Assert(count, Equals, items)
+    c.Assert(count > 0, Equals, true)
+}
+
+// a hint file of another data file, a cut off one and one with a bad item
+// are not used, restore reads the data files and writes the hints again
+func (s *testHintSuite) TestHintRejected(c *C) {
+    good, err := ioutil.ReadFile(s.hintPath(0))
+    c.Assert(err, IsNil)
+    other, err := ioutil.ReadFile(s.hintPath(1))
+    c.Assert(err, IsNil)
+
+    c.Assert(ioutil.WriteFile(s.hintPath(0), other, 0644), IsNil)
+    c.Assert(s.reopen(c), DeepEquals, good)
+
+    c.Assert(os.Truncate(s.hintPath(0), int64(len(good) - 1)), IsNil)
+    c.Assert(s.reopen(c), DeepEquals, good)
+
+    // the last byte of the key of the first item
+    bad := append([]byte{}, good...)
+    hf, err := NewHintFile(s.hintPath(0), 0, 0, nil)
+    c.Assert(err, IsNil)
+    _, err = hf.ReadHeader()
+    c.Assert(err, IsNil)
+    hf.Close()
+    bad[hf.itemsOffset + HINT_ITEM_HEADER_SIZE + int64(len("key000")) - 1] ^= 1
+    c.Assert(ioutil.WriteFile(s.hintPath(0), bad, 0644), IsNil)
+    c.Assert(s.reopen(c), DeepEquals, good)
+
+    report, err := VerifyDir(s.dir, s.opts, false)
+    c.Assert(err, IsNil)
+    c.Assert(report.OK(), Equals, true)
+}
+
+func (s *testHintSuite) readHintHeader(c *C) (*HintFile, []byte) {
+    hf, err := openHintFile(s.hintPath(0), 0, nil)
+    c.Assert(err, IsNil)
+    defer hf.Close()
+    md5, err := hf.ReadHeader()
+    c.Assert(err, IsNil)
+    return hf, md5
+}
+
+// the data file isn't read for its md5 while its size and mtime match the
+// hint, a hint of an older mtime is checked by the md5 and written again
+func (s *testHintSuite) TestHintStamp(c *C) {
+    dataPath := fmt.Sprintf("%s/%09d.data", s.dir, 0)
+    sum, err := sumDataFile(dataPath)
+    c.Assert(err, IsNil)
+    hf, md5 := s.readHintHeader(c)
+    c.Assert(hf.version, Equals, 2)
+    c.Assert(md5, DeepEquals, sum.md5)
+    c.Assert(hf.dataSize, Equals, sum.size)
+    c.Assert(hf.dataMtime, Equals, sum.mtime)
+
+    // a hint of the same size and mtime, with another md5
+    hf, err = openHintFile(s.hintPath(0), 0, nil)
+    c.Assert(err, IsNil)
+    _, err = hf.ReadHeader()
+    c.Assert(err, IsNil)
+    items := make([]*HintItem, 0)
+    c.Assert(hf.ForEachItem(func(item *HintItem) error {
+        items = append(items, item)
+        return nil
+    }), IsNil)
+    hf.Close()
+    c.Assert(os.Remove(s.hintPath(0)), IsNil)
+    hf, err = NewHintFile(s.hintPath(0), 0, 0, nil)
+    c.Assert(err, IsNil)
+    fake := &dataSum{md5: make([]byte, len(sum.md5)), size: sum.size, mtime: sum.mtime}
+    c.Assert(hf.WriteHeader(fake), IsNil)
+    for _, item := range items {
+        c.Assert(hf.AddItem(item), IsNil)
+    }
+    c.Assert(hf.WriteTrailer(), IsNil)
+    c.Assert(hf.Close(), IsNil)
+
+    bc, err := Open(s.dir, s.opts)
+    c.Assert(err, IsNil)
+    metas, _ := bc.GetDataFiles()
+    c.Assert(metas[0].Md5, DeepEquals, fake.md5)
+    c.Assert(bc.Close(), IsNil)
+
+    // the md5 doesn't match once the mtime doesn't
+    mtime := time.Unix(0, sum.mtime).Add(-time.Hour)
+    c.Assert(os.Chtimes(dataPath, mtime, mtime), IsNil)
+    s.reopen(c)
+    hf, md5 = s.readHintHeader(c)
+    c.Assert(md5, DeepEquals, sum.md5)
+    c.Assert(hf.dataMtime, Equals, mtime.UnixNano())
+
+    // the md5 matches, the hint is written with the mtime
+    mtime = mtime.Add(-time.Hour)
+    c.Assert(os.Chtimes(dataPath, mtime, mtime), IsNil)
+    s.reopen(c)
+    hf, md5 = s.readHintHeader(c)
+    c.Assert(md5, DeepEquals, sum.md5)
+    c.Assert(hf.dataMtime, Equals, mtime.UnixNano())
+}
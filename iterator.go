@@ -0,0 +1,262 @@
+package bitcask
+
+import (
+    "bytes"
+    "time"
+)
+
+type IteratorOptions struct {
+    prefix      []byte
+    start       []byte
+    end         []byte
+    limit       int
+}
+
+func NewIteratorOptions() *IteratorOptions {
+    return &IteratorOptions{}
+}
+
+// only iterate over keys with the prefix
+func (o *IteratorOptions) SetPrefix(prefix []byte) {
+    o.prefix = make([]byte, len(prefix))
+    copy(o.prefix, prefix)
+}
+
+// only iterate over keys in [start, end), a nil end means no upper bound
+func (o *IteratorOptions) SetRange(start []byte, end []byte) {
+    o.start = append([]byte(nil), start...)
+    o.end = nil
+    if end != nil {
+        o.end = append([]byte(nil), end...)
+    }
+}
+
+// keep only the first n live keys of the range, 0 keeps all. The compact
+// and hash keydirs sort all keys of the range when an iterator is created,
+// with a limit they keep n keys instead, e.g. to read a page of keys.
+func (o *IteratorOptions) SetLimit(n int) {
+    o.limit = n
+}
+
+// Iterator walks live keys in order over a point-in-time view of the KeyDir,
+// deleted keys and keys expired when the iterator is created are skipped.
+// Values are read on demand, the data files are pinned like a snapshot's
+// until Close.
+type Iterator struct {
+    bc          *BitCask
+    kd          *KeyDir
+    it          keyDirIterator
+    lower       []byte      // the bounds of prefix and range
+    upper       []byte      // nil means no upper bound
+    now         int64
+    pinned      bool        // false if the files are pinned by a snapshot
+    fileIds     []int64
+    activeId    int64
+}
+
+func (bc *BitCask) NewIterator(opts *IteratorOptions) (*Iterator, error) {
+    bc.mu.Lock()
+    fileIds, activeId, err := bc.pinFiles()
+    if err != nil {
+        bc.mu.Unlock()
+        return nil, err
+    }
+    kd := bc.cloneKeyDir()
+    bc.mu.Unlock()
+
+    // keys are read from the data files in KEYDIR_HASH mode, without bc.mu
+    it, err := newIterator(bc, kd, opts)
+    if err != nil {
+        bc.mu.Lock()
+        bc.unpinFiles(fileIds, activeId)
+        bc.mu.Unlock()
+        return nil, err
+    }
+    it.pinned = true
+    it.fileIds = fileIds
+    it.activeId = activeId
+    return it, nil
+}
+
+func newIterator(bc *BitCask, kd *KeyDir, opts *IteratorOptions) (*Iterator, error) {
+    if opts == nil {
+        opts = NewIteratorOptions()
+    }
+    it := &Iterator{
+        bc: bc,
+        kd: kd,
+        lower: opts.prefix,
+        upper: prefixSuccessor(opts.prefix),
+        now: time.Now().Unix(),
+    }
+    if bytes.Compare(opts.start, it.lower) > 0 {
+        it.lower = opts.start
+    }
+    if opts.end != nil && (it.upper == nil || bytes.Compare(opts.end, it.upper) < 0) {
+        it.upper = opts.end
+    }
+
+    var err error
+    it.it, err = kd.newRangeIterator(&keyRange{
+        start: it.lower,
+        end: it.upper,
+        match: it.isLiveItem,
+        limit: opts.limit,
+    })
+    if err != nil {
+        return nil, err
+    }
+    return it, nil
+}
+
+func (it *Iterator) Valid() bool {
+    if !it.it.Valid() {
+        return false
+    }
+    key := it.it.Key()
+    return bytes.Compare(key, it.lower) >= 0 && (it.upper == nil || bytes.Compare(key, it.upper) < 0)
+}
+
+func (it *Iterator) SeekToFirst() {
+    it.Seek(nil)
+}
+
+func (it *Iterator) SeekToLast() {
+    if it.upper != nil {
+        it.it.Seek(it.upper)
+        if it.it.Valid() {
+            it.it.Prev()
+        } else {
+            it.it.SeekToLast()
+        }
+    } else {
+        it.it.SeekToLast()
+    }
+    it.skipBackward()
+}
+
+// Seek moves to the first live key >= key
+func (it *Iterator) Seek(key []byte) {
+    if bytes.Compare(key, it.lower) < 0 {
+        key = it.lower
+    }
+    it.it.Seek(key)
+    it.skipForward()
+}
+
+func (it *Iterator) Next() {
+    it.it.Next()
+    it.skipForward()
+}
+
+func (it *Iterator) Prev() {
+    it.it.Prev()
+    it.skipBackward()
+}
+
+func (it *Iterator) Key() []byte {
+    return it.it.Key()
+}
+
+// Value reads the value of current key
+func (it *Iterator) Value() ([]byte, error) {
+    di := it.dirItem()
+    bc := it.bc
+    offset := int64(di.valuePos) - RecordValueOffset()
+
+    bc.mu.RLock()
+    defer bc.mu.RUnlock()
+    rec, err := bc.refRecord(di.fileId, offset)
+    if err != nil {
+        return nil, err
+    }
+    defer bc.unrefRecord(di.fileId, offset)
+    return rec.ownedValue(), nil
+}
+
+// Close unpins the data files, the iterator must not be used after it
+func (it *Iterator) Close() {
+    if it.pinned {
+        it.pinned = false
+        bc := it.bc
+        bc.mu.Lock()
+        bc.unpinFiles(it.fileIds, it.activeId)
+        bc.mu.Unlock()
+    }
+    it.kd = nil
+}
+
+func (it *Iterator) dirItem() *DirItem {
+    return it.it.Value().(*DirItem)
+}
+
+func (it *Iterator) isLive() bool {
+    return it.isLiveItem(it.dirItem())
+}
+
+func (it *Iterator) isLiveItem(di *DirItem) bool {
+    return di.flag & RECORD_FLAG_DELETED == 0 && !isExpired(di.expration, it.now)
+}
+
+func (it *Iterator) skipForward() {
+    for it.it.Valid() && !it.isLive() {
+        it.it.Next()
+    }
+}
+
+func (it *Iterator) skipBackward() {
+    for it.it.Valid() && !it.isLive() {
+        it.it.Prev()
+    }
+}
+
+// smallest key greater than all keys with the prefix, nil if there's none
+func prefixSuccessor(prefix []byte) []byte {
+    for i := len(prefix) - 1; i >= 0; i-- {
+        if prefix[i] != 0xff {
+            next := make([]byte, i + 1)
+            copy(next, prefix)
+            next[i]++
+            return next
+        }
+    }
+    return nil
+}
+
+// Scan calls fn for every live key in [start, end) with its value,
+// a nil end means no upper bound.
+func (bc *BitCask) Scan(start []byte, end []byte, fn func(key []byte, value []byte) error) error {
+    opts := NewIteratorOptions()
+    opts.SetRange(start, end)
+    it, err := bc.NewIterator(opts)
+    if err != nil {
+        return err
+    }
+    defer it.Close()
+    return it.scan(fn)
+}
+
+// PrefixScan calls fn for every live key with the prefix and its value
+func (bc *BitCask) PrefixScan(prefix []byte, fn func(key []byte, value []byte) error) error {
+    opts := NewIteratorOptions()
+    opts.SetPrefix(prefix)
+    it, err := bc.NewIterator(opts)
+    if err != nil {
+        return err
+    }
+    defer it.Close()
+    return it.scan(fn)
+}
+
+func (it *Iterator) scan(fn func(key []byte, value []byte) error) error {
+    for it.SeekToFirst(); it.Valid(); it.Next() {
+        value, err := it.Value()
+        if err != nil {
+            return err
+        }
+        if err := fn(it.Key(), value); err != nil {
+            return err
+        }
+    }
+    return nil
+}
@@ -0,0 +1,128 @@
+package bitcask
+
+import (
+    "fmt"
+    . "gopkg.in/check.v1"
+)
+
+type testIteratorSuite struct {
+    bc  *BitCask
+}
+
+var _ = Suite(&testIteratorSuite{})
+
+func (s *testIteratorSuite) SetUpTest(c *C) {
+    var err error
+    s.bc, err = Open(c.MkDir(), NewOptions())
+    c.Assert(err, IsNil)
+
+    for i := 0; i < 100; i++ {
+        key := fmt.Sprintf("key%03d", i)
+        c.Assert(s.bc.Set([]byte(key), []byte(fmt.Sprintf("value%d", i))), IsNil)
+    }
+    c.Assert(s.bc.Set([]byte("other"), []byte("x")), IsNil)
+    c.Assert(s.bc.Del([]byte("key050")), IsNil)
+}
+
+func (s *testIteratorSuite) TearDownTest(c *C) {
+    s.bc.Close()
+}
+
+func (s *testIteratorSuite) TestIterate(c *C) {
+    it, err := s.bc.NewIterator(nil)
+    c.Assert(err, IsNil)
+    defer it.Close()
+
+    // writes after the iterator is created are not visible
+    c.Assert(s.bc.Set([]byte("key100"), []byte("new")), IsNil)
+
+    n := 0
+    var last string
+    for it.SeekToFirst(); it.Valid(); it.Next() {
+        c.Assert(string(it.Key()) > last, Equals, true)
+        c.Assert(string(it.Key()), Not(Equals), "key050")
+        last = string(it.Key())
+        n++
+    }
+    c.Assert(n, Equals, 100)
+
+    it.Seek([]byte("key050"))
+    c.Assert(it.Valid(), Equals, true)
+    c.Assert(string(it.Key()), Equals, "key051")
+    val, err := it.Value()
+    c.Assert(err, IsNil)
+    c.Assert(string(val), Equals, "value51")
+    it.Prev()
+    c.Assert(string(it.Key()), Equals, "key049")
+}
+
+func (s *testIteratorSuite) TestPrefix(c *C) {
+    opts := NewIteratorOptions()
+    opts.SetPrefix([]byte("key09"))
+    it, err := s.bc.NewIterator(opts)
+    c.Assert(err, IsNil)
+    defer it.Close()
+
+    it.SeekToLast()
+    c.Assert(it.Valid(), Equals, true)
+    c.Assert(string(it.Key()), Equals, "key099")
+
+    keys := make([]string, 0)
+    err = s.bc.PrefixScan([]byte("key09"), func(key []byte, value []byte) error {
+        keys = append(keys, string(key))
+        return nil
+    })
+    c.Assert(err, IsNil)
+    c.Assert(len(keys), Equals, 10)
+    c.Assert(keys[0], Equals, "key090")
+}
+
+func (s *testIteratorSuite) TestScan(c *C) {
+    values := make([]string, 0)
+    err := s.bc.Scan([]byte("key048"), []byte("key053"), func(key []byte, value []byte) error {
+        values = append(values, string(value))
+        return nil
+    })
+    c.Assert(err, IsNil)
+    c.Assert(values, DeepEquals, []string{"value48", "value49", "value51", "value52"})
+}
+
+// the compact and hash keydirs keep only the keys of a page, dead keys don't
+// take the place of live ones
+func (s *testIteratorSuite) TestRangeLimit(c *C) {
+    for _, mode := range []int{KEYDIR_BTREE, KEYDIR_COMPACT, KEYDIR_HASH} {
+        opts := NewOptions()
+        opts.SetKeyDirMode(mode)
+        bc, err := Open(c.MkDir(), opts)
+        c.Assert(err, IsNil)
+        for i := 0; i < 100; i++ {
+            c.Assert(bc.Set([]byte(fmt.Sprintf("key%03d", i)), []byte(fmt.Sprintf("value%d", i))), IsNil)
+        }
+        c.Assert(bc.Del([]byte("key021")), IsNil)
+
+        iopts := NewIteratorOptions()
+        iopts.SetRange([]byte("key020"), []byte("key060"))
+        iopts.SetLimit(3)
+        it, err := bc.NewIterator(iopts)
+        c.Assert(err, IsNil)
+        keys := make([]string, 0)
+        for it.SeekToFirst(); it.Valid() && len(keys) < 3; it.Next() {
+            val, err := it.Value()
+            c.Assert(err, IsNil)
+            c.Assert(string(val), Equals, "value" + string(it.Key())[4:])
+            keys = append(keys, string(it.Key()))
+        }
+        c.Assert(keys, DeepEquals, []string{"key020", "key022", "key023"})
+        it.Seek([]byte("key010"))
+        c.Assert(string(it.Key()), Equals, "key020")
+        it.Close()
+
+        values := make([]string, 0)
+        c.Assert(bc.Scan([]byte("key097"), nil, func(key []byte, value []byte) error {
+            values = append(values, string(value))
+            return nil
+        }), IsNil)
+        c.Assert(values, DeepEquals, []string{"value97", "value98", "value99"})
+        c.Assert(bc.Close(), IsNil)
+    }
+}
@@ -1,6 +1,22 @@
 package bitcask
 
 import (
+    "bytes"
+    "container/heap"
+    "sort"
+    "github.com/rocket323/bitcask/btree"
+)
+
+const (
+    KEYDIR_BTREE_DEGREE = 32
+    KEYDIR_BTREE_ITEM_SIZE = 104    // about, an item of a node 3/4 full and its DirItem
+)
+
+// keydir modes
+const (
+    KEYDIR_BTREE    = 0     // ordered by key
+    KEYDIR_COMPACT  = 1     // hash table with dir items packed into fixed-width fields
+    KEYDIR_HASH     = 2     // compact table keeping a 64-bit hash of keys instead of keys
 )
 
 type DirItem struct {
@@ -11,39 +27,324 @@ type DirItem struct {
     expration   uint32
 }
 
+// KeyDir keeps DirItems ordered by key, or packed in a compactTable in
+// KEYDIR_COMPACT mode, or in a hashTable in KEYDIR_HASH mode. DirItems are
+// shared by clones of the KeyDir, so never modify a DirItem after it is put.
+//
+// In KEYDIR_HASH mode keys are read from records, so the errors of reading
+// them are returned as well.
 type KeyDir struct {
-    mp      map[string]*DirItem
+    tree        *btree.BTree
+    table       *compactTable
+    hashes      *hashTable
+    keyBytes    int64           // of the tree
 }
 
 func NewKeyDir() *KeyDir {
     kd := &KeyDir {
-        mp: make(map[string]*DirItem),
+        tree: btree.New(KEYDIR_BTREE_DEGREE),
     }
     return kd
 }
 
+// readKey is used in KEYDIR_HASH mode only
+func newKeyDirOf(mode int, readKey keyReader) *KeyDir {
+    switch mode {
+    case KEYDIR_COMPACT:
+        return &KeyDir{table: newCompactTable(COMPACT_MIN_SLOTS)}
+    case KEYDIR_HASH:
+        return &KeyDir{hashes: newHashTable(readKey)}
+    }
+    return NewKeyDir()
+}
+
+// walks a KeyDir in key order
+type keyDirIterator interface {
+    Valid() bool
+    Key() []byte
+    Value() interface{}
+    Seek(key []byte)
+    SeekToFirst()
+    SeekToLast()
+    Next()
+    Prev()
+}
+
 func (kd *KeyDir) Get(key []byte) (*DirItem, error) {
-    v, ok := kd.mp[string(key)]
+    if kd.hashes != nil {
+        return kd.hashes.get(key)
+    }
+    if kd.table != nil {
+        di, ok := kd.table.get(key)
+        if !ok {
+            return nil, ErrKeyNotFound
+        }
+        return di, nil
+    }
+    v, ok := kd.tree.Get(key)
     if !ok {
         return nil, ErrKeyNotFound
     }
-    return v, nil
+    return v.(*DirItem), nil
 }
 
+// GetAt returns the item of key if it points to the record at fileId and
+// valuePos, the record is known to be of key so no key is read
+func (kd *KeyDir) GetAt(key []byte, fileId int64, valuePos int64) (*DirItem, bool) {
+    if kd.hashes != nil {
+        return kd.hashes.getAt(key, fileId, valuePos)
+    }
+    di, err := kd.Get(key)
+    if err != nil || di.fileId != fileId || di.valuePos != valuePos {
+        return nil, false
+    }
+    return di, true
+}
+
+// fails with ErrKeyDirOverflow if di doesn't fit in the compact table
 func (kd *KeyDir) Put(key []byte, di *DirItem) error {
-    kd.mp[string(key)] = di
+    return kd.Replace(key, nil, di)
+}
+
+// Replace puts di for key, old is an item key is known to point to, i.e. got
+// by Get, or nil. In KEYDIR_HASH mode the key isn't read if kd still has old.
+func (kd *KeyDir) Replace(key []byte, old *DirItem, di *DirItem) error {
+    if kd.hashes != nil {
+        return kd.hashes.put(key, old, di)
+    }
+    if kd.table != nil {
+        return kd.table.put(key, di)
+    }
+    if _, replaced := kd.tree.Put(key, di); !replaced {
+        kd.keyBytes += int64(len(key))
+    }
     return nil
 }
 
 func (kd *KeyDir) Del(key []byte) error {
-    if _, ok := kd.mp[string(key)]; !ok {
+    if kd.hashes != nil {
+        if ok, err := kd.hashes.del(key); err != nil {
+            return err
+        } else if !ok {
+            return ErrKeyNotFound
+        }
+        return nil
+    }
+    if kd.table != nil {
+        if !kd.table.del(key) {
+            return ErrKeyNotFound
+        }
+        return nil
+    }
+    if _, ok := kd.tree.Delete(key); !ok {
         return ErrKeyNotFound
     }
-    delete(kd.mp, string(key))
+    kd.keyBytes -= int64(len(key))
     return nil
 }
 
+func (kd *KeyDir) Len() int {
+    if kd.hashes != nil {
+        return kd.hashes.len()
+    }
+    if kd.table != nil {
+        return kd.table.used
+    }
+    return kd.tree.Len()
+}
+
 func (kd *KeyDir) Clear() {
-    kd.mp = make(map[string]*DirItem)
+    if kd.hashes != nil {
+        kd.hashes.clear()
+        return
+    }
+    if kd.table != nil {
+        kd.table.clear()
+        return
+    }
+    kd.tree.Clear()
+    kd.keyBytes = 0
+}
+
+// MemUsage returns bytes held by the KeyDir, estimated in btree mode.
+// Clones share memory, which is counted by each of them.
+func (kd *KeyDir) MemUsage() int64 {
+    if kd.hashes != nil {
+        return kd.hashes.memUsage()
+    }
+    if kd.table != nil {
+        return kd.table.memUsage()
+    }
+    return int64(kd.tree.Len()) * KEYDIR_BTREE_ITEM_SIZE + kd.keyBytes
+}
+
+// Clone returns a point-in-time copy of the KeyDir, it's cheap since
+// the underlying tree is copy-on-write.
+func (kd *KeyDir) Clone() *KeyDir {
+    if kd.hashes != nil {
+        return &KeyDir{hashes: kd.hashes.clone()}
+    }
+    if kd.table != nil {
+        return &KeyDir{table: kd.table.clone()}
+    }
+    return &KeyDir{
+        tree: kd.tree.Clone(),
+        keyBytes: kd.keyBytes,
+    }
+}
+
+// ForEach calls fn for every item, stops at the first error. Items are in
+// key order in btree mode only, in the other modes fn may delete keys but
+// must not put any.
+func (kd *KeyDir) ForEach(fn func(key []byte, di *DirItem) error) error {
+    return kd.ForEachMatch(nil, fn)
+}
+
+// ForEachMatch calls fn for the items matched, in KEYDIR_HASH mode only the
+// keys of them are read
+func (kd *KeyDir) ForEachMatch(match func(di *DirItem) bool, fn func(key []byte, di *DirItem) error) error {
+    if kd.hashes != nil {
+        return kd.hashes.forEach(match, fn)
+    }
+    if kd.table != nil {
+        return kd.table.forEach(match, fn)
+    }
+    var err error
+    kd.tree.ForEach(func(key []byte, v interface{}) bool {
+        if di := v.(*DirItem); match == nil || match(di) {
+            err = fn(key, di)
+        }
+        return err == nil
+    })
+    return err
+}
+
+// the KeyDir must not be modified while iterating, the compact table sorts
+// all keys when the iterator is created, and the hash table reads them too
+func (kd *KeyDir) NewIterator() (keyDirIterator, error) {
+    return kd.newRangeIterator(nil)
 }
 
+// an iterator of the compact and hash tables only sorts the keys of r, a nil
+// r is all keys. The tree ignores r, its iterator is cheap anyway.
+func (kd *KeyDir) newRangeIterator(r *keyRange) (keyDirIterator, error) {
+    if kd.hashes != nil {
+        return kd.hashes.newIterator(r)
+    }
+    if kd.table != nil {
+        return kd.table.newIterator(r), nil
+    }
+    return kd.tree.NewIterator(), nil
+}
+
+// keyRange is the keys in [start, end) matched, only the first limit of
+// them are kept if limit > 0
+type keyRange struct {
+    start       []byte
+    end         []byte          // nil means no upper bound
+    match       func(di *DirItem) bool
+    limit       int
+}
+
+type rangeEntry struct {
+    key         []byte
+    di          *DirItem
+    ref         uint64          // slot in a compact table
+}
+
+// a max-heap of entries by key, to keep the first limit keys
+type rangeHeap []rangeEntry
+
+func (h rangeHeap) Len() int { return len(h) }
+func (h rangeHeap) Less(i, j int) bool { return bytes.Compare(h[i].key, h[j].key) > 0 }
+func (h rangeHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+func (h *rangeHeap) Push(x interface{}) { *h = append(*h, x.(rangeEntry)) }
+func (h *rangeHeap) Pop() interface{} {
+    old := *h
+    e := old[len(old) - 1]
+    *h = old[:len(old) - 1]
+    return e
+}
+
+func (r *keyRange) matches(di *DirItem) bool {
+    return r == nil || r.match == nil || r.match(di)
+}
+
+// add e to h if its key is in r
+func (r *keyRange) add(h *rangeHeap, e rangeEntry) {
+    if r == nil {
+        *h = append(*h, e)
+        return
+    }
+    if bytes.Compare(e.key, r.start) < 0 || (r.end != nil && bytes.Compare(e.key, r.end) >= 0) {
+        return
+    }
+    if r.limit <= 0 {
+        *h = append(*h, e)
+    } else if len(*h) < r.limit {
+        heap.Push(h, e)
+    } else if bytes.Compare(e.key, (*h)[0].key) < 0 {
+        (*h)[0] = e
+        heap.Fix(h, 0)
+    }
+}
+
+// the entries added in key order
+func sortRange(h rangeHeap) []rangeEntry {
+    sort.Slice(h, func(a, b int) bool { return bytes.Compare(h[a].key, h[b].key) < 0 })
+    return h
+}
+
+// keys of the KEYDIR_HASH mode are read by readKey from now on
+func (kd *KeyDir) setKeyReader(readKey keyReader) {
+    if kd.hashes != nil {
+        kd.hashes.readKey = readKey
+    }
+}
+
+type KeyDirStats struct {
+    Mode            int
+    Keys            int
+    MemBytes        int64       // of the keydirs of the db and the active file, and the slot index
+    SlotIndexBytes  int64
+}
+
+func (bc *BitCask) newKeyDir() *KeyDir {
+    return newKeyDirOf(bc.opts.keyDirMode, bc.readKey)
+}
+
+// a clone of keyDir to read without bc.mu held, keys of KEYDIR_HASH mode
+// are read under the read lock. requires bc.mu held
+func (bc *BitCask) cloneKeyDir() *KeyDir {
+    kd := bc.keyDir.Clone()
+    kd.setKeyReader(bc.readKeyLocked)
+    return kd
+}
+
+// the key of the record di points to, requires bc.mu held
+func (bc *BitCask) readKey(di *DirItem) ([]byte, error) {
+    offset := di.valuePos - RecordValueOffset()
+    rec, err := bc.refRecord(di.fileId, offset)
+    if err != nil {
+        return nil, err
+    }
+    defer bc.unrefRecord(di.fileId, offset)
+    return append([]byte(nil), rec.key...), nil
+}
+
+func (bc *BitCask) readKeyLocked(di *DirItem) ([]byte, error) {
+    bc.mu.RLock()
+    defer bc.mu.RUnlock()
+    return bc.readKey(di)
+}
+
+func (bc *BitCask) KeyDirStats() *KeyDirStats {
+    bc.mu.RLock()
+    defer bc.mu.RUnlock()
+    return &KeyDirStats{
+        Mode: bc.opts.keyDirMode,
+        Keys: bc.keyDir.Len(),
+        MemBytes: bc.keyDir.MemUsage() + bc.activeKD.MemUsage() + bc.slotIndexMemUsage(),
+        SlotIndexBytes: bc.slotIndexMemUsage(),
+    }
+}
@@ -0,0 +1,147 @@
+package bitcask
+
+import (
+    "fmt"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    . "gopkg.in/check.v1"
+)
+
+type testLockSuite struct {
+    path string
+}
+
+var _ = Suite(&testLockSuite{})
+
+func (s *testLockSuite) SetUpTest(c *C) {
+    s.path = c.MkDir()
+}
+
+func readOnlyOptions() *Options {
+    opts := NewOptions()
+    opts.SetReadOnly(true)
+    return opts
+}
+
+func (s *testLockSuite) TestExclusive(c *C) {
+    bc, err := Open(s.path, NewOptions())
+    c.Assert(err, IsNil)
+
+    _, err = Open(s.path, NewOptions())
+    c.Assert(err, Equals, ErrLocked)
+    _, err = Open(s.path, readOnlyOptions())
+    c.Assert(err, Equals, ErrLocked)
+
+    // the lock survives ClearAll
+    c.Assert(bc.ClearAll(), IsNil)
+    _, err = Open(s.path, NewOptions())
+    c.Assert(err, Equals, ErrLocked)
+
+    bc.Close()
+    bc, err = Open(s.path, NewOptions())
+    c.Assert(err, IsNil)
+    bc.Close()
+}
+
+func (s *testLockSuite) TestReadOnly(c *C) {
+    opts := NewOptions()
+    opts.SetMaxFileSize(1024)
+    bc, err := Open(s.path, opts)
+    c.Assert(err, IsNil)
+    for i := 0; i < 50; i++ {
+        c.Assert(bc.Set([]byte(fmt.Sprintf("key%02d", i)), []byte(fmt.Sprintf("value%02d", i))), IsNil)
+    }
+    bc.Close()
+
+    r1, err := Open(s.path, readOnlyOptions())
+    c.Assert(err, IsNil)
+    defer r1.Close()
+    r2, err := Open(s.path, readOnlyOptions())
+    c.Assert(err, IsNil)
+    defer r2.Close()
+    _, err = Open(s.path, NewOptions())
+    c.Assert(err, Equals, ErrLocked)
+
+    for _, r := range []*BitCask{r1, r2} {
+        for i := 0; i < 50; i++ {
+            val, err := r.Get([]byte(fmt.Sprintf("key%02d", i)))
+            c.Assert(err, IsNil)
+            c.Assert(string(val), Equals, fmt.Sprintf("value%02d", i))
+        }
+    }
+
+    n := 0
+    err = r1.PrefixScan([]byte("key"), func(key, value []byte) error {
+        n++
+        return nil
+    })
+    c.Assert(err, IsNil)
+    c.Assert(n, Equals, 50)
+
+    snap, err := r1.Snapshot()
+    c.Assert(err, IsNil)
+    val, err := snap.Get([]byte("key49"))
+    c.Assert(err, IsNil)
+    c.Assert(string(val), Equals, "value49")
+    snap.Release()
+
+    c.Assert(r1.Set([]byte("key00"), []byte("x")), Equals, ErrReadOnly)
+    c.Assert(r1.Del([]byte("key00")), Equals, ErrReadOnly)
+    c.Assert(r1.Expire([]byte("key00"), 1), Equals, ErrReadOnly)
+    b := NewBatch()
+    b.Set([]byte("key00"), []byte("x"))
+    c.Assert(r1.Write(b), Equals, ErrReadOnly)
+    done := make(chan int, 1)
+    r1.Merge(done)
+    c.Assert(<-done, Equals, 0)
+    c.Assert(r1.ClearAll(), Equals, ErrReadOnly)
+}
+
+// a read-only open never writes, so it works on a read-only directory
+func (s *testLockSuite) TestReadOnlyDir(c *C) {
+    opts := NewOptions()
+    opts.SetMaxFileSize(1024)
+    bc, err := Open(s.path, opts)
+    c.Assert(err, IsNil)
+    for i := 0; i < 50; i++ {
+        c.Assert(bc.Set([]byte(fmt.Sprintf("key%02d", i)), []byte(fmt.Sprintf("value%02d", i))), IsNil)
+    }
+    bc.Close()
+    // one data file is left without a hint
+    hints, err := filepath.Glob(s.path + "/*.hint")
+    c.Assert(err, IsNil)
+    c.Assert(os.Remove(hints[0]), IsNil)
+
+    files, err := ioutil.ReadDir(s.path)
+    c.Assert(err, IsNil)
+    for _, f := range files {
+        c.Assert(os.Chmod(s.path + "/" + f.Name(), 0444), IsNil)
+    }
+    c.Assert(os.Chmod(s.path, 0555), IsNil)
+    defer os.Chmod(s.path, 0755)
+
+    r, err := Open(s.path, readOnlyOptions())
+    c.Assert(err, IsNil)
+    defer r.Close()
+    for i := 0; i < 50; i++ {
+        val, err := r.Get([]byte(fmt.Sprintf("key%02d", i)))
+        c.Assert(err, IsNil)
+        c.Assert(string(val), Equals, fmt.Sprintf("value%02d", i))
+    }
+
+    // data files are opened read-only, even where permissions aren't checked
+    df, err := r.refDataFile(r.GetMinDataFileId())
+    c.Assert(err, IsNil)
+    _, err = df.FileReader.(*FileWithBuffer).f.Write([]byte("x"))
+    c.Assert(err, NotNil)
+    r.unrefDataFile(df.id)
+
+    after, err := ioutil.ReadDir(s.path)
+    c.Assert(err, IsNil)
+    c.Assert(len(after), Equals, len(files))
+    for i, f := range after {
+        c.Assert(f.Name(), Equals, files[i].Name())
+        c.Assert(f.Size(), Equals, files[i].Size())
+    }
+}
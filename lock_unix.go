@@ -0,0 +1,37 @@
+// +build !windows
+
+package bitcask
+
+import (
+    "os"
+    "syscall"
+)
+
+type fileLock struct {
+    f   *os.File
+}
+
+// flock path, shared locks can be held by many readers but not with an exclusive one
+func lockFile(path string, shared bool) (*fileLock, error) {
+    f, err := os.OpenFile(path, os.O_RDONLY | os.O_CREATE, 0644)
+    if err != nil {
+        return nil, err
+    }
+    how := syscall.LOCK_EX
+    if shared {
+        how = syscall.LOCK_SH
+    }
+    if err := syscall.Flock(int(f.Fd()), how | syscall.LOCK_NB); err != nil {
+        f.Close()
+        if err == syscall.EWOULDBLOCK {
+            return nil, ErrLocked
+        }
+        return nil, err
+    }
+    return &fileLock{f: f}, nil
+}
+
+func (l *fileLock) unlock() error {
+    syscall.Flock(int(l.f.Fd()), syscall.LOCK_UN)
+    return l.f.Close()
+}
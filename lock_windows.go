@@ -0,0 +1,26 @@
+// +build windows
+
+package bitcask
+
+import (
+    "log"
+    "os"
+)
+
+type fileLock struct {
+    f   *os.File
+}
+
+// flock is not available, the LOCK file is only created
+func lockFile(path string, shared bool) (*fileLock, error) {
+    f, err := os.OpenFile(path, os.O_RDONLY | os.O_CREATE, 0644)
+    if err != nil {
+        return nil, err
+    }
+    log.Printf("file lock is not supported on windows, %s is not locked", path)
+    return &fileLock{f: f}, nil
+}
+
+func (l *fileLock) unlock() error {
+    return l.f.Close()
+}
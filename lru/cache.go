@@ -2,6 +2,7 @@ package lru
 
 import (
     "fmt"
+    "sync"
     "container/list"
 )
 
@@ -13,11 +14,14 @@ type entry struct {
     key         interface{}
     value       interface{}
     refCount    int
+    removed     bool    // evict once refCount drops to 0
 }
 
 type EvitCallback func(key interface{}, value interface{})
 
+// Cache is safe for concurrent use, onEvit is called with the cache locked.
 type Cache struct {
+    mu          sync.Mutex
     capacity    int
     l           *list.List
     hash        map[interface{}]*list.Element
@@ -35,23 +39,46 @@ func NewCache(capacity int, onEvit EvitCallback) *Cache {
 }
 
 func (c *Cache) Put(key interface{}, value interface{}) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    c.put(key, value)
+}
+
+func (c *Cache) put(key interface{}, value interface{}) *list.Element {
     if e, ok := c.hash[key]; ok {
         c.l.MoveToFront(e)
         e.Value.(*entry).value = value
-        return
+        return e
     }
 
     if len(c.hash) >= c.capacity {
-        c.Prune(c.capacity - 1, false)
+        c.prune(c.capacity - 1, false)
     }
 
-    e := &entry{key, value, 0}
+    e := &entry{key, value, 0, false}
     ent := c.l.PushFront(e)
     c.hash[key] = ent
-    return
+    return ent
+}
+
+// PutAndRef refs the value of key, putting value first if key is not in cache.
+// It returns the value in cache and whether it's the one given.
+func (c *Cache) PutAndRef(key interface{}, value interface{}) (interface{}, bool) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    if e, ok := c.hash[key]; ok {
+        c.l.MoveToFront(e)
+        e.Value.(*entry).refCount++
+        return e.Value.(*entry).value, false
+    }
+    e := c.put(key, value)
+    e.Value.(*entry).refCount++
+    return value, true
 }
 
 func (c *Cache) Ref(key interface{}) (interface{}, error) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
     if e, ok := c.hash[key]; !ok {
         return nil, ErrNotInCache
     } else {
@@ -62,15 +89,57 @@ func (c *Cache) Ref(key interface{}) (interface{}, error) {
 }
 
 func (c *Cache) Unref(key interface{}) error {
+    c.mu.Lock()
+    defer c.mu.Unlock()
     if e, ok := c.hash[key]; !ok {
         return ErrNotInCache
     } else {
-        e.Value.(*entry).refCount--
+        ee := e.Value.(*entry)
+        ee.refCount--
+        if ee.removed && ee.refCount <= 0 {
+            c.remove(e)
+        }
         return nil
     }
 }
 
+// Remove drops key from the cache. If it's referenced, it's still found by
+// Ref and onEvit is called when it's unrefed by all.
+func (c *Cache) Remove(key interface{}) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    if e, ok := c.hash[key]; ok {
+        c.remove(e)
+    }
+}
+
+// RemoveAll removes every key as Remove does
+func (c *Cache) RemoveAll() {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    for e := c.l.Front(); e != nil; {
+        next := e.Next()
+        c.remove(e)
+        e = next
+    }
+}
+
+func (c *Cache) remove(e *list.Element) {
+    ee := e.Value.(*entry)
+    if ee.refCount > 0 {
+        ee.removed = true
+        return
+    }
+    c.l.Remove(e)
+    delete(c.hash, ee.key)
+    if c.onEvit != nil {
+        c.onEvit(ee.key, ee.value)
+    }
+}
+
 func (c *Cache) Size() int {
+    c.mu.Lock()
+    defer c.mu.Unlock()
     return c.l.Len()
 }
 
@@ -79,6 +148,12 @@ func (c *Cache) Close() {
 }
 
 func (c *Cache) Prune(limit int, force bool) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    c.prune(limit, force)
+}
+
+func (c *Cache) prune(limit int, force bool) {
     removeEntries := make([]*list.Element, 0)
 
     for e := c.l.Back(); e != nil; e = e.Prev() {
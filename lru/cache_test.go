@@ -1,7 +1,8 @@
 package lru_test
 
 import (
-    _ "fmt"
+    "fmt"
+    "sync"
     "testing"
     "github.com/rocket323/bitcask/lru"
 )
@@ -94,3 +95,63 @@ func TestNotEvitAfterUnref(t *testing.T) {
         t.Errorf("get failed, err=%+v\n", err)
     }
 }
+
+func TestPutAndRefConcurrent(t *testing.T) {
+    c := lru.NewCache(10, nil)
+    defer c.Close()
+
+    var wg sync.WaitGroup
+    winners := make(chan string, 8)
+    for i := 0; i < 8; i++ {
+        wg.Add(1)
+        go func(i int) {
+            defer wg.Done()
+            v, ok := c.PutAndRef(1, fmt.Sprintf("v%d", i))
+            if ok {
+                winners <- v.(string)
+            }
+            c.Unref(1)
+        }(i)
+    }
+    wg.Wait()
+    close(winners)
+
+    if len(winners) != 1 {
+        t.Errorf("%d values put for the same key", len(winners))
+    }
+    v, err := c.Ref(1)
+    if err != nil || v.(string) != <-winners {
+        t.Errorf("ref failed, v=%v err=%+v\n", v, err)
+    }
+}
+
+func TestRemoveWhenRef(t *testing.T) {
+    evicted := make([]interface{}, 0)
+    c := lru.NewCache(10, func(k interface{}, v interface{}) {
+        evicted = append(evicted, k)
+    })
+    defer c.Close()
+    c.Put(1, "nihao")
+    c.Put(2, "hello")
+    c.Ref(1)
+
+    c.Remove(2)
+    if len(evicted) != 1 || evicted[0] != 2 {
+        t.Errorf("unreferenced key not evicted, evicted=%v", evicted)
+    }
+    c.RemoveAll()
+    if len(evicted) != 1 {
+        t.Errorf("referenced key evicted, evicted=%v", evicted)
+    }
+    if _, err := c.Ref(1); err != nil {
+        t.Errorf("removed key not found before unref, err=%+v", err)
+    }
+    c.Unref(1)
+    c.Unref(1)
+    if len(evicted) != 2 || evicted[1] != 1 {
+        t.Errorf("removed key not evicted after unref, evicted=%v", evicted)
+    }
+    if _, err := c.Ref(1); err != lru.ErrNotInCache {
+        t.Errorf("get failed, err=%+v", err)
+    }
+}
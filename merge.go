@@ -1,88 +1,527 @@
 package bitcask
 
 import (
-    "time"
+    "bytes"
+    "encoding/binary"
+    "hash/crc32"
+    "io/ioutil"
     "log"
-    "sync/atomic"
+    "os"
+    "path/filepath"
+    "sort"
+    "time"
+)
+
+// Merge writes live records of the data files into a staging dir with their
+// hint files, then installs them with renames once a manifest is written.
+// On open, a merge with manifest is resumed, otherwise it's rolled back.
+//
+//   dir/merge/000000012.data      merged output
+//   dir/merge/000000012.hint
+//   dir/merge/MANIFEST            input and output fileIds, commit point
+
+const (
+    MERGE_DIR = "merge"
+    MERGE_MANIFEST = "MANIFEST"
 )
 
 func (bc *BitCask) Merge(done chan int) {
     go bc.merge(done)
 }
 
+// merge all data files below the active file, sends 1 to done on success, 0 on failure
 func (bc *BitCask) merge(done chan int) {
-    if !atomic.CompareAndSwapInt32(&bc.isMerging, 0, 1) {
-        log.Println("there is a merge process running.")
-        return
-    }
-    defer atomic.CompareAndSwapInt32(&bc.isMerging, 1, 0)
     log.Println("start merge...")
 
     begin := time.Now()
     bc.mu.Lock()
-    end := bc.activeFile.id
+    inputs := make([]int64, 0, len(bc.fileMetas))
+    for _, meta := range bc.fileMetas {
+        inputs = append(inputs, meta.FileId)
+    }
     bc.mu.Unlock()
 
-    for fileId := bc.minDataFileId; fileId < end; fileId = bc.NextDataFileId(fileId) {
-        err := bc.mergeDataFile(fileId)
+    if err := bc.runMerge(inputs); err != nil {
+        log.Printf("merge failed, err = %s", err)
+        done <- 0
+        return
+    }
+    d := time.Now().Sub(begin)
+    log.Printf("merge succ. cost %.2f seconds", d.Seconds())
+    done <- 1
+}
+
+// Merge live records of inputs into new files. The new files take the fileIds
+// reserved right after the active file, so they're newer than the inputs and
+// older than any write done after the merge starts.
+func (bc *BitCask) mergeFiles(inputs []int64) error {
+    if len(inputs) == 0 {
+        return nil
+    }
+    sort.Slice(inputs, func(i, j int) bool { return inputs[i] < inputs[j] })
+    isInput := make(map[int64]bool)
+    for _, fileId := range inputs {
+        isInput[fileId] = true
+    }
+
+    mergeDir := bc.getMergeDir()
+    if err := os.RemoveAll(mergeDir); err != nil {
+        return err
+    }
+    if err := os.Mkdir(mergeDir, 0755); err != nil {
+        return err
+    }
+
+    bc.mu.Lock()
+    firstOutput := bc.activeFile.id + 1
+    if err := bc.rotateActiveFile(firstOutput + int64(len(inputs))); err != nil {
+        bc.mu.Unlock()
+        os.RemoveAll(mergeDir)
+        return err
+    }
+    kd := bc.cloneKeyDir()
+
+    // a tombstone can be dropped only if no older file is left out of the merge
+    firstKept := bc.activeFile.id
+    for _, meta := range bc.fileMetas {
+        if !isInput[meta.FileId] && meta.FileId < firstKept {
+            firstKept = meta.FileId
+        }
+    }
+    bc.mu.Unlock()
+
+    mw := newMergeWriter(bc, firstOutput, firstOutput + int64(len(inputs)) - 1)
+    now := time.Now().Unix()
+    dropped := make([][]byte, 0)
+    for _, fileId := range inputs {
+        keys, err := bc.mergeDataFile(fileId, kd, mw, fileId < firstKept, now)
         if err != nil {
-            log.Println("merge data-file[%d] failed, err=%s", fileId, err)
-            return
+            log.Printf("merge data-file[%d] failed, err = %s", fileId, err)
+            mw.abort()
+            os.RemoveAll(mergeDir)
+            return err
         }
+        dropped = append(dropped, keys...)
+    }
+    outputs, err := mw.finish()
+    if err != nil {
+        os.RemoveAll(mergeDir)
+        return err
+    }
 
-        // add delete file record
+    m := &mergeManifest{
+        inputs: inputs,
+        outputs: make([]int64, 0, len(outputs)),
+    }
+    for _, out := range outputs {
+        m.outputs = append(m.outputs, out.fileId)
+    }
+    if err := writeMergeManifest(mergeDir + "/" + MERGE_MANIFEST, m); err != nil {
+        os.RemoveAll(mergeDir)
+        return err
+    }
+
+    bc.mu.Lock()
+    err = bc.installMerge(m, outputs, dropped)
+    bc.mu.Unlock()
+    if err != nil {
+        // the manifest is kept, the merge is resumed on next open
+        log.Printf("install merge failed, err = %s", err)
+        return err
+    }
+    return os.RemoveAll(mergeDir)
+}
+
+// copy live records of data-file[fileId] to mw, returns the keys dropped
+func (bc *BitCask) mergeDataFile(fileId int64, kd *KeyDir, mw *mergeWriter, dropTombstone bool, now int64) ([][]byte, error) {
+    fc, err := bc.getFileCipher(fileId)
+    if err != nil {
+        return nil, err
+    }
+    df, err := NewDataFile(bc.GetDataFilePath(fileId), fileId, fc, bc.opts.mmap)
+    if err != nil {
+        return nil, err
+    }
+    defer df.Close()
+
+    begin := time.Now()
+    dropped := make([][]byte, 0)
+    err = df.ForEachItem(func (rec *Record, offset int64) error {
+        if rec.flag & (RECORD_FLAG_MERGE | RECORD_FLAG_BATCH_COMMIT) > 0 {
+            return nil
+        }
+        kdItem, ok := kd.GetAt(rec.key, fileId, offset + RecordValueOffset())
+        if !ok {
+            return nil
+        }
+        // the value is written out before df is closed, but the key is kept
+        rec.ownKey()
+        // skip deleted and exprired key
+        deleted := kdItem.flag & RECORD_FLAG_DELETED > 0
+        expired := !deleted && isExpired(kdItem.expration, now)
+        if (deleted || expired) && dropTombstone {
+            dropped = append(dropped, rec.key)
+            return nil
+        }
+        // an older value may be in a file left out of the merge
+        if expired {
+            rec = &Record{
+                flag: RECORD_FLAG_DELETED,
+                keySize: int64(len(rec.key)),
+                key: rec.key,
+            }
+        }
+        // the record is rewritten alone, not as part of a batch
+        rec.flag &^= RECORD_FLAG_BATCH
+        return mw.add(rec)
+    })
+    if err != nil {
+        return nil, err
+    }
+
+    log.Printf("merge data-file[%d] succ. costs %.2f seconds", fileId,
+            time.Now().Sub(begin).Seconds())
+    return dropped, nil
+}
+
+// requires bc.mu held
+func (bc *BitCask) installMerge(m *mergeManifest, outputs []*mergeOutput, dropped [][]byte) error {
+    if err := bc.moveMergeOutputs(m); err != nil {
+        return err
+    }
+
+    isInput := make(map[int64]bool)
+    for _, fileId := range m.inputs {
+        isInput[fileId] = true
+    }
+
+    // keys still pointing to inputs are the ones merged, the others
+    // are overwritten during merge. Inputs are removed after it, as keys
+    // are read from them in KEYDIR_HASH mode.
+    for _, out := range outputs {
+        bc.fileStat(out.fileId).TotalBytes = out.size
+        err := out.kd.ForEach(func(key []byte, di *DirItem) error {
+            cur, err := bc.keyDir.Get(key)
+            if err != nil && err != ErrKeyNotFound {
+                return err
+            }
+            if err == nil && isInput[cur.fileId] {
+                if err := bc.keyDir.Put(key, di); err != nil {
+                    return err
+                }
+                // expired keys are merged into tombstones
+                if di.flag & RECORD_FLAG_DELETED > 0 {
+                    bc.unindexKey(key)
+                } else {
+                    bc.indexKey(key, di, false)
+                }
+            } else {
+                bc.addDeadBytes(out.fileId, recordSize(key, di))
+            }
+            return nil
+        })
+        if err != nil {
+            return err
+        }
+    }
+    for _, key := range dropped {
+        cur, err := bc.keyDir.Get(key)
+        if err != nil && err != ErrKeyNotFound {
+            return err
+        }
+        if err == nil && isInput[cur.fileId] {
+            if err := bc.keyDir.Del(key); err != nil {
+                return err
+            }
+            bc.unindexKey(key)
+        }
+    }
+    if err := bc.removeMergeInputs(m); err != nil {
+        return err
+    }
+
+    metas := make([]*FileMeta, 0, len(bc.fileMetas))
+    for _, meta := range bc.fileMetas {
+        if !isInput[meta.FileId] {
+            metas = append(metas, meta)
+        }
+    }
+    for _, out := range outputs {
+        metas = append(metas, &FileMeta{FileId: out.fileId, Md5: out.md5})
+    }
+    sort.Slice(metas, func(i, j int) bool { return metas[i].FileId < metas[j].FileId })
+    bc.fileMetas = metas
+    if len(metas) > 0 {
+        bc.minDataFileId = metas[0].FileId
+    } else {
+        bc.minDataFileId = bc.activeFile.id
+    }
+
+    // add delete file records for replication
+    for _, fileId := range m.inputs {
         rec := &Record{
             flag: RECORD_FLAG_MERGE,
             valueSize: fileId,
         }
-        if err := bc.AddRecord(rec, false); err != nil {
+        if err := bc.addRecord(rec, false); err != nil {
             log.Printf("add merge info for data-file[%d] failed, err = %s", fileId, err)
-            return
+            return err
         }
     }
-    d := time.Now().Sub(begin)
-    log.Printf("merge succ. cost %.2f seconds", d.Seconds())
-    done <- 1
+    return nil
 }
 
-func (bc *BitCask) mergeDataFile(fileId int64) error {
-    df, err := bc.dfCache.Ref(fileId)
-    if err != nil {
+// move merged files in place and remove inputs, it's safe to apply it again
+// requires bc.mu held
+func (bc *BitCask) applyMergeManifest(m *mergeManifest) error {
+    if err := bc.moveMergeOutputs(m); err != nil {
         return err
     }
-    defer bc.dfCache.Unref(fileId)
+    return bc.removeMergeInputs(m)
+}
 
-    begin := time.Now()
-    err = df.ForEachItem(func (rec *Record, offset int64) error {
-        kdItem, _ := bc.keyDir.Get(rec.key)
-        if kdItem != nil && kdItem.fileId == df.id &&
-                int64(kdItem.valuePos) - RecordValueOffset() == offset {
-            // skip exprired key
-            if int64(kdItem.expration) <= begin.Unix() {
-                return nil
+func (bc *BitCask) moveMergeOutputs(m *mergeManifest) error {
+    for _, fileId := range m.outputs {
+        moves := [][2]string{
+            {bc.getMergeDataFilePath(fileId), bc.GetDataFilePath(fileId)},
+            {bc.getMergeHintFilePath(fileId), bc.getHintFilePath(fileId)},
+        }
+        for _, mv := range moves {
+            if _, err := os.Stat(mv[0]); os.IsNotExist(err) {
+                continue
             }
-
-            err := bc.AddRecord(rec, false)
-            if err != nil {
+            if err := os.Rename(mv[0], mv[1]); err != nil {
                 return err
             }
         }
+    }
+    return nil
+}
+
+func (bc *BitCask) removeMergeInputs(m *mergeManifest) error {
+    for _, fileId := range m.inputs {
+        if err := bc.removeDataFile(fileId); err != nil {
+            return err
+        }
+    }
+    return syncDir(bc.dir)
+}
+
+// resume a committed merge or roll back an interrupted one
+// requires bc.mu held
+func (bc *BitCask) recoverMerge() error {
+    mergeDir := bc.getMergeDir()
+    if _, err := os.Stat(mergeDir); os.IsNotExist(err) {
         return nil
-    })
+    }
 
+    m, err := readMergeManifest(mergeDir + "/" + MERGE_MANIFEST)
     if err != nil {
+        log.Printf("merge was not committed, roll back. err = %s", err)
+        return os.RemoveAll(mergeDir)
+    }
+    log.Printf("resume merge of data-files %v into %v", m.inputs, m.outputs)
+    if err := bc.applyMergeManifest(m); err != nil {
         return err
     }
-    end := time.Now()
+    return os.RemoveAll(mergeDir)
+}
+
+///////////////////////////////////
 
-    // remove data file and hint file
-    if err := bc.removeDataFile(fileId); err != nil {
-        log.Fatalf("remove data-file[%d] failed, err = %s", fileId, err)
+type mergeOutput struct {
+    fileId      int64
+    size        int64
+    md5         []byte
+    kd          *KeyDir
+}
+
+// mergeWriter writes merged records into output files in the staging dir,
+// moving to the next reserved fileId when a file is full.
+type mergeWriter struct {
+    bc          *BitCask
+    nextId      int64
+    lastId      int64
+    af          *ActiveFile
+    kd          *KeyDir
+    outputs     []*mergeOutput
+}
+
+func newMergeWriter(bc *BitCask, firstId int64, lastId int64) *mergeWriter {
+    return &mergeWriter{
+        bc: bc,
+        nextId: firstId,
+        lastId: lastId,
+        outputs: make([]*mergeOutput, 0),
+    }
+}
+
+func (mw *mergeWriter) add(rec *Record) error {
+    if mw.af == nil {
+        // the key file goes straight to the db dir, Restore drops it if the merge is rolled back
+        fc, err := mw.bc.newFileCipher(mw.nextId)
+        if err != nil {
+            return err
+        }
+        af, err := NewActiveFile(mw.bc.getMergeDataFilePath(mw.nextId), mw.nextId, mw.bc.opts.bufferSize, fc)
+        if err != nil {
+            return err
+        }
+        mw.af = af
+        mw.kd = NewKeyDir()
+        mw.nextId++
+    }
+
+    offset := mw.af.Size()
+    if err := mw.af.AddRecord(rec); err != nil {
         return err
     }
+    di := &DirItem{
+        flag: rec.flag,
+        fileId: mw.af.id,
+        valuePos: offset + RecordValueOffset(),
+        valueSize: rec.valueSize,
+        expration: rec.expration,
+    }
+    mw.kd.Put(rec.key, di)
 
-    log.Printf("merge data-file[%d] succ. costs %.2f seconds", fileId,
-            end.Sub(begin).Seconds())
+    // the last reserved file takes all that's left
+    if mw.af.Size() >= mw.bc.opts.maxFileSize && mw.af.id < mw.lastId {
+        return mw.closeOutput()
+    }
     return nil
 }
 
+func (mw *mergeWriter) closeOutput() error {
+    af := mw.af
+    mw.af = nil
+    if err := af.Sync(); err != nil {
+        af.Close()
+        return err
+    }
+    af.Close()
+
+    // the mtime is kept when the file is moved in place
+    sum, err := sumDataFile(af.Path())
+    if err != nil {
+        return err
+    }
+    if err := mw.bc.writeHintFile(mw.bc.getMergeHintFilePath(af.id), af.id, sum, mw.kd); err != nil {
+        return err
+    }
+    mw.outputs = append(mw.outputs, &mergeOutput{af.id, af.Size(), sum.md5, mw.kd})
+    return nil
+}
+
+func (mw *mergeWriter) finish() ([]*mergeOutput, error) {
+    if mw.af != nil {
+        if err := mw.closeOutput(); err != nil {
+            return nil, err
+        }
+    }
+    if err := syncDir(mw.bc.getMergeDir()); err != nil {
+        return nil, err
+    }
+    return mw.outputs, nil
+}
+
+func (mw *mergeWriter) abort() {
+    if mw.af != nil {
+        mw.af.Close()
+        mw.af = nil
+    }
+}
+
+///////////////////////////////////
+
+type mergeManifest struct {
+    inputs      []int64
+    outputs     []int64
+}
+
+func (m *mergeManifest) Encode() ([]byte, error) {
+    buf := new(bytes.Buffer)
+    var data = []interface{}{
+        uint32(len(m.inputs)),
+        m.inputs,
+        uint32(len(m.outputs)),
+        m.outputs,
+    }
+    for _, v := range data {
+        if err := binary.Write(buf, binary.LittleEndian, v); err != nil {
+            return nil, err
+        }
+    }
+    crc := crc32.ChecksumIEEE(buf.Bytes())
+    if err := binary.Write(buf, binary.LittleEndian, crc); err != nil {
+        return nil, err
+    }
+    return buf.Bytes(), nil
+}
+
+func parseMergeManifest(data []byte) (*mergeManifest, error) {
+    if len(data) < 4 {
+        return nil, ErrRecordCorrupted
+    }
+    body := data[:len(data) - 4]
+    if crc32.ChecksumIEEE(body) != binary.LittleEndian.Uint32(data[len(data) - 4:]) {
+        return nil, ErrRecordCorrupted
+    }
+
+    r := bytes.NewReader(body)
+    readIds := func() ([]int64, error) {
+        var n uint32
+        if err := binary.Read(r, binary.LittleEndian, &n); err != nil {
+            return nil, err
+        }
+        ids := make([]int64, n)
+        if err := binary.Read(r, binary.LittleEndian, ids); err != nil {
+            return nil, err
+        }
+        return ids, nil
+    }
+
+    m := &mergeManifest{}
+    var err error
+    if m.inputs, err = readIds(); err != nil {
+        return nil, err
+    }
+    if m.outputs, err = readIds(); err != nil {
+        return nil, err
+    }
+    return m, nil
+}
+
+// write the manifest to a temp file, then rename it in place
+func writeMergeManifest(path string, m *mergeManifest) error {
+    data, err := m.Encode()
+    if err != nil {
+        return err
+    }
+    tmpPath := path + ".tmp"
+    f, err := os.OpenFile(tmpPath, os.O_RDWR | os.O_CREATE | os.O_TRUNC, 0644)
+    if err != nil {
+        return err
+    }
+    if _, err := f.Write(data); err != nil {
+        f.Close()
+        return err
+    }
+    if err := f.Sync(); err != nil {
+        f.Close()
+        return err
+    }
+    f.Close()
+    if err := os.Rename(tmpPath, path); err != nil {
+        return err
+    }
+    return syncDir(filepath.Dir(path))
+}
+
+func readMergeManifest(path string) (*mergeManifest, error) {
+    data, err := ioutil.ReadFile(path)
+    if err != nil {
+        return nil, err
+    }
+    return parseMergeManifest(data)
+}
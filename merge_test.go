@@ -4,6 +4,8 @@ import (
     "time"
     "math/rand"
     "fmt"
+    "io/ioutil"
+    "os"
     "testing"
     . "gopkg.in/check.v1"
 )
@@ -44,7 +46,7 @@ func (s *testBitCaskSuite) TestMerge(c *C) {
 
     for i := 0; i < n; i++ {
         key := testRandomKey()
-        err := s.bc.Set(key, value)
+        err := s.bc.Set([]byte(key), value)
         c.Assert(err, IsNil)
         keys[key] = true
     }
@@ -54,7 +56,7 @@ func (s *testBitCaskSuite) TestMerge(c *C) {
 
     for i := 0; i < n; i++ {
         key := testRandomKey()
-        err := s.bc.Set(key, value)
+        err := s.bc.Set([]byte(key), value)
         c.Assert(err, IsNil)
         keys[key] = true
     }
@@ -63,8 +65,152 @@ func (s *testBitCaskSuite) TestMerge(c *C) {
 
     fmt.Printf("done\n")
     for k, _ := range keys {
-        _, err := s.bc.Get(k)
+        _, err := s.bc.Get([]byte(k))
         c.Assert(err, IsNil)
     }
 }
 
+
+type testMergeRecoverSuite struct {
+    path string
+    bc   *BitCask
+}
+
+var _ = Suite(&testMergeRecoverSuite{})
+
+func (s *testMergeRecoverSuite) SetUpTest(c *C) {
+    s.path = c.MkDir()
+    s.bc = s.open(c)
+
+    v := make([]byte, 100)
+    for i := 0; i < 200; i++ {
+        c.Assert(s.bc.Set([]byte(fmt.Sprintf("key%03d", i)), v), IsNil)
+    }
+    for i := 0; i < 200; i += 2 {
+        c.Assert(s.bc.Set([]byte(fmt.Sprintf("key%03d", i)), []byte(fmt.Sprintf("new%03d", i))), IsNil)
+    }
+    for i := 0; i < 200; i += 3 {
+        c.Assert(s.bc.Del([]byte(fmt.Sprintf("key%03d", i))), IsNil)
+    }
+}
+
+func (s *testMergeRecoverSuite) TearDownTest(c *C) {
+    s.bc.Close()
+}
+
+func (s *testMergeRecoverSuite) open(c *C) *BitCask {
+    opts := NewOptions()
+    opts.SetMaxFileSize(4096)
+    bc, err := Open(s.path, opts)
+    c.Assert(err, IsNil)
+    return bc
+}
+
+func (s *testMergeRecoverSuite) check(c *C) {
+    for i := 0; i < 200; i++ {
+        val, err := s.bc.Get([]byte(fmt.Sprintf("key%03d", i)))
+        switch {
+        case i % 3 == 0:
+            c.Assert(err, Equals, ErrKeyNotFound)
+        case i % 2 == 0:
+            c.Assert(err, IsNil)
+            c.Assert(string(val), Equals, fmt.Sprintf("new%03d", i))
+        default:
+            c.Assert(err, IsNil)
+            c.Assert(len(val), Equals, 100)
+        }
+    }
+}
+
+func (s *testMergeRecoverSuite) TestMergeAndReopen(c *C) {
+    done := make(chan int, 1)
+    s.bc.Merge(done)
+    c.Assert(<-done, Equals, 1)
+    s.check(c)
+
+    _, err := os.Stat(s.bc.getMergeDir())
+    c.Assert(os.IsNotExist(err), Equals, true)
+
+    s.bc.Close()
+    s.bc = s.open(c)
+    s.check(c)
+}
+
+func (s *testMergeRecoverSuite) TestRollback(c *C) {
+    s.bc.Close()
+    c.Assert(os.Mkdir(s.bc.getMergeDir(), 0755), IsNil)
+    c.Assert(ioutil.WriteFile(s.bc.getMergeDataFilePath(100), []byte("garbage"), 0644), IsNil)
+
+    s.bc = s.open(c)
+    _, err := os.Stat(s.bc.getMergeDir())
+    c.Assert(os.IsNotExist(err), Equals, true)
+    s.check(c)
+}
+
+func (s *testMergeRecoverSuite) TestResumeCommittedMerge(c *C) {
+    bc := s.bc
+    inputs := make([]int64, 0)
+    for _, meta := range bc.fileMetas {
+        inputs = append(inputs, meta.FileId)
+    }
+
+    // run merge up to the manifest, then stop as if crashed
+    c.Assert(os.Mkdir(bc.getMergeDir(), 0755), IsNil)
+    bc.mu.Lock()
+    first := bc.activeFile.id + 1
+    c.Assert(bc.rotateActiveFile(first + int64(len(inputs))), IsNil)
+    kd := bc.keyDir.Clone()
+    bc.mu.Unlock()
+
+    mw := newMergeWriter(bc, first, first + int64(len(inputs)) - 1)
+    for _, fileId := range inputs {
+        _, err := bc.mergeDataFile(fileId, kd, mw, true, time.Now().Unix())
+        c.Assert(err, IsNil)
+    }
+    outputs, err := mw.finish()
+    c.Assert(err, IsNil)
+    m := &mergeManifest{inputs: inputs}
+    for _, out := range outputs {
+        m.outputs = append(m.outputs, out.fileId)
+    }
+    c.Assert(writeMergeManifest(bc.getMergeDir() + "/" + MERGE_MANIFEST, m), IsNil)
+    bc.Close()
+
+    s.bc = s.open(c)
+    s.check(c)
+    for _, fileId := range inputs {
+        _, err := os.Stat(s.bc.GetDataFilePath(fileId))
+        c.Assert(os.IsNotExist(err), Equals, true)
+    }
+    for _, fileId := range m.outputs {
+        _, err := os.Stat(s.bc.GetDataFilePath(fileId))
+        c.Assert(err, IsNil)
+    }
+}
+
+// an expired key merged without the older files is written as a tombstone,
+// so the older value doesn't show up again after reopen
+func (s *testMergeRecoverSuite) TestPartialMergeOfExpired(c *C) {
+    rotate := func() int64 {
+        s.bc.mu.Lock()
+        defer s.bc.mu.Unlock()
+        id := s.bc.activeFile.id
+        c.Assert(s.bc.rotateActiveFile(id + 1), IsNil)
+        return id
+    }
+    rotate()
+    c.Assert(s.bc.Set([]byte("k"), []byte("old")), IsNil)
+    rotate()
+    c.Assert(s.bc.SetWithExpr([]byte("k"), []byte("new"), uint32(time.Now().Unix() - 1)), IsNil)
+    newFile := rotate()
+
+    c.Assert(s.bc.runMerge([]int64{newFile}), IsNil)
+    _, err := s.bc.Get([]byte("k"))
+    c.Assert(err, Equals, ErrKeyNotFound)
+
+    s.bc.Close()
+    s.bc = s.open(c)
+    _, err = s.bc.Get([]byte("k"))
+    c.Assert(err, Equals, ErrKeyNotFound)
+    s.check(c)
+}
@@ -0,0 +1,148 @@
+package bitcask
+
+import (
+    "log"
+    "sort"
+    "sync/atomic"
+    "time"
+)
+
+// FileStat tracks how many bytes of a data file are dead, i.e. records
+// overwritten by a later write. Tombstones are live until merged away.
+type FileStat struct {
+    FileId      int64
+    TotalBytes  int64
+    DeadBytes   int64
+}
+
+func (fs *FileStat) FragmentationRatio() float64 {
+    if fs.TotalBytes == 0 {
+        return 0
+    }
+    return float64(fs.DeadBytes) / float64(fs.TotalBytes)
+}
+
+func recordSize(key []byte, di *DirItem) int64 {
+    size := RECORD_HEADER_SIZE + int64(len(key)) + di.valueSize
+    if di.flag & RECORD_FLAG_ENCRYPTED > 0 {
+        // valueSize is already the sealed size
+        size += CIPHER_OVERHEAD
+    }
+    return size
+}
+
+// requires bc.mu held
+func (bc *BitCask) fileStat(fileId int64) *FileStat {
+    fs, ok := bc.fileStats[fileId]
+    if !ok {
+        fs = &FileStat{FileId: fileId}
+        bc.fileStats[fileId] = fs
+    }
+    return fs
+}
+
+// requires bc.mu held
+func (bc *BitCask) addDeadBytes(fileId int64, n int64) {
+    bc.fileStat(fileId).DeadBytes += n
+}
+
+// GetFileStats returns the stats of all data files, ordered by fileId
+func (bc *BitCask) GetFileStats() []*FileStat {
+    bc.mu.RLock()
+    defer bc.mu.RUnlock()
+
+    stats := make([]*FileStat, 0, len(bc.fileStats))
+    for _, fs := range bc.fileStats {
+        s := *fs
+        stats = append(stats, &s)
+    }
+    sort.Slice(stats, func(i, j int) bool { return stats[i].FileId < stats[j].FileId })
+    return stats
+}
+
+// requires bc.mu held
+func (bc *BitCask) shouldMergeFile(fs *FileStat) bool {
+    opts := bc.opts
+    if opts.mergeFragmentationRatio > 0 && fs.FragmentationRatio() >= opts.mergeFragmentationRatio {
+        return true
+    }
+    if opts.mergeDeadBytesThreshold > 0 && fs.DeadBytes >= opts.mergeDeadBytesThreshold {
+        return true
+    }
+    return false
+}
+
+// pick the closed files that qualify for merge, the most dead bytes first
+func (bc *BitCask) pickMergeFiles() []int64 {
+    // stats are copied, writers update them under bc.mu
+    bc.mu.Lock()
+    candidates := make([]FileStat, 0)
+    for _, meta := range bc.fileMetas {
+        fs := bc.fileStat(meta.FileId)
+        if bc.shouldMergeFile(fs) {
+            candidates = append(candidates, *fs)
+        }
+    }
+    bc.mu.Unlock()
+
+    sort.Slice(candidates, func(i, j int) bool { return candidates[i].DeadBytes > candidates[j].DeadBytes })
+    if max := bc.opts.mergeMaxFiles; max > 0 && len(candidates) > max {
+        candidates = candidates[:max]
+    }
+
+    fileIds := make([]int64, 0, len(candidates))
+    for _, fs := range candidates {
+        fileIds = append(fileIds, fs.FileId)
+    }
+    return fileIds
+}
+
+func (o *Options) inMergeWindow(t time.Time) bool {
+    start, end := o.mergeWindowStart, o.mergeWindowEnd
+    if start == end {
+        return true
+    }
+    h := t.Hour()
+    if start < end {
+        return h >= start && h < end
+    }
+    // window crosses midnight
+    return h >= start || h < end
+}
+
+// merge inputs unless another merge is running
+func (bc *BitCask) runMerge(inputs []int64) error {
+    if bc.opts.readOnly {
+        return ErrReadOnly
+    }
+    if !atomic.CompareAndSwapInt32(&bc.isMerging, 0, 1) {
+        return ErrMergeRunning
+    }
+    defer atomic.CompareAndSwapInt32(&bc.isMerging, 1, 0)
+    return bc.mergeFiles(inputs)
+}
+
+func (bc *BitCask) mergeLoop(interval time.Duration) {
+    defer bc.bgWg.Done()
+    ticker := time.NewTicker(interval)
+    defer ticker.Stop()
+
+    for {
+        select {
+        case <-bc.closeCh:
+            return
+        case now := <-ticker.C:
+            if !bc.opts.inMergeWindow(now) {
+                continue
+            }
+            inputs := bc.pickMergeFiles()
+            if len(inputs) == 0 {
+                continue
+            }
+            log.Printf("merge policy picks data-files %v", inputs)
+            if err := bc.runMerge(inputs); err != nil && err != ErrMergeRunning {
+                log.Printf("scheduled merge failed, err = %s", err)
+            }
+        }
+    }
+}
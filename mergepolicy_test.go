@@ -0,0 +1,99 @@
+package bitcask
+
+import (
+    "fmt"
+    "time"
+    . "gopkg.in/check.v1"
+)
+
+type testMergePolicySuite struct {
+    path string
+    bc   *BitCask
+}
+
+var _ = Suite(&testMergePolicySuite{})
+
+func (s *testMergePolicySuite) open(c *C) *BitCask {
+    opts := NewOptions()
+    opts.SetMaxFileSize(4096)
+    opts.SetMergeFragmentationRatio(0.5)
+    bc, err := Open(s.path, opts)
+    c.Assert(err, IsNil)
+    return bc
+}
+
+func (s *testMergePolicySuite) SetUpTest(c *C) {
+    s.path = c.MkDir()
+    s.bc = s.open(c)
+}
+
+func (s *testMergePolicySuite) TearDownTest(c *C) {
+    s.bc.Close()
+}
+
+func (s *testMergePolicySuite) deadBytes() map[int64]int64 {
+    dead := make(map[int64]int64)
+    for _, fs := range s.bc.GetFileStats() {
+        dead[fs.FileId] = fs.DeadBytes
+    }
+    return dead
+}
+
+func (s *testMergePolicySuite) TestStats(c *C) {
+    value := make([]byte, 100)
+    for i := 0; i < 100; i++ {
+        c.Assert(s.bc.Set([]byte(fmt.Sprintf("key%03d", i)), value), IsNil)
+    }
+    for _, fs := range s.bc.GetFileStats() {
+        c.Assert(fs.DeadBytes, Equals, int64(0))
+    }
+
+    // overwrite keys in the first 3 files
+    for i := 0; i < 90; i++ {
+        c.Assert(s.bc.Set([]byte(fmt.Sprintf("key%03d", i)), []byte("x")), IsNil)
+    }
+    dead := s.deadBytes()
+    c.Assert(dead[0] > 0, Equals, true)
+
+    // stats are rebuilt from hint files on open
+    s.bc.Close()
+    s.bc = s.open(c)
+    c.Assert(s.deadBytes(), DeepEquals, dead)
+
+    picked := s.bc.pickMergeFiles()
+    c.Assert(len(picked) > 0, Equals, true)
+    c.Assert(picked[0] < 3, Equals, true)
+    c.Assert(s.bc.runMerge(picked), IsNil)
+
+    dead = s.deadBytes()
+    for _, fileId := range picked {
+        _, ok := dead[fileId]
+        c.Assert(ok, Equals, false)
+    }
+    for i := 0; i < 100; i++ {
+        val, err := s.bc.Get([]byte(fmt.Sprintf("key%03d", i)))
+        c.Assert(err, IsNil)
+        if i < 90 {
+            c.Assert(string(val), Equals, "x")
+        } else {
+            c.Assert(len(val), Equals, 100)
+        }
+    }
+}
+
+func (s *testMergePolicySuite) TestMergeWindow(c *C) {
+    opts := NewOptions()
+    at := func(h int) time.Time {
+        return time.Date(2020, 1, 1, h, 30, 0, 0, time.Local)
+    }
+    c.Assert(opts.inMergeWindow(at(12)), Equals, true)
+
+    opts.SetMergeWindow(1, 5)
+    c.Assert(opts.inMergeWindow(at(1)), Equals, true)
+    c.Assert(opts.inMergeWindow(at(5)), Equals, false)
+
+    opts.SetMergeWindow(22, 2)
+    c.Assert(opts.inMergeWindow(at(23)), Equals, true)
+    c.Assert(opts.inMergeWindow(at(1)), Equals, true)
+    c.Assert(opts.inMergeWindow(at(12)), Equals, false)
+}
@@ -0,0 +1,243 @@
+package bitcask
+
+import (
+    "fmt"
+    "log"
+    "time"
+)
+
+// Slot migration moves the live keys of a slot, or of a hash tag, to another
+// node in batches. A key is deleted locally only after the target has stored
+// it, so a failed or stopped migration is resumed by running it again.
+
+var (
+    ErrMigrateStopped = fmt.Errorf("migration stopped, db is closing")
+)
+
+// MigrateTarget stores keys moved out of the db, i.e. a client of another node.
+// Storing the same key again must overwrite it.
+type MigrateTarget interface {
+    MigrateKeys(items []*MigrateItem) error
+}
+
+type MigrateItem struct {
+    Key         []byte
+    Value       []byte
+    Expration   uint32      // unix timestamp in seconds, 0 means no ttl
+}
+
+type MigrateProgress struct {
+    Name        string      // slot[n] or tag[t]
+    Total       int64       // keys in the index when the migration started
+    Moved       int64
+    Skipped     int64       // deleted or expired keys
+    Bytes       int64       // bytes of values moved
+    Done        bool
+}
+
+func (p *MigrateProgress) Remaining() int64 {
+    return p.Total - p.Moved - p.Skipped
+}
+
+// MigrateSlot moves all live keys of slot to target.
+func (bc *BitCask) MigrateSlot(slot uint32, target MigrateTarget) (*MigrateProgress, error) {
+    if slot >= MaxSlotNum {
+        return nil, ErrInvalid
+    }
+    return bc.migrate(fmt.Sprintf("slot[%d]", slot), target, func() ([][]byte, error) {
+        return bc.slotKeys(slot)
+    })
+}
+
+// MigrateTag moves all live keys with hash tag, and the key equal to tag, to target.
+func (bc *BitCask) MigrateTag(tag []byte, target MigrateTarget) (*MigrateProgress, error) {
+    return bc.migrate(fmt.Sprintf("tag[%s]", tag), target, func() ([][]byte, error) {
+        keys, err := bc.tagKeys(tag)
+        if err != nil {
+            return nil, err
+        }
+        if _, err := bc.getLive(tag); err == nil {
+            keys = append(keys, append([]byte(nil), tag...))
+        }
+        return keys, nil
+    })
+}
+
+// MigrateKey moves key to target if it's live.
+func (bc *BitCask) MigrateKey(key []byte, target MigrateTarget) (*MigrateProgress, error) {
+    key = append([]byte(nil), key...)
+    return bc.migrate(fmt.Sprintf("key[%s]", key), target, func() ([][]byte, error) {
+        // an expired key left in the index is listed to be dropped from it
+        if _, err := bc.getLive(key); err == nil || bc.isIndexed(key) {
+            return [][]byte{key}, nil
+        }
+        return nil, nil
+    })
+}
+
+// listKeys is called under bc.mu, it runs again until nothing is left to move,
+// keys overwritten while being moved are moved again in the next pass
+func (bc *BitCask) migrate(name string, target MigrateTarget, listKeys func() ([][]byte, error)) (*MigrateProgress, error) {
+    if bc.opts.readOnly {
+        return nil, ErrReadOnly
+    }
+    opts := bc.opts
+    batchSize := opts.migrateBatchSize
+    if batchSize <= 0 {
+        batchSize = 1
+    }
+
+    log.Printf("start migrating %s", name)
+    begin := time.Now()
+    progress := &MigrateProgress{Name: name}
+    first := true
+    for {
+        bc.mu.RLock()
+        keys, err := listKeys()
+        bc.mu.RUnlock()
+        if err != nil {
+            log.Printf("list keys of %s failed, err = %s", name, err)
+            return progress, err
+        }
+        if first {
+            progress.Total = int64(len(keys))
+            first = false
+        }
+        if len(keys) == 0 {
+            break
+        }
+
+        var moved int64 = 0
+        for i := 0; i < len(keys); i += batchSize {
+            select {
+            case <-bc.closeCh:
+                return progress, ErrMigrateStopped
+            default:
+            }
+
+            end := i + batchSize
+            if end > len(keys) {
+                end = len(keys)
+            }
+            n, bytes, err := bc.migrateBatch(keys[i:end], target, progress)
+            if err != nil {
+                log.Printf("migrate %s failed, %d keys moved, err = %s", name, progress.Moved, err)
+                return progress, err
+            }
+            moved += n
+            progress.Bytes += bytes
+            if opts.migrateProgress != nil {
+                p := *progress
+                opts.migrateProgress(&p)
+            }
+
+            // throttle by the bytes moved so far
+            if opts.migrateRateLimit > 0 {
+                want := time.Duration(float64(progress.Bytes) / float64(opts.migrateRateLimit) * float64(time.Second))
+                if wait := want - time.Since(begin); wait > 0 {
+                    timer := time.NewTimer(wait)
+                    select {
+                    case <-bc.closeCh:
+                        timer.Stop()
+                        return progress, ErrMigrateStopped
+                    case <-timer.C:
+                    }
+                }
+            }
+        }
+        if moved == 0 {
+            break
+        }
+    }
+
+    // keys written faster than they're moved are left, run it again later
+    bc.mu.RLock()
+    keys, err := listKeys()
+    bc.mu.RUnlock()
+    if err != nil {
+        return progress, err
+    }
+    left := len(keys)
+    progress.Done = left == 0
+    if opts.migrateProgress != nil {
+        p := *progress
+        opts.migrateProgress(&p)
+    }
+    if progress.Done {
+        log.Printf("migrate %s succ. %d keys moved, %d skipped, costs %.2f seconds", name, progress.Moved, progress.Skipped, time.Since(begin).Seconds())
+    } else {
+        log.Printf("migrate %s unfinished, %d keys moved, %d keys left", name, progress.Moved, left)
+    }
+    return progress, nil
+}
+
+// move the live ones of keys, returns the number of keys and value bytes moved
+func (bc *BitCask) migrateBatch(keys [][]byte, target MigrateTarget, progress *MigrateProgress) (int64, int64, error) {
+    items := make([]*MigrateItem, 0, len(keys))
+    dirItems := make([]*DirItem, 0, len(keys))
+    dead := make([][]byte, 0)
+
+    bc.mu.RLock()
+    for _, key := range keys {
+        di, err := bc.getLive(key)
+        if err == ErrKeyNotFound {
+            dead = append(dead, key)
+            continue
+        }
+        if err != nil {
+            bc.mu.RUnlock()
+            return 0, 0, err
+        }
+        offset := int64(di.valuePos) - RecordValueOffset()
+        rec, err := bc.refRecord(di.fileId, offset)
+        if err != nil {
+            bc.mu.RUnlock()
+            return 0, 0, err
+        }
+        items = append(items, &MigrateItem{
+            Key: key,
+            Value: append([]byte(nil), rec.value...),
+            Expration: di.expration,
+        })
+        bc.unrefRecord(di.fileId, offset)
+        dirItems = append(dirItems, di)
+    }
+    bc.mu.RUnlock()
+
+    if len(items) > 0 {
+        if err := target.MigrateKeys(items); err != nil {
+            return 0, 0, err
+        }
+    }
+
+    // delete the keys as DelLocal does, unless written meanwhile
+    var moved, bytes int64 = 0, 0
+    bc.mu.Lock()
+    for i, item := range items {
+        di, err := bc.keyDir.Get(item.Key)
+        if err != nil || di.fileId != dirItems[i].fileId || di.valuePos != dirItems[i].valuePos {
+            continue
+        }
+        rec := &Record{
+            flag: RECORD_FLAG_DELETED,
+            keySize: int64(len(item.Key)),
+            key: item.Key,
+        }
+        if err := bc.addRecord(rec, false); err != nil {
+            bc.mu.Unlock()
+            return moved, bytes, err
+        }
+        bc.unindexKey(item.Key)
+        moved++
+        bytes += int64(len(item.Value))
+    }
+    for _, key := range dead {
+        bc.unindexKey(key)
+    }
+    seq := bc.writeSeq
+    bc.mu.Unlock()
+
+    progress.Moved += moved
+    progress.Skipped += int64(len(dead))
+    return moved, bytes, bc.waitSync(seq)
+}
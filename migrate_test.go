@@ -0,0 +1,198 @@
+package bitcask
+
+import (
+    "fmt"
+    "time"
+    . "gopkg.in/check.v1"
+)
+
+type testMigrateSuite struct {
+    bc      *BitCask
+}
+
+var _ = Suite(&testMigrateSuite{})
+
+func (s *testMigrateSuite) SetUpTest(c *C) {
+    opts := NewOptions()
+    opts.SetMaxFileSize(4096)
+    opts.SetMigrateBatchSize(7)
+    var err error
+    s.bc, err = Open(c.MkDir(), opts)
+    c.Assert(err, IsNil)
+}
+
+func (s *testMigrateSuite) TearDownTest(c *C) {
+    s.bc.Close()
+}
+
+// stores keys in memory, fails the call after failAfter calls if it's set
+type memTarget struct {
+    items       map[string]*MigrateItem
+    calls       int
+    failAfter   int
+}
+
+func newMemTarget() *memTarget {
+    return &memTarget{items: make(map[string]*MigrateItem)}
+}
+
+func (t *memTarget) MigrateKeys(items []*MigrateItem) error {
+    t.calls++
+    if t.failAfter > 0 && t.calls > t.failAfter {
+        return fmt.Errorf("target is down")
+    }
+    for _, item := range items {
+        t.items[string(item.Key)] = item
+    }
+    return nil
+}
+
+// keys of one slot, tagged keys share the slot of their tag
+func (s *testMigrateSuite) fill(c *C, tag string, n int) [][]byte {
+    keys := make([][]byte, 0, n)
+    for i := 0; i < n; i++ {
+        key := []byte(fmt.Sprintf("{%s}key%03d", tag, i))
+        c.Assert(s.bc.Set(key, []byte(fmt.Sprintf("value%03d", i))), IsNil)
+        keys = append(keys, key)
+    }
+    return keys
+}
+
+func (s *testMigrateSuite) TestMigrateSlot(c *C) {
+    keys := s.fill(c, "user1", 50)
+    _, slot := HashKeyToSlot(keys[0])
+    other := s.fill(c, "user2", 10)
+    _, otherSlot := HashKeyToSlot(other[0])
+    c.Assert(otherSlot, Not(Equals), slot)
+
+    // a deleted key, and keys with ttl
+    c.Assert(s.bc.Del(keys[0]), IsNil)
+    future := uint32(time.Now().Unix() + 3600)
+    c.Assert(s.bc.SetWithExpr(keys[1], []byte("ttl"), future), IsNil)
+    c.Assert(s.bc.SetWithExpr(keys[2], []byte("expired"), uint32(time.Now().Unix() - 1)), IsNil)
+
+    reports := make([]*MigrateProgress, 0)
+    s.bc.opts.SetMigrateProgressFunc(func(p *MigrateProgress) {
+        reports = append(reports, p)
+    })
+    target := newMemTarget()
+    progress, err := s.bc.MigrateSlot(slot, target)
+    c.Assert(err, IsNil)
+    c.Assert(progress.Done, Equals, true)
+    c.Assert(progress.Moved, Equals, int64(48))
+    // the deleted key has left the index, the expired one is skipped
+    c.Assert(progress.Total, Equals, int64(49))
+    c.Assert(progress.Skipped, Equals, int64(1))
+    c.Assert(progress.Remaining(), Equals, int64(0))
+    c.Assert(len(target.items), Equals, 48)
+    c.Assert(target.items[string(keys[1])].Expration, Equals, future)
+    c.Assert(target.items[string(keys[3])].Value, DeepEquals, []byte("value003"))
+    c.Assert(target.calls, Equals, 7)
+    c.Assert(len(reports) > 1, Equals, true)
+    c.Assert(reports[len(reports) - 1].Done, Equals, true)
+
+    // moved keys are gone, other slots are untouched
+    for _, key := range keys {
+        _, err := s.bc.Get(key)
+        c.Assert(err, Equals, ErrKeyNotFound)
+    }
+    for _, key := range other {
+        _, err := s.bc.Get(key)
+        c.Assert(err, IsNil)
+    }
+
+    // nothing left to move
+    progress, err = s.bc.MigrateSlot(slot, newMemTarget())
+    c.Assert(err, IsNil)
+    c.Assert(progress.Total, Equals, int64(0))
+}
+
+func (s *testMigrateSuite) TestResume(c *C) {
+    keys := s.fill(c, "user1", 50)
+    _, slot := HashKeyToSlot(keys[0])
+
+    target := newMemTarget()
+    target.failAfter = 3
+    progress, err := s.bc.MigrateSlot(slot, target)
+    c.Assert(err, NotNil)
+    c.Assert(progress.Moved, Equals, int64(21))
+    c.Assert(len(target.items), Equals, 21)
+
+    // the rest is moved on next run, also after reopen
+    dir := s.bc.dir
+    opts := s.bc.opts
+    c.Assert(s.bc.Close(), IsNil)
+    s.bc, err = Open(dir, opts)
+    c.Assert(err, IsNil)
+
+    target.failAfter = 0
+    progress, err = s.bc.MigrateSlot(slot, target)
+    c.Assert(err, IsNil)
+    c.Assert(progress.Done, Equals, true)
+    c.Assert(progress.Moved, Equals, int64(29))
+    c.Assert(progress.Skipped, Equals, int64(0))
+    c.Assert(len(target.items), Equals, 50)
+    for _, key := range keys {
+        _, err := s.bc.Get(key)
+        c.Assert(err, Equals, ErrKeyNotFound)
+    }
+}
+
+func (s *testMigrateSuite) TestMigrateTag(c *C) {
+    keys := s.fill(c, "user1", 20)
+    c.Assert(s.bc.Set([]byte("user1"), []byte("plain")), IsNil)
+    // keys of other tags stay
+    c.Assert(s.bc.Set([]byte("user2"), []byte("other")), IsNil)
+
+    target := newMemTarget()
+    progress, err := s.bc.MigrateTag([]byte("user1"), target)
+    c.Assert(err, IsNil)
+    c.Assert(progress.Done, Equals, true)
+    c.Assert(progress.Moved, Equals, int64(21))
+    c.Assert(string(target.items["user1"].Value), Equals, "plain")
+    for _, key := range keys {
+        c.Assert(target.items[string(key)], NotNil)
+    }
+    _, err = s.bc.Get([]byte("user2"))
+    c.Assert(err, IsNil)
+}
+
+func (s *testMigrateSuite) TestRateLimit(c *C) {
+    keys := s.fill(c, "user1", 20)
+    _, slot := HashKeyToSlot(keys[0])
+
+    // 20 values of 8 bytes at 800 bytes per second
+    s.bc.opts.SetMigrateRateLimit(800)
+    begin := time.Now()
+    progress, err := s.bc.MigrateSlot(slot, newMemTarget())
+    c.Assert(err, IsNil)
+    c.Assert(progress.Bytes, Equals, int64(160))
+    c.Assert(time.Since(begin) >= 150 * time.Millisecond, Equals, true)
+}
+
+func (s *testMigrateSuite) TestMigrateKey(c *C) {
+    keys := s.fill(c, "user1", 3)
+    c.Assert(s.bc.SetWithExpr(keys[1], []byte("expired"), uint32(time.Now().Unix() - 1)), IsNil)
+
+    target := newMemTarget()
+    progress, err := s.bc.MigrateKey(keys[0], target)
+    c.Assert(err, IsNil)
+    c.Assert(progress.Moved, Equals, int64(1))
+    c.Assert(string(target.items[string(keys[0])].Value), Equals, "value000")
+    _, err = s.bc.Get(keys[0])
+    c.Assert(err, Equals, ErrKeyNotFound)
+
+    // an expired key leaves the index, a missing key is nothing to move
+    _, slot := HashKeyToSlot(keys[0])
+    progress, err = s.bc.MigrateKey(keys[1], target)
+    c.Assert(err, IsNil)
+    c.Assert(progress.Moved, Equals, int64(0))
+    c.Assert(progress.Skipped, Equals, int64(1))
+    stat, err := s.bc.SlotInfo(slot)
+    c.Assert(err, IsNil)
+    c.Assert(stat.Keys, Equals, int64(1))
+    progress, err = s.bc.MigrateKey([]byte("missing"), target)
+    c.Assert(err, IsNil)
+    c.Assert(progress.Total, Equals, int64(0))
+    c.Assert(target.calls, Equals, 1)
+}
@@ -0,0 +1,155 @@
+package bitcask
+
+import (
+    "fmt"
+    "os"
+    "path/filepath"
+    . "gopkg.in/check.v1"
+)
+
+type testMmapSuite struct {
+    dir     string
+    opts    *Options
+    bc      *BitCask
+}
+
+var _ = Suite(&testMmapSuite{})
+
+func (s *testMmapSuite) SetUpTest(c *C) {
+    s.dir = c.MkDir()
+    s.opts = NewOptions()
+    s.opts.SetMaxFileSize(4096)
+    s.opts.SetMmap(true)
+    var err error
+    s.bc, err = Open(s.dir, s.opts)
+    c.Assert(err, IsNil)
+}
+
+func (s *testMmapSuite) TearDownTest(c *C) {
+    s.bc.Close()
+}
+
+func (s *testMmapSuite) TestBorrowedRecord(c *C) {
+    if !mmapSupported {
+        c.Skip("mmap is not supported")
+    }
+    for i := 0; i < 200; i++ {
+        c.Assert(s.bc.Set([]byte(fmt.Sprintf("key%03d", i)), []byte(fmt.Sprintf("value%03d", i))), IsNil)
+    }
+    fileId := s.bc.GetMinDataFileId()
+    df, err := s.bc.refDataFile(fileId)
+    c.Assert(err, IsNil)
+    defer s.bc.unrefDataFile(fileId)
+    rec, err := parseRecordAt(df, 0, df.fc)
+    c.Assert(err, IsNil)
+    c.Assert(rec.borrowed, Equals, true)
+    c.Assert(string(rec.key), Equals, "key000")
+    c.Assert(string(rec.value), Equals, "value000")
+    // appends don't write to the mapping
+    c.Assert(cap(rec.key), Equals, len(rec.key))
+    mapped := &rec.value[0]
+
+    owned := *rec
+    owned.own()
+    c.Assert(owned.borrowed, Equals, false)
+    c.Assert(string(owned.value), Equals, "value000")
+    c.Assert(&owned.value[0] != mapped, Equals, true)
+
+    // records of mapped files are read in place, not cached
+    ref, err := s.bc.RefRecord(fileId, 0)
+    c.Assert(err, IsNil)
+    c.Assert(ref.borrowed, Equals, true)
+    s.bc.UnrefRecord(fileId, 0)
+    c.Assert(s.bc.recCache.cache.Size(), Equals, 0)
+
+    // View reads the value in place, Get copies it
+    var viewed []byte
+    c.Assert(s.bc.View([]byte("key000"), func(value []byte, expration uint32) error {
+        viewed = value
+        return nil
+    }), IsNil)
+    c.Assert(string(viewed), Equals, "value000")
+    c.Assert(&viewed[0] == mapped, Equals, true)
+    got, err := s.bc.Get([]byte("key000"))
+    c.Assert(err, IsNil)
+    c.Assert(string(got), Equals, "value000")
+    c.Assert(&got[0] != mapped, Equals, true)
+}
+
+// a merged file stays mapped until its last reader is done
+func (s *testMmapSuite) TestMergeWhileReading(c *C) {
+    if !mmapSupported {
+        c.Skip("mmap is not supported")
+    }
+    n := 200
+    for i := 0; i < n; i++ {
+        c.Assert(s.bc.Set([]byte(fmt.Sprintf("key%03d", i)), []byte(fmt.Sprintf("value%03d", i))), IsNil)
+    }
+    fileId := s.bc.GetMinDataFileId()
+    s.bc.mu.RLock()
+    df, err := s.bc.refDataFile(fileId)
+    s.bc.mu.RUnlock()
+    c.Assert(err, IsNil)
+    rec, err := parseRecordAt(df, 0, df.fc)
+    c.Assert(err, IsNil)
+    c.Assert(rec.borrowed, Equals, true)
+
+    snap, err := s.bc.Snapshot()
+    c.Assert(err, IsNil)
+    for i := 0; i < n; i++ {
+        c.Assert(s.bc.Set([]byte(fmt.Sprintf("key%03d", i)), []byte("new")), IsNil)
+    }
+    inputs := make([]int64, 0)
+    for _, meta := range s.bc.GetFileMetas() {
+        inputs = append(inputs, meta.FileId)
+    }
+    c.Assert(s.bc.runMerge(inputs), IsNil)
+
+    mf := df.FileReader.(*MmapFile)
+    c.Assert(mf.data, NotNil)
+    c.Assert(string(rec.value), Equals, "value000")
+    for i := 0; i < n; i++ {
+        val, err := snap.Get([]byte(fmt.Sprintf("key%03d", i)))
+        c.Assert(err, IsNil)
+        c.Assert(string(val), Equals, fmt.Sprintf("value%03d", i))
+    }
+
+    snap.Release()
+    c.Assert(mf.data, NotNil)
+    s.bc.mu.RLock()
+    s.bc.unrefDataFile(fileId)
+    s.bc.mu.RUnlock()
+    c.Assert(mf.data, IsNil)
+
+    for i := 0; i < n; i++ {
+        val, err := s.bc.Get([]byte(fmt.Sprintf("key%03d", i)))
+        c.Assert(err, IsNil)
+        c.Assert(string(val), Equals, "new")
+    }
+}
+
+// keys of records restored from mapped data files outlive the mappings
+func (s *testMmapSuite) TestRestore(c *C) {
+    s.opts.SetCompression(COMPRESS_SNAPPY)
+    s.opts.SetCompressionMinSize(0)
+    n := 300
+    for i := 0; i < n; i++ {
+        c.Assert(s.bc.Set([]byte(fmt.Sprintf("key%03d", i)), []byte(fmt.Sprintf("value%03d", i))), IsNil)
+    }
+    c.Assert(s.bc.Close(), IsNil)
+    hints, err := filepath.Glob(s.dir + "/*.hint")
+    c.Assert(err, IsNil)
+    for _, path := range hints {
+        c.Assert(os.Remove(path), IsNil)
+    }
+
+    s.bc, err = Open(s.dir, s.opts)
+    c.Assert(err, IsNil)
+    count := 0
+    c.Assert(s.bc.Scan(nil, nil, func(key []byte, value []byte) error {
+        c.Assert(string(value), Equals, "value" + string(key[3:]))
+        count++
+        return nil
+    }), IsNil)
+    c.Assert(count, Equals, n)
+}
@@ -0,0 +1,18 @@
+// +build !windows
+
+package bitcask
+
+import (
+    "os"
+    "syscall"
+)
+
+const mmapSupported = true
+
+func mmap(f *os.File, size int64) ([]byte, error) {
+    return syscall.Mmap(int(f.Fd()), 0, int(size), syscall.PROT_READ, syscall.MAP_SHARED)
+}
+
+func munmap(data []byte) error {
+    return syscall.Munmap(data)
+}
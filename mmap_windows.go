@@ -0,0 +1,18 @@
+// +build windows
+
+package bitcask
+
+import (
+    "os"
+)
+
+// data files are read with pread, the mmap option is ignored
+const mmapSupported = false
+
+func mmap(f *os.File, size int64) ([]byte, error) {
+    return nil, ErrInvalid
+}
+
+func munmap(data []byte) error {
+    return nil
+}
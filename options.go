@@ -1,10 +1,39 @@
 package bitcask
 
+import (
+    "runtime"
+)
+
 type Options struct {
     maxFileSize         int64
     cacheSize           int64
     maxOpenFiles        uint32
     bufferSize          int64
+    syncMode            int
+    syncInterval        int64       // ms
+    expireSweepInterval int64       // ms, 0 disables the background sweeper
+    compression         int
+    compressMinSize     int64       // values shorter than this are stored raw
+    keyProvider         KeyProvider // nil disables encryption
+    readOnly            bool
+    restoreParallelism  int         // files loaded at the same time on open
+    restoreProgress     func(*RestoreProgress)
+    keyDirMode          int
+    slotIndex           bool
+    mmap                bool
+
+    // merge policy
+    mergeCheckInterval      int64       // ms, 0 disables the merge scheduler
+    mergeFragmentationRatio float64     // merge files with dead/total bytes >= ratio
+    mergeDeadBytesThreshold int64       // merge files with dead bytes >= threshold
+    mergeWindowStart        int         // merge only in hours [start, end), start == end means any time
+    mergeWindowEnd          int
+    mergeMaxFiles           int         // max files per merge, 0 means no limit
+
+    // slot migration
+    migrateBatchSize        int
+    migrateRateLimit        int64       // bytes per second, 0 means no limit
+    migrateProgress         func(*MigrateProgress)
 }
 
 func NewOptions() *Options {
@@ -13,6 +42,14 @@ func NewOptions() *Options {
         cacheSize: 100 * 1024 * 1024,
         maxOpenFiles: 4096,
         bufferSize: 10 * 1024 + 10,
+        syncMode: SYNC_NONE,
+        syncInterval: 1000,
+        compression: COMPRESS_NONE,
+        compressMinSize: 64,
+        restoreParallelism: runtime.NumCPU(),
+        slotIndex: true,
+        mergeFragmentationRatio: 0.5,
+        migrateBatchSize: 100,
     }
 }
 
@@ -32,3 +69,117 @@ func (o *Options) SetBufferSize(n int64) {
     o.bufferSize = n
 }
 
+
+// one of SYNC_NONE, SYNC_ALWAYS, SYNC_INTERVAL
+func (o *Options) SetSyncMode(mode int) {
+    o.syncMode = mode
+}
+
+// fsync interval in ms for SYNC_INTERVAL mode
+func (o *Options) SetSyncInterval(ms int64) {
+    o.syncInterval = ms
+}
+
+// write tombstones for expired keys in background every ms, 0 disables it
+func (o *Options) SetExpireSweepInterval(ms int64) {
+    o.expireSweepInterval = ms
+}
+
+// one of COMPRESS_NONE, COMPRESS_SNAPPY, COMPRESS_ZSTD, COMPRESS_LZ4,
+// only affects new writes, files of any codec stay readable
+func (o *Options) SetCompression(codec int) {
+    o.compression = codec
+}
+
+// compress values of at least n bytes
+func (o *Options) SetCompressionMinSize(n int64) {
+    o.compressMinSize = n
+}
+
+// encrypt data and hint files with data keys wrapped by master keys of kp
+func (o *Options) SetEncryption(kp KeyProvider) {
+    o.keyProvider = kp
+}
+
+// open with a shared lock and no active file, writes return ErrReadOnly
+func (o *Options) SetReadOnly(readOnly bool) {
+    o.readOnly = readOnly
+}
+
+// load n hint or data files at the same time on open
+func (o *Options) SetRestoreParallelism(n int) {
+    o.restoreParallelism = n
+}
+
+// fn is called after each file is restored on open
+func (o *Options) SetRestoreProgressFunc(fn func(*RestoreProgress)) {
+    o.restoreProgress = fn
+}
+
+// one of KEYDIR_BTREE, KEYDIR_COMPACT, KEYDIR_HASH. The compact keydir takes
+// less memory, but iterators sort all keys when created. The hash keydir
+// keeps no key, keys are read from records to check a lookup, to iterate
+// and to write hint files. Either keeps the slot index, see SetSlotIndex.
+func (o *Options) SetKeyDirMode(mode int) {
+    o.keyDirMode = mode
+}
+
+// keep the keys of each slot and hash tag in memory for the slot commands
+// and migration, that's a copy of every key. Without it, the keys of a slot
+// are listed by a scan of the keydir, which reads every key in KEYDIR_HASH
+// mode, and FirstKeyUnderSlot and AllKeysWithTag return ErrNoSlotIndex.
+func (o *Options) SetSlotIndex(enabled bool) {
+    o.slotIndex = enabled
+}
+
+// read closed data files through read-only mappings instead of pread.
+// Records are then read in place and not kept in the record cache, restore,
+// merge and View take values from the mappings without copying them, and
+// compressed values are decompressed on every read. A writer or an offline
+// repair takes the exclusive lock, so files mapped by read-only processes
+// aren't truncated, but files changed in place by other tools crash readers
+// with SIGBUS. It's ignored on windows.
+func (o *Options) SetMmap(mmap bool) {
+    o.mmap = mmap
+}
+
+// check merge policy in background every ms, 0 disables it
+func (o *Options) SetMergeCheckInterval(ms int64) {
+    o.mergeCheckInterval = ms
+}
+
+// merge files whose dead bytes / total bytes >= ratio, 0 disables the check
+func (o *Options) SetMergeFragmentationRatio(ratio float64) {
+    o.mergeFragmentationRatio = ratio
+}
+
+// merge files with at least n dead bytes, 0 disables the check
+func (o *Options) SetMergeDeadBytesThreshold(n int64) {
+    o.mergeDeadBytesThreshold = n
+}
+
+// only run scheduled merges between hours [start, end) of local time
+func (o *Options) SetMergeWindow(startHour int, endHour int) {
+    o.mergeWindowStart = startHour
+    o.mergeWindowEnd = endHour
+}
+
+// max files merged in one scheduled run, 0 means no limit
+func (o *Options) SetMergeMaxFiles(n int) {
+    o.mergeMaxFiles = n
+}
+
+// keys sent to the target in one call of a slot migration
+func (o *Options) SetMigrateBatchSize(n int) {
+    o.migrateBatchSize = n
+}
+
+// throttle slot migrations to about n bytes of values per second, 0 means no limit
+func (o *Options) SetMigrateRateLimit(n int64) {
+    o.migrateRateLimit = n
+}
+
+// fn is called after each batch of a slot migration
+func (o *Options) SetMigrateProgressFunc(fn func(*MigrateProgress)) {
+    o.migrateProgress = fn
+}
@@ -17,12 +17,19 @@ type Record struct {
     keySize     int64
     value       []byte
     key         []byte
+    borrowed    bool    // key or value slice the mapping of a data file
 }
 
 const (
     RECORD_FLAG_DELETED = 1 << iota
     RECORD_FLAG_BATCH
     RECORD_FLAG_MERGE       // record for merge info, i.e. delete file
+    RECORD_FLAG_BATCH_COMMIT    // end of a batch, value is the number of records in the batch
+    // bits 4-5 hold the value codec, see compress.go
+)
+
+const (
+    RECORD_FLAG_ENCRYPTED = 1 << 6  // key and value are sealed with the data key of the file
 )
 
 const (
@@ -30,6 +37,10 @@ const (
 )
 
 func (r *Record) Size() int64 {
+    // merge record keeps the merged fileId in valueSize, it has no payload
+    if r.flag & RECORD_FLAG_MERGE > 0 {
+        return RECORD_HEADER_SIZE
+    }
     return RECORD_HEADER_SIZE + int64(r.keySize + r.valueSize)
 }
 
@@ -38,14 +49,51 @@ func RecordValueOffset() int64 {
 }
 
 func (r *Record) Encode() ([]byte, error) {
+    return r.encode(nil)
+}
+
+// value is compressed with the codec in flag, then key and value are
+// encrypted if fc is set. valueSize and keySize are set to the stored sizes.
+func (r *Record) encode(fc *fileCipher) ([]byte, error) {
+    value := r.value
+    key := r.key
+    if r.flag & RECORD_FLAG_MERGE == 0 {
+        if codec := recordCodec(r.flag); codec != COMPRESS_NONE {
+            data, err := compressValue(codec, r.value)
+            if err != nil {
+                log.Println(err)
+                return nil, err
+            }
+            if len(data) < len(r.value) {
+                value = data
+            } else {
+                r.flag = setRecordCodec(r.flag, COMPRESS_NONE)
+            }
+        }
+
+        r.flag &^= RECORD_FLAG_ENCRYPTED
+        if fc != nil {
+            var err error
+            if value, err = fc.seal(value); err != nil {
+                return nil, err
+            }
+            if key, err = fc.seal(key); err != nil {
+                return nil, err
+            }
+            r.flag |= RECORD_FLAG_ENCRYPTED
+        }
+        r.valueSize = int64(len(value))
+        r.keySize = int64(len(key))
+    }
+
     buf := new(bytes.Buffer)
     var data = []interface{}{
         r.flag,
         r.expration,
         r.valueSize,
         r.keySize,
-        r.value,        // len(value) can be zero
-        r.key,
+        value,          // len(value) can be zero
+        key,
     }
 
     for _, v := range data {
@@ -64,9 +112,61 @@ func (r *Record) Encode() ([]byte, error) {
     return append(crc, buf.Bytes()...), nil
 }
 
-func parseRecordAt(r io.ReaderAt, offset int64) (*Record, error) {
-    header := make([]byte, RECORD_HEADER_SIZE)
-    _, err := r.ReadAt(header, offset)
+// some readers, i.e. bytes.Reader, return EOF for an empty read at the end
+func readFullAt(r io.ReaderAt, data []byte, offset int64) error {
+    if len(data) == 0 {
+        return nil
+    }
+    _, err := r.ReadAt(data, offset)
+    return err
+}
+
+// readers whose bytes are sliced instead of copied
+type byteSlicer interface {
+    slice(offset int64, n int64) ([]byte, error)
+}
+
+func slicerOf(r io.ReaderAt) byteSlicer {
+    if df, ok := r.(*DataFile); ok {
+        return df.slicer()
+    }
+    return nil
+}
+
+// n bytes at offset, sliced from s if it's set
+func readOrSlice(r io.ReaderAt, s byteSlicer, offset int64, n int64) ([]byte, error) {
+    if s != nil {
+        return s.slice(offset, n)
+    }
+    data := make([]byte, n)
+    if err := readFullAt(r, data, offset); err != nil {
+        return nil, err
+    }
+    return data, nil
+}
+
+// size of the record with header at offset of a file of fileSize bytes, 0 if
+// it runs past the end of the file. Sizes are checked before anything is
+// read, a corrupted header may claim gigabytes.
+func recordSizeAt(header []byte, offset int64, fileSize int64) int64 {
+    if header[4] & RECORD_FLAG_MERGE > 0 {
+        return RECORD_HEADER_SIZE
+    }
+    rest := fileSize - offset - RECORD_HEADER_SIZE
+    valueSize := int64(binary.LittleEndian.Uint64(header[9:17]))
+    keySize := int64(binary.LittleEndian.Uint64(header[17:25]))
+    if valueSize < 0 || keySize < 0 || valueSize > rest || keySize > rest - valueSize {
+        return 0
+    }
+    return RECORD_HEADER_SIZE + valueSize + keySize
+}
+
+// fc decrypts records with RECORD_FLAG_ENCRYPTED, it can be nil for plaintext files.
+// Key and value of a plaintext record of a mapped data file are borrowed, they
+// are valid while the file is referenced, see own.
+func parseRecordAt(r io.ReaderAt, offset int64, fc *fileCipher) (*Record, error) {
+    s := slicerOf(r)
+    header, err := readOrSlice(r, s, offset, RECORD_HEADER_SIZE)
     if err != nil {
         if err != io.EOF {
             log.Println(err)
@@ -80,21 +180,23 @@ func parseRecordAt(r io.ReaderAt, offset int64) (*Record, error) {
         expration:      uint32(binary.LittleEndian.Uint32(header[5:9])),
         valueSize:      int64(binary.LittleEndian.Uint64(header[9:17])),
         keySize:        int64(binary.LittleEndian.Uint64(header[17:25])),
+        borrowed:       s != nil,
+    }
+    if f, ok := r.(interface{ Size() int64 }); ok && recordSizeAt(header, offset, f.Size()) == 0 {
+        return nil, ErrRecordCorrupted
     }
     crc := crc32.ChecksumIEEE(header[4:])
 
     if rec.flag & RECORD_FLAG_MERGE == 0 {
         offset += RECORD_HEADER_SIZE
-        rec.value = make([]byte, rec.valueSize)
-        _, err = r.ReadAt(rec.value, offset)
+        rec.value, err = readOrSlice(r, s, offset, rec.valueSize)
         if err != nil {
             log.Println(err)
             return nil, err
         }
 
         offset += rec.valueSize
-        rec.key = make([]byte, rec.keySize)
-        _, err = r.ReadAt(rec.key, offset)
+        rec.key, err = readOrSlice(r, s, offset, rec.keySize)
         if err != nil {
             log.Println(err)
             return nil, err
@@ -109,9 +211,63 @@ func parseRecordAt(r io.ReaderAt, offset int64) (*Record, error) {
         return nil, ErrRecordCorrupted
     }
 
+    // sizes keep the stored sizes, so Size() still steps to the next record
+    if rec.flag & RECORD_FLAG_ENCRYPTED > 0 && rec.flag & RECORD_FLAG_MERGE == 0 {
+        if fc == nil {
+            return nil, ErrNoCipher
+        }
+        if rec.value, err = fc.open(rec.value); err != nil {
+            log.Printf("decrypt value failed, err = %s", err)
+            return nil, ErrRecordCorrupted
+        }
+        if rec.key, err = fc.open(rec.key); err != nil {
+            log.Printf("decrypt key failed, err = %s", err)
+            return nil, ErrRecordCorrupted
+        }
+        rec.borrowed = false
+    }
+    if codec := recordCodec(rec.flag); codec != COMPRESS_NONE && rec.flag & RECORD_FLAG_MERGE == 0 {
+        rec.value, err = decompressValue(codec, rec.value)
+        if err != nil {
+            log.Printf("decompress value failed, codec = %d, err = %s", codec, err)
+            return nil, err
+        }
+    }
+
     return rec, nil
 }
 
+// own copies key and value of a borrowed record, so it outlives the data file
+func (r *Record) own() {
+    if !r.borrowed {
+        return
+    }
+    value := make([]byte, len(r.value))
+    copy(value, r.value)
+    key := make([]byte, len(r.key))
+    copy(key, r.key)
+    r.value, r.key, r.borrowed = value, key, false
+}
+
+// the value to use after the record is unrefed, a borrowed one is copied
+func (r *Record) ownedValue() []byte {
+    if !r.borrowed {
+        return r.value
+    }
+    value := make([]byte, len(r.value))
+    copy(value, r.value)
+    return value
+}
+
+// ownKey copies only the key of a borrowed record, the value is still borrowed
+func (r *Record) ownKey() {
+    if r.borrowed {
+        key := make([]byte, len(r.key))
+        copy(key, r.key)
+        r.key = key
+    }
+}
+
 /////////////////////////////////
 type RecordCache struct {
     cache           *lru.Cache
@@ -143,13 +299,13 @@ func (rc *RecordCache) Ref(fileId int64, offset int64) (*Record, error) {
         return v.(*Record), nil
     }
     var fr FileReader
+    var fc *fileCipher
     env := rc.env
 
-    if env.getActiveFile() == nil {
-        log.Fatal("activeFiel is nil")
-    }
-    if fileId == env.getActiveFile().id {
+    // no active file in read-only mode
+    if af := env.getActiveFile(); af != nil && fileId == af.id {
         fr = env.getActiveFile()
+        fc = env.getActiveFile().fc
     } else {
         df, err := env.refDataFile(fileId)
         if err != nil {
@@ -157,16 +313,18 @@ func (rc *RecordCache) Ref(fileId int64, offset int64) (*Record, error) {
         }
         defer env.unrefDataFile(fileId)
         fr = df
+        fc = df.fc
     }
 
-    rec, err := parseRecordAt(fr, offset)
+    rec, err := parseRecordAt(fr, offset, fc)
     if err != nil {
         return nil, err
     }
-    rc.cache.Put(recKey, rec)
-    rc.cache.Ref(recKey)
-
-    return rec, nil
+    // cached records outlive the ref of the data file, records of mapped
+    // files are read by refRecord without the cache
+    rec.own()
+    v, _ = rc.cache.PutAndRef(recKey, rec)
+    return v.(*Record), nil
 }
 
 func (rc *RecordCache) Unref(fileId int64, offset int64) {
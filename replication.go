@@ -0,0 +1,678 @@
+package bitcask
+
+import (
+    "crypto/md5"
+    "encoding/binary"
+    "fmt"
+    "io"
+    "io/ioutil"
+    "log"
+    "net"
+    "os"
+    "sync"
+    "time"
+)
+
+// Replication streams the data files as they are on disk. A follower at
+// (fileId, offset) gets the raw records after it in RECORDS frames and
+// appends them with SyncFile, so its files stay byte-identical to the
+// master's. Merge outputs are installed below the active file, a stream
+// that has passed them gets them as whole files before the merge records
+// that remove the inputs.
+
+var (
+    ErrReplPositionGone = fmt.Errorf("replication position is gone, full resync needed")
+    ErrReplClosed = fmt.Errorf("replication source closed")
+)
+
+const (
+    REPL_FRAME_RECORDS = iota + 1   // whole records of a data file at offset
+    REPL_FRAME_FILE                 // a chunk of a whole data file at offset
+    REPL_FRAME_FILE_END             // end of a whole data file, data is its md5
+    REPL_FRAME_KEY                  // key file of an encrypted data file
+    REPL_FRAME_HEARTBEAT            // no data, sent when there is nothing to stream
+)
+
+const (
+    // type(1) + fileId(8) + offset(8) + length(8) + pendingBytes(8) + pendingRecords(8)
+    REPL_FRAME_HEADER_SIZE = 41
+    REPL_POSITION_SIZE = 16
+    REPL_MAX_FRAME_SIZE = 1024 * 1024
+    REPL_HEARTBEAT_INTERVAL = time.Second
+)
+
+type ReplPosition struct {
+    FileId  int64
+    Offset  int64
+}
+
+func (p ReplPosition) less(o ReplPosition) bool {
+    return p.FileId < o.FileId || (p.FileId == o.FileId && p.Offset < o.Offset)
+}
+
+func (p ReplPosition) Encode() []byte {
+    buf := make([]byte, REPL_POSITION_SIZE)
+    binary.LittleEndian.PutUint64(buf[0:8], uint64(p.FileId))
+    binary.LittleEndian.PutUint64(buf[8:16], uint64(p.Offset))
+    return buf
+}
+
+func ReadReplPosition(r io.Reader) (ReplPosition, error) {
+    buf := make([]byte, REPL_POSITION_SIZE)
+    if _, err := io.ReadFull(r, buf); err != nil {
+        return ReplPosition{}, err
+    }
+    return ReplPosition{
+        FileId: int64(binary.LittleEndian.Uint64(buf[0:8])),
+        Offset: int64(binary.LittleEndian.Uint64(buf[8:16])),
+    }, nil
+}
+
+// ReplFrame is a unit of the replication stream. PendingBytes and
+// PendingRecords tell how much the master has written after this frame.
+type ReplFrame struct {
+    Type            uint8
+    FileId          int64
+    Offset          int64
+    Data            []byte
+    PendingBytes    int64
+    PendingRecords  int64
+}
+
+func (f *ReplFrame) Encode() []byte {
+    buf := make([]byte, REPL_FRAME_HEADER_SIZE + len(f.Data))
+    buf[0] = f.Type
+    binary.LittleEndian.PutUint64(buf[1:9], uint64(f.FileId))
+    binary.LittleEndian.PutUint64(buf[9:17], uint64(f.Offset))
+    binary.LittleEndian.PutUint64(buf[17:25], uint64(len(f.Data)))
+    binary.LittleEndian.PutUint64(buf[25:33], uint64(f.PendingBytes))
+    binary.LittleEndian.PutUint64(buf[33:41], uint64(f.PendingRecords))
+    copy(buf[REPL_FRAME_HEADER_SIZE:], f.Data)
+    return buf
+}
+
+func ReadReplFrame(r io.Reader) (*ReplFrame, error) {
+    header := make([]byte, REPL_FRAME_HEADER_SIZE)
+    if _, err := io.ReadFull(r, header); err != nil {
+        return nil, err
+    }
+    f := &ReplFrame{
+        Type: header[0],
+        FileId: int64(binary.LittleEndian.Uint64(header[1:9])),
+        Offset: int64(binary.LittleEndian.Uint64(header[9:17])),
+        PendingBytes: int64(binary.LittleEndian.Uint64(header[25:33])),
+        PendingRecords: int64(binary.LittleEndian.Uint64(header[33:41])),
+    }
+    length := int64(binary.LittleEndian.Uint64(header[17:25]))
+    if f.Type < REPL_FRAME_RECORDS || f.Type > REPL_FRAME_HEARTBEAT || length < 0 || length > 16 * REPL_MAX_FRAME_SIZE {
+        return nil, ErrInvalid
+    }
+    f.Data = make([]byte, length)
+    if _, err := io.ReadFull(r, f.Data); err != nil {
+        return nil, err
+    }
+    return f, nil
+}
+
+// ReplFileInfo describes a closed data file of the master in the handshake
+type ReplFileInfo struct {
+    FileId  int64
+    Size    int64
+    Md5     []byte
+}
+
+// handshake sent by the master on connect: count(8), then fileId(8) +
+// size(8) + md5(16) of each closed data file, then the master head
+func encodeReplHandshake(infos []*ReplFileInfo, head ReplPosition) []byte {
+    buf := make([]byte, 8, 8 + len(infos) * (16 + md5.Size) + REPL_POSITION_SIZE)
+    binary.LittleEndian.PutUint64(buf[0:8], uint64(len(infos)))
+    item := make([]byte, 16 + md5.Size)
+    for _, info := range infos {
+        binary.LittleEndian.PutUint64(item[0:8], uint64(info.FileId))
+        binary.LittleEndian.PutUint64(item[8:16], uint64(info.Size))
+        copy(item[16:], info.Md5)
+        buf = append(buf, item...)
+    }
+    return append(buf, head.Encode()...)
+}
+
+func readReplHandshake(r io.Reader) ([]*ReplFileInfo, ReplPosition, error) {
+    buf := make([]byte, 8)
+    if _, err := io.ReadFull(r, buf); err != nil {
+        return nil, ReplPosition{}, err
+    }
+    n := binary.LittleEndian.Uint64(buf)
+    if n > 1 << 24 {
+        return nil, ReplPosition{}, ErrInvalid
+    }
+    infos := make([]*ReplFileInfo, 0, n)
+    item := make([]byte, 16 + md5.Size)
+    for i := uint64(0); i < n; i++ {
+        if _, err := io.ReadFull(r, item); err != nil {
+            return nil, ReplPosition{}, err
+        }
+        infos = append(infos, &ReplFileInfo{
+            FileId: int64(binary.LittleEndian.Uint64(item[0:8])),
+            Size: int64(binary.LittleEndian.Uint64(item[8:16])),
+            Md5: append([]byte(nil), item[16:]...),
+        })
+    }
+    head, err := ReadReplPosition(r)
+    return infos, head, err
+}
+
+/////////////////////////////////
+// notify tailing streams of new writes, requires bc.mu held
+func (bc *BitCask) notifyWrite() {
+    close(bc.writeCh)
+    bc.writeCh = make(chan struct{})
+}
+
+// span of whole records in a data file
+type recordSpan struct {
+    end         int64   // offset after the last record, never inside a batch
+    records     int64
+    mergeOf     int64   // fileId removed by the merge record at offset, -1 if none
+}
+
+// scan records at offset up to about maxBytes, a merge record is always
+// returned alone. requires bc.mu read lock if r is the active file
+func scanRecords(r FileReader, offset int64, maxBytes int64) (recordSpan, error) {
+    span := recordSpan{end: offset, mergeOf: -1}
+    size := r.Size()
+    header := make([]byte, RECORD_HEADER_SIZE)
+    cur := offset
+    var inBatch int64 = 0
+    for cur + RECORD_HEADER_SIZE <= size {
+        if _, err := r.ReadAt(header, cur); err != nil {
+            return span, err
+        }
+        flag := header[4]
+        valueSize := int64(binary.LittleEndian.Uint64(header[9:17]))
+        keySize := int64(binary.LittleEndian.Uint64(header[17:25]))
+        recSize := int64(RECORD_HEADER_SIZE)
+        if flag & RECORD_FLAG_MERGE > 0 {
+            if cur == offset {
+                span.end = cur + recSize
+                span.records = 1
+                span.mergeOf = valueSize
+            }
+            break
+        }
+        recSize += valueSize + keySize
+        if valueSize < 0 || keySize < 0 || cur + recSize > size {
+            break
+        }
+        if cur + recSize - offset > maxBytes && span.end > offset {
+            break
+        }
+        cur += recSize
+        inBatch++
+        if flag & RECORD_FLAG_BATCH == 0 {
+            span.end = cur
+            span.records += inBatch
+            inBatch = 0
+        }
+    }
+    return span, nil
+}
+
+// requires bc.mu held
+func (bc *BitCask) hasDataFile(fileId int64) bool {
+    if fileId == bc.ActiveFileId() {
+        return true
+    }
+    for _, meta := range bc.fileMetas {
+        if meta.FileId == fileId {
+            return true
+        }
+    }
+    return false
+}
+
+// the first data file after fileId, -1 if fileId is the active one
+// requires bc.mu held
+func (bc *BitCask) nextDataFile(fileId int64) int64 {
+    var next int64 = -1
+    for _, meta := range bc.fileMetas {
+        if meta.FileId > fileId && (next < 0 || meta.FileId < next) {
+            next = meta.FileId
+        }
+    }
+    if next < 0 && bc.ActiveFileId() > fileId {
+        next = bc.ActiveFileId()
+    }
+    return next
+}
+
+// scan data-file[fileId] at offset, and read the records if read is set.
+// returns whether the file is closed. reads the active file under the read lock
+func (bc *BitCask) scanDataFile(fileId int64, offset int64, maxBytes int64, read bool) (recordSpan, []byte, bool, error) {
+    bc.mu.RLock()
+    defer bc.mu.RUnlock()
+    if !bc.hasDataFile(fileId) {
+        return recordSpan{}, nil, false, ErrReplPositionGone
+    }
+
+    var r FileReader
+    closed := true
+    if fileId == bc.ActiveFileId() && bc.activeFile != nil {
+        r = bc.activeFile
+        closed = false
+    } else {
+        df, err := bc.refDataFile(fileId)
+        if err != nil {
+            return recordSpan{}, nil, false, err
+        }
+        defer bc.unrefDataFile(fileId)
+        r = df
+    }
+
+    span, err := scanRecords(r, offset, maxBytes)
+    if err != nil {
+        return span, nil, closed, err
+    }
+    if closed && span.end == offset && offset < r.Size() {
+        log.Printf("data-file[%d] has a broken tail at %d, skip it", fileId, offset)
+    }
+    var data []byte
+    if read && span.end > offset {
+        data = make([]byte, span.end - offset)
+        if _, err := r.ReadAt(data, offset); err != nil {
+            return span, nil, closed, err
+        }
+    }
+    return span, data, closed, nil
+}
+
+/////////////////////////////////
+// ReplicationSource streams the data files of bc to followers.
+type ReplicationSource struct {
+    bc                  *BitCask
+    mu                  sync.Mutex
+    followers           map[string]ReplPosition     // acked positions of tcp followers
+    closeCh             chan struct{}
+    closed              bool
+    maxFrameSize        int64
+    heartbeatInterval   time.Duration
+}
+
+func NewReplicationSource(bc *BitCask) *ReplicationSource {
+    return &ReplicationSource{
+        bc: bc,
+        followers: make(map[string]ReplPosition),
+        closeCh: make(chan struct{}),
+        maxFrameSize: REPL_MAX_FRAME_SIZE,
+        heartbeatInterval: REPL_HEARTBEAT_INTERVAL,
+    }
+}
+
+func (rs *ReplicationSource) SetMaxFrameSize(n int64) {
+    rs.mu.Lock()
+    defer rs.mu.Unlock()
+    rs.maxFrameSize = n
+}
+
+func (rs *ReplicationSource) SetHeartbeatInterval(d time.Duration) {
+    rs.mu.Lock()
+    defer rs.mu.Unlock()
+    rs.heartbeatInterval = d
+}
+
+// settings can be changed while streaming
+func (rs *ReplicationSource) getMaxFrameSize() int64 {
+    rs.mu.Lock()
+    defer rs.mu.Unlock()
+    return rs.maxFrameSize
+}
+
+func (rs *ReplicationSource) getHeartbeatInterval() time.Duration {
+    rs.mu.Lock()
+    defer rs.mu.Unlock()
+    return rs.heartbeatInterval
+}
+
+// Close stops all streams.
+func (rs *ReplicationSource) Close() {
+    rs.mu.Lock()
+    defer rs.mu.Unlock()
+    if !rs.closed {
+        rs.closed = true
+        close(rs.closeCh)
+    }
+}
+
+// Followers returns the last acked position of each tcp follower.
+func (rs *ReplicationSource) Followers() map[string]ReplPosition {
+    rs.mu.Lock()
+    defer rs.mu.Unlock()
+    out := make(map[string]ReplPosition, len(rs.followers))
+    for addr, pos := range rs.followers {
+        out[addr] = pos
+    }
+    return out
+}
+
+// replStream is the state of one follower stream
+type replStream struct {
+    rs              *ReplicationSource
+    w               io.Writer
+    pos             ReplPosition
+    known           map[int64]bool      // data files the follower has
+    // records in [pos, scanPos) not streamed yet
+    scanPos         ReplPosition
+    pendingBytes    int64
+    pendingRecords  int64
+}
+
+// Stream writes frames of everything written after from to w, and keeps
+// tailing the active file until the source or the db is closed, or w fails.
+// The follower is expected to have all data files up to from.FileId.
+func (rs *ReplicationSource) Stream(w io.Writer, from ReplPosition) error {
+    bc := rs.bc
+    s := &replStream{
+        rs: rs,
+        w: w,
+        pos: from,
+        known: make(map[int64]bool),
+        scanPos: from,
+    }
+    bc.mu.RLock()
+    if !bc.hasDataFile(from.FileId) {
+        bc.mu.RUnlock()
+        return ErrReplPositionGone
+    }
+    for _, meta := range bc.fileMetas {
+        if meta.FileId <= from.FileId {
+            s.known[meta.FileId] = true
+        }
+    }
+    s.known[from.FileId] = true
+    bc.mu.RUnlock()
+
+    // the follower may have made its own key for an empty file
+    if err := s.sendKey(from.FileId); err != nil {
+        return err
+    }
+
+    lastSend := time.Now()
+    for {
+        bc.mu.RLock()
+        notify := bc.writeCh
+        bc.mu.RUnlock()
+
+        sent, err := s.step()
+        if err != nil {
+            return err
+        }
+        if sent {
+            lastSend = time.Now()
+            continue
+        }
+
+        // caught up, wait for writes
+        wait := rs.getHeartbeatInterval() - time.Since(lastSend)
+        if wait <= 0 {
+            if err := s.send(&ReplFrame{Type: REPL_FRAME_HEARTBEAT, FileId: s.pos.FileId, Offset: s.pos.Offset}); err != nil {
+                return err
+            }
+            lastSend = time.Now()
+            continue
+        }
+        timer := time.NewTimer(wait)
+        select {
+        case <-notify:
+        case <-timer.C:
+        case <-rs.closeCh:
+            timer.Stop()
+            return ErrReplClosed
+        case <-bc.closeCh:
+            timer.Stop()
+            return ErrReplClosed
+        }
+        timer.Stop()
+    }
+}
+
+func (s *replStream) send(f *ReplFrame) error {
+    f.PendingBytes = s.pendingBytes
+    f.PendingRecords = s.pendingRecords
+    _, err := s.w.Write(f.Encode())
+    return err
+}
+
+// send the next frames if there is anything to send
+func (s *replStream) step() (bool, error) {
+    bc := s.rs.bc
+    s.scanAhead()
+
+    span, data, closed, err := bc.scanDataFile(s.pos.FileId, s.pos.Offset, s.rs.getMaxFrameSize(), true)
+    if err != nil {
+        return false, err
+    }
+
+    if span.end == s.pos.Offset {
+        if !closed {
+            return false, nil
+        }
+        // end of a closed file, go on with the next one
+        bc.mu.RLock()
+        next := bc.nextDataFile(s.pos.FileId)
+        bc.mu.RUnlock()
+        if next < 0 {
+            return false, nil
+        }
+        s.pos = ReplPosition{next, 0}
+        s.known[next] = true
+        if err := s.sendKey(next); err != nil {
+            return false, err
+        }
+        // an empty frame rotates the follower, even if next has no records yet
+        return true, s.send(&ReplFrame{Type: REPL_FRAME_RECORDS, FileId: next, Offset: 0})
+    }
+
+    if span.mergeOf >= 0 {
+        if err := s.sendMergeOutputs(span.mergeOf); err != nil {
+            return false, err
+        }
+    }
+
+    s.advance(ReplPosition{s.pos.FileId, span.end}, span.end - s.pos.Offset, span.records)
+    f := &ReplFrame{
+        Type: REPL_FRAME_RECORDS,
+        FileId: s.pos.FileId,
+        Offset: s.pos.Offset,
+        Data: data,
+    }
+    s.pos.Offset = span.end
+    return true, s.send(f)
+}
+
+// move the stream to end, which has n bytes of records after the current position
+func (s *replStream) advance(end ReplPosition, n int64, records int64) {
+    if !s.pos.less(s.scanPos) || !end.less(s.scanPos) {
+        s.scanPos = end
+        s.pendingBytes = 0
+        s.pendingRecords = 0
+        return
+    }
+    s.pendingBytes -= n
+    s.pendingRecords -= records
+}
+
+// count the records written after the stream position, a few frames at a time
+func (s *replStream) scanAhead() {
+    bc := s.rs.bc
+    if s.scanPos.less(s.pos) {
+        s.scanPos = s.pos
+        s.pendingBytes = 0
+        s.pendingRecords = 0
+    }
+    budget := 16 * s.rs.getMaxFrameSize()
+    for budget > 0 {
+        span, _, closed, err := bc.scanDataFile(s.scanPos.FileId, s.scanPos.Offset, budget, false)
+        if err != nil {
+            // merged away meanwhile, count again from the stream position
+            s.scanPos = s.pos
+            s.pendingBytes = 0
+            s.pendingRecords = 0
+            return
+        }
+        if span.end == s.scanPos.Offset {
+            if !closed {
+                return
+            }
+            bc.mu.RLock()
+            next := bc.nextDataFile(s.scanPos.FileId)
+            bc.mu.RUnlock()
+            if next < 0 {
+                return
+            }
+            s.scanPos = ReplPosition{next, 0}
+            continue
+        }
+        n := span.end - s.scanPos.Offset
+        s.scanPos.Offset = span.end
+        s.pendingBytes += n
+        s.pendingRecords += span.records
+        budget -= n
+    }
+}
+
+func (s *replStream) sendKey(fileId int64) error {
+    bc := s.rs.bc
+    if bc.keys == nil {
+        return nil
+    }
+    data, err := ioutil.ReadFile(bc.getKeyFilePath(fileId))
+    if os.IsNotExist(err) {
+        return nil
+    }
+    if err != nil {
+        return err
+    }
+    return s.send(&ReplFrame{Type: REPL_FRAME_KEY, FileId: fileId, Data: data})
+}
+
+// send the data files between the merged file and the stream position
+// the follower doesn't have, they're outputs of the merge
+func (s *replStream) sendMergeOutputs(mergedFileId int64) error {
+    bc := s.rs.bc
+    bc.mu.RLock()
+    outputs := make([]*FileMeta, 0)
+    for _, meta := range bc.fileMetas {
+        if meta.FileId > mergedFileId && meta.FileId < s.pos.FileId && !s.known[meta.FileId] {
+            outputs = append(outputs, meta)
+        }
+    }
+    bc.mu.RUnlock()
+
+    for _, meta := range outputs {
+        if err := s.sendFile(meta); err != nil {
+            return err
+        }
+        s.known[meta.FileId] = true
+    }
+    return nil
+}
+
+func (s *replStream) sendFile(meta *FileMeta) error {
+    bc := s.rs.bc
+    log.Printf("replicate merged data-file[%d]", meta.FileId)
+    if err := s.sendKey(meta.FileId); err != nil {
+        return err
+    }
+    df, err := bc.refDataFile(meta.FileId)
+    if err != nil {
+        return err
+    }
+    defer bc.unrefDataFile(meta.FileId)
+
+    var offset int64 = 0
+    size := df.Size()
+    maxFrameSize := s.rs.getMaxFrameSize()
+    for offset < size {
+        n := size - offset
+        if n > maxFrameSize {
+            n = maxFrameSize
+        }
+        data := make([]byte, n)
+        if _, err := df.ReadAt(data, offset); err != nil {
+            return err
+        }
+        if err := s.send(&ReplFrame{Type: REPL_FRAME_FILE, FileId: meta.FileId, Offset: offset, Data: data}); err != nil {
+            return err
+        }
+        offset += n
+    }
+    return s.send(&ReplFrame{Type: REPL_FRAME_FILE_END, FileId: meta.FileId, Offset: size, Data: meta.Md5})
+}
+
+/////////////////////////////////
+// Serve accepts followers on l until l or the source is closed. The source
+// sends the handshake, then a follower sends its start position, and
+// streams its acked positions back.
+func (rs *ReplicationSource) Serve(l net.Listener) error {
+    go func() {
+        <-rs.closeCh
+        l.Close()
+    }()
+    for {
+        conn, err := l.Accept()
+        if err != nil {
+            select {
+            case <-rs.closeCh:
+                return nil
+            default:
+            }
+            return err
+        }
+        go rs.serveConn(conn)
+    }
+}
+
+func (rs *ReplicationSource) serveConn(conn net.Conn) {
+    defer conn.Close()
+    addr := conn.RemoteAddr().String()
+    infos, head, err := rs.bc.replFileInfos()
+    if err != nil {
+        log.Printf("list data-files for follower[%s] failed, err = %s", addr, err)
+        return
+    }
+    if _, err := conn.Write(encodeReplHandshake(infos, head)); err != nil {
+        log.Printf("send handshake to follower[%s] failed, err = %s", addr, err)
+        return
+    }
+    from, err := ReadReplPosition(conn)
+    if err != nil {
+        log.Printf("read start position of follower[%s] failed, err = %s", addr, err)
+        return
+    }
+    log.Printf("follower[%s] connected, start at %d:%d", addr, from.FileId, from.Offset)
+
+    rs.mu.Lock()
+    rs.followers[addr] = from
+    rs.mu.Unlock()
+    defer func() {
+        rs.mu.Lock()
+        delete(rs.followers, addr)
+        rs.mu.Unlock()
+    }()
+
+    go func() {
+        for {
+            pos, err := ReadReplPosition(conn)
+            if err != nil {
+                // stops the stream too
+                conn.Close()
+                return
+            }
+            rs.mu.Lock()
+            rs.followers[addr] = pos
+            rs.mu.Unlock()
+        }
+    }()
+
+    err = rs.Stream(conn, from)
+    log.Printf("stream to follower[%s] stopped, err = %s", addr, err)
+}
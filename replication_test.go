@@ -0,0 +1,234 @@
+package bitcask
+
+import (
+    "bytes"
+    "fmt"
+    "io"
+    "net"
+    . "gopkg.in/check.v1"
+)
+
+type testReplicationSuite struct {
+    master      *BitCask
+    follower    *BitCask
+}
+
+var _ = Suite(&testReplicationSuite{})
+
+func (s *testReplicationSuite) SetUpTest(c *C) {
+    opts := NewOptions()
+    opts.SetMaxFileSize(2048)
+    var err error
+    s.master, err = Open(c.MkDir(), opts)
+    c.Assert(err, IsNil)
+    s.follower, err = Open(c.MkDir(), NewOptions())
+    c.Assert(err, IsNil)
+}
+
+func (s *testReplicationSuite) TearDownTest(c *C) {
+    s.master.Close()
+    s.follower.Close()
+}
+
+func (s *testReplicationSuite) write(c *C, from int, to int) {
+    for i := from; i < to; i++ {
+        c.Assert(s.master.Set([]byte(fmt.Sprintf("key%03d", i)), []byte(fmt.Sprintf("value%03d", i))), IsNil)
+    }
+    b := NewBatch()
+    b.Set([]byte("batch-a"), []byte(fmt.Sprintf("a%d", to)))
+    b.Set([]byte("batch-b"), []byte(fmt.Sprintf("b%d", to)))
+    c.Assert(s.master.Write(b), IsNil)
+    c.Assert(s.master.Del([]byte(fmt.Sprintf("key%03d", from))), IsNil)
+}
+
+func (s *testReplicationSuite) head() ReplPosition {
+    s.master.mu.RLock()
+    defer s.master.mu.RUnlock()
+    return ReplPosition{s.master.activeFile.id, s.master.activeFile.Size()}
+}
+
+func (s *testReplicationSuite) position() ReplPosition {
+    s.follower.mu.RLock()
+    defer s.follower.mu.RUnlock()
+    return ReplPosition{s.follower.activeFile.id, s.follower.activeFile.Size()}
+}
+
+// apply record frames from r until the follower reaches the master head
+func (s *testReplicationSuite) apply(c *C, r io.Reader, ack io.Writer) []*ReplFrame {
+    frames := make([]*ReplFrame, 0)
+    for s.position() != s.head() {
+        f, err := ReadReplFrame(r)
+        c.Assert(err, IsNil)
+        frames = append(frames, f)
+        if f.Type == REPL_FRAME_RECORDS {
+            c.Assert(s.follower.SyncFile(f.FileId, f.Offset, int64(len(f.Data)), f.Data), IsNil)
+        }
+        if ack != nil {
+            _, err := ack.Write(s.position().Encode())
+            c.Assert(err, IsNil)
+        }
+    }
+    return frames
+}
+
+func (s *testReplicationSuite) check(c *C) {
+    for _, key := range []string{"key001", "key050", "key099", "batch-a", "batch-b"} {
+        want, err1 := s.master.Get([]byte(key))
+        got, err2 := s.follower.Get([]byte(key))
+        c.Assert(err2, Equals, err1)
+        c.Assert(got, DeepEquals, want)
+    }
+    c.Assert(len(s.follower.GetFileMetas()), Equals, len(s.master.GetFileMetas()))
+    for i, meta := range s.master.GetFileMetas() {
+        c.Assert(s.follower.GetFileMetas()[i], DeepEquals, meta)
+    }
+}
+
+func (s *testReplicationSuite) TestStreamAndResume(c *C) {
+    s.write(c, 0, 50)
+
+    rs := NewReplicationSource(s.master)
+    pr, pw := io.Pipe()
+    done := make(chan error, 1)
+    go func() {
+        done <- rs.Stream(pw, ReplPosition{0, 0})
+        pw.Close()
+    }()
+    frames := s.apply(c, pr, nil)
+    c.Assert(frames[len(frames) - 1].PendingBytes, Equals, int64(0))
+
+    // tail new writes
+    s.write(c, 50, 100)
+    s.apply(c, pr, nil)
+    s.check(c)
+
+    rs.Close()
+    pr.Close()
+    c.Assert(<-done, NotNil)
+
+    // resume from the follower position
+    s.write(c, 100, 120)
+    rs = NewReplicationSource(s.master)
+    defer rs.Close()
+    rs.SetMaxFrameSize(256)
+    pr2, pw2 := io.Pipe()
+    go rs.Stream(pw2, s.position())
+    frames = s.apply(c, pr2, nil)
+    c.Assert(frames[0].PendingBytes > 0, Equals, true)
+    s.check(c)
+    pr2.Close()
+}
+
+func (s *testReplicationSuite) TestServe(c *C) {
+    s.write(c, 0, 100)
+
+    rs := NewReplicationSource(s.master)
+    defer rs.Close()
+    l, err := net.Listen("tcp", "127.0.0.1:0")
+    c.Assert(err, IsNil)
+    go rs.Serve(l)
+
+    conn, err := net.Dial("tcp", l.Addr().String())
+    c.Assert(err, IsNil)
+    defer conn.Close()
+    infos, head, err := readReplHandshake(conn)
+    c.Assert(err, IsNil)
+    c.Assert(head, Equals, s.head())
+    c.Assert(len(infos), Equals, len(s.master.GetFileMetas()))
+    for i, meta := range s.master.GetFileMetas() {
+        c.Assert(infos[i].FileId, Equals, meta.FileId)
+        c.Assert(infos[i].Md5, DeepEquals, meta.Md5)
+    }
+    _, err = conn.Write(ReplPosition{0, 0}.Encode())
+    c.Assert(err, IsNil)
+
+    s.apply(c, conn, conn)
+    s.check(c)
+
+    // the ack arrives asynchronously, a heartbeat round trip is enough to see it
+    rs.SetHeartbeatInterval(0)
+    f, err := ReadReplFrame(conn)
+    c.Assert(err, IsNil)
+    c.Assert(f.Type, Equals, uint8(REPL_FRAME_HEARTBEAT))
+    followers := rs.Followers()
+    c.Assert(len(followers), Equals, 1)
+    for _, pos := range followers {
+        c.Assert(pos, Equals, s.head())
+    }
+}
+
+func (s *testReplicationSuite) TestMergeOutputs(c *C) {
+    s.write(c, 0, 200)
+
+    rs := NewReplicationSource(s.master)
+    defer rs.Close()
+    pr, pw := io.Pipe()
+    defer pr.Close()
+    go func() {
+        pw.CloseWithError(rs.Stream(pw, ReplPosition{0, 0}))
+    }()
+    s.apply(c, pr, nil)
+
+    // merge the closed files
+    inputs := make([]int64, 0)
+    for _, meta := range s.master.GetFileMetas() {
+        inputs = append(inputs, meta.FileId)
+    }
+    c.Assert(len(inputs) > 1, Equals, true)
+    active := s.master.ActiveFileId()
+    c.Assert(s.master.runMerge(inputs), IsNil)
+    // outputs take the fileIds reserved after the active file
+    outputs := make([]int64, 0)
+    for _, meta := range s.master.GetFileMetas() {
+        if meta.FileId > active {
+            outputs = append(outputs, meta.FileId)
+        }
+    }
+    c.Assert(len(outputs) > 0, Equals, true)
+
+    // the outputs come before the merge records, as plain records if the
+    // stream hasn't passed them yet, or else as whole files
+    got := make(map[int64]bool)
+    for {
+        f, err := ReadReplFrame(pr)
+        c.Assert(err, IsNil)
+        if f.Type == REPL_FRAME_FILE_END || f.Type == REPL_FRAME_RECORDS && len(f.Data) > 0 {
+            got[f.FileId] = true
+        }
+        if f.Type == REPL_FRAME_RECORDS && len(f.Data) > 0 {
+            rec, err := parseRecordAt(bytes.NewReader(f.Data), 0, nil)
+            c.Assert(err, IsNil)
+            if rec.flag & RECORD_FLAG_MERGE > 0 {
+                break
+            }
+        }
+    }
+    for _, fileId := range outputs {
+        c.Assert(got[fileId], Equals, true)
+    }
+
+    // a stream already past the outputs sends them as files
+    buf := new(bytes.Buffer)
+    st := &replStream{
+        rs: rs,
+        w: buf,
+        pos: ReplPosition{s.master.ActiveFileId(), 0},
+        known: map[int64]bool{active: true, s.master.ActiveFileId(): true},
+        scanPos: ReplPosition{s.master.ActiveFileId(), 0},
+    }
+    sent, err := st.step()
+    c.Assert(err, IsNil)
+    c.Assert(sent, Equals, true)
+    ends := make([]int64, 0)
+    var last *ReplFrame
+    for buf.Len() > 0 {
+        f, err := ReadReplFrame(buf)
+        c.Assert(err, IsNil)
+        if f.Type == REPL_FRAME_FILE_END {
+            ends = append(ends, f.FileId)
+        }
+        last = f
+    }
+    c.Assert(ends, DeepEquals, outputs)
+    c.Assert(last.Type, Equals, uint8(REPL_FRAME_RECORDS))
+}
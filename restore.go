@@ -0,0 +1,356 @@
+package bitcask
+
+import (
+    "bytes"
+    "log"
+    "os"
+    "sync"
+    "time"
+)
+
+// Files are loaded by restoreParallelism workers into per-file entries,
+// which are put to keydir in fileId order by Restore, so the newest file
+// still wins as if files were restored one by one.
+
+type RestoreProgress struct {
+    Files       int         // files put to keydir
+    TotalFiles  int
+    HintFiles   int         // files read from their hint files
+    Bytes       int64       // bytes of the data files put to keydir
+    TotalBytes  int64
+    Keys        int         // keys in keydir
+    Done        bool
+}
+
+// a key of a file, with the slot and tag computed by the worker
+type restoreEntry struct {
+    key         []byte
+    di          *DirItem
+    slot        uint32
+    tagPos      uint32
+    tagSize     uint32
+}
+
+type fileLoad struct {
+    id          int64
+    entries     []*restoreEntry     // in the order of the file
+    sum         *dataSum            // of the data file
+    fromHint    bool
+    staleHint   bool                // the hint file is rejected, write it again
+    err         error
+}
+
+func newRestoreEntry(key []byte, di *DirItem) *restoreEntry {
+    pos, size := hashTagPos(key)
+    return &restoreEntry{
+        key: key,
+        di: di,
+        slot: HashTagToSlot(key[pos:pos + size]),
+        tagPos: uint32(pos),
+        tagSize: uint32(size),
+    }
+}
+
+// the hint file is rejected if it's of another version of the data file.
+// The data file is only read for its md5 if its size or mtime doesn't match
+// the hint, e.g. a copy, or the hint is v1.
+func (bc *BitCask) loadHintFile(path string, id int64) (*fileLoad, error) {
+    log.Printf("restore data from hint-file[%d]", id)
+    fc, err := bc.getFileCipher(id)
+    if err != nil {
+        return nil, err
+    }
+    hf, err := openHintFile(path, id, fc)
+    if err != nil {
+        return nil, err
+    }
+    defer hf.Close()
+
+    hintMd5, err := hf.ReadHeader()
+    if err != nil {
+        return nil, err
+    }
+    sum, err := statDataFile(bc.GetDataFilePath(id))
+    if err != nil {
+        return nil, err
+    }
+    stale := false
+    if hf.dataSize != sum.size || hf.dataMtime != sum.mtime {
+        if sum, err = bc.getDataFileSum(id); err != nil {
+            log.Printf("calc md5 for data-file[%d] failed, err = %s", id, err)
+            return nil, err
+        }
+        if !bytes.Equal(hintMd5, sum.md5) {
+            return nil, ErrHintStale
+        }
+        // write the size and mtime of the data file
+        stale = !bc.opts.readOnly
+    }
+    sum.md5 = hintMd5
+
+    load := &fileLoad{id: id, sum: sum, fromHint: true, staleHint: stale}
+    err = hf.ForEachItem(func (item *HintItem) error {
+        di := &DirItem{
+            flag: item.flag,
+            fileId: id,
+            valuePos: item.valuePos,
+            valueSize: item.valueSize,
+            expration: item.expration,
+        }
+        load.entries = append(load.entries, &restoreEntry{
+            key: item.key,
+            di: di,
+            slot: item.slot,
+            tagPos: item.tagPos,
+            tagSize: item.tagSize,
+        })
+        return nil
+    })
+    if err != nil {
+        return nil, err
+    }
+    return load, nil
+}
+
+// records of uncommitted batches are dropped, and so is a partially written
+// tail unless read-only
+func (bc *BitCask) loadDataFile(path string, id int64) (*fileLoad, error) {
+    log.Printf("restore data from data-file[%d]", id)
+    fc, err := bc.getFileCipher(id)
+    if err != nil {
+        return nil, err
+    }
+    df, err := NewDataFile(path, id, fc, bc.opts.mmap)
+    if err != nil {
+        return nil, err
+    }
+    defer df.Close()
+
+    load := &fileLoad{id: id}
+    pending := make([]*restoreEntry, 0)
+    var validEnd int64 = 0
+
+    err = df.ForEachItem(func (rec *Record, offset int64) error {
+        if rec.flag & RECORD_FLAG_MERGE > 0 {
+            validEnd = offset + rec.Size()
+            return nil
+        }
+        if rec.flag & RECORD_FLAG_BATCH_COMMIT > 0 {
+            if batchCommitCount(rec) != int64(len(pending)) {
+                log.Printf("data-file[%d], batch at offset[%d] mismatch, discard it", id, offset)
+            } else {
+                load.entries = append(load.entries, pending...)
+            }
+            pending = pending[:0]
+            validEnd = offset + rec.Size()
+            return nil
+        }
+
+        di := &DirItem{
+            flag: rec.flag,
+            fileId: df.id,
+            valuePos: offset + RecordValueOffset(),
+            valueSize: rec.valueSize,
+            expration: rec.expration,
+        }
+        // the keydir keeps the key after df is closed
+        rec.ownKey()
+        if rec.flag & RECORD_FLAG_BATCH > 0 {
+            pending = append(pending, newRestoreEntry(rec.key, di))
+            return nil
+        }
+        if len(pending) > 0 {
+            log.Printf("data-file[%d], uncommitted batch before offset[%d], discard it", id, offset)
+            pending = pending[:0]
+        }
+        load.entries = append(load.entries, newRestoreEntry(rec.key, di))
+        validEnd = offset + rec.Size()
+        return nil
+    })
+    if err != nil {
+        return nil, err
+    }
+
+    // drop partially written records and uncommitted batch at the tail
+    if validEnd < df.Size() && !bc.opts.readOnly {
+        log.Printf("data-file[%d], truncate tail from %d to %d", id, df.Size(), validEnd)
+        if err := os.Truncate(path, validEnd); err != nil {
+            return nil, err
+        }
+    }
+    return load, nil
+}
+
+// loadFile reads data-file[id] from its hint file, or from the data file if
+// there's no hint file or it's rejected. A corrupted data file is repaired
+// unless read-only. It only touches the files of id, so it runs in parallel.
+func (bc *BitCask) loadFile(id int64) (*fileLoad, error) {
+    readOnly := bc.opts.readOnly
+    dataPath := bc.GetDataFilePath(id)
+    hintPath := bc.getHintFilePath(id)
+
+    // a missing master key is not corruption, don't repair the file
+    if _, err := bc.getFileCipher(id); err != nil {
+        return nil, err
+    }
+
+    var load *fileLoad
+    var err error
+    if _, err = os.Stat(hintPath); err == nil {
+        load, err = bc.loadHintFile(hintPath, id)
+        if err != nil && err != ErrNoCipher {
+            log.Printf("hint-file[%d] is not used, err = %s", id, err)
+            load, err = bc.loadDataFile(dataPath, id)
+            if err == nil {
+                load.staleHint = !readOnly
+            }
+        }
+    } else {
+        load, err = bc.loadDataFile(dataPath, id)
+    }
+    if err == ErrNoCipher {
+        log.Printf("data-file[%d] is encrypted, but encryption is not enabled", id)
+        return nil, err
+    }
+    if err != nil && readOnly {
+        log.Printf("data-file[%d], corrupted! err = %s", id, err)
+        return nil, err
+    }
+    if err != nil {
+        // cut the damaged records out and read the data file again
+        log.Printf("data-file[%d], corrupted! err = %s, repair it.", id, err)
+        if err := bc.repairDataFile(id); err != nil {
+            log.Printf("repair data-file[%d] failed, err = %s", id, err)
+            return nil, err
+        }
+        load, err = bc.loadDataFile(dataPath, id)
+        if err != nil {
+            log.Printf("restore repaired data-file[%d] failed, err = %s", id, err)
+            return nil, err
+        }
+    }
+
+    // the data file may be truncated or repaired
+    if load.sum == nil {
+        if load.sum, err = bc.getDataFileSum(id); err != nil {
+            log.Printf("calc md5 for data-file[%d] failed, err = %s", id, err)
+            return nil, err
+        }
+    }
+    return load, nil
+}
+
+// applyFileLoad puts the entries of a file to keydir, and returns the keydir
+// of the file
+func (bc *BitCask) applyFileLoad(load *fileLoad) (*KeyDir, error) {
+    activeKD := bc.newKeyDir()
+    var live int64 = 0
+    for _, e := range load.entries {
+        live += recordSize(e.key, e.di)
+        ok, err := bc.putKeyDir(e.key, e.di, activeKD)
+        if err != nil {
+            return nil, err
+        }
+        if !ok {
+            continue
+        }
+        // fill slot, deleted keys leave it
+        tag := e.key[e.tagPos:e.tagPos + e.tagSize]
+        if e.di.flag & RECORD_FLAG_DELETED > 0 {
+            bc.unindexKeyAt(e.key, tag, e.slot)
+        } else {
+            bc.indexKeyAt(e.key, tag, e.slot, e.di, true)
+        }
+    }
+
+    // records missing from the hint file are overwritten in the same file
+    if load.fromHint {
+        bc.addDeadBytes(load.id, load.sum.size - live)
+    }
+    return activeKD, nil
+}
+
+// loadFiles loads files of ids by workers, and calls fn with them in the
+// order of ids. Workers stay at most 2 * parallelism files ahead of fn.
+func (bc *BitCask) loadFiles(ids []int64, fn func(load *fileLoad) error) error {
+    n := bc.opts.restoreParallelism
+    if n < 1 {
+        n = 1
+    }
+    results := make([]chan *fileLoad, len(ids))
+    for i := range results {
+        results[i] = make(chan *fileLoad, 1)
+    }
+    tokens := make(chan struct{}, 2 * n)
+    jobs := make(chan int)
+    stop := make(chan struct{})
+
+    go func() {
+        defer close(jobs)
+        for i := range ids {
+            select {
+            case tokens <- struct{}{}:
+            case <-stop:
+                return
+            }
+            select {
+            case jobs <- i:
+            case <-stop:
+                return
+            }
+        }
+    }()
+
+    var wg sync.WaitGroup
+    for w := 0; w < n; w++ {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            for i := range jobs {
+                load, err := bc.loadFile(ids[i])
+                if err != nil {
+                    load = &fileLoad{id: ids[i], err: err}
+                }
+                results[i] <- load
+            }
+        }()
+    }
+
+    var err error
+    for i := range ids {
+        load := <-results[i]
+        <-tokens
+        if err = load.err; err != nil {
+            break
+        }
+        if err = fn(load); err != nil {
+            break
+        }
+    }
+    close(stop)
+    wg.Wait()
+    return err
+}
+
+// logs progress at most once a second, and calls the progress func of
+// options on every file
+type restoreReporter struct {
+    progress    RestoreProgress
+    fn          func(*RestoreProgress)
+    begin       time.Time
+    last        time.Time
+}
+
+func (r *restoreReporter) report() {
+    p := &r.progress
+    now := time.Now()
+    if now.Sub(r.last) >= time.Second || p.Done {
+        r.last = now
+        log.Printf("restore %d/%d files, %d/%d MB, %d keys, %.2f seconds",
+            p.Files, p.TotalFiles, p.Bytes >> 20, p.TotalBytes >> 20, p.Keys, now.Sub(r.begin).Seconds())
+    }
+    if r.fn != nil {
+        cp := *p
+        r.fn(&cp)
+    }
+}
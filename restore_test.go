@@ -0,0 +1,153 @@
+package bitcask
+
+import (
+    "fmt"
+    "os"
+    . "gopkg.in/check.v1"
+)
+
+type testRestoreSuite struct {
+    dir     string
+}
+
+var _ = Suite(&testRestoreSuite{})
+
+func (s *testRestoreSuite) SetUpTest(c *C) {
+    s.dir = c.MkDir()
+    opts := NewOptions()
+    opts.SetMaxFileSize(1024)
+    bc, err := Open(s.dir, opts)
+    c.Assert(err, IsNil)
+    defer bc.Close()
+
+    // keys overwritten and deleted across files, some files without hint
+    for round := 0; round < 5; round++ {
+        for i := 0; i < 50; i++ {
+            key := []byte(fmt.Sprintf("{tag%d}key%03d", i % 7, i))
+            if i % 5 == round {
+                c.Assert(bc.Del(key), IsNil)
+                continue
+            }
+            c.Assert(bc.Set(key, []byte(fmt.Sprintf("value%d-%d", round, i))), IsNil)
+        }
+    }
+    for _, meta := range bc.GetFileMetas() {
+        if meta.FileId % 3 == 0 {
+            c.Assert(os.Remove(bc.getHintFilePath(meta.FileId)), IsNil)
+        }
+    }
+}
+
+type restoreState struct {
+    values      map[string]string
+    slots       []*SlotStat
+    stats       map[int64]FileStat
+    files       int
+}
+
+func (s *testRestoreSuite) restore(c *C, parallelism int) *restoreState {
+    opts := NewOptions()
+    opts.SetMaxFileSize(1024)
+    opts.SetRestoreParallelism(parallelism)
+    progress := make([]*RestoreProgress, 0)
+    opts.SetRestoreProgressFunc(func(p *RestoreProgress) {
+        progress = append(progress, p)
+    })
+    bc, err := Open(s.dir, opts)
+    c.Assert(err, IsNil)
+    defer bc.Close()
+
+    c.Assert(len(progress) > 1, Equals, true)
+    last := progress[len(progress) - 1]
+    c.Assert(last.Done, Equals, true)
+    c.Assert(last.Files, Equals, last.TotalFiles)
+    c.Assert(last.Bytes, Equals, last.TotalBytes)
+    c.Assert(last.Keys, Equals, bc.keyDir.Len())
+    for i, p := range progress {
+        c.Assert(p.Files, Equals, i + 1)
+    }
+
+    st := &restoreState{
+        values: make(map[string]string),
+        slots: bc.SlotsSummary(),
+        stats: make(map[int64]FileStat),
+        files: last.Files,
+    }
+    for i := 0; i < 50; i++ {
+        key := fmt.Sprintf("{tag%d}key%03d", i % 7, i)
+        if v, err := bc.Get([]byte(key)); err == nil {
+            st.values[key] = string(v)
+        }
+    }
+    for id, stat := range bc.fileStats {
+        st.stats[id] = *stat
+    }
+    return st
+}
+
+func (s *testRestoreSuite) TestParallel(c *C) {
+    serial := s.restore(c, 1)
+    c.Assert(serial.files > 5, Equals, true)
+    c.Assert(len(serial.values), Equals, 40)
+    for key, v := range serial.values {
+        var i int
+        fmt.Sscanf(key[len(key) - 3:], "%d", &i)
+        c.Assert(v, Equals, fmt.Sprintf("value4-%d", i))
+    }
+
+    for _, n := range []int{2, 8} {
+        st := s.restore(c, n)
+        c.Assert(st, DeepEquals, serial)
+    }
+}
+
+// the hint written on close is read on open, then removed as the active
+// file is appended
+func (s *testRestoreSuite) TestActiveHint(c *C) {
+    dir := c.MkDir()
+    hintFiles := 0
+    opts := NewOptions()
+    opts.SetRestoreProgressFunc(func(p *RestoreProgress) {
+        hintFiles = p.HintFiles
+    })
+    hintPath := dir + "/000000000.hint"
+
+    bc, err := Open(dir, opts)
+    c.Assert(err, IsNil)
+    c.Assert(bc.Set([]byte("a"), []byte("1")), IsNil)
+    c.Assert(bc.Set([]byte("b"), []byte("2")), IsNil)
+    c.Assert(bc.Close(), IsNil)
+    _, err = os.Stat(hintPath)
+    c.Assert(err, IsNil)
+
+    for i, key := range []string{"c", "d"} {
+        bc, err = Open(dir, opts)
+        c.Assert(err, IsNil)
+        c.Assert(hintFiles, Equals, 1)
+        _, err = os.Stat(hintPath)
+        c.Assert(os.IsNotExist(err), Equals, true)
+        c.Assert(bc.ActiveFileId(), Equals, int64(0))
+        c.Assert(bc.keyDir.Len(), Equals, 2 + i)
+        c.Assert(bc.Set([]byte(key), []byte("3")), IsNil)
+        c.Assert(bc.Close(), IsNil)
+    }
+
+    // appended after the hint is written
+    f, err := os.OpenFile(dir + "/000000000.data", os.O_WRONLY | os.O_APPEND, 0644)
+    c.Assert(err, IsNil)
+    rec := &Record{key: []byte("e"), value: []byte("4")}
+    data, err := rec.Encode()
+    c.Assert(err, IsNil)
+    _, err = f.Write(data)
+    c.Assert(err, IsNil)
+    f.Close()
+
+    bc, err = Open(dir, opts)
+    c.Assert(err, IsNil)
+    defer bc.Close()
+    c.Assert(hintFiles, Equals, 0)
+    for _, key := range []string{"a", "b", "c", "d", "e"} {
+        _, err := bc.Get([]byte(key))
+        c.Assert(err, IsNil)
+    }
+}
@@ -0,0 +1,322 @@
+package bitcask
+
+import (
+    "bytes"
+    "log"
+    "sort"
+    "time"
+    "github.com/rocket323/bitcask/btree"
+)
+
+// The slot index keeps the live keys of each slot ordered by key, with the
+// bytes of their records. Keys of a hash tag are indexed by tag as well.
+// Deleted keys leave the index, expired keys stay until they're swept.
+//
+// The index keeps a copy of every key, it can be disabled by
+// Options.SetSlotIndex. The keys of a slot or tag are then listed by a scan
+// of the keydir, expired keys are left out.
+
+const (
+    SLOT_BTREE_DEGREE = 16
+    SLOT_INDEX_ITEM_SIZE = 64       // about, an item of a node 3/4 full and its boxed bytes
+    TAG_INDEX_ITEM_SIZE = 48        // about, a map entry and its string header
+)
+
+type slotIndex struct {
+    keys        *btree.BTree        // key -> record bytes
+    bytes       int64
+    keyBytes    int64
+}
+
+type SlotStat struct {
+    Slot    uint32
+    Keys    int64
+    Bytes   int64
+}
+
+// add key to the index, or update its bytes if it's there already.
+// requires bc.mu held
+func (bc *BitCask) indexKey(key []byte, di *DirItem, add bool) {
+    tag, slot := HashKeyToSlot(key)
+    bc.indexKeyAt(key, tag, slot, di, add)
+}
+
+// indexKey with the tag and slot of key known, i.e. from a hint file
+func (bc *BitCask) indexKeyAt(key []byte, tag []byte, slot uint32, di *DirItem, add bool) {
+    if !bc.opts.slotIndex {
+        return
+    }
+    si := bc.keysInSlot[slot]
+    if si == nil {
+        if !add {
+            return
+        }
+        si = &slotIndex{keys: btree.New(SLOT_BTREE_DEGREE)}
+        bc.keysInSlot[slot] = si
+    }
+    size := recordSize(key, di)
+    if old, ok := si.keys.Get(key); ok {
+        si.bytes -= old.(int64)
+    } else if !add {
+        return
+    } else {
+        si.keyBytes += int64(len(key))
+    }
+    si.keys.Put(key, size)
+    si.bytes += size
+
+    if len(tag) < len(key) {
+        keys := bc.keysInTag[string(tag)]
+        if keys == nil {
+            keys = make(map[string]bool)
+            bc.keysInTag[string(tag)] = keys
+            bc.tagIndexBytes += int64(len(tag)) + TAG_INDEX_ITEM_SIZE
+        }
+        if !keys[string(key)] {
+            keys[string(key)] = true
+            bc.tagIndexBytes += int64(len(key)) + TAG_INDEX_ITEM_SIZE
+        }
+    }
+}
+
+// requires bc.mu held
+func (bc *BitCask) unindexKey(key []byte) {
+    tag, slot := HashKeyToSlot(key)
+    bc.unindexKeyAt(key, tag, slot)
+}
+
+func (bc *BitCask) unindexKeyAt(key []byte, tag []byte, slot uint32) {
+    if si := bc.keysInSlot[slot]; si != nil {
+        if old, ok := si.keys.Delete(key); ok {
+            si.bytes -= old.(int64)
+            si.keyBytes -= int64(len(key))
+        }
+        if si.keys.Len() == 0 {
+            delete(bc.keysInSlot, slot)
+        }
+    }
+    if keys := bc.keysInTag[string(tag)]; keys != nil {
+        if keys[string(key)] {
+            delete(keys, string(key))
+            bc.tagIndexBytes -= int64(len(key)) + TAG_INDEX_ITEM_SIZE
+        }
+        if len(keys) == 0 {
+            delete(bc.keysInTag, string(tag))
+            bc.tagIndexBytes -= int64(len(tag)) + TAG_INDEX_ITEM_SIZE
+        }
+    }
+}
+
+// bytes held by the slot and tag indexes, estimated.
+// requires bc.mu held
+func (bc *BitCask) slotIndexMemUsage() int64 {
+    n := bc.tagIndexBytes
+    for _, si := range bc.keysInSlot {
+        n += int64(si.keys.Len()) * SLOT_INDEX_ITEM_SIZE + si.keyBytes
+    }
+    return n
+}
+
+// scanSlots calls fn for every live key of the keydir with its tag and slot,
+// for the queries of a slot without the slot index.
+// requires bc.mu held
+func (bc *BitCask) scanSlots(fn func(key []byte, tag []byte, slot uint32, di *DirItem)) error {
+    now := time.Now().Unix()
+    return bc.keyDir.ForEachMatch(func(di *DirItem) bool {
+        return di.flag & RECORD_FLAG_DELETED == 0 && !isExpired(di.expration, now)
+    }, func(key []byte, di *DirItem) error {
+        tag, slot := HashKeyToSlot(key)
+        fn(key, tag, slot, di)
+        return nil
+    })
+}
+
+// live keys of slot in key order, only the keys with hash tag if tag isn't
+// nil, listed by a scan of the keydir.
+// requires bc.mu held
+func (bc *BitCask) scanSlotKeys(slot uint32, tag []byte) ([][]byte, error) {
+    keys := make([][]byte, 0)
+    err := bc.scanSlots(func(key []byte, t []byte, s uint32, di *DirItem) {
+        if s == slot && (tag == nil || len(t) < len(key) && bytes.Equal(t, tag)) {
+            keys = append(keys, append([]byte(nil), key...))
+        }
+    })
+    if err != nil {
+        return nil, err
+    }
+    sort.Slice(keys, func(i, j int) bool { return bytes.Compare(keys[i], keys[j]) < 0 })
+    return keys, nil
+}
+
+// requires bc.mu held
+func (bc *BitCask) isIndexed(key []byte) bool {
+    _, slot := HashKeyToSlot(key)
+    if si := bc.keysInSlot[slot]; si != nil {
+        _, ok := si.keys.Get(key)
+        return ok
+    }
+    return false
+}
+
+// all keys of slot in order, requires bc.mu held
+func (bc *BitCask) slotKeys(slot uint32) ([][]byte, error) {
+    if !bc.opts.slotIndex {
+        return bc.scanSlotKeys(slot, nil)
+    }
+    si := bc.keysInSlot[slot]
+    if si == nil {
+        return nil, nil
+    }
+    keys := make([][]byte, 0, si.keys.Len())
+    si.keys.ForEach(func(key []byte, value interface{}) bool {
+        keys = append(keys, append([]byte(nil), key...))
+        return true
+    })
+    return keys, nil
+}
+
+// keys with hash tag in order, requires bc.mu held
+func (bc *BitCask) tagKeys(tag []byte) ([][]byte, error) {
+    if !bc.opts.slotIndex {
+        return bc.scanSlotKeys(HashTagToSlot(tag), tag)
+    }
+    keys := make([][]byte, 0, len(bc.keysInTag[string(tag)]))
+    for k := range bc.keysInTag[string(tag)] {
+        keys = append(keys, []byte(k))
+    }
+    sort.Slice(keys, func(i, j int) bool { return bytes.Compare(keys[i], keys[j]) < 0 })
+    return keys, nil
+}
+
+// SlotInfo returns the number of live keys in slot and the bytes of their records.
+func (bc *BitCask) SlotInfo(slot uint32) (*SlotStat, error) {
+    if slot >= MaxSlotNum {
+        return nil, ErrInvalid
+    }
+    bc.mu.RLock()
+    defer bc.mu.RUnlock()
+
+    stat := &SlotStat{Slot: slot}
+    if !bc.opts.slotIndex {
+        err := bc.scanSlots(func(key []byte, tag []byte, s uint32, di *DirItem) {
+            if s == slot {
+                stat.Keys++
+                stat.Bytes += recordSize(key, di)
+            }
+        })
+        if err != nil {
+            return nil, err
+        }
+        return stat, nil
+    }
+    if si := bc.keysInSlot[slot]; si != nil {
+        stat.Keys = int64(si.keys.Len())
+        stat.Bytes = si.bytes
+    }
+    return stat, nil
+}
+
+// KeysInSlot returns up to count keys of slot after cursor in key order, and
+// the cursor of the next page. Start with a nil cursor, a nil next cursor
+// means there are no more keys.
+func (bc *BitCask) KeysInSlot(slot uint32, cursor []byte, count int) ([][]byte, []byte, error) {
+    if slot >= MaxSlotNum || count <= 0 {
+        return nil, nil, ErrInvalid
+    }
+    bc.mu.RLock()
+    defer bc.mu.RUnlock()
+
+    if !bc.opts.slotIndex {
+        all, err := bc.scanSlotKeys(slot, nil)
+        if err != nil {
+            return nil, nil, err
+        }
+        i := 0
+        if cursor != nil {
+            i = sort.Search(len(all), func(i int) bool { return bytes.Compare(all[i], cursor) > 0 })
+        }
+        if len(all) - i <= count {
+            return all[i:], nil, nil
+        }
+        keys := all[i:i + count]
+        return keys, keys[count - 1], nil
+    }
+    si := bc.keysInSlot[slot]
+    if si == nil {
+        return nil, nil, nil
+    }
+    it := si.keys.NewIterator()
+    if cursor == nil {
+        it.SeekToFirst()
+    } else {
+        it.Seek(cursor)
+        if it.Valid() && bytes.Equal(it.Key(), cursor) {
+            it.Next()
+        }
+    }
+
+    keys := make([][]byte, 0, count)
+    for ; it.Valid() && len(keys) < count; it.Next() {
+        keys = append(keys, append([]byte(nil), it.Key()...))
+    }
+    if !it.Valid() {
+        return keys, nil, nil
+    }
+    return keys, keys[len(keys) - 1], nil
+}
+
+// SlotsSummary returns the stats of all slots with keys, ordered by slot.
+func (bc *BitCask) SlotsSummary() []*SlotStat {
+    bc.mu.RLock()
+    defer bc.mu.RUnlock()
+
+    if !bc.opts.slotIndex {
+        return bc.scanSlotsSummary()
+    }
+    stats := make([]*SlotStat, 0, len(bc.keysInSlot))
+    for slot, si := range bc.keysInSlot {
+        stats = append(stats, &SlotStat{
+            Slot: slot,
+            Keys: int64(si.keys.Len()),
+            Bytes: si.bytes,
+        })
+    }
+    sort.Slice(stats, func(i, j int) bool { return stats[i].Slot < stats[j].Slot })
+    return stats
+}
+
+// requires bc.mu held
+func (bc *BitCask) scanSlotsSummary() []*SlotStat {
+    bySlot := make(map[uint32]*SlotStat)
+    err := bc.scanSlots(func(key []byte, tag []byte, slot uint32, di *DirItem) {
+        stat := bySlot[slot]
+        if stat == nil {
+            stat = &SlotStat{Slot: slot}
+            bySlot[slot] = stat
+        }
+        stat.Keys++
+        stat.Bytes += recordSize(key, di)
+    })
+    if err != nil {
+        log.Printf("scan slots failed, err = %s", err)
+    }
+    stats := make([]*SlotStat, 0, len(bySlot))
+    for _, stat := range bySlot {
+        stats = append(stats, stat)
+    }
+    sort.Slice(stats, func(i, j int) bool { return stats[i].Slot < stats[j].Slot })
+    return stats
+}
+
+// KeysWithTag returns the live keys with hash tag in key order, unlike
+// AllKeysWithTag it leaves the index as it is.
+func (bc *BitCask) KeysWithTag(tag []byte) [][]byte {
+    bc.mu.RLock()
+    defer bc.mu.RUnlock()
+
+    keys, err := bc.tagKeys(tag)
+    if err != nil {
+        log.Printf("list keys with tag[%s] failed, err = %s", tag, err)
+    }
+    return keys
+}
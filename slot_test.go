@@ -0,0 +1,296 @@
+package bitcask
+
+import (
+    "bytes"
+    "encoding/binary"
+    "fmt"
+    "io/ioutil"
+    "time"
+    . "gopkg.in/check.v1"
+)
+
+type testSlotSuite struct {
+    bc      *BitCask
+}
+
+var _ = Suite(&testSlotSuite{})
+
+func (s *testSlotSuite) SetUpTest(c *C) {
+    opts := NewOptions()
+    opts.SetMaxFileSize(1024)
+    var err error
+    s.bc, err = Open(c.MkDir(), opts)
+    c.Assert(err, IsNil)
+}
+
+func (s *testSlotSuite) TearDownTest(c *C) {
+    s.bc.Close()
+}
+
+func (s *testSlotSuite) fill(c *C, tag string, n int) [][]byte {
+    keys := make([][]byte, 0, n)
+    for i := 0; i < n; i++ {
+        key := []byte(fmt.Sprintf("{%s}key%03d", tag, i))
+        c.Assert(s.bc.Set(key, []byte(fmt.Sprintf("value%03d", i))), IsNil)
+        keys = append(keys, key)
+    }
+    return keys
+}
+
+func (s *testSlotSuite) slotInfo(c *C, slot uint32) *SlotStat {
+    stat, err := s.bc.SlotInfo(slot)
+    c.Assert(err, IsNil)
+    return stat
+}
+
+func (s *testSlotSuite) TestSlotInfo(c *C) {
+    keys := s.fill(c, "user1", 50)
+    _, slot := HashKeyToSlot(keys[0])
+    // header + key + value
+    size := int64(RECORD_HEADER_SIZE + len(keys[0]) + len("value000"))
+
+    stat := s.slotInfo(c, slot)
+    c.Assert(stat.Keys, Equals, int64(50))
+    c.Assert(stat.Bytes, Equals, 50 * size)
+
+    // overwrite, delete
+    c.Assert(s.bc.Set(keys[0], []byte("longer value")), IsNil)
+    c.Assert(s.bc.Del(keys[1]), IsNil)
+    c.Assert(s.bc.DelLocal(keys[2]), IsNil)
+    want := 47 * size + int64(RECORD_HEADER_SIZE + len(keys[0]) + len("longer value"))
+    stat = s.slotInfo(c, slot)
+    c.Assert(stat.Keys, Equals, int64(48))
+    c.Assert(stat.Bytes, Equals, want)
+    c.Assert(len(s.bc.KeysWithTag([]byte("user1"))), Equals, 48)
+
+    // looking doesn't change anything
+    stat = s.slotInfo(c, slot)
+    c.Assert(stat.Keys, Equals, int64(48))
+
+    // merge drops expired keys
+    c.Assert(s.bc.SetWithExpr(keys[3], []byte("value003"), uint32(time.Now().Unix() - 1)), IsNil)
+    s.fill(c, "user2", 50)
+    inputs := make([]int64, 0)
+    for _, meta := range s.bc.GetFileMetas() {
+        inputs = append(inputs, meta.FileId)
+    }
+    c.Assert(s.bc.runMerge(inputs), IsNil)
+    stat = s.slotInfo(c, slot)
+    c.Assert(stat.Keys, Equals, int64(47))
+    c.Assert(stat.Bytes, Equals, want - size)
+
+    // same after reopen
+    dir := s.bc.dir
+    opts := s.bc.opts
+    c.Assert(s.bc.Close(), IsNil)
+    var err error
+    s.bc, err = Open(dir, opts)
+    c.Assert(err, IsNil)
+    stat = s.slotInfo(c, slot)
+    c.Assert(stat.Keys, Equals, int64(47))
+    c.Assert(stat.Bytes, Equals, want - size)
+
+    _, err = s.bc.SlotInfo(MaxSlotNum)
+    c.Assert(err, Equals, ErrInvalid)
+}
+
+func (s *testSlotSuite) TestKeysInSlot(c *C) {
+    keys := s.fill(c, "user1", 50)
+    _, slot := HashKeyToSlot(keys[0])
+    c.Assert(s.bc.Del(keys[10]), IsNil)
+
+    got := make([][]byte, 0)
+    var cursor []byte
+    pages := 0
+    for {
+        page, next, err := s.bc.KeysInSlot(slot, cursor, 7)
+        c.Assert(err, IsNil)
+        c.Assert(len(page) <= 7, Equals, true)
+        got = append(got, page...)
+        pages++
+        if next == nil {
+            break
+        }
+        cursor = next
+    }
+    c.Assert(pages, Equals, 7)
+    c.Assert(len(got), Equals, 49)
+    want := append(append([][]byte(nil), keys[:10]...), keys[11:]...)
+    c.Assert(got, DeepEquals, want)
+
+    // a key deleted between pages doesn't break the cursor
+    page, next, err := s.bc.KeysInSlot(slot, nil, 5)
+    c.Assert(err, IsNil)
+    c.Assert(s.bc.Del(page[4]), IsNil)
+    page, _, err = s.bc.KeysInSlot(slot, next, 1)
+    c.Assert(err, IsNil)
+    c.Assert(page, DeepEquals, [][]byte{keys[5]})
+
+    page, next, err = s.bc.KeysInSlot(slot + 1, nil, 10)
+    c.Assert(err, IsNil)
+    c.Assert(len(page), Equals, 0)
+    c.Assert(next, IsNil)
+}
+
+func (s *testSlotSuite) TestSlotsSummary(c *C) {
+    c.Assert(len(s.bc.SlotsSummary()), Equals, 0)
+    a := s.fill(c, "user1", 10)
+    b := s.fill(c, "user2", 20)
+    _, slotA := HashKeyToSlot(a[0])
+    _, slotB := HashKeyToSlot(b[0])
+
+    summary := s.bc.SlotsSummary()
+    c.Assert(len(summary), Equals, 2)
+    c.Assert(summary[0].Slot < summary[1].Slot, Equals, true)
+    for _, stat := range summary {
+        switch stat.Slot {
+        case slotA:
+            c.Assert(stat.Keys, Equals, int64(10))
+        case slotB:
+            c.Assert(stat.Keys, Equals, int64(20))
+        default:
+            c.Fatalf("unexpected slot %d", stat.Slot)
+        }
+    }
+
+    // an emptied slot is gone
+    for _, key := range a {
+        c.Assert(s.bc.Del(key), IsNil)
+    }
+    summary = s.bc.SlotsSummary()
+    c.Assert(len(summary), Equals, 1)
+    c.Assert(summary[0].Slot, Equals, slotB)
+}
+
+func (s *testSlotSuite) reopen(c *C) {
+    dir := s.bc.dir
+    opts := s.bc.opts
+    c.Assert(s.bc.Close(), IsNil)
+    var err error
+    s.bc, err = Open(dir, opts)
+    c.Assert(err, IsNil)
+}
+
+func (s *testSlotSuite) TestHintSlots(c *C) {
+    a := s.fill(c, "user1", 40)
+    s.fill(c, "user2", 40)
+    for i := 0; i < 40; i++ {
+        c.Assert(s.bc.Set([]byte(fmt.Sprintf("plain%03d", i)), []byte("value")), IsNil)
+    }
+    c.Assert(s.bc.Del(a[0]), IsNil)
+    before := s.bc.SlotsSummary()
+
+    // slots and tags of the closed files, from the hint items
+    for _, meta := range s.bc.GetFileMetas() {
+        hf, err := openHintFile(s.bc.getHintFilePath(meta.FileId), meta.FileId, nil)
+        c.Assert(err, IsNil)
+        c.Assert(hf.ForEachItem(func(item *HintItem) error {
+            tag, slot := HashKeyToSlot(item.key)
+            c.Assert(item.slot, Equals, slot)
+            c.Assert(item.tag(), DeepEquals, tag)
+            return nil
+        }), IsNil)
+        hf.Close()
+    }
+
+    s.reopen(c)
+    c.Assert(s.bc.SlotsSummary(), DeepEquals, before)
+    c.Assert(len(s.bc.KeysWithTag([]byte("user1"))), Equals, 39)
+    c.Assert(len(s.bc.KeysWithTag([]byte("user2"))), Equals, 40)
+}
+
+// hint files written before slots were kept in them
+func (s *testSlotSuite) TestHintV1(c *C) {
+    s.fill(c, "user1", 40)
+    before := s.bc.SlotsSummary()
+
+    metas := s.bc.GetFileMetas()
+    c.Assert(len(metas) > 0, Equals, true)
+    for _, meta := range metas {
+        path := s.bc.getHintFilePath(meta.FileId)
+        hf, err := NewHintFile(path, meta.FileId, 0, nil)
+        c.Assert(err, IsNil)
+        _, err = hf.ReadHeader()
+        c.Assert(err, IsNil)
+        items := make([]*HintItem, 0)
+        c.Assert(hf.ForEachItem(func(item *HintItem) error {
+            items = append(items, item)
+            return nil
+        }), IsNil)
+        hf.Close()
+
+        buf := new(bytes.Buffer)
+        binary.Write(buf, binary.LittleEndian, meta.FileId)
+        buf.Write(meta.Md5)
+        for _, item := range items {
+            for _, v := range []interface{}{item.flag, item.expration, item.valueSize, item.valuePos, item.keySize, item.key} {
+                binary.Write(buf, binary.LittleEndian, v)
+            }
+        }
+        c.Assert(ioutil.WriteFile(path, buf.Bytes(), 0644), IsNil)
+    }
+
+    s.reopen(c)
+    c.Assert(s.bc.SlotsSummary(), DeepEquals, before)
+    c.Assert(len(s.bc.KeysWithTag([]byte("user1"))), Equals, 40)
+}
+
+func (s *testSlotSuite) TestSlotIndexMem(c *C) {
+    a := s.fill(c, "user1", 20)
+    stats := s.bc.KeyDirStats()
+    c.Assert(stats.SlotIndexBytes > 0, Equals, true)
+    c.Assert(stats.MemBytes > stats.SlotIndexBytes, Equals, true)
+    for _, key := range a {
+        c.Assert(s.bc.Del(key), IsNil)
+    }
+    c.Assert(s.bc.KeyDirStats().SlotIndexBytes, Equals, int64(0))
+}
+
+func (s *testSlotSuite) TestNoSlotIndex(c *C) {
+    want := s.fill(c, "user1", 30)
+    s.fill(c, "user2", 20)
+    s.bc.opts.SetKeyDirMode(KEYDIR_COMPACT)
+    s.reopen(c)
+    withIndex := s.bc.SlotsSummary()
+    withMem := s.bc.KeyDirStats().MemBytes
+
+    s.bc.opts.SetSlotIndex(false)
+    s.reopen(c)
+    stats := s.bc.KeyDirStats()
+    c.Assert(stats.SlotIndexBytes, Equals, int64(0))
+    c.Assert(stats.MemBytes < withMem, Equals, true)
+
+    // same answers from a scan of the keydir
+    c.Assert(s.bc.SlotsSummary(), DeepEquals, withIndex)
+    c.Assert(s.bc.Del(want[5]), IsNil)
+    c.Assert(s.bc.SetWithExpr(want[6], []byte("value006"), uint32(time.Now().Unix() - 1)), IsNil)
+    want = append(append([][]byte(nil), want[:5]...), want[7:]...)
+    c.Assert(s.bc.KeysWithTag([]byte("user1")), DeepEquals, want)
+    _, slot := HashKeyToSlot(want[0])
+    c.Assert(s.slotInfo(c, slot).Keys, Equals, int64(28))
+
+    got := make([][]byte, 0)
+    var cursor []byte
+    for {
+        page, next, err := s.bc.KeysInSlot(slot, cursor, 10)
+        c.Assert(err, IsNil)
+        got = append(got, page...)
+        if next == nil {
+            break
+        }
+        cursor = next
+    }
+    c.Assert(got, DeepEquals, want)
+
+    _, err := s.bc.FirstKeyUnderSlot(slot)
+    c.Assert(err, Equals, ErrNoSlotIndex)
+    _, err = s.bc.AllKeysWithTag([]byte("user1"))
+    c.Assert(err, Equals, ErrNoSlotIndex)
+
+    target := newMemTarget()
+    progress, err := s.bc.MigrateSlot(slot, target)
+    c.Assert(err, IsNil)
+    c.Assert(progress.Moved, Equals, int64(28))
+    c.Assert(len(target.items), Equals, 28)
+    c.Assert(s.slotInfo(c, slot).Keys, Equals, int64(0))
+}
@@ -0,0 +1,182 @@
+package bitcask
+
+import (
+    "log"
+    "os"
+    "sync"
+    "time"
+)
+
+// Snapshot is a read-only view of the db at the moment it's taken.
+// Data files referenced by a snapshot are kept open and won't be
+// removed by merge until the snapshot is released. The active file is
+// only pinned by id, it's opened when read after it's rotated.
+type Snapshot struct {
+    mu          sync.Mutex
+    bc          *BitCask
+    kd          *KeyDir
+    fileIds     []int64
+    activeId    int64       // -1 if there's no active file
+    activeSize  int64       // size of the active file when it's taken
+    released    bool
+}
+
+func (bc *BitCask) Snapshot() (*Snapshot, error) {
+    bc.mu.Lock()
+    defer bc.mu.Unlock()
+
+    fileIds, activeId, err := bc.pinFiles()
+    if err != nil {
+        return nil, err
+    }
+    var activeSize int64
+    if activeId >= 0 {
+        activeSize = bc.activeFile.Size()
+    }
+
+    snap := &Snapshot{
+        bc: bc,
+        kd: bc.cloneKeyDir(),
+        fileIds: fileIds,
+        activeId: activeId,
+        activeSize: activeSize,
+    }
+    return snap, nil
+}
+
+func (s *Snapshot) Get(key []byte) ([]byte, error) {
+    value, _, err := s.GetWithExpr(key)
+    return value, err
+}
+
+func (s *Snapshot) GetWithExpr(key []byte) ([]byte, uint32, error) {
+    s.mu.Lock()
+    if s.released {
+        s.mu.Unlock()
+        return nil, 0, ErrSnapshotReleased
+    }
+    kd := s.kd
+    s.mu.Unlock()
+
+    di, err := kd.Get(key)
+    if err != nil {
+        return nil, 0, err
+    }
+    if di.flag & RECORD_FLAG_DELETED > 0 || isExpired(di.expration, time.Now().Unix()) {
+        return nil, 0, ErrKeyNotFound
+    }
+
+    bc := s.bc
+    offset := int64(di.valuePos) - RecordValueOffset()
+    bc.mu.RLock()
+    defer bc.mu.RUnlock()
+    rec, err := bc.refRecord(di.fileId, offset)
+    if err != nil {
+        log.Printf("ref file[%d] at offset[%d] failed, err=%s\n", di.fileId, offset, err)
+        return nil, 0, err
+    }
+    defer bc.unrefRecord(di.fileId, offset)
+    return rec.ownedValue(), di.expration, nil
+}
+
+// the snapshot KeyDir is never written, so iterators can share it
+func (s *Snapshot) NewIterator(opts *IteratorOptions) (*Iterator, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if s.released {
+        return nil, ErrSnapshotReleased
+    }
+    return newIterator(s.bc, s.kd, opts)
+}
+
+// Release unpins the data files of the snapshot, files merged meanwhile
+// are removed now. Iterators of the snapshot must not be used after it.
+func (s *Snapshot) Release() {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if s.released {
+        return
+    }
+    s.released = true
+
+    bc := s.bc
+    bc.mu.Lock()
+    defer bc.mu.Unlock()
+    bc.unpinFiles(s.fileIds, s.activeId)
+    s.kd = nil
+}
+
+// pin all data files for a view of the db, the active file is pinned by id
+// only, its id is -1 if there's none.
+// requires bc.mu held
+func (bc *BitCask) pinFiles() ([]int64, int64, error) {
+    fileIds := make([]int64, 0, len(bc.fileMetas) + 1)
+    for _, meta := range bc.fileMetas {
+        fileIds = append(fileIds, meta.FileId)
+    }
+    var activeId int64 = -1
+    if bc.activeFile != nil {
+        activeId = bc.activeFile.id
+    } else {
+        // the last data file in read-only mode, it's not written
+        fileIds = append(fileIds, bc.ActiveFileId())
+    }
+
+    for i, fileId := range fileIds {
+        if err := bc.pinDataFile(fileId); err != nil {
+            for _, pinned := range fileIds[:i] {
+                bc.unpinDataFile(pinned)
+            }
+            return nil, -1, err
+        }
+    }
+    // a handle of the active file would miss what's written after it
+    if activeId >= 0 {
+        bc.pinnedFiles[activeId]++
+    }
+    return fileIds, activeId, nil
+}
+
+// requires bc.mu held
+func (bc *BitCask) unpinFiles(fileIds []int64, activeId int64) {
+    for _, fileId := range fileIds {
+        bc.unpinDataFile(fileId)
+    }
+    if activeId >= 0 {
+        bc.releasePin(activeId)
+    }
+}
+
+// requires bc.mu held
+func (bc *BitCask) pinDataFile(fileId int64) error {
+    if _, err := bc.refDataFile(fileId); err != nil {
+        return err
+    }
+    bc.pinnedFiles[fileId]++
+    return nil
+}
+
+// requires bc.mu held
+func (bc *BitCask) unpinDataFile(fileId int64) {
+    bc.unrefDataFile(fileId)
+    bc.releasePin(fileId)
+}
+
+// drop a pin of fileId, a merged file is removed with its last pin
+// requires bc.mu held
+func (bc *BitCask) releasePin(fileId int64) {
+    bc.pinnedFiles[fileId]--
+    if bc.pinnedFiles[fileId] > 0 {
+        return
+    }
+    delete(bc.pinnedFiles, fileId)
+
+    if bc.obsoleteFiles[fileId] {
+        delete(bc.obsoleteFiles, fileId)
+        log.Printf("data-file[%d] released by snapshot, remove it", fileId)
+        if err := os.Remove(getObsoletePath(bc.GetDataFilePath(fileId))); err != nil {
+            log.Printf("remove data-file[%d] failed, err = %s", fileId, err)
+        }
+        bc.removeKeyFile(fileId)
+    }
+}
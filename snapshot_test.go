@@ -0,0 +1,181 @@
+package bitcask
+
+import (
+    "fmt"
+    "os"
+    . "gopkg.in/check.v1"
+)
+
+type testSnapshotSuite struct {
+    bc  *BitCask
+}
+
+var _ = Suite(&testSnapshotSuite{})
+
+func (s *testSnapshotSuite) SetUpTest(c *C) {
+    opts := NewOptions()
+    opts.SetMaxFileSize(4096)
+    var err error
+    s.bc, err = Open(c.MkDir(), opts)
+    c.Assert(err, IsNil)
+}
+
+func (s *testSnapshotSuite) TearDownTest(c *C) {
+    s.bc.Close()
+}
+
+func (s *testSnapshotSuite) TestSnapshotSurvivesMerge(c *C) {
+    n := 200
+    value := make([]byte, 100)
+    for i := 0; i < n; i++ {
+        c.Assert(s.bc.Set([]byte(fmt.Sprintf("key%03d", i)), value), IsNil)
+    }
+    firstFile := s.bc.GetDataFilePath(s.bc.GetMinDataFileId())
+
+    snap, err := s.bc.Snapshot()
+    c.Assert(err, IsNil)
+
+    for i := 0; i < n; i++ {
+        key := []byte(fmt.Sprintf("key%03d", i))
+        if i % 2 == 0 {
+            c.Assert(s.bc.Del(key), IsNil)
+        } else {
+            c.Assert(s.bc.Set(key, []byte("new")), IsNil)
+        }
+    }
+
+    done := make(chan int, 1)
+    s.bc.Merge(done)
+    <-done
+
+    // merged files are kept for the snapshot
+    _, err = os.Stat(firstFile)
+    c.Assert(os.IsNotExist(err), Equals, true)
+    _, err = os.Stat(getObsoletePath(firstFile))
+    c.Assert(err, IsNil)
+
+    for i := 0; i < n; i++ {
+        val, err := snap.Get([]byte(fmt.Sprintf("key%03d", i)))
+        c.Assert(err, IsNil)
+        c.Assert(len(val), Equals, len(value))
+    }
+
+    it, err := snap.NewIterator(nil)
+    c.Assert(err, IsNil)
+    count := 0
+    for it.SeekToFirst(); it.Valid(); it.Next() {
+        count++
+    }
+    c.Assert(count, Equals, n)
+
+    snap.Release()
+    _, err = snap.Get([]byte("key001"))
+    c.Assert(err, Equals, ErrSnapshotReleased)
+    _, err = os.Stat(getObsoletePath(firstFile))
+    c.Assert(os.IsNotExist(err), Equals, true)
+}
+
+// keys written to the active file after a snapshot are still read once it's
+// rotated, and the snapshot reads it after it's merged
+func (s *testSnapshotSuite) TestActiveFileRotates(c *C) {
+    c.Assert(s.bc.Set([]byte("a"), []byte("1")), IsNil)
+    activeId := s.bc.ActiveFileId()
+    snap, err := s.bc.Snapshot()
+    c.Assert(err, IsNil)
+    c.Assert(snap.activeId, Equals, activeId)
+    c.Assert(s.bc.Set([]byte("b"), []byte("2")), IsNil)
+    value := make([]byte, 100)
+    for i := 0; s.bc.ActiveFileId() == activeId; i++ {
+        c.Assert(s.bc.Set([]byte(fmt.Sprintf("key%03d", i)), value), IsNil)
+    }
+
+    val, err := s.bc.Get([]byte("b"))
+    c.Assert(err, IsNil)
+    c.Assert(string(val), Equals, "2")
+    val, err = snap.Get([]byte("a"))
+    c.Assert(err, IsNil)
+    c.Assert(string(val), Equals, "1")
+    _, err = snap.Get([]byte("b"))
+    c.Assert(err, Equals, ErrKeyNotFound)
+
+    done := make(chan int, 1)
+    s.bc.Merge(done)
+    <-done
+    val, err = snap.Get([]byte("a"))
+    c.Assert(err, IsNil)
+    c.Assert(string(val), Equals, "1")
+    snap.Release()
+    _, err = os.Stat(getObsoletePath(s.bc.GetDataFilePath(activeId)))
+    c.Assert(os.IsNotExist(err), Equals, true)
+}
+
+// iterators pin the data files like snapshots until they're closed
+func (s *testSnapshotSuite) TestIteratorSurvivesMerge(c *C) {
+    n := 200
+    for i := 0; i < n; i++ {
+        c.Assert(s.bc.Set([]byte(fmt.Sprintf("key%03d", i)), []byte(fmt.Sprintf("value%d", i))), IsNil)
+    }
+    firstFile := s.bc.GetDataFilePath(s.bc.GetMinDataFileId())
+
+    it, err := s.bc.NewIterator(nil)
+    c.Assert(err, IsNil)
+    for i := 0; i < n; i += 2 {
+        c.Assert(s.bc.Del([]byte(fmt.Sprintf("key%03d", i))), IsNil)
+    }
+    done := make(chan int, 1)
+    s.bc.Merge(done)
+    <-done
+    _, err = os.Stat(getObsoletePath(firstFile))
+    c.Assert(err, IsNil)
+
+    count := 0
+    for it.SeekToFirst(); it.Valid(); it.Next() {
+        val, err := it.Value()
+        c.Assert(err, IsNil)
+        c.Assert(string(val), Equals, fmt.Sprintf("value%d", count))
+        count++
+    }
+    c.Assert(count, Equals, n)
+    it.Close()
+    _, err = os.Stat(getObsoletePath(firstFile))
+    c.Assert(os.IsNotExist(err), Equals, true)
+
+    // a merge in the middle of a scan
+    for i := 0; i < n; i += 2 {
+        c.Assert(s.bc.Set([]byte(fmt.Sprintf("key%03d", i)), []byte(fmt.Sprintf("value%d", i))), IsNil)
+    }
+    count = 0
+    err = s.bc.Scan(nil, nil, func(key []byte, value []byte) error {
+        if count == 0 {
+            for i := 1; i < n; i += 2 {
+                c.Assert(s.bc.Del([]byte(fmt.Sprintf("key%03d", i))), IsNil)
+            }
+            s.bc.Merge(done)
+            <-done
+        }
+        c.Assert(string(value), Equals, fmt.Sprintf("value%d", count))
+        count++
+        return nil
+    })
+    c.Assert(err, IsNil)
+    c.Assert(count, Equals, n)
+}
+
+// reads racing with Release either succeed or see the snapshot released
+func (s *testSnapshotSuite) TestReleaseWhileReading(c *C) {
+    c.Assert(s.bc.Set([]byte("a"), []byte("1")), IsNil)
+    snap, err := s.bc.Snapshot()
+    c.Assert(err, IsNil)
+
+    done := make(chan error)
+    go func() {
+        for {
+            if _, err := snap.Get([]byte("a")); err != nil {
+                done <- err
+                return
+            }
+        }
+    }()
+    snap.Release()
+    c.Assert(<-done, Equals, ErrSnapshotReleased)
+}
@@ -0,0 +1,114 @@
+package bitcask
+
+import (
+    "log"
+    "sync"
+    "time"
+)
+
+const (
+    SYNC_NONE = iota        // leave it to the os
+    SYNC_ALWAYS             // fsync before a write returns, concurrent writes share one fsync
+    SYNC_INTERVAL           // fsync in background every syncInterval ms
+)
+
+// groupSyncer lets concurrent writers share one fsync. Every write gets
+// a sequence number, a writer waits until a fsync covering its sequence
+// is done, starting one itself if no fsync is running.
+type groupSyncer struct {
+    mu          sync.Mutex
+    cond        *sync.Cond
+    syncing     bool
+    synced      uint64
+    syncFn      func() (uint64, error)
+}
+
+func newGroupSyncer(syncFn func() (uint64, error)) *groupSyncer {
+    s := &groupSyncer{
+        syncFn: syncFn,
+    }
+    s.cond = sync.NewCond(&s.mu)
+    return s
+}
+
+func (s *groupSyncer) wait(seq uint64) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    for s.synced < seq {
+        if s.syncing {
+            s.cond.Wait()
+            continue
+        }
+        s.syncing = true
+        s.mu.Unlock()
+        target, err := s.syncFn()
+        s.mu.Lock()
+        s.syncing = false
+        if err == nil && target > s.synced {
+            s.synced = target
+        }
+        s.cond.Broadcast()
+        if err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// fsync the active file without holding bc.mu, returns the last write sequence it covers
+func (bc *BitCask) syncActiveFile() (uint64, error) {
+    bc.mu.RLock()
+    af := bc.activeFile
+    seq := bc.writeSeq
+    bc.mu.RUnlock()
+    if af == nil {
+        return seq, nil
+    }
+
+    if err := af.SyncFlushed(); err != nil {
+        bc.mu.RLock()
+        rotated := bc.activeFile != af
+        bc.mu.RUnlock()
+        // the file is synced before it's closed by rotation
+        if rotated {
+            return seq, nil
+        }
+        log.Printf("sync active file[%d] failed, err = %s", af.id, err)
+        return 0, err
+    }
+    return seq, nil
+}
+
+// wait until write seq is synced if it's required by the sync mode
+func (bc *BitCask) waitSync(seq uint64) error {
+    if bc.opts.syncMode != SYNC_ALWAYS {
+        return nil
+    }
+    return bc.syncer.wait(seq)
+}
+
+// Sync flushes and fsyncs all writes done so far.
+func (bc *BitCask) Sync() error {
+    bc.mu.RLock()
+    seq := bc.writeSeq
+    bc.mu.RUnlock()
+    return bc.syncer.wait(seq)
+}
+
+func (bc *BitCask) syncLoop(interval time.Duration) {
+    defer bc.bgWg.Done()
+    ticker := time.NewTicker(interval)
+    defer ticker.Stop()
+
+    for {
+        select {
+        case <-bc.closeCh:
+            return
+        case <-ticker.C:
+            if err := bc.Sync(); err != nil {
+                log.Printf("background sync failed, err = %s", err)
+            }
+        }
+    }
+}
@@ -0,0 +1,52 @@
+package bitcask
+
+import (
+    "fmt"
+    "sync"
+    . "gopkg.in/check.v1"
+)
+
+type testSyncSuite struct{}
+
+var _ = Suite(&testSyncSuite{})
+
+func (s *testSyncSuite) TestGroupCommit(c *C) {
+    opts := NewOptions()
+    opts.SetSyncMode(SYNC_ALWAYS)
+    bc, err := Open(c.MkDir(), opts)
+    c.Assert(err, IsNil)
+    defer bc.Close()
+
+    var wg sync.WaitGroup
+    for i := 0; i < 8; i++ {
+        wg.Add(1)
+        go func(i int) {
+            defer wg.Done()
+            for j := 0; j < 100; j++ {
+                key := []byte(fmt.Sprintf("key-%d-%d", i, j))
+                c.Check(bc.Set(key, key), IsNil)
+            }
+        }(i)
+    }
+    wg.Wait()
+
+    c.Assert(bc.writeSeq, Equals, uint64(800))
+    c.Assert(bc.syncer.synced, Equals, uint64(800))
+
+    val, err := bc.Get([]byte("key-3-42"))
+    c.Assert(err, IsNil)
+    c.Assert(string(val), Equals, "key-3-42")
+}
+
+func (s *testSyncSuite) TestIntervalSync(c *C) {
+    opts := NewOptions()
+    opts.SetSyncMode(SYNC_INTERVAL)
+    opts.SetSyncInterval(10)
+    bc, err := Open(c.MkDir(), opts)
+    c.Assert(err, IsNil)
+
+    c.Assert(bc.Set([]byte("a"), []byte("1")), IsNil)
+    c.Assert(bc.Sync(), IsNil)
+    c.Assert(bc.syncer.synced, Equals, uint64(1))
+    c.Assert(bc.Close(), IsNil)
+}
@@ -0,0 +1,162 @@
+package bitcask
+
+import (
+    "log"
+    "time"
+)
+
+// expration is a unix timestamp in seconds, 0 means the key never expires
+func isExpired(expration uint32, now int64) bool {
+    return expration != 0 && int64(expration) <= now
+}
+
+// requires bc.mu held
+func (bc *BitCask) getLive(key []byte) (*DirItem, error) {
+    di, err := bc.keyDir.Get(key)
+    if err != nil {
+        return nil, err
+    }
+    if di.flag & RECORD_FLAG_DELETED > 0 || isExpired(di.expration, time.Now().Unix()) {
+        return nil, ErrKeyNotFound
+    }
+    return di, nil
+}
+
+// TTL returns the remaining seconds before key expires, -1 if key has no ttl
+func (bc *BitCask) TTL(key []byte) (int64, error) {
+    bc.mu.RLock()
+    defer bc.mu.RUnlock()
+
+    di, err := bc.getLive(key)
+    if err != nil {
+        return 0, err
+    }
+    if di.expration == 0 {
+        return -1, nil
+    }
+    return int64(di.expration) - time.Now().Unix(), nil
+}
+
+// Expire sets the expration of key to the unix timestamp t
+func (bc *BitCask) Expire(key []byte, t uint32) error {
+    return bc.setExpration(key, t)
+}
+
+// Persist removes the expration of key
+func (bc *BitCask) Persist(key []byte) error {
+    return bc.setExpration(key, 0)
+}
+
+// rewrite the record of key with new expration
+func (bc *BitCask) setExpration(key []byte, expration uint32) error {
+    if bc.opts.readOnly {
+        return ErrReadOnly
+    }
+    bc.mu.Lock()
+    di, err := bc.getLive(key)
+    if err != nil {
+        bc.mu.Unlock()
+        return err
+    }
+    if di.expration == expration {
+        bc.mu.Unlock()
+        return nil
+    }
+
+    offset := int64(di.valuePos) - RecordValueOffset()
+    old, err := bc.refRecord(di.fileId, offset)
+    if err != nil {
+        bc.mu.Unlock()
+        return err
+    }
+    rec := &Record{
+        expration: expration,
+        valueSize: old.valueSize,
+        keySize: old.keySize,
+        value: old.value,
+        key: old.key,
+    }
+    bc.compressRecord(rec)
+    err = bc.addRecord(rec, true)
+    bc.unrefRecord(di.fileId, offset)
+    seq := bc.writeSeq
+    bc.mu.Unlock()
+    if err != nil {
+        return err
+    }
+    return bc.waitSync(seq)
+}
+
+// write a tombstone for key if it's still expired
+func (bc *BitCask) expireKey(key []byte) (bool, error) {
+    bc.mu.Lock()
+    di, err := bc.keyDir.Get(key)
+    if err != nil || di.flag & RECORD_FLAG_DELETED > 0 || !isExpired(di.expration, time.Now().Unix()) {
+        bc.mu.Unlock()
+        return false, nil
+    }
+
+    rec := &Record{
+        flag: RECORD_FLAG_DELETED,
+        keySize: int64(len(key)),
+        key: key,
+    }
+    err = bc.addRecord(rec, true)
+    seq := bc.writeSeq
+    bc.mu.Unlock()
+    if err != nil {
+        return false, err
+    }
+    return true, bc.waitSync(seq)
+}
+
+// write tombstones for all expired keys, returns the number of keys expired
+func (bc *BitCask) sweepExpired() (int, error) {
+    bc.mu.Lock()
+    kd := bc.cloneKeyDir()
+    bc.mu.Unlock()
+
+    now := time.Now().Unix()
+    keys := make([][]byte, 0)
+    err := kd.ForEachMatch(func(di *DirItem) bool {
+        return di.flag & RECORD_FLAG_DELETED == 0 && isExpired(di.expration, now)
+    }, func(key []byte, di *DirItem) error {
+        keys = append(keys, key)
+        return nil
+    })
+    if err != nil {
+        return 0, err
+    }
+
+    n := 0
+    for _, key := range keys {
+        expired, err := bc.expireKey(key)
+        if err != nil {
+            return n, err
+        }
+        if expired {
+            n++
+        }
+    }
+    return n, nil
+}
+
+func (bc *BitCask) expireLoop(interval time.Duration) {
+    defer bc.bgWg.Done()
+    ticker := time.NewTicker(interval)
+    defer ticker.Stop()
+
+    for {
+        select {
+        case <-bc.closeCh:
+            return
+        case <-ticker.C:
+            n, err := bc.sweepExpired()
+            if err != nil {
+                log.Printf("sweep expired keys failed, err = %s", err)
+            } else if n > 0 {
+                log.Printf("sweep %d expired keys", n)
+            }
+        }
+    }
+}
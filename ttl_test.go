@@ -0,0 +1,114 @@
+package bitcask
+
+import (
+    "fmt"
+    "time"
+    . "gopkg.in/check.v1"
+)
+
+type testTTLSuite struct {
+    bc  *BitCask
+}
+
+var _ = Suite(&testTTLSuite{})
+
+func (s *testTTLSuite) SetUpTest(c *C) {
+    opts := NewOptions()
+    opts.SetMaxFileSize(4096)
+    var err error
+    s.bc, err = Open(c.MkDir(), opts)
+    c.Assert(err, IsNil)
+}
+
+func (s *testTTLSuite) TearDownTest(c *C) {
+    s.bc.Close()
+}
+
+func (s *testTTLSuite) TestExpiredOnRead(c *C) {
+    now := uint32(time.Now().Unix())
+    c.Assert(s.bc.SetWithExpr([]byte("old"), []byte("v"), now - 1), IsNil)
+    c.Assert(s.bc.SetWithExpr([]byte("new"), []byte("v"), now + 100), IsNil)
+    c.Assert(s.bc.Set([]byte("forever"), []byte("v")), IsNil)
+
+    _, err := s.bc.Get([]byte("old"))
+    c.Assert(err, Equals, ErrKeyNotFound)
+    _, err = s.bc.TTL([]byte("old"))
+    c.Assert(err, Equals, ErrKeyNotFound)
+
+    ttl, err := s.bc.TTL([]byte("new"))
+    c.Assert(err, IsNil)
+    c.Assert(ttl > 90 && ttl <= 100, Equals, true)
+    ttl, err = s.bc.TTL([]byte("forever"))
+    c.Assert(err, IsNil)
+    c.Assert(ttl, Equals, int64(-1))
+}
+
+func (s *testTTLSuite) TestExpireAndPersist(c *C) {
+    c.Assert(s.bc.Set([]byte("k"), []byte("v")), IsNil)
+    c.Assert(s.bc.Expire([]byte("k"), uint32(time.Now().Unix()) + 100), IsNil)
+    ttl, err := s.bc.TTL([]byte("k"))
+    c.Assert(err, IsNil)
+    c.Assert(ttl > 0, Equals, true)
+
+    c.Assert(s.bc.Persist([]byte("k")), IsNil)
+    ttl, err = s.bc.TTL([]byte("k"))
+    c.Assert(err, IsNil)
+    c.Assert(ttl, Equals, int64(-1))
+    val, err := s.bc.Get([]byte("k"))
+    c.Assert(err, IsNil)
+    c.Assert(string(val), Equals, "v")
+
+    c.Assert(s.bc.Expire([]byte("k"), uint32(time.Now().Unix()) - 1), IsNil)
+    _, err = s.bc.Get([]byte("k"))
+    c.Assert(err, Equals, ErrKeyNotFound)
+    c.Assert(s.bc.Persist([]byte("k")), Equals, ErrKeyNotFound)
+}
+
+func (s *testTTLSuite) TestSweep(c *C) {
+    now := uint32(time.Now().Unix())
+    for i := 0; i < 10; i++ {
+        c.Assert(s.bc.SetWithExpr([]byte(fmt.Sprintf("k%d", i)), []byte("v"), now - 1), IsNil)
+    }
+    c.Assert(s.bc.Set([]byte("live"), []byte("v")), IsNil)
+
+    n, err := s.bc.sweepExpired()
+    c.Assert(err, IsNil)
+    c.Assert(n, Equals, 10)
+    di, err := s.bc.keyDir.Get([]byte("k3"))
+    c.Assert(err, IsNil)
+    c.Assert(di.flag & RECORD_FLAG_DELETED > 0, Equals, true)
+
+    n, err = s.bc.sweepExpired()
+    c.Assert(err, IsNil)
+    c.Assert(n, Equals, 0)
+}
+
+// the sweeper is stopped once, TearDownTest closes again
+func (s *testTTLSuite) TestCloseTwice(c *C) {
+    c.Assert(s.bc.Set([]byte("k"), []byte("v")), IsNil)
+    c.Assert(s.bc.Close(), IsNil)
+    c.Assert(s.bc.Close(), IsNil)
+}
+
+func (s *testTTLSuite) TestMergeKeepsKeysWithoutTTL(c *C) {
+    value := make([]byte, 100)
+    for i := 0; i < 100; i++ {
+        c.Assert(s.bc.Set([]byte(fmt.Sprintf("key%03d", i)), value), IsNil)
+    }
+    c.Assert(s.bc.SetWithExpr([]byte("expired"), value, uint32(time.Now().Unix()) - 1), IsNil)
+    for i := 0; i < 50; i++ {
+        c.Assert(s.bc.Set([]byte(fmt.Sprintf("pad%03d", i)), value), IsNil)
+    }
+
+    done := make(chan int, 1)
+    s.bc.Merge(done)
+    <-done
+
+    for i := 0; i < 100; i++ {
+        val, err := s.bc.Get([]byte(fmt.Sprintf("key%03d", i)))
+        c.Assert(err, IsNil)
+        c.Assert(len(val), Equals, len(value))
+    }
+    _, err := s.bc.keyDir.Get([]byte("expired"))
+    c.Assert(err, Equals, ErrKeyNotFound)
+}
@@ -0,0 +1,491 @@
+package bitcask
+
+import (
+    "bytes"
+    "crypto/md5"
+    "encoding/binary"
+    "fmt"
+    "hash/crc32"
+    "io/ioutil"
+    "log"
+    "os"
+    "path/filepath"
+    "sort"
+    "strings"
+    "sync"
+)
+
+var (
+    ErrTailCorrupted = fmt.Errorf("corrupted tail, no valid record after it")
+    ErrHintMismatch = fmt.Errorf("hint item doesn't match the record in the data file")
+    ErrHintOrphan = fmt.Errorf("hint file without data file")
+)
+
+// VerifyIssue is a damaged range of a data file, or a bad hint file or item.
+type VerifyIssue struct {
+    FileId      int64
+    Path        string
+    Offset      int64       // -1 for the whole file
+    Length      int64       // bytes of a damaged range, 0 for hint issues
+    Err         error
+    Repaired    bool
+}
+
+func (i *VerifyIssue) String() string {
+    s := i.Path
+    if i.Offset >= 0 {
+        s += fmt.Sprintf(" at offset %d", i.Offset)
+    }
+    if i.Length > 0 {
+        s += fmt.Sprintf(", %d bytes", i.Length)
+    }
+    s += ": " + i.Err.Error()
+    if i.Repaired {
+        s += " (repaired)"
+    }
+    return s
+}
+
+type VerifyReport struct {
+    DataFiles   int
+    HintFiles   int
+    Records     int64
+    HintItems   int64
+    Issues      []*VerifyIssue
+}
+
+// OK returns true if there is no issue left unrepaired
+func (r *VerifyReport) OK() bool {
+    for _, issue := range r.Issues {
+        if !issue.Repaired {
+            return false
+        }
+    }
+    return true
+}
+
+func (r *VerifyReport) addIssue(issue *VerifyIssue) {
+    log.Printf("verify: %s", issue)
+    r.Issues = append(r.Issues, issue)
+}
+
+// records of a data file with a valid crc by offset, values are dropped.
+// damaged ranges are [begin, end) pairs.
+type dataScan struct {
+    size        int64
+    records     map[int64]*Record
+    damaged     [][2]int64
+}
+
+// size of the record at offset if it has a valid crc, 0 otherwise
+func checkRawRecord(data []byte, offset int64) int64 {
+    size := declaredSize(data, offset)
+    if size == 0 {
+        return 0
+    }
+    if crc32.ChecksumIEEE(data[offset + 4:offset + size]) != binary.LittleEndian.Uint32(data[offset:offset + 4]) {
+        return 0
+    }
+    return size
+}
+
+// scanData checks the crc of every record in data, a damaged range ends at
+// the next valid record or the end of file. Records with a valid crc that
+// can't be decoded are reported, but never counted as damaged.
+func scanData(id int64, path string, data []byte, fc *fileCipher, report *VerifyReport) (*dataScan, error) {
+    scan := &dataScan{
+        size: int64(len(data)),
+        records: make(map[int64]*Record),
+    }
+    r := bytes.NewReader(data)
+    var offset int64 = 0
+    for offset < scan.size {
+        if n := checkRawRecord(data, offset); n > 0 {
+            rec, err := parseRecordAt(r, offset, fc)
+            if err == ErrNoCipher {
+                return nil, err
+            }
+            if err != nil {
+                report.addIssue(&VerifyIssue{FileId: id, Path: path, Offset: offset, Err: err})
+            } else {
+                rec.value = nil
+                scan.records[offset] = rec
+            }
+            report.Records++
+            offset += n
+            continue
+        }
+
+        // a valid record may still follow a corrupted size in the header
+        end := offset + 1
+        if n := declaredSize(data, offset); n > 0 && checkRawRecord(data, offset + n) > 0 {
+            end = offset + n
+        }
+        for end < scan.size && checkRawRecord(data, end) == 0 {
+            end++
+        }
+        err := ErrRecordCorrupted
+        if end == scan.size {
+            err = ErrTailCorrupted
+        }
+        report.addIssue(&VerifyIssue{FileId: id, Path: path, Offset: offset, Length: end - offset, Err: err})
+        scan.damaged = append(scan.damaged, [2]int64{offset, end})
+        offset = end
+    }
+    return scan, nil
+}
+
+// size in the header at offset, 0 if it's out of the file
+func declaredSize(data []byte, offset int64) int64 {
+    if int64(len(data)) - offset < RECORD_HEADER_SIZE {
+        return 0
+    }
+    return recordSizeAt(data[offset:], offset, int64(len(data)))
+}
+
+// checkHint returns false if the hint file is bad and should be written again
+func checkHint(hf *HintFile, path string, md5sum []byte, scan *dataScan, report *VerifyReport) (bool, error) {
+    report.HintFiles++
+    hintMd5, err := hf.ReadHeader()
+    if err != nil {
+        report.addIssue(&VerifyIssue{FileId: hf.id, Path: path, Offset: 0, Err: err})
+        return false, nil
+    }
+    if !bytes.Equal(hintMd5, md5sum) {
+        // items point into another version of the data file, don't check them
+        report.addIssue(&VerifyIssue{FileId: hf.id, Path: path, Offset: -1, Err: ErrHintStale})
+        return false, nil
+    }
+
+    ok := true
+    err = hf.forEachItemAt(func(item *HintItem, offset int64) error {
+        report.HintItems++
+        rec := scan.records[item.valuePos - RecordValueOffset()]
+        if rec == nil || !bytes.Equal(rec.key, item.key) || rec.valueSize != item.valueSize ||
+                rec.expration != item.expration ||
+                rec.flag & RECORD_FLAG_DELETED != item.flag & RECORD_FLAG_DELETED {
+            report.addIssue(&VerifyIssue{FileId: hf.id, Path: path, Offset: offset, Err: ErrHintMismatch})
+            ok = false
+        }
+        return nil
+    })
+    if err == ErrNoCipher {
+        return false, err
+    }
+    if err != nil {
+        report.addIssue(&VerifyIssue{FileId: hf.id, Path: path, Offset: -1, Err: err})
+        return false, nil
+    }
+    return ok, nil
+}
+
+// Verify checks the crc of every record in the data files, and every hint
+// file against its data file. Files are pinned while they are checked, so
+// merge and writes go on, the active file is checked up to its size when
+// Verify is called. Nothing is repaired, see VerifyDir.
+func (bc *BitCask) Verify() (*VerifyReport, error) {
+    bc.mu.Lock()
+    fileIds := make([]int64, 0, len(bc.fileMetas))
+    for _, meta := range bc.fileMetas {
+        fileIds = append(fileIds, meta.FileId)
+    }
+    for i, fileId := range fileIds {
+        if err := bc.pinDataFile(fileId); err != nil {
+            for _, pinned := range fileIds[:i] {
+                bc.unpinDataFile(pinned)
+            }
+            bc.mu.Unlock()
+            return nil, err
+        }
+    }
+    activeId := bc.ActiveFileId()
+    var activeSize int64 = -1
+    if bc.activeFile != nil {
+        activeSize = bc.activeFile.Size()
+    }
+    active, err := os.Open(bc.GetDataFilePath(activeId))
+    bc.mu.Unlock()
+
+    defer func() {
+        bc.mu.Lock()
+        for _, fileId := range fileIds {
+            bc.unpinDataFile(fileId)
+        }
+        bc.mu.Unlock()
+    }()
+    if err != nil && !os.IsNotExist(err) {
+        return nil, err
+    }
+    if active != nil {
+        defer active.Close()
+    }
+
+    report := &VerifyReport{}
+    for _, fileId := range fileIds {
+        df, err := bc.refDataFile(fileId)
+        if err != nil {
+            return nil, err
+        }
+        data := make([]byte, df.Size())
+        err = readFullAt(df, data, 0)
+        bc.unrefDataFile(fileId)
+        if err != nil {
+            return nil, err
+        }
+        if err := bc.verifyFile(fileId, data, true, report); err != nil {
+            return nil, err
+        }
+    }
+
+    if active != nil {
+        if activeSize < 0 {
+            // read-only, nothing is appended
+            fi, err := active.Stat()
+            if err != nil {
+                return nil, err
+            }
+            activeSize = fi.Size()
+        }
+        data := make([]byte, activeSize)
+        if err := readFullAt(active, data, 0); err != nil {
+            return nil, err
+        }
+        // the active file has no hint yet
+        if err := bc.verifyFile(activeId, data, false, report); err != nil {
+            return nil, err
+        }
+    }
+    return report, nil
+}
+
+func (bc *BitCask) verifyFile(fileId int64, data []byte, hint bool, report *VerifyReport) error {
+    fc, err := bc.getFileCipher(fileId)
+    if err != nil {
+        return err
+    }
+    report.DataFiles++
+    scan, err := scanData(fileId, bc.GetDataFilePath(fileId), data, fc, report)
+    if err != nil || !hint {
+        return err
+    }
+
+    hintPath := bc.getHintFilePath(fileId)
+    hf, err := openHintFile(hintPath, fileId, fc)
+    if os.IsNotExist(err) {
+        return nil
+    }
+    if err != nil {
+        return err
+    }
+    defer hf.Close()
+    md5sum := md5.Sum(data)
+    _, err = checkHint(hf, hintPath, md5sum[:], scan, report)
+    return err
+}
+
+// VerifyDir checks the db at dir like Verify, the db must not be opened by
+// others. With repair, damaged ranges are cut out of the data files, a
+// damaged tail is truncated, and bad hint files are written again from the
+// repaired data files. Whole files are never removed, except hint files
+// without data file.
+func VerifyDir(dir string, opts *Options, repair bool) (*VerifyReport, error) {
+    bc := &BitCask{
+        mu: &sync.RWMutex{},
+        dir: dir,
+        opts: opts,
+    }
+    bc.clear()
+    defer bc.close()
+
+    lock, err := lockFile(dir + "/" + LOCK_FILE, !repair)
+    if err != nil {
+        return nil, err
+    }
+    defer lock.unlock()
+    bc.lock = lock
+
+    if _, err := os.Stat(bc.getMergeDir() + "/" + MERGE_MANIFEST); err == nil {
+        if !repair {
+            return nil, ErrMergeUnfinished
+        }
+        if err := bc.recoverMerge(); err != nil {
+            return nil, err
+        }
+    }
+
+    files, err := ioutil.ReadDir(dir)
+    if err != nil {
+        return nil, err
+    }
+    dataIds := make([]int64, 0)
+    hintIds := make(map[int64]bool)
+    for _, file := range files {
+        name := file.Name()
+        if id, err := getIdFromDataPath(name); err == nil {
+            dataIds = append(dataIds, id)
+        } else if filepath.Ext(name) == ".hint" {
+            if id, err := getIdFromDataPath(strings.TrimSuffix(name, ".hint") + ".data"); err == nil {
+                hintIds[id] = true
+            }
+        }
+    }
+    sort.Slice(dataIds, func(i, j int) bool { return dataIds[i] < dataIds[j] })
+
+    report := &VerifyReport{}
+    for _, id := range dataIds {
+        hasHint := hintIds[id]
+        delete(hintIds, id)
+        if err := bc.verifyDataFile(id, hasHint, repair, report); err != nil {
+            return nil, err
+        }
+    }
+
+    for id := range hintIds {
+        path := bc.getHintFilePath(id)
+        issue := &VerifyIssue{FileId: id, Path: path, Offset: -1, Err: ErrHintOrphan}
+        if repair {
+            if err := os.Remove(path); err != nil {
+                return nil, err
+            }
+            issue.Repaired = true
+        }
+        report.addIssue(issue)
+    }
+    return report, nil
+}
+
+func (bc *BitCask) verifyDataFile(id int64, hasHint bool, repair bool, report *VerifyReport) error {
+    dataPath := bc.GetDataFilePath(id)
+    hintPath := bc.getHintFilePath(id)
+    fc, err := bc.getFileCipher(id)
+    if err != nil {
+        return err
+    }
+    data, err := ioutil.ReadFile(dataPath)
+    if err != nil {
+        return err
+    }
+    report.DataFiles++
+    first := len(report.Issues)
+    scan, err := scanData(id, dataPath, data, fc, report)
+    if err != nil {
+        return err
+    }
+
+    hintOk := true
+    if hasHint {
+        hf, err := openHintFile(hintPath, id, fc)
+        if err != nil {
+            return err
+        }
+        md5sum := md5.Sum(data)
+        hintOk, err = checkHint(hf, hintPath, md5sum[:], scan, report)
+        hf.Close()
+        if err != nil {
+            return err
+        }
+    }
+    if !repair || (len(scan.damaged) == 0 && hintOk) {
+        return nil
+    }
+
+    if len(scan.damaged) > 0 {
+        if err := cutDamaged(dataPath, data, scan.damaged); err != nil {
+            return err
+        }
+    }
+    if hasHint {
+        if err := bc.rewriteHintFile(id); err != nil {
+            return err
+        }
+    }
+    for _, issue := range report.Issues[first:] {
+        if issue.Length > 0 || issue.Path == hintPath {
+            issue.Repaired = true
+        }
+    }
+    return nil
+}
+
+// cutDamaged removes the damaged ranges from the data file at path, a file
+// damaged only at the tail is truncated
+func cutDamaged(path string, data []byte, damaged [][2]int64) error {
+    if len(damaged) == 1 && damaged[0][1] == int64(len(data)) {
+        log.Printf("truncate %s from %d to %d", path, len(data), damaged[0][0])
+        if err := os.Truncate(path, damaged[0][0]); err != nil {
+            return err
+        }
+        return nil
+    }
+
+    good := make([]byte, 0, len(data))
+    var begin int64 = 0
+    for _, r := range damaged {
+        log.Printf("cut [%d, %d) out of %s", r[0], r[1], path)
+        good = append(good, data[begin:r[0]]...)
+        begin = r[1]
+    }
+    good = append(good, data[begin:]...)
+
+    tmpPath := path + ".repair"
+    f, err := os.OpenFile(tmpPath, os.O_RDWR | os.O_CREATE | os.O_TRUNC, 0644)
+    if err != nil {
+        return err
+    }
+    if _, err := f.Write(good); err != nil {
+        f.Close()
+        return err
+    }
+    if err := f.Sync(); err != nil {
+        f.Close()
+        return err
+    }
+    f.Close()
+    if err := os.Rename(tmpPath, path); err != nil {
+        return err
+    }
+    return syncDir(filepath.Dir(path))
+}
+
+// write the hint of data-file[id] from the data file, bc is a scratch one
+// so its keydir is thrown away
+func (bc *BitCask) rewriteHintFile(id int64) error {
+    bc.keyDir = NewKeyDir()
+    kd, err := bc.restoreFromDataFile(bc.GetDataFilePath(id), id)
+    if err != nil {
+        return err
+    }
+    sum, err := bc.getDataFileSum(id)
+    if err != nil {
+        return err
+    }
+    return bc.replaceHintFile(id, sum, kd)
+}
+
+// repairDataFile cuts the damaged ranges out of data-file[id] and removes
+// its hint, for Restore to read the data file again
+func (bc *BitCask) repairDataFile(id int64) error {
+    dataPath := bc.GetDataFilePath(id)
+    fc, err := bc.getFileCipher(id)
+    if err != nil {
+        return err
+    }
+    data, err := ioutil.ReadFile(dataPath)
+    if err != nil {
+        return err
+    }
+    report := &VerifyReport{}
+    scan, err := scanData(id, dataPath, data, fc, report)
+    if err != nil {
+        return err
+    }
+    if len(scan.damaged) > 0 {
+        if err := cutDamaged(dataPath, data, scan.damaged); err != nil {
+            return err
+        }
+    }
+    if err := os.Remove(bc.getHintFilePath(id)); err != nil && !os.IsNotExist(err) {
+        return err
+    }
+    return nil
+}
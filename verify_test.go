@@ -0,0 +1,196 @@
+package bitcask
+
+import (
+    "encoding/binary"
+    "fmt"
+    "io/ioutil"
+    "os"
+    . "gopkg.in/check.v1"
+)
+
+type testVerifySuite struct {
+    dir     string
+    opts    *Options
+    keys    [][]byte
+}
+
+var _ = Suite(&testVerifySuite{})
+
+func (s *testVerifySuite) SetUpTest(c *C) {
+    s.dir = c.MkDir()
+    s.opts = NewOptions()
+    s.opts.SetMaxFileSize(1024)
+    s.keys = nil
+}
+
+func (s *testVerifySuite) open(c *C) *BitCask {
+    bc, err := Open(s.dir, s.opts)
+    c.Assert(err, IsNil)
+    return bc
+}
+
+// fill some files, and returns where the value of key i is
+func (s *testVerifySuite) fill(c *C, n int) []*DirItem {
+    bc := s.open(c)
+    defer bc.Close()
+    items := make([]*DirItem, 0, n)
+    for i := 0; i < n; i++ {
+        key := []byte(fmt.Sprintf("key%03d", i))
+        c.Assert(bc.Set(key, []byte(fmt.Sprintf("value%03d", i))), IsNil)
+        s.keys = append(s.keys, key)
+    }
+    for _, key := range s.keys {
+        di, err := bc.keyDir.Get(key)
+        c.Assert(err, IsNil)
+        items = append(items, di)
+    }
+    return items
+}
+
+func flipByte(c *C, path string, offset int64) {
+    data, err := ioutil.ReadFile(path)
+    c.Assert(err, IsNil)
+    data[offset] ^= 0xff
+    c.Assert(ioutil.WriteFile(path, data, 0644), IsNil)
+}
+
+// keys missing from the db
+func (s *testVerifySuite) missing(c *C) []string {
+    bc := s.open(c)
+    defer bc.Close()
+    missing := make([]string, 0)
+    for _, key := range s.keys {
+        if _, err := bc.Get(key); err != nil {
+            c.Assert(err, Equals, ErrKeyNotFound)
+            missing = append(missing, string(key))
+        }
+    }
+    return missing
+}
+
+func (s *testVerifySuite) TestVerify(c *C) {
+    s.fill(c, 100)
+    bc := s.open(c)
+    report, err := bc.Verify()
+    c.Assert(err, IsNil)
+    c.Assert(report.OK(), Equals, true)
+    c.Assert(report.Records, Equals, int64(100))
+    c.Assert(report.HintItems > 0, Equals, true)
+    c.Assert(report.DataFiles, Equals, report.HintFiles + 1)
+    c.Assert(bc.Close(), IsNil)
+
+    report, err = VerifyDir(s.dir, s.opts, false)
+    c.Assert(err, IsNil)
+    c.Assert(report.OK(), Equals, true)
+    c.Assert(report.Records, Equals, int64(100))
+}
+
+func (s *testVerifySuite) TestRepairMiddle(c *C) {
+    items := s.fill(c, 100)
+    di := items[1]
+    path := fmt.Sprintf("%s/%09d.data", s.dir, di.fileId)
+    flipByte(c, path, di.valuePos)
+
+    report, err := VerifyDir(s.dir, s.opts, false)
+    c.Assert(err, IsNil)
+    c.Assert(len(report.Issues), Equals, 2)
+    c.Assert(report.Issues[0].Err, Equals, ErrRecordCorrupted)
+    c.Assert(report.Issues[0].Offset, Equals, di.valuePos - RecordValueOffset())
+    c.Assert(report.Issues[0].Length, Equals, recordSize(s.keys[1], di))
+    c.Assert(report.Issues[1].Err, Equals, ErrHintStale)
+    c.Assert(report.OK(), Equals, false)
+
+    report, err = VerifyDir(s.dir, s.opts, true)
+    c.Assert(err, IsNil)
+    c.Assert(len(report.Issues), Equals, 2)
+    c.Assert(report.OK(), Equals, true)
+
+    report, err = VerifyDir(s.dir, s.opts, false)
+    c.Assert(err, IsNil)
+    c.Assert(len(report.Issues), Equals, 0)
+    c.Assert(report.Records, Equals, int64(99))
+    c.Assert(s.missing(c), DeepEquals, []string{"key001"})
+}
+
+func (s *testVerifySuite) TestRepairTail(c *C) {
+    items := s.fill(c, 100)
+    di := items[99]
+    path := fmt.Sprintf("%s/%09d.data", s.dir, di.fileId)
+    flipByte(c, path, di.valuePos)
+
+    // the hint written on close is stale too
+    report, err := VerifyDir(s.dir, s.opts, true)
+    c.Assert(err, IsNil)
+    c.Assert(len(report.Issues), Equals, 2)
+    c.Assert(report.Issues[0].Err, Equals, ErrTailCorrupted)
+    c.Assert(report.Issues[1].Err, Equals, ErrHintStale)
+    c.Assert(report.OK(), Equals, true)
+    fi, err := os.Stat(path)
+    c.Assert(err, IsNil)
+    c.Assert(fi.Size(), Equals, di.valuePos - RecordValueOffset())
+    c.Assert(s.missing(c), DeepEquals, []string{"key099"})
+}
+
+func (s *testVerifySuite) TestRepairHint(c *C) {
+    items := s.fill(c, 100)
+    fileId := items[0].fileId
+    hintPath := fmt.Sprintf("%s/%09d.hint", s.dir, fileId)
+    fi, err := os.Stat(hintPath)
+    c.Assert(err, IsNil)
+    c.Assert(os.Truncate(hintPath, fi.Size() - 1), IsNil)
+
+    // a hint file without data file
+    data, err := ioutil.ReadFile(hintPath)
+    c.Assert(err, IsNil)
+    c.Assert(ioutil.WriteFile(fmt.Sprintf("%s/%09d.hint", s.dir, 999), data, 0644), IsNil)
+
+    report, err := VerifyDir(s.dir, s.opts, true)
+    c.Assert(err, IsNil)
+    c.Assert(len(report.Issues), Equals, 2)
+    c.Assert(report.Issues[0].Err, Equals, ErrRecordCorrupted)
+    c.Assert(report.Issues[1].Err, Equals, ErrHintOrphan)
+    c.Assert(report.OK(), Equals, true)
+
+    report, err = VerifyDir(s.dir, s.opts, false)
+    c.Assert(err, IsNil)
+    c.Assert(len(report.Issues), Equals, 0)
+    c.Assert(s.missing(c), DeepEquals, []string{})
+}
+
+// restore cuts out the damaged records instead of dropping the file and
+// all files after it
+func (s *testVerifySuite) TestRestoreRepairs(c *C) {
+    items := s.fill(c, 100)
+    di := items[1]
+    flipByte(c, fmt.Sprintf("%s/%09d.data", s.dir, di.fileId), di.valuePos)
+    c.Assert(os.Remove(fmt.Sprintf("%s/%09d.hint", s.dir, di.fileId)), IsNil)
+
+    // a cut off hint file
+    hintPath := fmt.Sprintf("%s/%09d.hint", s.dir, items[99].fileId - 1)
+    fi, err := os.Stat(hintPath)
+    c.Assert(err, IsNil)
+    c.Assert(os.Truncate(hintPath, fi.Size() - 1), IsNil)
+
+    c.Assert(s.missing(c), DeepEquals, []string{"key001"})
+    report, err := VerifyDir(s.dir, s.opts, false)
+    c.Assert(err, IsNil)
+    c.Assert(len(report.Issues), Equals, 0)
+}
+
+// a size in a record header claiming more than the file is corruption, it's
+// never allocated
+func (s *testVerifySuite) TestRestoreBadSize(c *C) {
+    items := s.fill(c, 100)
+    di := items[2]
+    path := fmt.Sprintf("%s/%09d.data", s.dir, di.fileId)
+    data, err := ioutil.ReadFile(path)
+    c.Assert(err, IsNil)
+    binary.LittleEndian.PutUint64(data[di.valuePos - RecordValueOffset() + 9:], 1 << 50)
+    c.Assert(ioutil.WriteFile(path, data, 0644), IsNil)
+    c.Assert(os.Remove(fmt.Sprintf("%s/%09d.hint", s.dir, di.fileId)), IsNil)
+
+    c.Assert(s.missing(c), DeepEquals, []string{"key002"})
+    report, err := VerifyDir(s.dir, s.opts, false)
+    c.Assert(err, IsNil)
+    c.Assert(len(report.Issues), Equals, 0)
+}